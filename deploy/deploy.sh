@@ -5,6 +5,8 @@
 # Required environment variables (set in .env or export them):
 #   DEPLOY_SSH_KEY   - Path to SSH private key (e.g. ~/.ssh/id_rsa)
 #   DEPLOY_SERVER    - SSH target (e.g. root@example.com)
+#   DEPLOY_SIGNING_KEY   - Ed25519 private key (PEM) used to sign client binaries
+#   DEPLOY_RELEASE_PUBKEY - Matching base64 public key baked into client binaries
 #
 # Optional:
 #   DEPLOY_REMOTE_DIR    - Remote install dir (default: /opt/piportal)
@@ -28,6 +30,12 @@ if [ -z "$DEPLOY_SERVER" ]; then
     echo "Create deploy/.env with: DEPLOY_SERVER=root@your-server.com"
     exit 1
 fi
+# Without a pinned key, clients would take any binary the server offers
+if [ -z "$DEPLOY_RELEASE_PUBKEY" ] || [ -z "$DEPLOY_SIGNING_KEY" ]; then
+    echo "Error: DEPLOY_RELEASE_PUBKEY and DEPLOY_SIGNING_KEY must be set"
+    echo "See 'Signed Releases' in deploy/deploy.md to create a release key"
+    exit 1
+fi
 
 SSH_KEY="${DEPLOY_SSH_KEY}"
 SERVER="${DEPLOY_SERVER}"
@@ -38,11 +46,20 @@ BASE_DIR="$(dirname "$0")/.."
 
 echo "=== Building client binaries ==="
 cd "${BASE_DIR}/piportal-client"
-GOOS=linux GOARCH=arm64 go build -ldflags "-s -w" -o piportal-linux-arm64 .
-GOOS=linux GOARCH=arm   go build -ldflags "-s -w" -o piportal-linux-arm .
-GOOS=linux GOARCH=amd64 go build -ldflags "-s -w" -o piportal-linux-amd64 .
+CLIENT_LDFLAGS="-s -w -X github.com/piportal/piportal-client/cmd.ReleasePublicKey=${DEPLOY_RELEASE_PUBKEY}"
+GOOS=linux GOARCH=arm64 go build -ldflags "${CLIENT_LDFLAGS}" -o piportal-linux-arm64 .
+GOOS=linux GOARCH=arm   go build -ldflags "${CLIENT_LDFLAGS}" -o piportal-linux-arm .
+GOOS=linux GOARCH=amd64 go build -ldflags "${CLIENT_LDFLAGS}" -o piportal-linux-amd64 .
 echo "Client binaries built."
 
+# Sign binaries so clients built with DEPLOY_RELEASE_PUBKEY can verify upgrades
+CLIENT_FILES="piportal-linux-arm64 piportal-linux-arm piportal-linux-amd64"
+for f in piportal-linux-arm64 piportal-linux-arm piportal-linux-amd64; do
+    openssl pkeyutl -sign -inkey "${DEPLOY_SIGNING_KEY}" -rawin -in "$f" -out "$f.sig"
+    CLIENT_FILES="${CLIENT_FILES} $f.sig"
+done
+echo "Client binaries signed."
+
 echo ""
 echo "=== Building server binary ==="
 cd "${BASE_DIR}/piportal-server"
@@ -62,8 +79,8 @@ echo ""
 echo "=== Uploading client binaries ==="
 ssh ${SSH_OPTS} ${SERVER} "mkdir -p ${DOWNLOADS_DIR}"
 cd "${BASE_DIR}/piportal-client"
-scp ${SSH_OPTS} piportal-linux-arm64 piportal-linux-arm piportal-linux-amd64 ${SERVER}:${DOWNLOADS_DIR}/
-ssh ${SSH_OPTS} ${SERVER} "chmod +x ${DOWNLOADS_DIR}/piportal-linux-*"
+scp ${SSH_OPTS} ${CLIENT_FILES} ${SERVER}:${DOWNLOADS_DIR}/
+ssh ${SSH_OPTS} ${SERVER} "chmod +x ${DOWNLOADS_DIR}/piportal-linux-arm64 ${DOWNLOADS_DIR}/piportal-linux-arm ${DOWNLOADS_DIR}/piportal-linux-amd64"
 
 echo ""
 echo "=== Starting service ==="
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// AgentSettings are settings the device's owner chose in the dashboard. The
+// server sends them at auth and they're used for that session in place of
+// the config file's. They can tighten what the server may run here but
+// never loosen it: allow_exec is only ever read from the config file.
+type AgentSettings struct {
+	PingInterval    int      `json:"ping_interval,omitempty"`    // Seconds between pings
+	MetricsInterval int      `json:"metrics_interval,omitempty"` // Seconds between metrics reports (0 = with every ping)
+	ExecAllowlist   []string `json:"exec_allowlist,omitempty"`   // Applies on top of the config file's
+	ExecDryRunOnly  bool     `json:"exec_dry_run_only,omitempty"`
+}
+
+// String lists the settings for the log
+func (s AgentSettings) String() string {
+	var parts []string
+	if s.PingInterval > 0 {
+		parts = append(parts, fmt.Sprintf("ping every %s", time.Duration(s.PingInterval)*time.Second))
+	}
+	if s.MetricsInterval > 0 {
+		parts = append(parts, fmt.Sprintf("metrics every %s", time.Duration(s.MetricsInterval)*time.Second))
+	}
+	if len(s.ExecAllowlist) > 0 {
+		parts = append(parts, fmt.Sprintf("exec allowlist %q", s.ExecAllowlist))
+	}
+	if s.ExecDryRunOnly {
+		parts = append(parts, "exec dry-run only")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// applySettings takes the settings the server sent for this session, or
+// goes back to the config file's if it sent none
+func (t *Tunnel) applySettings(settings *AgentSettings) {
+	applied := AgentSettings{}
+	if settings != nil {
+		applied = *settings
+	}
+	ping := time.Duration(applied.PingInterval) * time.Second
+	if ping < 0 || (ping > 0 && t.config.ReadTimeout != 0 && ping >= t.config.ReadTimeout) {
+		log.Printf("Ignoring ping interval %s from the server: it must be shorter than read_timeout (%s)", ping, t.config.ReadTimeout)
+		applied.PingInterval = 0
+	}
+	if applied.MetricsInterval < 0 {
+		applied.MetricsInterval = 0
+	}
+	if desc := applied.String(); desc != "" {
+		log.Printf("Using settings from the dashboard: %s", desc)
+	}
+
+	t.mu.Lock()
+	t.settings = applied
+	t.mu.Unlock()
+}
+
+// serverSettings returns the settings the server sent for this session
+func (t *Tunnel) serverSettings() AgentSettings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.settings
+}
+
+// pingInterval is how often to ping the server this session
+func (t *Tunnel) pingInterval() time.Duration {
+	if s := t.serverSettings(); s.PingInterval > 0 {
+		return time.Duration(s.PingInterval) * time.Second
+	}
+	return t.config.PingInterval
+}
+
+// metricsInterval is how often to report metrics this session; 0 reports
+// them with every ping
+func (t *Tunnel) metricsInterval() time.Duration {
+	return time.Duration(t.serverSettings().MetricsInterval) * time.Second
+}
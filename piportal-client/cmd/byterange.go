@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errRangeNotSatisfiable means a requested range starts past the body's end
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a range of a response body. end is inclusive, or -1 for the
+// rest of a body whose length isn't known.
+type byteRange struct {
+	start, end int64
+}
+
+// servesRange reports whether Forward should cut the range a GET asks for
+// out of a full response, because the local service ignored it. A request
+// with If-Range gets the full body, as does an encoded one (a range of the
+// encoded bytes isn't what the visitor's decoder expects).
+func servesRange(req *http.Request, resp *http.Response) bool {
+	return req.Method == http.MethodGet &&
+		resp.StatusCode == http.StatusOK &&
+		req.Header.Get("Range") != "" &&
+		req.Header.Get("If-Range") == "" &&
+		resp.Header.Get("Content-Encoding") == ""
+}
+
+// parseByteRange parses a single-range Range header for a body of size
+// bytes (-1 if unknown). ok is false for headers the full body answers
+// instead: other units, several ranges, invalid ones, and suffix ranges of a
+// body of unknown length.
+func parseByteRange(header string, size int64) (r byteRange, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return byteRange{}, false, nil
+	}
+
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 || size < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 {
+			return byteRange{}, true, errRangeNotSatisfiable
+		}
+		return byteRange{start: max(size-n, 0), end: size - 1}, true, nil
+	}
+
+	r.start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || r.start < 0 {
+		return byteRange{}, false, nil
+	}
+	r.end = size - 1 // To the end, or -1 if unknown
+	if last != "" {
+		end, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || end < r.start {
+			return byteRange{}, false, nil
+		}
+		if size < 0 || end < size {
+			r.end = end
+		}
+	}
+	if size >= 0 && r.start >= size {
+		return byteRange{}, true, errRangeNotSatisfiable
+	}
+	return r, true, nil
+}
+
+// readByteRange reads r from body as it streams in, skipping what comes
+// before it and leaving what comes after unread, so only the range is held
+// in memory. It returns the range's bytes and their Content-Range. size is
+// the body's length, or -1 if unknown.
+func readByteRange(body io.Reader, r byteRange, size, maxBodySize int64) ([]byte, string, error) {
+	if skipped, err := io.CopyN(io.Discard, body, r.start); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Sprintf("bytes */%d", skipped), errRangeNotSatisfiable
+		}
+		return nil, "", err
+	}
+
+	limit := maxBodySize + 1
+	if r.end >= 0 {
+		limit = min(r.end-r.start+1, limit)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, limit))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxBodySize {
+		return nil, "", fmt.Errorf("%w: range over %d bytes", errResponseTooLarge, maxBodySize)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Sprintf("bytes */%d", r.start), errRangeNotSatisfiable
+	}
+
+	end := r.start + int64(len(data)) - 1
+	total := "*"
+	switch {
+	case size >= 0:
+		total = strconv.FormatInt(size, 10)
+	case r.end < 0 || end < r.end:
+		// Read to the end, so now it's known
+		total = strconv.FormatInt(end+1, 10)
+	}
+	return data, fmt.Sprintf("bytes %d-%d/%s", r.start, end, total), nil
+}
+
+// rangeResult answers a range request from a full response: a 206 with the
+// range, or a 416 if parsing it (parseErr) or reading it finds it starts
+// past the end
+func rangeResult(resp *http.Response, r byteRange, parseErr error, headers map[string]string, maxBodySize int64) (*ProxyResult, error) {
+	var body []byte
+	contentRange := fmt.Sprintf("bytes */%d", resp.ContentLength)
+	err := parseErr
+	if err == nil {
+		body, contentRange, err = readByteRange(resp.Body, r, resp.ContentLength, maxBodySize)
+	}
+	if errors.Is(err, errRangeNotSatisfiable) {
+		return &ProxyResult{
+			StatusCode: http.StatusRequestedRangeNotSatisfiable,
+			Headers:    map[string]string{"Content-Range": contentRange},
+		}, nil
+	}
+	if errors.Is(err, errResponseTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	headers["Content-Range"] = contentRange
+	headers["Content-Length"] = strconv.Itoa(len(body))
+	return &ProxyResult{
+		StatusCode: http.StatusPartialContent,
+		Headers:    headers,
+		Body:       body,
+	}, nil
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// shellControlChars could chain or redirect commands past an allowlist
+// pattern, e.g. "uptime; curl ... | sh" matching "uptime*"
+const shellControlChars = ";&|<>`$\n\\"
+
+// checkCommand applies the device owner's local policy to a command from
+// the server, returning why it's refused or nil if it may run. The server
+// can't override it: only the config file on the device can.
+func (c *Config) checkCommand(cmd *CommandMessage) error {
+	switch cmd.Command {
+	case "reboot":
+		if !c.AllowReboot {
+			return fmt.Errorf("remote reboot is disabled on this device (allow_reboot: false)")
+		}
+	case "exec":
+		if !c.AllowExec {
+			return fmt.Errorf("remote commands are disabled on this device (set allow_exec: true to enable)")
+		}
+		return checkAllowlist(c.ExecAllowlist, cmd.Shell, "this device's exec_allowlist")
+	}
+	return nil
+}
+
+// checkTerminal applies the device owner's local policy to a terminal the
+// server asks to open. A terminal is an interactive shell, so no allowlist
+// can narrow it: it's either enabled in the config file or refused.
+func (c *Config) checkTerminal() error {
+	if !c.AllowTerminal {
+		return fmt.Errorf("terminal sessions are disabled on this device (set allow_terminal: true to enable)")
+	}
+	return nil
+}
+
+// checkAllowlist refuses a shell command that doesn't match one of the
+// allowlist's patterns; an empty allowlist allows anything. name says whose
+// allowlist it is.
+func checkAllowlist(allowlist []string, shell, name string) error {
+	if len(allowlist) == 0 {
+		return nil
+	}
+	shell = strings.TrimSpace(shell)
+	if strings.ContainsAny(shell, shellControlChars) {
+		return fmt.Errorf("command refused: shell operators aren't allowed with an exec_allowlist")
+	}
+	for _, pattern := range allowlist {
+		if matchCommandPattern(pattern, shell) {
+			return nil
+		}
+	}
+	return fmt.Errorf("command refused: not in %s", name)
+}
+
+// matchCommandPattern matches a whole command line against a pattern in
+// which * stands for any text, e.g. "systemctl restart *"
+func matchCommandPattern(pattern, command string) bool {
+	expr := strings.ReplaceAll(regexp.QuoteMeta(strings.TrimSpace(pattern)), `\*`, `.*`)
+	matched, _ := regexp.MatchString("^"+expr+"$", command)
+	return matched
+}
@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "View and edit settings",
+	Long: `View and edit the settings in the config file without editing YAML by
+hand. Keys are the ones used in the file, e.g. local_port or allow_exec.
+
+Examples:
+  piportal config get local_port
+  piportal config set local_port 3000
+  piportal config set exec_allowlist "uptime,df -h"
+  piportal config path`,
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get <key>",
+	Short: "Show a setting",
+	Long: `Show the value a setting has, including defaults and PIPORTAL_*
+environment overrides. Lists go on one line, comma-separated.`,
+	Args:         cobra.ExactArgs(1),
+	RunE:         runConfigGet,
+	SilenceUsage: true,
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set <key> <value>",
+	Short: "Change a setting",
+	Long: `Check a setting and save it to the config file. The rest of the file,
+including comments and anything this version doesn't know about, is left
+alone.
+
+Durations take units (30s, 5m), booleans true or false, and lists are
+comma-separated. A running tunnel picks up changes when it's restarted.`,
+	Args:         cobra.ExactArgs(2),
+	RunE:         runConfigSet,
+	SilenceUsage: true,
+}
+
+var configPathCmd = &cobra.Command{
+	Use:   "path",
+	Short: "Show where the config file is",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println(editableConfigPath())
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configPathCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// configField returns the Config field saved under key in the config file
+func configField(cfg *Config, key string) (reflect.Value, bool) {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if yamlKey(v.Type().Field(i)) == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func yamlKey(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("yaml"), ",")[0]
+}
+
+// unknownKeyError lists the keys there are, since a typo is the usual cause
+func unknownKeyError(key string) error {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, yamlKey(t.Field(i)))
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("unknown setting %q (settings: %s)", key, strings.Join(keys, ", "))
+}
+
+func runConfigGet(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	field, ok := configField(cfg, args[0])
+	if !ok {
+		return unknownKeyError(args[0])
+	}
+
+	out := cmd.OutOrStdout()
+	switch {
+	case field.Type() == durationType:
+		fmt.Fprintln(out, time.Duration(field.Int()))
+	case field.Kind() == reflect.Slice:
+		fmt.Fprintln(out, strings.Join(field.Interface().([]string), ","))
+	default:
+		fmt.Fprintln(out, field.Interface())
+	}
+	return nil
+}
+
+func runConfigSet(cmd *cobra.Command, args []string) error {
+	key, raw := args[0], strings.TrimSpace(args[1])
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	field, ok := configField(cfg, key)
+	if !ok {
+		return unknownKeyError(key)
+	}
+
+	// Set the field so the whole config can be checked, and keep the value
+	// in the form the file uses
+	var value interface{}
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %q (use a duration such as 30s or 5m)", key, raw)
+		}
+		field.SetInt(int64(d))
+		value = d.String()
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q (use a whole number)", key, raw)
+		}
+		field.SetInt(int64(n))
+		value = n
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q (use true or false)", key, raw)
+		}
+		field.SetBool(b)
+		value = b
+	case field.Kind() == reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+		value = items
+	default:
+		field.SetString(raw)
+		value = raw
+	}
+
+	if err := checkConfigValue(key, raw); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	configPath, err := updateConfigFile(key, value)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  ✓ %s saved to %s\n", key, configPath)
+	if env := "PIPORTAL_" + strings.ToUpper(key); os.Getenv(env) != "" {
+		fmt.Printf("  ! %s is set and overrides this\n", env)
+	}
+	return nil
+}
+
+// checkConfigValue applies the rules for settings that aren't just any
+// string: URLs, the token and the subdomain
+func checkConfigValue(key, value string) error {
+	switch key {
+	case "server":
+		return checkURL(key, value, "ws", "wss")
+	case "server_url":
+		return checkURL(key, value, "http", "https")
+	case "token":
+		if !strings.HasPrefix(value, "pp_") {
+			return fmt.Errorf("that doesn't look like a device token (they start with pp_)")
+		}
+	case "subdomain":
+		return validateSubdomain(value)
+	case "local_host":
+		if value == "" {
+			return fmt.Errorf("local_host can't be empty")
+		}
+	case "local_scheme":
+		if value != "http" && value != "https" {
+			return fmt.Errorf("invalid local_scheme %q (use http or https)", value)
+		}
+	}
+	return nil
+}
+
+// checkURL checks value is an absolute URL with one of schemes
+func checkURL(key, value string, schemes ...string) error {
+	u, err := url.Parse(value)
+	if err == nil && u.Host != "" {
+		for _, scheme := range schemes {
+			if u.Scheme == scheme {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid %s %q (use a %s:// URL)", key, value, strings.Join(schemes, ":// or "))
+}
+
+// updateConfigFile sets one key in the config file in place, so settings it
+// doesn't mention keep their defaults rather than being written out, and
+// ones this version doesn't know survive. It edits the parsed document
+// rather than a map, so comments and the order of keys are kept too.
+func updateConfigFile(key string, value interface{}) (string, error) {
+	configPath := editableConfigPath()
+	var doc yaml.Node
+	if data, err := os.ReadFile(configPath); err == nil {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return "", fmt.Errorf("invalid config file %s: %w", configPath, err)
+		}
+	}
+	if len(doc.Content) == 0 { // No file, or nothing but comments
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return "", fmt.Errorf("invalid config file %s: not a list of settings", configPath)
+	}
+
+	var valueNode yaml.Node
+	if err := valueNode.Encode(value); err != nil {
+		return "", err
+	}
+	setMappingValue(root, key, &valueNode)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return "", err
+	}
+	enc.Close()
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(configPath, buf.Bytes(), 0600); err != nil {
+		return "", fmt.Errorf("failed to save config: %w", err)
+	}
+	return configPath, nil
+}
+
+// setMappingValue sets key in a YAML mapping, adding it at the end if it's
+// new. A replaced value keeps the comments that were on the old one.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			old := mapping.Content[i+1]
+			value.HeadComment, value.LineComment, value.FootComment = old.HeadComment, old.LineComment, old.FootComment
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
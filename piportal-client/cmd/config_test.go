@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useConfigFile points the config commands at a fresh config file holding
+// contents, returning its path
+func useConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if contents != "" {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configFile = path
+	t.Cleanup(func() { configFile = "" })
+	for _, env := range []string{"PIPORTAL_LOCAL_PORT", "PIPORTAL_EXEC_ALLOWLIST", "PIPORTAL_ALLOW_EXEC"} {
+		t.Setenv(env, "")
+	}
+	return path
+}
+
+func configGet(t *testing.T, key string) string {
+	t.Helper()
+	var out bytes.Buffer
+	configGetCmd.SetOut(&out)
+	defer configGetCmd.SetOut(nil)
+	if err := runConfigGet(configGetCmd, []string{key}); err != nil {
+		t.Fatalf("config get %s: %v", key, err)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func TestConfigGetSet(t *testing.T) {
+	useConfigFile(t, "token: pp_test\n")
+
+	if got := configGet(t, "local_port"); got != "8080" {
+		t.Errorf("default local_port = %q, want 8080", got)
+	}
+	for _, set := range [][]string{
+		{"local_port", "3000"},
+		{"exec_allowlist", "uptime, df -h"},
+		{"terminal_idle_timeout", "5m"},
+		{"allow_exec", "true"},
+	} {
+		if err := runConfigSet(configSetCmd, set); err != nil {
+			t.Fatalf("config set %s: %v", set[0], err)
+		}
+	}
+	for key, want := range map[string]string{
+		"local_port":            "3000",
+		"exec_allowlist":        "uptime,df -h",
+		"terminal_idle_timeout": "5m0s",
+		"allow_exec":            "true",
+		"token":                 "pp_test",
+	} {
+		if got := configGet(t, key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	if err := runConfigSet(configSetCmd, []string{"local_port", "many"}); err == nil {
+		t.Error("a non-number local_port was saved")
+	}
+	if err := runConfigSet(configSetCmd, []string{"local_prot", "3000"}); err == nil {
+		t.Error("an unknown setting was saved")
+	}
+}
+
+// Editing one setting leaves the rest of the file as the user wrote it
+func TestConfigSetKeepsComments(t *testing.T) {
+	path := useConfigFile(t, `# Written by piportal setup
+token: pp_test
+# The app on this Pi
+local_port: 8080 # dev server
+future_setting: kept
+`)
+
+	if err := runConfigSet(configSetCmd, []string{"local_port", "3000"}); err != nil {
+		t.Fatalf("config set: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Written by piportal setup
+token: pp_test
+# The app on this Pi
+local_port: 3000 # dev server
+future_setting: kept
+`
+	if string(data) != want {
+		t.Errorf("config file is now:\n%s\nwant:\n%s", data, want)
+	}
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// commonPorts are where services people expose from a Pi usually listen:
+// web servers, dev servers, Node-RED, Home Assistant, Jellyfin, Plex
+var commonPorts = []int{80, 1880, 3000, 5000, 8000, 8080, 8081, 8096, 8123, 8888, 9000, 32400}
+
+const (
+	detectDialTimeout = 300 * time.Millisecond
+	detectHTTPTimeout = 700 * time.Millisecond
+)
+
+// DetectedService is a local port that accepted a connection during setup
+type DetectedService struct {
+	Port   int
+	HTTP   bool   // Answered an HTTP HEAD
+	Server string // Server header, if any
+}
+
+// String describes the service for the setup wizard
+func (d DetectedService) String() string {
+	switch {
+	case d.Server != "":
+		return fmt.Sprintf("%d (HTTP, %s)", d.Port, d.Server)
+	case d.HTTP:
+		return fmt.Sprintf("%d (HTTP)", d.Port)
+	default:
+		return fmt.Sprintf("%d (not HTTP)", d.Port)
+	}
+}
+
+// detectLocalServices probes commonPorts on 127.0.0.1 concurrently. It takes
+// at most about detectDialTimeout+detectHTTPTimeout however many ports are
+// closed. HTTP services are listed first, then by port.
+func detectLocalServices() []DetectedService {
+	var (
+		mu    sync.Mutex
+		found []DetectedService
+		wg    sync.WaitGroup
+	)
+	client := &http.Client{
+		Timeout: detectHTTPTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, port := range commonPorts {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+			conn, err := net.DialTimeout("tcp", addr, detectDialTimeout)
+			if err != nil {
+				return
+			}
+			conn.Close()
+
+			svc := DetectedService{Port: port}
+			if resp, err := client.Head("http://" + addr + "/"); err == nil {
+				resp.Body.Close()
+				svc.HTTP = true
+				svc.Server = resp.Header.Get("Server")
+			}
+
+			mu.Lock()
+			found = append(found, svc)
+			mu.Unlock()
+		}(port)
+	}
+	wg.Wait()
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].HTTP != found[j].HTTP {
+			return found[i].HTTP
+		}
+		return found[i].Port < found[j].Port
+	})
+	return found
+}
@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Clock drift thresholds. JWTs and TLS certificates are checked against the
+// local clock, so a Pi without NTP eventually fails to connect.
+const (
+	clockDriftWarn = 30 * time.Second
+	clockDriftFail = 5 * time.Minute
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose common setup problems",
+	Long: `Run every check 'piportal test' does, plus a few more, and suggest a fix
+for each problem found:
+
+  - the config file exists and is valid
+  - the PiPortal server's API is reachable
+  - the system clock agrees with the server's
+  - the device token is accepted
+  - the local service is listening and answers HTTP
+  - the background service is installed and running
+
+Exits non-zero if any check fails. Warnings don't affect the exit code.`,
+	RunE:         runDoctor,
+	SilenceUsage: true, // A failed check isn't a usage error
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	fmt.Println()
+	fmt.Println("  PiPortal Doctor")
+	fmt.Println("  ─────────────────────────────────────────")
+	fmt.Println()
+
+	c := &checklist{}
+
+	cfg := doctorConfig(c)
+	if cfg.Server != "" && cfg.Token != "" {
+		doctorServer(c, cfg)
+		doctorToken(c, cfg)
+	} else {
+		c.skip("Server API", "skipped")
+		c.skip("Token", "skipped")
+	}
+
+	failed := c.failed
+	testLocalService(c, cfg)
+	if c.failed > failed {
+		doctorLocalHint(c, cfg)
+	}
+
+	doctorService(c)
+
+	fmt.Println()
+	if c.failed > 0 {
+		return fmt.Errorf("%d check(s) failed", c.failed)
+	}
+	if c.warned > 0 {
+		fmt.Printf("  No failures, %d warning(s).\n", c.warned)
+	} else {
+		fmt.Println("  Everything looks good.")
+	}
+	fmt.Println()
+	return nil
+}
+
+// doctorConfig checks the config file. It always returns a config, falling
+// back to the defaults, so the local service can still be checked.
+func doctorConfig(c *checklist) *Config {
+	path := getConfigPath()
+	fallback := &Config{LocalHost: "127.0.0.1", LocalPort: 8080}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		c.fail("Config", err.Error())
+		c.hint(fmt.Sprintf("Fix %s, or run 'piportal setup' to write a new one", path))
+		return fallback
+	}
+
+	_, statErr := os.Stat(path)
+	switch {
+	case cfg.Server == "" || cfg.Token == "":
+		if statErr != nil {
+			c.fail("Config", fmt.Sprintf("no config file at %s", path))
+		} else {
+			c.fail("Config", fmt.Sprintf("%s is missing the server or token", path))
+		}
+		c.hint("Run 'piportal setup' to register this device")
+	case statErr != nil:
+		// Configured entirely from PIPORTAL_* variables or the service's config
+		c.warn("Config", fmt.Sprintf("no config file at %s, using environment or service config", path))
+	default:
+		c.pass("Config", path)
+	}
+	return cfg
+}
+
+// doctorServer fetches /api/status, then compares the server's Date header
+// with the local clock
+func doctorServer(c *checklist, cfg *Config) {
+	base := serverBaseURL(cfg)
+	if base == "" {
+		c.fail("Server API", fmt.Sprintf("can't work out the server URL from %q", cfg.Server))
+		c.hint("Set server_url in your config, e.g. https://yourdomain.com")
+		c.skip("Clock", "skipped")
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	start := time.Now()
+	resp, err := client.Get(base + "/api/status")
+	if err != nil {
+		c.fail("Server API", fmt.Sprintf("could not reach %s: %v", base, err))
+		if strings.Contains(err.Error(), "certificate") {
+			c.hint("TLS failed - check the system clock and that the server's certificate is valid")
+		} else {
+			c.hint("Check the server URL, DNS and that outbound HTTPS isn't blocked")
+		}
+		c.skip("Clock", "skipped")
+		return
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+
+	if resp.StatusCode != http.StatusOK {
+		c.fail("Server API", fmt.Sprintf("%s/api/status returned %d", base, resp.StatusCode))
+		c.hint(fmt.Sprintf("Make sure %s is a PiPortal server", base))
+	} else {
+		c.pass("Server API", fmt.Sprintf("%s answered in %s", base, rtt.Round(time.Millisecond)))
+	}
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		c.skip("Clock", "server sent no Date header")
+		return
+	}
+	// The Date header has one-second resolution and was stamped mid-request
+	drift := start.Add(rtt / 2).Sub(serverTime)
+	if drift < 0 {
+		drift = -drift
+	}
+	detail := fmt.Sprintf("within %s of the server", drift.Round(time.Second))
+	switch {
+	case drift >= clockDriftFail:
+		c.fail("Clock", fmt.Sprintf("off by %s from the server", drift.Round(time.Second)))
+		c.hint(clockHint())
+	case drift >= clockDriftWarn:
+		c.warn("Clock", fmt.Sprintf("off by %s from the server", drift.Round(time.Second)))
+		c.hint(clockHint())
+	default:
+		c.pass("Clock", detail)
+	}
+}
+
+// doctorToken checks the token. Authenticating over the tunnel would replace
+// a running tunnel's connection, so in that case the usage API is used.
+func doctorToken(c *checklist, cfg *Config) {
+	if st := readRunState(); st != nil {
+		c.pass("Tunnel", fmt.Sprintf("running (pid %d, %s)", st.PID, st.State))
+		if _, err := fetchUsage(serverBaseURL(cfg), cfg.Token); err != nil {
+			c.fail("Token", fmt.Sprintf("usage lookup failed: %v", err))
+			c.hint("Check the device still exists in the dashboard, or run 'piportal setup' again")
+			return
+		}
+		c.pass("Token", "accepted by the usage API")
+		return
+	}
+
+	failed := c.failed
+	testServerAuth(c, cfg)
+	if c.failed > failed {
+		c.hint("Check the device still exists in the dashboard, or run 'piportal setup' again")
+	}
+}
+
+// doctorLocalHint suggests other ports when the local service check fails
+func doctorLocalHint(c *checklist, cfg *Config) {
+	if socket := cfg.LocalSocket(); socket != "" {
+		c.hint(fmt.Sprintf("Start your app, or check the socket path in local_host (now %s)", socket))
+		return
+	}
+
+	var ports []string
+	for _, s := range detectLocalServices() {
+		if s.HTTP && s.Port != cfg.LocalPort {
+			ports = append(ports, s.String())
+		}
+	}
+	if len(ports) > 0 {
+		c.hint("Found HTTP services on " + strings.Join(ports, ", ") + " - set local_port in your config")
+		return
+	}
+	c.hint(fmt.Sprintf("Start your app, or point PiPortal at it with local_port (now %d)", cfg.LocalPort))
+}
+
+// doctorService checks the background service
+func doctorService(c *checklist) {
+	if err := serviceSupported(); err != nil {
+		c.skip("Service", err.Error())
+		return
+	}
+	switch {
+	case !serviceInstalled():
+		c.skip("Service", "not installed (optional: 'piportal service install')")
+	case serviceRunning():
+		c.pass("Service", "installed and running")
+	default:
+		c.warn("Service", "installed but not running")
+		c.hint("Run 'piportal service restart', then check its logs")
+	}
+}
+
+// serverBaseURL returns the server's HTTP base URL, deriving it from the
+// tunnel URL (wss://example.com/tunnel → https://example.com) if needed
+func serverBaseURL(cfg *Config) string {
+	if cfg.ServerURL != "" {
+		return strings.TrimSuffix(cfg.ServerURL, "/")
+	}
+	u, err := url.Parse(cfg.Server)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	case "ws":
+		u.Scheme = "http"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/tunnel")
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+// clockHint suggests how to turn on time sync for this OS
+func clockHint() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "Enable time sync: sudo timedatectl set-ntp true"
+	case "darwin":
+		return "Enable 'Set time and date automatically' in System Settings"
+	case "windows":
+		return "Resync the clock: w32tm /resync"
+	default:
+		return "Enable NTP time sync"
+	}
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dryRunRule says how to dry-run commands whose first words are prefix
+type dryRunRule struct {
+	prefix  string
+	rewrite string   // Replaces prefix to simulate the command; "" runs it unchanged
+	refuse  bool     // Can't be simulated, so it's not run at all
+	unsafe  []string // Options that undo the simulation or run other programs
+	dotted  bool     // Also matches prefix.<suffix>, like mkfs.ext4
+}
+
+// dryRunRules are checked in order. Commands matching none are echoed, not run.
+// pip isn't rewritten: its --dry-run still downloads packages and runs their
+// build scripts, so pip commands are echoed like any other.
+var dryRunRules = []dryRunRule{
+	// Package managers have a simulate mode. Options that could switch it
+	// back off, load other config or run hooks are refused.
+	{prefix: "apt-get", rewrite: "apt-get -s", unsafe: aptUnsafeOptions},
+	{prefix: "apt", rewrite: "apt -s", unsafe: aptUnsafeOptions},
+	{prefix: "dnf", rewrite: "dnf --assumeno", unsafe: dnfUnsafeOptions},
+	{prefix: "yum", rewrite: "yum --assumeno", unsafe: dnfUnsafeOptions},
+	// rsync still runs the remote shell and remote rsync under --dry-run
+	{prefix: "rsync", rewrite: "rsync --dry-run", unsafe: []string{"--no-", "-e", "--rsh", "--rsync-path", "--daemon", "--config"}},
+
+	// Read-only, so safe to run for real
+	{prefix: "systemctl status"},
+	{prefix: "systemctl is-active"},
+	{prefix: "systemctl is-enabled"},
+	{prefix: "systemctl list-units"},
+	{prefix: "uptime"},
+	{prefix: "df"},
+	{prefix: "free"},
+
+	// Destructive with no simulate mode
+	{prefix: "rm", refuse: true},
+	{prefix: "dd", refuse: true},
+	{prefix: "mkfs", refuse: true, dotted: true},
+	{prefix: "shutdown", refuse: true},
+	{prefix: "reboot", refuse: true},
+	{prefix: "poweroff", refuse: true},
+}
+
+var (
+	// apt takes --no-<option> for any boolean, e.g. --no-simulate
+	aptUnsafeOptions = []string{"--no-", "-o", "--option", "-c", "--config-file"}
+	dnfUnsafeOptions = []string{"-y", "--assumeyes", "--setopt", "-c", "--config"}
+)
+
+// matches reports whether command starts with the rule's words
+func (r dryRunRule) matches(command string) bool {
+	return command == r.prefix ||
+		strings.HasPrefix(command, r.prefix+" ") ||
+		(r.dotted && strings.HasPrefix(command, r.prefix+"."))
+}
+
+// unsafeOption returns the first argument of command that is one of the
+// rule's unsafe options, or "". A short option also counts inside a cluster
+// such as -ae, and an entry ending in "-" matches any option it starts.
+func (r dryRunRule) unsafeOption(command string) string {
+	for _, arg := range strings.Fields(command)[1:] {
+		for _, opt := range r.unsafe {
+			switch {
+			case strings.HasSuffix(opt, "-"):
+				if strings.HasPrefix(arg, opt) {
+					return arg
+				}
+			case strings.HasPrefix(opt, "--"):
+				if arg == opt || strings.HasPrefix(arg, opt+"=") {
+					return arg
+				}
+			default:
+				if !strings.HasPrefix(arg, "--") && strings.HasPrefix(arg, "-") && strings.Contains(arg[1:], opt[1:]) {
+					return arg
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// simulateCommand works out how to dry-run a shell command. It returns the
+// command to run instead, or if that's "", the output to report without
+// running anything. An error means the command can't be dry-run.
+func simulateCommand(shell string) (run, output string, err error) {
+	shell = strings.TrimSpace(shell)
+	wouldRun := fmt.Sprintf("[dry run] would execute: %s", shell)
+
+	// A rewrite only covers the first command of a chain or pipeline, and
+	// quoted words can hide options from the checks below
+	if strings.ContainsAny(shell, shellControlChars+`'"`) {
+		return "", wouldRun, nil
+	}
+
+	sudo := ""
+	command := shell
+	if rest, ok := strings.CutPrefix(shell, "sudo "); ok {
+		sudo, command = "sudo ", strings.TrimSpace(rest)
+	}
+
+	for _, rule := range dryRunRules {
+		if !rule.matches(command) {
+			continue
+		}
+		if rule.refuse {
+			return "", "", fmt.Errorf("%s can't be dry-run, so it was not executed", rule.prefix)
+		}
+		if opt := rule.unsafeOption(command); opt != "" {
+			return "", "", fmt.Errorf("%s %s can't be dry-run safely, so it was not executed", rule.prefix, opt)
+		}
+		if rule.rewrite == "" {
+			return shell, "", nil
+		}
+		return sudo + rule.rewrite + strings.TrimPrefix(command, rule.prefix), "", nil
+	}
+	return "", wouldRun, nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import "testing"
+
+func TestSimulateCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		shell   string
+		wantRun string // "" if nothing should run
+		wantErr bool
+	}{
+		{"simulate mode", "apt-get install -y vim", "apt-get -s install -y vim", false},
+		{"simulate mode under sudo", "sudo apt upgrade", "sudo apt -s upgrade", false},
+		{"rsync", "rsync -a src/ dst/", "rsync --dry-run -a src/ dst/", false},
+		{"read-only", "systemctl status nginx", "systemctl status nginx", false},
+		{"destructive", "sudo rm -rf /tmp/x", "", true},
+		{"mkfs variant", "mkfs.ext4 /dev/sda1", "", true},
+		{"unknown", "touch /tmp/x", "", false},
+		{"chain", "df && rm -rf /", "", false},
+		{"quoted", `apt-get "--no-simulate" install vim`, "", false},
+
+		// Options that turn the simulation off or run other programs
+		{"apt-get no-simulate", "apt-get --no-simulate install vim", "", true},
+		{"apt option", "sudo apt-get -o APT::Get::Simulate=false install vim", "", true},
+		{"apt config file", "apt --config-file=/tmp/apt.conf upgrade", "", true},
+		{"dnf assumeyes", "dnf --assumeno install -y vim", "", true},
+		{"yum setopt", "yum --setopt=assumeyes=1 install vim", "", true},
+		{"rsync remote shell", "rsync -e /tmp/evil src/ host:dst/", "", true},
+		{"rsync clustered remote shell", "rsync -ae /tmp/evil src/ host:dst/", "", true},
+		{"rsync long remote shell", "rsync --rsh=/tmp/evil src/ host:dst/", "", true},
+		{"rsync remote path", "rsync --rsync-path=/tmp/evil src/ host:dst/", "", true},
+		{"rsync no-dry-run", "rsync --no-dry-run -a src/ dst/", "", true},
+		{"rsync exclude", "rsync -a --exclude=.git src/ dst/", "rsync --dry-run -a --exclude=.git src/ dst/", false},
+
+		// Only mkfs has dotted variants
+		{"dotted df", "df.foo", "", false},
+		{"dotted uptime", "uptime.x", "", false},
+
+		// pip's --dry-run downloads packages and runs their build scripts
+		{"pip", "pip install requests", "", false},
+		{"pip3 under sudo", "sudo pip3 install requests", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run, output, err := simulateCommand(tt.shell)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if run != tt.wantRun {
+				t.Errorf("runs %q, want %q", run, tt.wantRun)
+			}
+			if run == "" && !tt.wantErr && output != "[dry run] would execute: "+tt.shell {
+				t.Errorf("output = %q, want the command echoed", output)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly && !windows
+
+package cmd
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile is unsupported here, so nothing stops a second 'piportal start'
+func lockFile(f *os.File) error {
+	return errors.ErrUnsupported
+}
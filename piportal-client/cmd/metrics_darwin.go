@@ -0,0 +1,71 @@
+//go:build darwin
+
+package cmd
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// collectPlatformMetrics reads metrics via sysctl and statfs.
+// CPU temperature needs IOKit/SMC access, so it stays at -1.
+func collectPlatformMetrics(m *MetricsMessage) {
+	m.MemTotal, m.MemFree = readDarwinMemory()
+	m.DiskTotal, m.DiskFree = readDarwinDisk()
+	m.Uptime = readDarwinUptime()
+	m.LoadAvg = readDarwinLoadAvg()
+}
+
+// readDarwinMemory returns total and free bytes (free + inactive pages,
+// which the kernel can reclaim without swapping)
+func readDarwinMemory() (total, free uint64) {
+	total, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return 0, 0
+	}
+	pageSize, err := unix.SysctlUint32("hw.pagesize")
+	if err != nil {
+		return total, 0
+	}
+	freePages, err := unix.SysctlUint32("vm.page_free_count")
+	if err != nil {
+		return total, 0
+	}
+	inactivePages, _ := unix.SysctlUint32("vm.page_inactive_count")
+	return total, (uint64(freePages) + uint64(inactivePages)) * uint64(pageSize)
+}
+
+// readDarwinDisk returns root volume total and free bytes (available to non-root)
+func readDarwinDisk() (total, free uint64) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs("/", &stat); err != nil {
+		return 0, 0
+	}
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize)
+}
+
+// readDarwinUptime returns seconds since kern.boottime
+func readDarwinUptime() int64 {
+	tv, err := unix.SysctlTimeval("kern.boottime")
+	if err != nil {
+		return 0
+	}
+	return int64(time.Since(time.Unix(tv.Unix())).Seconds())
+}
+
+// readDarwinLoadAvg decodes the 1-minute load average from vm.loadavg
+// (struct loadavg { fixpt_t ldavg[3]; long fscale; })
+func readDarwinLoadAvg() float64 {
+	raw, err := unix.SysctlRaw("vm.loadavg")
+	if err != nil || len(raw) < 24 {
+		return -1
+	}
+	load := binary.LittleEndian.Uint32(raw[0:4])
+	scale := binary.LittleEndian.Uint64(raw[16:24])
+	if scale == 0 {
+		return -1
+	}
+	return float64(load) / float64(scale)
+}
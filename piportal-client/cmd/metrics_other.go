@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !windows
+
+package cmd
+
+// collectPlatformMetrics is a no-op on platforms without a metrics reader;
+// the dashboard shows these metrics as unavailable
+func collectPlatformMetrics(m *MetricsMessage) {}
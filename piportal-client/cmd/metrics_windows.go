@@ -0,0 +1,61 @@
+//go:build windows
+
+package cmd
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// memoryStatusEx mirrors MEMORYSTATUSEX
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// collectPlatformMetrics reads metrics via the Win32 API.
+// Windows has no load average and no standard CPU temperature source,
+// so both stay at -1.
+func collectPlatformMetrics(m *MetricsMessage) {
+	m.MemTotal, m.MemFree = readWindowsMemory()
+	m.DiskTotal, m.DiskFree = readWindowsDisk()
+	m.Uptime = int64(windows.DurationSinceBoot().Seconds())
+}
+
+// readWindowsMemory returns total and available physical memory in bytes
+func readWindowsMemory() (total, free uint64) {
+	var status memoryStatusEx
+	status.Length = uint32(unsafe.Sizeof(status))
+	if r, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); r == 0 {
+		return 0, 0
+	}
+	return status.TotalPhys, status.AvailPhys
+}
+
+// readWindowsDisk returns system drive total and free bytes (available to the caller)
+func readWindowsDisk() (total, free uint64) {
+	drive := os.Getenv("SystemDrive")
+	if drive == "" {
+		drive = "C:"
+	}
+	root, err := windows.UTF16PtrFromString(drive + `\`)
+	if err != nil {
+		return 0, 0
+	}
+	var totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(root, &free, &total, &totalFree); err != nil {
+		return 0, 0
+	}
+	return total, free
+}
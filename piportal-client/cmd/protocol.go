@@ -17,6 +17,10 @@ const (
 	MessageTypeMetrics    = "metrics"
 	MessageTypeCommand       = "command"
 	MessageTypeCommandResult = "command_result"
+	MessageTypeCommandOutput = "command_output"
+	MessageTypeCommandCancel = "command_cancel"
+	MessageTypeReconnect     = "reconnect"
+	MessageTypeMetricsRequest = "metrics_request"
 
 	// Terminal message types
 	MessageTypeTerminalOpen   = "terminal_open"
@@ -35,6 +39,14 @@ type AuthMessage struct {
 	Type          string `json:"type"`
 	Token         string `json:"token"`
 	ClientVersion string `json:"client_version"`
+
+	// Connection telemetry, so the server can spot flaky devices
+	Reconnects     int    `json:"reconnects"`
+	ClientUptime   int64  `json:"client_uptime"` // Seconds since this process started
+	LastDisconnect string `json:"last_disconnect,omitempty"`
+
+	// Monitoring only: this client won't answer proxied requests
+	NoProxy bool `json:"no_proxy,omitempty"`
 }
 
 func NewAuthMessage(token, version string) AuthMessage {
@@ -52,6 +64,8 @@ type ResponseMessage struct {
 	StatusCode int               `json:"status_code"`
 	Headers    map[string]string `json:"headers"`
 	BodyBase64 string            `json:"body_base64,omitempty"`
+
+	UpstreamTime int64 `json:"upstream_time_us,omitempty"` // Microseconds the local service took
 }
 
 func NewResponseMessage(requestID string, statusCode int, headers map[string]string, body []byte) ResponseMessage {
@@ -79,10 +93,16 @@ func NewPingMessage() PingMessage {
 
 // AuthResultMessage is the server's response to authentication
 type AuthResultMessage struct {
-	Type      string `json:"type"`
-	Success   bool   `json:"success"`
-	Subdomain string `json:"subdomain,omitempty"`
-	Message   string `json:"message,omitempty"`
+	Type           string `json:"type"`
+	Success        bool   `json:"success"`
+	Subdomain      string `json:"subdomain,omitempty"`
+	Message        string `json:"message,omitempty"`
+	RequestTimeout int    `json:"request_timeout,omitempty"` // Seconds the server waits for a response
+	MaxBodySize    int64  `json:"max_body_size,omitempty"`   // Largest body the server will accept
+	BaseDomain     string `json:"base_domain,omitempty"`
+	URL            string `json:"url,omitempty"` // The device's public URL
+
+	Settings *AgentSettings `json:"settings,omitempty"` // From the dashboard, for this session
 }
 
 // RequestMessage is an incoming HTTP request to forward
@@ -93,6 +113,12 @@ type RequestMessage struct {
 	Path       string            `json:"path"`
 	Headers    map[string]string `json:"headers"`
 	BodyBase64 string            `json:"body_base64,omitempty"`
+	Timeout    int               `json:"timeout,omitempty"` // Seconds the server waits (0 = the session's request_timeout)
+
+	// Where the visitor sent the request. Older servers leave these empty.
+	Host     string `json:"host,omitempty"`      // Public hostname
+	Scheme   string `json:"scheme,omitempty"`    // http or https
+	ClientIP string `json:"client_ip,omitempty"` // The visitor's address
 }
 
 func (r *RequestMessage) GetBody() ([]byte, error) {
@@ -109,9 +135,16 @@ type ErrorMessage struct {
 	Message string `json:"message"`
 }
 
+// ReconnectMessage asks the client to drop its connection and reconnect
+type ReconnectMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
 // MetricsMessage reports system metrics to the server
 type MetricsMessage struct {
 	Type      string  `json:"type"`
+	RequestID string  `json:"request_id,omitempty"` // Set when answering a metrics_request
 	CPUTemp   float64 `json:"cpu_temp"`
 	MemTotal  uint64  `json:"mem_total"`
 	MemFree   uint64  `json:"mem_free"`
@@ -121,6 +154,12 @@ type MetricsMessage struct {
 	LoadAvg   float64 `json:"load_avg"`
 }
 
+// MetricsRequestMessage asks for metrics now rather than at the next ping
+type MetricsRequestMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+}
+
 // CommandMessage is a command sent from the server to the client
 type CommandMessage struct {
 	Type      string `json:"type"`
@@ -128,6 +167,8 @@ type CommandMessage struct {
 	Command   string `json:"command"`
 	Shell     string `json:"shell,omitempty"`
 	DryRun    bool   `json:"dry_run,omitempty"`
+	Stream    bool   `json:"stream,omitempty"`  // Send output as command_output chunks
+	Timeout   int    `json:"timeout,omitempty"` // Seconds (0 = client default)
 }
 
 // CommandResultMessage is sent back to the server after executing a command
@@ -137,6 +178,9 @@ type CommandResultMessage struct {
 	ExitCode  int    `json:"exit_code"`
 	Output    string `json:"output"`
 	Error     string `json:"error,omitempty"`
+
+	DryRunEnforced bool  `json:"dry_run_enforced,omitempty"` // Only simulated, because of exec_dry_run_only
+	OutputDropped  int64 `json:"output_dropped,omitempty"`   // Bytes of streamed output that were never sent
 }
 
 // NewCommandResultMessage creates a new command result message
@@ -150,6 +194,31 @@ func NewCommandResultMessage(commandID string, exitCode int, output, errMsg stri
 	}
 }
 
+// CommandOutputMessage carries a chunk of output from a streaming command
+type CommandOutputMessage struct {
+	Type       string `json:"type"`
+	CommandID  string `json:"command_id"`
+	Stream     string `json:"stream"` // "stdout" or "stderr"
+	DataBase64 string `json:"data_base64"`
+}
+
+// NewCommandOutputMessage creates a command output chunk
+func NewCommandOutputMessage(commandID, stream string, data []byte) CommandOutputMessage {
+	return CommandOutputMessage{
+		Type:       MessageTypeCommandOutput,
+		CommandID:  commandID,
+		Stream:     stream,
+		DataBase64: base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+// CommandCancelMessage stops a streaming command, e.g. because whoever was
+// watching its output went away
+type CommandCancelMessage struct {
+	Type      string `json:"type"`
+	CommandID string `json:"command_id"`
+}
+
 // --- Terminal Messages (Server <-> Client) ---
 
 // TerminalOpenMessage tells the client to open a PTY session
@@ -187,6 +256,7 @@ type TerminalResizeMessage struct {
 type TerminalCloseMessage struct {
 	Type      string `json:"type"`
 	SessionID string `json:"session_id"`
+	Reason    string `json:"reason,omitempty"` // Why the device refused or ended it
 }
 
 func NewTerminalCloseMessage(sessionID string) TerminalCloseMessage {
@@ -221,10 +291,22 @@ func ParseMessage(data []byte) (interface{}, string, error) {
 		var m ErrorMessage
 		err = json.Unmarshal(data, &m)
 		msg = m
+	case MessageTypeReconnect:
+		var m ReconnectMessage
+		err = json.Unmarshal(data, &m)
+		msg = m
+	case MessageTypeMetricsRequest:
+		var m MetricsRequestMessage
+		err = json.Unmarshal(data, &m)
+		msg = m
 	case MessageTypeCommand:
 		var m CommandMessage
 		err = json.Unmarshal(data, &m)
 		msg = m
+	case MessageTypeCommandCancel:
+		var m CommandCancelMessage
+		err = json.Unmarshal(data, &m)
+		msg = m
 	case MessageTypeTerminalOpen:
 		var m TerminalOpenMessage
 		err = json.Unmarshal(data, &m)
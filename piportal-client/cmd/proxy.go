@@ -3,29 +3,147 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// Defaults used until the server sends its limits on auth
+const (
+	defaultRequestTimeout = 30 * time.Second
+	defaultMaxBodySize    = 10 * 1024 * 1024
+)
+
+// Connection pool defaults for the local service
+const (
+	defaultLocalMaxIdleConns = 16
+	defaultLocalIdleTimeout  = 90 * time.Second
+	defaultLocalDialTimeout  = 5 * time.Second
+)
+
+// errResponseTooLarge is returned by Forward when the local service's
+// response is bigger than the server accepts
+var errResponseTooLarge = errors.New("response body too large")
+
+// mirrorMaxInFlight bounds mirrored requests waiting on the mirror. Past it,
+// copies are dropped rather than queued, so a slow mirror costs nothing.
+const mirrorMaxInFlight = 8
+
+// MirrorHeader marks the copies sent to the mirror
+const MirrorHeader = "X-PiPortal-Mirror"
+
+// unixSocketPrefix marks a local service on a Unix domain socket rather than
+// host:port, e.g. unix:/var/run/docker.sock
+const unixSocketPrefix = "unix:"
+
+// localNetwork splits a local address into the network and address to dial
+func localNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixSocketPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// ProxyOptions tunes connections to the local service. Keeping idle
+// connections open saves a TCP handshake per request and stops busy tunnels
+// running the device out of local ports.
+type ProxyOptions struct {
+	MaxIdleConns    int           // Idle keep-alive connections kept open (0 disables keep-alive)
+	IdleConnTimeout time.Duration // Close idle connections after this long
+	DialTimeout     time.Duration // Give up connecting to the local service after this long
+
+	MirrorAddr string // Also send a copy of each request here (host:port), ignoring the reply
+
+	Scheme             string // http (the default) or https
+	InsecureSkipVerify bool   // Accept any certificate from an https local service
+
+	PreserveHost bool // Send the public hostname as Host instead of the local address
+}
+
 // Proxy handles forwarding requests to a local HTTP service
 type Proxy struct {
-	targetAddr string
-	client     *http.Client
+	scheme      string
+	targetAddr  string
+	client      *http.Client
+	timeout     atomic.Int64 // time.Duration
+	maxBodySize atomic.Int64
+
+	preserveHost bool // Send the public hostname as Host
+
+	// Shadow copies of requests. The mirror has its own connections so it
+	// can't use up the primary's.
+	mirrorAddr   string
+	mirrorClient *http.Client
+	mirrorSlots  chan struct{}
 }
 
-// NewProxy creates a proxy that forwards to the given address
-func NewProxy(targetAddr string) *Proxy {
-	return &Proxy{
-		targetAddr: targetAddr,
+// NewProxy creates a proxy that forwards to the given address: host:port, or
+// unix:/path/to.sock for a service listening on a Unix socket
+func NewProxy(targetAddr string, opts ProxyOptions) *Proxy {
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+	if network, path := localNetwork(targetAddr); network == "unix" {
+		// Still HTTP, but every connection goes to the socket whatever the
+		// URL's host, which is only there for the Host header
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, path)
+		}
+		targetAddr = "localhost"
+	}
+
+	// All requests go to one host, so the per-host limit is the one that matters
+	transport := &http.Transport{
+		DialContext:         dial,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConns,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		DisableKeepAlives:   opts.MaxIdleConns <= 0,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify},
+	}
+	scheme := opts.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	noRedirects := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	p := &Proxy{
+		scheme:       scheme,
+		targetAddr:   targetAddr,
+		preserveHost: opts.PreserveHost,
 		client: &http.Client{
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-			Timeout: 30 * time.Second,
+			Transport:     transport,
+			CheckRedirect: noRedirects,
 		},
 	}
+	if opts.MirrorAddr != "" {
+		mirrorTransport := transport.Clone()
+		mirrorTransport.DialContext = dialer.DialContext // The mirror is always host:port
+		mirrorTransport.MaxIdleConnsPerHost = mirrorMaxInFlight
+		p.mirrorAddr = opts.MirrorAddr
+		p.mirrorClient = &http.Client{Transport: mirrorTransport, CheckRedirect: noRedirects}
+		p.mirrorSlots = make(chan struct{}, mirrorMaxInFlight)
+	}
+	p.SetLimits(defaultRequestTimeout, defaultMaxBodySize)
+	return p
+}
+
+// SetLimits applies the server's request timeout and body size limit
+func (p *Proxy) SetLimits(timeout time.Duration, maxBodySize int64) {
+	if timeout > 0 {
+		p.timeout.Store(int64(timeout))
+	}
+	if maxBodySize > 0 {
+		p.maxBodySize.Store(maxBodySize)
+	}
 }
 
 // ProxyResult contains the response from the local service
@@ -37,7 +155,7 @@ type ProxyResult struct {
 
 // Forward sends a request to the local service
 func (p *Proxy) Forward(ctx context.Context, req *RequestMessage) (*ProxyResult, error) {
-	url := fmt.Sprintf("http://%s%s", p.targetAddr, req.Path)
+	url := fmt.Sprintf("%s://%s%s", p.scheme, p.targetAddr, req.Path)
 
 	body, err := req.GetBody()
 	if err != nil {
@@ -49,6 +167,14 @@ func (p *Proxy) Forward(ctx context.Context, req *RequestMessage) (*ProxyResult,
 		bodyReader = bytes.NewReader(body)
 	}
 
+	// The server can give slow routes longer than the session default
+	timeout := time.Duration(p.timeout.Load())
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	httpReq, err := http.NewRequestWithContext(ctx, req.Method, url, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
@@ -60,27 +186,60 @@ func (p *Proxy) Forward(ctx context.Context, req *RequestMessage) (*ProxyResult,
 		}
 	}
 
-	httpReq.Header.Set("X-Forwarded-Proto", "https")
+	// Tell the local service the public scheme and host, so the absolute
+	// URLs it builds (redirects, links) work from outside. These replace
+	// anything the visitor sent.
+	proto := req.Scheme
+	if proto == "" {
+		proto = "https" // Older servers don't say
+	}
+	httpReq.Header.Set("X-Forwarded-Proto", proto)
+	if req.Host != "" {
+		httpReq.Header.Set("X-Forwarded-Host", req.Host)
+		httpReq.Header.Set("Forwarded", forwardedHeader(visitorAddr(req.ClientIP, httpReq.Header.Get("X-Forwarded-For")), req.Host, proto))
+		if p.preserveHost {
+			httpReq.Host = req.Host
+		}
+	}
 	httpReq.Header.Set("X-PiPortal", "true")
 
+	p.mirror(httpReq, body, timeout)
+
 	resp, err := p.client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to reach local service: %w", err)
 	}
 	defer resp.Body.Close()
 
-	const maxBodySize = 10 * 1024 * 1024
-	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
-	}
-
 	headers := make(map[string]string)
 	for key, values := range resp.Header {
 		if len(values) > 0 && !isHopByHopHeader(key) {
 			headers[key] = values[0]
 		}
 	}
+	if location := headers["Location"]; location != "" && req.Host != "" {
+		headers["Location"] = p.publicLocation(location, proto, req.Host)
+	}
+	maxBodySize := p.maxBodySize.Load()
+
+	// A local service that ignores Range sends the whole body. Only the
+	// range is kept, so seeking in a large video doesn't carry (or, past
+	// the size limit, fail on) the whole file.
+	if servesRange(httpReq, resp) {
+		if r, ok, err := parseByteRange(httpReq.Header.Get("Range"), resp.ContentLength); ok {
+			return rangeResult(resp, r, err, headers, maxBodySize)
+		}
+	}
+
+	// Read one byte past the limit, so a response that is too big fails
+	// rather than being cut short
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if int64(len(respBody)) > maxBodySize {
+		return nil, fmt.Errorf("%w: over %d bytes", errResponseTooLarge, maxBodySize)
+	}
 
 	return &ProxyResult{
 		StatusCode: resp.StatusCode,
@@ -89,6 +248,133 @@ func (p *Proxy) Forward(ctx context.Context, req *RequestMessage) (*ProxyResult,
 	}, nil
 }
 
+// publicLocation points a redirect at the local service's own address, as
+// built by an app that ignores X-Forwarded-Host, to the public host instead.
+// Relative redirects and ones to other hosts are left as they are.
+func (p *Proxy) publicLocation(location, scheme, host string) string {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !p.isLocalService(u) {
+		return location
+	}
+	u.Scheme, u.Host = scheme, host
+	return u.String()
+}
+
+// isLocalService reports whether u is on the local service. An app often
+// names itself by another loopback address than the one it's reached on,
+// e.g. localhost:3000 for 127.0.0.1:3000, so any loopback host on the
+// local port counts.
+func (p *Proxy) isLocalService(u *url.URL) bool {
+	if strings.EqualFold(u.Host, p.targetAddr) {
+		return true
+	}
+	if !isLoopbackHost(u.Hostname()) {
+		return false
+	}
+	_, targetPort, _ := net.SplitHostPort(p.targetAddr) // None for a Unix socket
+	port := u.Port()
+	if port == "" && targetPort != "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	return port == targetPort
+}
+
+// isLoopbackHost reports whether host is localhost or a loopback address
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// mirror fires a copy of a request at the mirror, if one is configured, and
+// forgets it: the reply and any error are discarded. When the mirror already
+// has mirrorMaxInFlight requests outstanding the copy is skipped.
+func (p *Proxy) mirror(primary *http.Request, body []byte, timeout time.Duration) {
+	if p.mirrorClient == nil {
+		return
+	}
+	select {
+	case p.mirrorSlots <- struct{}{}:
+	default:
+		return
+	}
+
+	// Not tied to the primary's context, which ends when it's answered
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, primary.Method, "http://"+p.mirrorAddr+primary.URL.RequestURI(), bodyReader)
+	if err != nil {
+		cancel()
+		<-p.mirrorSlots
+		return
+	}
+	req.Header = primary.Header.Clone()
+	req.Header.Set(MirrorHeader, "true")
+
+	go func() {
+		defer func() { <-p.mirrorSlots }()
+		defer cancel()
+		resp, err := p.mirrorClient.Do(req)
+		if err != nil {
+			return
+		}
+		// Read it out so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, p.maxBodySize.Load()))
+		resp.Body.Close()
+	}()
+}
+
+// requestIDHeader is set by the server on every proxied request, and returned
+// to the browser, so one ID matches up both sides' logs
+const requestIDHeader = "X-PiPortal-Request-ID"
+
+// LogID returns the request's ID for log lines: the server-assigned
+// request ID header, or the protocol ID from servers that don't send one
+func (r *RequestMessage) LogID() string {
+	for key, value := range r.Headers {
+		if strings.EqualFold(key, requestIDHeader) {
+			return value
+		}
+	}
+	return r.RequestID
+}
+
+// visitorAddr is the visitor's address as the server worked it out. Older
+// servers don't say, so it falls back to the last X-Forwarded-For entry:
+// the one the server or its proxy added, where anything before it could
+// have come from the visitor.
+func visitorAddr(clientIP, forwardedFor string) string {
+	if clientIP != "" {
+		return clientIP
+	}
+	if i := strings.LastIndex(forwardedFor, ","); i >= 0 {
+		forwardedFor = forwardedFor[i+1:]
+	}
+	return strings.TrimSpace(forwardedFor)
+}
+
+// forwardedHeader builds an RFC 7239 Forwarded value for the visitor
+// address and the public host and scheme
+func forwardedHeader(visitor, host, proto string) string {
+	var params []string
+	if visitor != "" {
+		if strings.Contains(visitor, ":") {
+			visitor = `"[` + visitor + `]"` // IPv6
+		}
+		params = append(params, "for="+visitor)
+	}
+	if strings.Contains(host, ":") {
+		host = `"` + host + `"` // With a port
+	}
+	params = append(params, "host="+host, "proto="+proto)
+	return strings.Join(params, ";")
+}
+
 func isHopByHopHeader(header string) bool {
 	switch header {
 	case "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProxy forwards to a local service run by handler
+func newTestProxy(t *testing.T, handler http.Handler) *Proxy {
+	t.Helper()
+	local := httptest.NewServer(handler)
+	t.Cleanup(local.Close)
+	return NewProxy(strings.TrimPrefix(local.URL, "http://"), ProxyOptions{
+		MaxIdleConns:    defaultLocalMaxIdleConns,
+		IdleConnTimeout: defaultLocalIdleTimeout,
+		DialTimeout:     defaultLocalDialTimeout,
+	})
+}
+
+func TestForwardResponseBodyLimit(t *testing.T) {
+	const limit = 1024
+
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"under limit", limit - 1, false},
+		{"at limit", limit, false},
+		{"over limit", limit + 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(strings.Repeat("x", tt.size)))
+			}))
+			proxy.SetLimits(5*time.Second, limit)
+
+			result, err := proxy.Forward(context.Background(), &RequestMessage{Method: "GET", Path: "/"})
+			if tt.wantErr {
+				if !errors.Is(err, errResponseTooLarge) {
+					t.Fatalf("Forward error = %v, want %v", err, errResponseTooLarge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Forward: %v", err)
+			}
+			if len(result.Body) != tt.size {
+				t.Errorf("body is %d bytes, want %d", len(result.Body), tt.size)
+			}
+		})
+	}
+}
+
+// A gzipped response from the local service reaches the server as it was
+// sent when the visitor accepts gzip, and decoded, with no stale length or
+// encoding, when they don't
+func TestForwardGzipOrigin(t *testing.T) {
+	page := strings.Repeat("<p>sensor reading 21.5C</p>\n", 500)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(page))
+	zw.Close()
+
+	proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("ETag", `"v1"`)
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			t.Errorf("local service asked for %q, want gzip offered", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+
+	tests := []struct {
+		name           string
+		acceptEncoding string // From the visitor
+		wantEncoding   string
+		wantBody       []byte
+	}{
+		{"visitor accepts gzip", "gzip, deflate, br", "gzip", compressed.Bytes()},
+		{"visitor doesn't", "", "", []byte(page)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &RequestMessage{Method: "GET", Path: "/", Headers: map[string]string{}}
+			if tt.acceptEncoding != "" {
+				req.Headers["Accept-Encoding"] = tt.acceptEncoding
+			}
+			result, err := proxy.Forward(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Forward: %v", err)
+			}
+
+			if got := result.Headers["Content-Encoding"]; got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := result.Headers["Content-Type"]; got != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want the origin's", got)
+			}
+			if got := result.Headers["Etag"]; got != `"v1"` {
+				t.Errorf("ETag = %q, want the origin's", got)
+			}
+			if length, ok := result.Headers["Content-Length"]; ok && length != strconv.Itoa(len(result.Body)) {
+				t.Errorf("Content-Length = %s for a %d byte body", length, len(result.Body))
+			}
+			if !bytes.Equal(result.Body, tt.wantBody) {
+				t.Fatalf("body is %d bytes, want %d", len(result.Body), len(tt.wantBody))
+			}
+			if tt.wantEncoding == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(result.Body))
+				if err != nil {
+					t.Fatalf("gzip: %v", err)
+				}
+				if decoded, _ := io.ReadAll(zr); string(decoded) != page {
+					t.Errorf("body doesn't decode to the page")
+				}
+			}
+		})
+	}
+}
+
+func TestForwardRange(t *testing.T) {
+	const limit = 1024
+	file := make([]byte, 4*limit) // Bigger than the limit; only ranges of it fit
+	for i := range file {
+		file[i] = byte('a' + i%26)
+	}
+	size := len(file)
+
+	origins := map[string]http.HandlerFunc{
+		// Answers ranges itself
+		"range-aware": func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "video.bin", time.Time{}, bytes.NewReader(file))
+		},
+		// Sends the whole body whatever is asked, with its length
+		"range-ignoring": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+			w.Write(file)
+		},
+		// The same, with no length up front
+		"range-ignoring, chunked": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(file[:10])
+			w.(http.Flusher).Flush()
+			w.Write(file[10:])
+		},
+	}
+
+	tests := []struct {
+		name      string
+		origin    string
+		header    map[string]string
+		want      int
+		wantRange string // Content-Range
+		wantBody  []byte
+	}{
+		{"passed through", "range-aware", map[string]string{"Range": "bytes=100-199"}, 206, fmt.Sprintf("bytes 100-199/%d", size), file[100:200]},
+
+		{"closed range", "range-ignoring", map[string]string{"Range": "bytes=100-199"}, 206, fmt.Sprintf("bytes 100-199/%d", size), file[100:200]},
+		{"open range", "range-ignoring", map[string]string{"Range": fmt.Sprintf("bytes=%d-", size-10)}, 206, fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size), file[size-10:]},
+		{"suffix", "range-ignoring", map[string]string{"Range": "bytes=-10"}, 206, fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size), file[size-10:]},
+		{"end past the body", "range-ignoring", map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", size-10, size+100)}, 206, fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size), file[size-10:]},
+		{"starts past the body", "range-ignoring", map[string]string{"Range": fmt.Sprintf("bytes=%d-", size)}, 416, fmt.Sprintf("bytes */%d", size), nil},
+		{"too big a range", "range-ignoring", map[string]string{"Range": "bytes=0-"}, 0, "", nil},
+
+		{"chunked, closed range", "range-ignoring, chunked", map[string]string{"Range": "bytes=5-14"}, 206, "bytes 5-14/*", file[5:15]},
+		{"chunked, open range", "range-ignoring, chunked", map[string]string{"Range": fmt.Sprintf("bytes=%d-", size-10)}, 206, fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size), file[size-10:]},
+		{"chunked, starts past the body", "range-ignoring, chunked", map[string]string{"Range": fmt.Sprintf("bytes=%d-", size)}, 416, fmt.Sprintf("bytes */%d", size), nil},
+
+		// Left for the full body, which here is too big
+		{"several ranges", "range-ignoring", map[string]string{"Range": "bytes=0-9,20-29"}, 0, "", nil},
+		{"If-Range", "range-ignoring", map[string]string{"Range": "bytes=0-9", "If-Range": `"v1"`}, 0, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, origins[tt.origin])
+			proxy.SetLimits(5*time.Second, limit)
+
+			result, err := proxy.Forward(context.Background(), &RequestMessage{Method: "GET", Path: "/video.bin", Headers: tt.header})
+			if tt.want == 0 {
+				if !errors.Is(err, errResponseTooLarge) {
+					t.Fatalf("Forward error = %v, want %v", err, errResponseTooLarge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Forward: %v", err)
+			}
+			if result.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", result.StatusCode, tt.want)
+			}
+			if got := result.Headers["Content-Range"]; got != tt.wantRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantRange)
+			}
+			if length, ok := result.Headers["Content-Length"]; ok && length != strconv.Itoa(len(result.Body)) {
+				t.Errorf("Content-Length = %s for a %d byte body", length, len(result.Body))
+			}
+			if !bytes.Equal(result.Body, tt.wantBody) {
+				t.Errorf("body = %q, want %q", result.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// Redirects the local service builds from its own address point at the
+// public URL instead; others are left alone
+func TestForwardLocation(t *testing.T) {
+	var location string
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer local.Close()
+	addr := strings.TrimPrefix(local.URL, "http://")
+	_, port, _ := net.SplitHostPort(addr)
+	proxy := NewProxy(addr, ProxyOptions{})
+
+	tests := []struct {
+		name     string
+		location string
+		host     string // Public host from the server
+		scheme   string
+		want     string
+	}{
+		{"local address", "http://" + addr + "/login?next=%2Fadmin", "mypi.piportal.dev", "https", "https://mypi.piportal.dev/login?next=%2Fadmin"},
+		{"local address over HTTPS", "https://" + addr + "/", "mypi.piportal.dev", "https", "https://mypi.piportal.dev/"},
+		{"public scheme kept", "http://" + addr + "/", "mypi.piportal.dev", "http", "http://mypi.piportal.dev/"},
+		{"relative", "/login", "mypi.piportal.dev", "https", "/login"},
+		{"other host", "https://accounts.example.com/auth?redirect=http://" + addr, "mypi.piportal.dev", "https", "https://accounts.example.com/auth?redirect=http://" + addr},
+		{"localhost on the local port", "http://localhost:" + port + "/login", "mypi.piportal.dev", "https", "https://mypi.piportal.dev/login"},
+		{"IPv6 loopback on the local port", "http://[::1]:" + port + "/", "mypi.piportal.dev", "https", "https://mypi.piportal.dev/"},
+		{"other loopback address", "http://127.0.0.2:" + port + "/", "mypi.piportal.dev", "https", "https://mypi.piportal.dev/"},
+		{"same host, other port", "http://127.0.0.1:1/", "mypi.piportal.dev", "https", "http://127.0.0.1:1/"},
+		{"localhost, other port", "http://localhost:1/", "mypi.piportal.dev", "https", "http://localhost:1/"},
+		{"LAN address on the local port", "http://192.168.1.20:" + port + "/", "mypi.piportal.dev", "https", "http://192.168.1.20:" + port + "/"},
+		{"older server, no public host", "http://" + addr + "/login", "", "", "http://" + addr + "/login"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location = tt.location
+			result, err := proxy.Forward(context.Background(), &RequestMessage{Method: "GET", Path: "/", Host: tt.host, Scheme: tt.scheme})
+			if err != nil {
+				t.Fatalf("Forward: %v", err)
+			}
+			if result.StatusCode != http.StatusFound {
+				t.Fatalf("status = %d, want 302", result.StatusCode)
+			}
+			if got := result.Headers["Location"]; got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The Forwarded header names the visitor the server worked out, not
+// whatever they put at the front of X-Forwarded-For themselves
+func TestForwardedHeader(t *testing.T) {
+	var forwarded string
+	proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("Forwarded")
+	}))
+
+	tests := []struct {
+		name     string
+		clientIP string
+		xff      string
+		want     string
+	}{
+		{"server's address", "203.0.113.9", "198.51.100.66, 203.0.113.9", "for=203.0.113.9;host=mypi.piportal.dev;proto=https"},
+		{"IPv6", "2001:db8::5", "2001:db8::5", `for="[2001:db8::5]";host=mypi.piportal.dev;proto=https`},
+		{"older server, last entry", "", "198.51.100.66, 203.0.113.9", "for=203.0.113.9;host=mypi.piportal.dev;proto=https"},
+		{"no address", "", "", "host=mypi.piportal.dev;proto=https"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &RequestMessage{Method: "GET", Path: "/", Host: "mypi.piportal.dev", Scheme: "https", ClientIP: tt.clientIP,
+				Headers: map[string]string{"X-Forwarded-For": tt.xff}}
+			if _, err := proxy.Forward(context.Background(), req); err != nil {
+				t.Fatalf("Forward: %v", err)
+			}
+			if forwarded != tt.want {
+				t.Errorf("Forwarded = %q, want %q", forwarded, tt.want)
+			}
+		})
+	}
+}
+
+// A redirect to the local service with no port, as an app on port 80 or a
+// Unix socket builds it, still counts as local
+func TestPublicLocationWithoutPort(t *testing.T) {
+	tests := []struct {
+		target   string
+		location string
+		want     string
+	}{
+		{"127.0.0.1:80", "http://localhost/login", "https://mypi.piportal.dev/login"},
+		{"127.0.0.1:8080", "http://localhost/login", "http://localhost/login"},
+		{"unix:/run/app.sock", "http://localhost/login", "https://mypi.piportal.dev/login"},
+		{"unix:/run/app.sock", "http://127.0.0.1/login", "https://mypi.piportal.dev/login"},
+	}
+	for _, tt := range tests {
+		proxy := NewProxy(tt.target, ProxyOptions{})
+		if got := proxy.publicLocation(tt.location, "https", "mypi.piportal.dev"); got != tt.want {
+			t.Errorf("%s: publicLocation(%q) = %q, want %q", tt.target, tt.location, got, tt.want)
+		}
+	}
+}
+
+// An HTTPS local service's certificate is verified unless the config says
+// to skip that, as it must for the self-signed ones many admin panels use
+func TestForwardHTTPS(t *testing.T) {
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin panel"))
+	}))
+	defer local.Close()
+	addr := strings.TrimPrefix(local.URL, "https://")
+
+	proxy := NewProxy(addr, ProxyOptions{Scheme: "https"})
+	_, err := proxy.Forward(context.Background(), &RequestMessage{Method: "GET", Path: "/"})
+	var certErr *tls.CertificateVerificationError
+	if !errors.As(err, &certErr) {
+		t.Errorf("Forward to a self-signed service: err = %v, want a certificate error", err)
+	}
+
+	proxy = NewProxy(addr, ProxyOptions{Scheme: "https", InsecureSkipVerify: true})
+	result, err := proxy.Forward(context.Background(), &RequestMessage{Method: "GET", Path: "/"})
+	if err != nil {
+		t.Fatalf("Forward with InsecureSkipVerify: %v", err)
+	}
+	if result.StatusCode != http.StatusOK || string(result.Body) != "admin panel" {
+		t.Errorf("got %d %q, want 200 from the local service", result.StatusCode, result.Body)
+	}
+}
+
+// A local service on a Unix socket is reached through the socket, whatever
+// the request's host
+func TestForwardUnixSocket(t *testing.T) {
+	// Socket paths are short on some systems, so not under t.TempDir()
+	dir, err := os.MkdirTemp("", "piportal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix sockets unavailable: %v", err)
+	}
+	local := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+	})}}
+	local.Start()
+	defer local.Close()
+
+	proxy := NewProxy(unixSocketPrefix+path, ProxyOptions{MaxIdleConns: defaultLocalMaxIdleConns})
+	for range 2 { // The second goes over the kept-alive connection
+		result, err := proxy.Forward(context.Background(), &RequestMessage{Method: "GET", Path: "/status", Host: "mypi.piportal.dev", Scheme: "https"})
+		if err != nil {
+			t.Fatalf("Forward: %v", err)
+		}
+		if result.StatusCode != http.StatusOK || string(result.Body) != "localhost /status" {
+			t.Errorf("got %d %q, want 200 from the socket", result.StatusCode, result.Body)
+		}
+	}
+}
+
+// Reusing connections to the local service versus a new one per request,
+// which is what MaxIdleConns 0 gives
+func BenchmarkForward(b *testing.B) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer local.Close()
+	addr := strings.TrimPrefix(local.URL, "http://")
+
+	for _, bm := range []struct {
+		name         string
+		maxIdleConns int
+	}{
+		{"keepalive", defaultLocalMaxIdleConns},
+		{"no-keepalive", 0},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			proxy := NewProxy(addr, ProxyOptions{
+				MaxIdleConns:    bm.maxIdleConns,
+				IdleConnTimeout: defaultLocalIdleTimeout,
+				DialTimeout:     defaultLocalDialTimeout,
+			})
+			req := &RequestMessage{Method: "GET", Path: "/"}
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := proxy.Forward(context.Background(), req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
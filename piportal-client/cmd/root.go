@@ -10,6 +10,12 @@ import (
 // Version is set at build time
 var Version = "0.1.4"
 
+// configFile overrides the default config path (--config)
+var configFile string
+
+// verbose logs headers, timing and sizes for every proxied request (--verbose)
+var verbose bool
+
 var rootCmd = &cobra.Command{
 	Use:   "piportal",
 	Short: "Expose local services to the internet",
@@ -34,4 +40,6 @@ func Execute() {
 func init() {
 	rootCmd.Version = Version
 	rootCmd.SetVersionTemplate("piportal version {{.Version}}\n")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Config file (default ~/.config/piportal/config.yaml)")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Log request and response headers, timing and sizes")
 }
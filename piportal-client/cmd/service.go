@@ -3,49 +3,57 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"os/exec"
-	"os/user"
 	"path/filepath"
-	"runtime"
 
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 )
 
+// Platform-specific service management lives in service_<os>.go:
+//
+//	Linux   - systemd unit, runs as a dedicated piportal user
+//	macOS   - launchd agent under ~/Library/LaunchAgents
+//	Windows - Service Control Manager service
+//
+// Each implements serviceSupported, requireServicePrivileges, systemConfigPath,
+// installService, uninstallService, printServiceStatus, serviceInstalled,
+// restartService, serviceHelp and runServiceHost.
+
 var servicePort int
 
 var serviceCmd = &cobra.Command{
 	Use:   "service",
 	Short: "Manage PiPortal as a system service",
-	Long:  `Install or uninstall PiPortal as a systemd service for automatic startup.`,
+	Long: `Install, uninstall, or restart PiPortal as a system service for automatic startup.
+
+Uses systemd on Linux, launchd on macOS, and the Service Control Manager on Windows.`,
 }
 
 var serviceInstallCmd = &cobra.Command{
 	Use:   "install",
 	Short: "Install PiPortal as a system service",
-	Long: `Install PiPortal as a systemd service.
+	Long: `Install PiPortal as a system service.
 
 This will:
-  1. Copy your config to /etc/piportal/
-  2. Create a piportal system user
-  3. Install the systemd service
-  4. Enable and start the service
+  1. Write the service config file
+  2. Install the service (systemd, launchd, or Windows service)
+  3. Enable and start the service
 
-Requires root privileges (use sudo).`,
+On Linux and Windows this requires root/Administrator privileges.
+On macOS it installs a per-user agent and must be run without sudo.`,
 	RunE: runServiceInstall,
 }
 
 var serviceUninstallCmd = &cobra.Command{
 	Use:   "uninstall",
 	Short: "Remove PiPortal system service",
-	Long: `Remove PiPortal systemd service.
+	Long: `Remove the PiPortal system service.
 
 This will:
   1. Stop and disable the service
-  2. Remove the systemd unit file
-  3. Optionally remove /etc/piportal/
+  2. Remove the service definition
 
-Requires root privileges (use sudo).`,
+The service config file and binary are kept.`,
 	RunE: runServiceUninstall,
 }
 
@@ -55,22 +63,30 @@ var serviceStatusCmd = &cobra.Command{
 	RunE:  runServiceStatus,
 }
 
+var serviceRestartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Restart the system service",
+	Long: `Restart the PiPortal system service, e.g. after 'piportal upgrade'
+so the new binary is loaded.`,
+	RunE: runServiceRestart,
+}
+
 func init() {
 	rootCmd.AddCommand(serviceCmd)
 	serviceCmd.AddCommand(serviceInstallCmd)
 	serviceCmd.AddCommand(serviceUninstallCmd)
 	serviceCmd.AddCommand(serviceStatusCmd)
+	serviceCmd.AddCommand(serviceRestartCmd)
 
 	serviceInstallCmd.Flags().IntVarP(&servicePort, "port", "p", 0, "Local port to forward to")
 }
 
 func runServiceInstall(cmd *cobra.Command, args []string) error {
-	if runtime.GOOS != "linux" {
-		return fmt.Errorf("service install is only supported on Linux")
+	if err := serviceSupported(); err != nil {
+		return err
 	}
-
-	if os.Geteuid() != 0 {
-		return fmt.Errorf("service install requires root privileges (use sudo)")
+	if err := requireServicePrivileges("install"); err != nil {
+		return err
 	}
 
 	fmt.Println()
@@ -92,125 +108,18 @@ func runServiceInstall(cmd *cobra.Command, args []string) error {
 		cfg.LocalPort = servicePort
 	}
 
-	// Create piportal user if needed
-	fmt.Print("  Creating piportal user... ")
-	if _, err := user.Lookup("piportal"); err != nil {
-		cmd := exec.Command("useradd", "--system", "--no-create-home", "--shell", "/usr/sbin/nologin", "piportal")
-		if err := cmd.Run(); err != nil {
-			fmt.Println("✗")
-			return fmt.Errorf("failed to create user: %w", err)
-		}
-		fmt.Println("✓")
-	} else {
-		fmt.Println("exists")
-	}
-
-	// Create /etc/piportal directory
-	fmt.Print("  Creating /etc/piportal... ")
-	if err := os.MkdirAll("/etc/piportal", 0700); err != nil {
-		fmt.Println("✗")
-		return err
-	}
-	fmt.Println("✓")
-
-	// Write system config
+	// Write the config the service will run with
 	fmt.Print("  Writing config file... ")
-	sysConfig := map[string]interface{}{
-		"server":     cfg.Server,
-		"token":      cfg.Token,
-		"subdomain":  cfg.Subdomain,
-		"local_port": cfg.LocalPort,
-		"local_host": cfg.LocalHost,
-	}
-	data, _ := yaml.Marshal(sysConfig)
-	if err := os.WriteFile("/etc/piportal/config.yaml", data, 0600); err != nil {
-		fmt.Println("✗")
-		return err
-	}
-	// Set ownership
-	exec.Command("chown", "-R", "piportal:piportal", "/etc/piportal").Run()
-	fmt.Println("✓")
-
-	// Find the piportal binary
-	binaryPath, err := exec.LookPath("piportal")
+	configPath, err := writeServiceConfig(cfg)
 	if err != nil {
-		// Try current directory
-		binaryPath, _ = filepath.Abs("piportal")
-		if _, err := os.Stat(binaryPath); err != nil {
-			binaryPath = "/usr/local/bin/piportal"
-		}
-	}
-
-	// Copy binary to /usr/local/bin if not there
-	if binaryPath != "/usr/local/bin/piportal" {
-		fmt.Print("  Installing binary... ")
-		currentBinary, _ := os.Executable()
-		input, err := os.ReadFile(currentBinary)
-		if err != nil {
-			fmt.Println("✗")
-			return err
-		}
-		if err := os.WriteFile("/usr/local/bin/piportal", input, 0755); err != nil {
-			fmt.Println("✗")
-			return err
-		}
-		fmt.Println("✓")
-	}
-
-	// Write systemd unit file
-	fmt.Print("  Installing systemd service... ")
-	unitFile := `[Unit]
-Description=PiPortal - Secure tunnel for your Pi
-After=network-online.target
-Wants=network-online.target
-
-[Service]
-Type=simple
-User=piportal
-Group=piportal
-ExecStart=/usr/local/bin/piportal start
-Restart=on-failure
-RestartSec=5
-NoNewPrivileges=yes
-ProtectSystem=strict
-ProtectHome=yes
-PrivateTmp=yes
-ReadOnlyPaths=/etc/piportal
-StandardOutput=journal
-StandardError=journal
-SyslogIdentifier=piportal
-
-[Install]
-WantedBy=multi-user.target
-`
-	if err := os.WriteFile("/etc/systemd/system/piportal.service", []byte(unitFile), 0644); err != nil {
-		fmt.Println("✗")
-		return err
-	}
-	fmt.Println("✓")
-
-	// Reload systemd
-	fmt.Print("  Reloading systemd... ")
-	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
 		fmt.Println("✗")
 		return err
 	}
 	fmt.Println("✓")
 
-	// Enable and start service
-	fmt.Print("  Enabling service... ")
-	if err := exec.Command("systemctl", "enable", "piportal").Run(); err != nil {
-		fmt.Println("✗")
-		return err
-	}
-	fmt.Println("✓")
-
-	fmt.Print("  Starting service... ")
-	if err := exec.Command("systemctl", "start", "piportal").Run(); err != nil {
-		fmt.Println("✗")
+	if err := installService(configPath); err != nil {
 		return err
 	}
-	fmt.Println("✓")
 
 	fmt.Println()
 	fmt.Println("  ✓ PiPortal service installed and running!")
@@ -218,25 +127,27 @@ WantedBy=multi-user.target
 	if cfg.Subdomain != "" {
 		fmt.Printf("  Subdomain: %s\n", cfg.Subdomain)
 	}
+	if publicURL := cfg.PublicURL(); publicURL != "" {
+		fmt.Printf("  URL:       %s\n", publicURL)
+	}
 	fmt.Printf("  Server:    %s\n", cfg.Server)
+	fmt.Printf("  Config:    %s\n", configPath)
 	fmt.Println()
 	fmt.Println("  Useful commands:")
-	fmt.Println("    sudo systemctl status piportal   # Check status")
-	fmt.Println("    sudo journalctl -u piportal -f   # View logs")
-	fmt.Println("    sudo systemctl restart piportal  # Restart")
-	fmt.Println("    sudo piportal service uninstall  # Remove")
+	for _, line := range serviceHelp() {
+		fmt.Printf("    %s\n", line)
+	}
 	fmt.Println()
 
 	return nil
 }
 
 func runServiceUninstall(cmd *cobra.Command, args []string) error {
-	if runtime.GOOS != "linux" {
-		return fmt.Errorf("service uninstall is only supported on Linux")
+	if err := serviceSupported(); err != nil {
+		return err
 	}
-
-	if os.Geteuid() != 0 {
-		return fmt.Errorf("service uninstall requires root privileges (use sudo)")
+	if err := requireServicePrivileges("uninstall"); err != nil {
+		return err
 	}
 
 	fmt.Println()
@@ -244,26 +155,14 @@ func runServiceUninstall(cmd *cobra.Command, args []string) error {
 	fmt.Println("  ─────────────────────────────────────────")
 	fmt.Println()
 
-	// Stop service
-	fmt.Print("  Stopping service... ")
-	exec.Command("systemctl", "stop", "piportal").Run()
-	fmt.Println("✓")
-
-	// Disable service
-	fmt.Print("  Disabling service... ")
-	exec.Command("systemctl", "disable", "piportal").Run()
-	fmt.Println("✓")
-
-	// Remove unit file
-	fmt.Print("  Removing systemd service... ")
-	os.Remove("/etc/systemd/system/piportal.service")
-	exec.Command("systemctl", "daemon-reload").Run()
-	fmt.Println("✓")
+	if err := uninstallService(); err != nil {
+		return err
+	}
 
 	fmt.Println()
 	fmt.Println("  ✓ Service removed!")
 	fmt.Println()
-	fmt.Println("  Note: /etc/piportal/ and /usr/local/bin/piportal were kept.")
+	fmt.Printf("  Note: %s and the piportal binary were kept.\n", filepath.Dir(systemConfigPath()))
 	fmt.Println("  Remove manually if no longer needed.")
 	fmt.Println()
 
@@ -271,16 +170,58 @@ func runServiceUninstall(cmd *cobra.Command, args []string) error {
 }
 
 func runServiceStatus(cmd *cobra.Command, args []string) error {
-	if runtime.GOOS != "linux" {
-		return fmt.Errorf("service status is only supported on Linux")
+	if err := serviceSupported(); err != nil {
+		return err
 	}
-
-	output, err := exec.Command("systemctl", "status", "piportal").CombinedOutput()
-	if err != nil {
-		// systemctl status returns non-zero if service is not running
-		fmt.Println(string(output))
+	if !serviceInstalled() {
+		fmt.Println("PiPortal service is not installed (run 'piportal service install')")
 		return nil
 	}
-	fmt.Println(string(output))
+	return printServiceStatus()
+}
+
+func runServiceRestart(cmd *cobra.Command, args []string) error {
+	if err := serviceSupported(); err != nil {
+		return err
+	}
+	if err := requireServicePrivileges("restart"); err != nil {
+		return err
+	}
+	if !serviceInstalled() {
+		return fmt.Errorf("PiPortal service is not installed (run 'piportal service install')")
+	}
+
+	fmt.Print("  Restarting service... ")
+	if err := restartService(); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	fmt.Println("✓")
 	return nil
 }
+
+// writeServiceConfig writes the subset of config the service needs to
+// systemConfigPath, which loadConfig falls back to when run as a service
+func writeServiceConfig(cfg *Config) (string, error) {
+	path := systemConfigPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+
+	sysConfig := map[string]interface{}{
+		"server":      cfg.Server,
+		"token":       cfg.Token,
+		"subdomain":   cfg.Subdomain,
+		"base_domain": cfg.BaseDomain,
+		"local_port":  cfg.LocalPort,
+		"local_host":  cfg.LocalHost,
+	}
+	data, err := yaml.Marshal(sysConfig)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
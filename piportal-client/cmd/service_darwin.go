@@ -0,0 +1,174 @@
+//go:build darwin
+
+package cmd
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchd label for the per-user agent
+const launchdLabel = "dev.piportal.agent"
+
+func serviceSupported() error {
+	return nil
+}
+
+// LaunchAgents belong to the logged-in user, so root would install it for the wrong account
+func requireServicePrivileges(action string) error {
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("service %s installs a per-user launchd agent on macOS - run it without sudo", action)
+	}
+	return nil
+}
+
+// systemConfigPath is used as XDG_CONFIG_HOME for the agent, so loadConfig finds it first
+func systemConfigPath() string {
+	return filepath.Join(launchdSupportDir(), "piportal", "config.yaml")
+}
+
+func launchdSupportDir() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library", "Application Support")
+}
+
+func launchdPlistPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist")
+}
+
+// launchdTarget is the agent's launchctl service target in the user's GUI domain
+func launchdTarget() string {
+	return fmt.Sprintf("gui/%d/%s", os.Getuid(), launchdLabel)
+}
+
+func installService(configPath string) error {
+	binaryPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not determine executable path: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(binaryPath); err == nil {
+		binaryPath = resolved
+	}
+
+	home, _ := os.UserHomeDir()
+	logPath := filepath.Join(home, "Library", "Logs", "piportal.log")
+
+	fmt.Print("  Installing launchd agent... ")
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>start</string>
+	</array>
+	<key>EnvironmentVariables</key>
+	<dict>
+		<key>XDG_CONFIG_HOME</key>
+		<string>%s</string>
+	</dict>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>5</integer>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, launchdLabel, html.EscapeString(binaryPath), html.EscapeString(launchdSupportDir()),
+		html.EscapeString(logPath), html.EscapeString(logPath))
+
+	plistPath := launchdPlistPath()
+	if err := os.MkdirAll(filepath.Dir(plistPath), 0755); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	if err := os.WriteFile(plistPath, []byte(plist), 0644); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	fmt.Println("✓")
+
+	// Replace any previously loaded copy
+	exec.Command("launchctl", "bootout", launchdTarget()).Run()
+
+	fmt.Print("  Starting agent... ")
+	domain := fmt.Sprintf("gui/%d", os.Getuid())
+	if output, err := exec.Command("launchctl", "bootstrap", domain, plistPath).CombinedOutput(); err != nil {
+		fmt.Println("✗")
+		return fmt.Errorf("launchctl bootstrap failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	fmt.Println("✓")
+
+	return nil
+}
+
+func uninstallService() error {
+	fmt.Print("  Stopping agent... ")
+	exec.Command("launchctl", "bootout", launchdTarget()).Run()
+	fmt.Println("✓")
+
+	fmt.Print("  Removing launchd agent... ")
+	os.Remove(launchdPlistPath())
+	fmt.Println("✓")
+
+	return nil
+}
+
+func printServiceStatus() error {
+	output, err := exec.Command("launchctl", "print", launchdTarget()).CombinedOutput()
+	if err != nil {
+		fmt.Println("PiPortal agent is installed but not loaded")
+		return nil
+	}
+	fmt.Println(string(output))
+	return nil
+}
+
+func serviceInstalled() bool {
+	_, err := os.Stat(launchdPlistPath())
+	return err == nil
+}
+
+// serviceRunning reports whether launchd has the agent running
+func serviceRunning() bool {
+	output, err := exec.Command("launchctl", "print", launchdTarget()).CombinedOutput()
+	return err == nil && strings.Contains(string(output), "state = running")
+}
+
+func restartService() error {
+	output, err := exec.Command("launchctl", "kickstart", "-k", launchdTarget()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl kickstart failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func serviceHelp() []string {
+	return []string{
+		"piportal service status          # Check status",
+		"tail -f ~/Library/Logs/piportal.log  # View logs",
+		"piportal service restart         # Restart",
+		"piportal service uninstall       # Remove",
+	}
+}
+
+// runServiceHost is only needed on Windows; launchd runs 'piportal start' directly
+func runServiceHost(t *Tunnel) (bool, error) {
+	return false, nil
+}
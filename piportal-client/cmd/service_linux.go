@@ -0,0 +1,203 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Path of the systemd unit written by 'service install'
+const serviceUnitPath = "/etc/systemd/system/piportal.service"
+
+func serviceSupported() error {
+	return nil
+}
+
+func requireServicePrivileges(action string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("service %s requires root privileges (use sudo)", action)
+	}
+	return nil
+}
+
+func systemConfigPath() string {
+	return "/etc/piportal/config.yaml"
+}
+
+func installService(configPath string) error {
+	// Create piportal user if needed
+	fmt.Print("  Creating piportal user... ")
+	if _, err := user.Lookup("piportal"); err != nil {
+		cmd := exec.Command("useradd", "--system", "--no-create-home", "--shell", "/usr/sbin/nologin", "piportal")
+		if err := cmd.Run(); err != nil {
+			fmt.Println("✗")
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+		fmt.Println("✓")
+	} else {
+		fmt.Println("exists")
+	}
+
+	// Let the service user read its config
+	exec.Command("chown", "-R", "piportal:piportal", filepath.Dir(configPath)).Run()
+
+	// Find the piportal binary
+	binaryPath, err := exec.LookPath("piportal")
+	if err != nil {
+		// Try current directory
+		binaryPath, _ = filepath.Abs("piportal")
+		if _, err := os.Stat(binaryPath); err != nil {
+			binaryPath = "/usr/local/bin/piportal"
+		}
+	}
+
+	// Copy binary to /usr/local/bin if not there
+	if binaryPath != "/usr/local/bin/piportal" {
+		fmt.Print("  Installing binary... ")
+		currentBinary, _ := os.Executable()
+		input, err := os.ReadFile(currentBinary)
+		if err != nil {
+			fmt.Println("✗")
+			return err
+		}
+		if err := os.WriteFile("/usr/local/bin/piportal", input, 0755); err != nil {
+			fmt.Println("✗")
+			return err
+		}
+		fmt.Println("✓")
+	}
+
+	// Write systemd unit file
+	fmt.Print("  Installing systemd service... ")
+	unitFile := `[Unit]
+Description=PiPortal - Secure tunnel for your Pi
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+User=piportal
+Group=piportal
+ExecStart=/usr/local/bin/piportal start
+Restart=on-failure
+RestartSec=5
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+ReadOnlyPaths=/etc/piportal
+StandardOutput=journal
+StandardError=journal
+SyslogIdentifier=piportal
+
+[Install]
+WantedBy=multi-user.target
+`
+	if err := os.WriteFile(serviceUnitPath, []byte(unitFile), 0644); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	fmt.Println("✓")
+
+	// Reload systemd
+	fmt.Print("  Reloading systemd... ")
+	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	fmt.Println("✓")
+
+	// Enable and start service
+	fmt.Print("  Enabling service... ")
+	if err := exec.Command("systemctl", "enable", "piportal").Run(); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	fmt.Println("✓")
+
+	fmt.Print("  Starting service... ")
+	if err := exec.Command("systemctl", "start", "piportal").Run(); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	fmt.Println("✓")
+
+	return nil
+}
+
+func uninstallService() error {
+	// Stop service
+	fmt.Print("  Stopping service... ")
+	exec.Command("systemctl", "stop", "piportal").Run()
+	fmt.Println("✓")
+
+	// Disable service
+	fmt.Print("  Disabling service... ")
+	exec.Command("systemctl", "disable", "piportal").Run()
+	fmt.Println("✓")
+
+	// Remove unit file
+	fmt.Print("  Removing systemd service... ")
+	os.Remove(serviceUnitPath)
+	exec.Command("systemctl", "daemon-reload").Run()
+	fmt.Println("✓")
+
+	return nil
+}
+
+func printServiceStatus() error {
+	// systemctl status returns non-zero if service is not running
+	output, _ := exec.Command("systemctl", "status", "piportal").CombinedOutput()
+	fmt.Println(string(output))
+	return nil
+}
+
+// serviceInstalled reports whether the systemd unit is present
+func serviceInstalled() bool {
+	_, err := os.Stat(serviceUnitPath)
+	return err == nil
+}
+
+// serviceRunning reports whether the systemd unit is active
+func serviceRunning() bool {
+	return exec.Command("systemctl", "is-active", "--quiet", "piportal").Run() == nil
+}
+
+// runningAsService reports whether this process was started by systemd
+func runningAsService() bool {
+	return os.Getenv("INVOCATION_ID") != ""
+}
+
+// restartService restarts the systemd service. When called from inside the
+// service itself, the restart is queued without waiting, since systemd will
+// stop this process as part of it.
+func restartService() error {
+	args := []string{"restart", "piportal"}
+	if runningAsService() {
+		args = []string{"restart", "--no-block", "piportal"}
+	}
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl restart failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func serviceHelp() []string {
+	return []string{
+		"sudo systemctl status piportal   # Check status",
+		"sudo journalctl -u piportal -f   # View logs",
+		"sudo piportal service restart    # Restart",
+		"sudo piportal service uninstall  # Remove",
+	}
+}
+
+// runServiceHost is only needed on Windows; systemd runs 'piportal start' directly
+func runServiceHost(t *Tunnel) (bool, error) {
+	return false, nil
+}
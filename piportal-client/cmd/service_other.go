@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !windows
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func serviceSupported() error {
+	return fmt.Errorf("service management is not supported on %s", runtime.GOOS)
+}
+
+func requireServicePrivileges(action string) error { return nil }
+func systemConfigPath() string                     { return "/etc/piportal/config.yaml" }
+func installService(configPath string) error       { return serviceSupported() }
+func uninstallService() error                      { return serviceSupported() }
+func printServiceStatus() error                    { return serviceSupported() }
+func serviceInstalled() bool                       { return false }
+func serviceRunning() bool                         { return false }
+func restartService() error                        { return serviceSupported() }
+func serviceHelp() []string                        { return nil }
+func runServiceHost(t *Tunnel) (bool, error)       { return false, nil }
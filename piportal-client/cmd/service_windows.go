@@ -0,0 +1,298 @@
+//go:build windows
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Name registered with the Service Control Manager
+const windowsServiceName = "PiPortal"
+
+func serviceSupported() error {
+	return nil
+}
+
+func requireServicePrivileges(action string) error {
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		return fmt.Errorf("service %s requires Administrator privileges (run from an elevated prompt)", action)
+	}
+	return nil
+}
+
+func programDataDir() string {
+	dir := os.Getenv("ProgramData")
+	if dir == "" {
+		dir = `C:\ProgramData`
+	}
+	return filepath.Join(dir, "PiPortal")
+}
+
+// The service runs as LocalSystem, which has no user config, so loadConfig
+// falls back to this path
+func systemConfigPath() string {
+	return filepath.Join(programDataDir(), "config.yaml")
+}
+
+func installService(configPath string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(windowsServiceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service is already installed (run 'piportal service uninstall' first)")
+	}
+
+	// Copy the binary somewhere stable, like /usr/local/bin on Linux
+	programFiles := os.Getenv("ProgramFiles")
+	if programFiles == "" {
+		programFiles = `C:\Program Files`
+	}
+	binaryPath := filepath.Join(programFiles, "PiPortal", "piportal.exe")
+	currentBinary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not determine executable path: %w", err)
+	}
+	if !strings.EqualFold(currentBinary, binaryPath) {
+		fmt.Print("  Installing binary... ")
+		input, err := os.ReadFile(currentBinary)
+		if err != nil {
+			fmt.Println("✗")
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(binaryPath), 0755); err != nil {
+			fmt.Println("✗")
+			return err
+		}
+		if err := os.WriteFile(binaryPath, input, 0755); err != nil {
+			fmt.Println("✗")
+			return err
+		}
+		fmt.Println("✓")
+	}
+
+	fmt.Print("  Installing Windows service... ")
+	s, err := m.CreateService(windowsServiceName, binaryPath, mgr.Config{
+		DisplayName: "PiPortal",
+		Description: "PiPortal - Secure tunnel for your device",
+		StartType:   mgr.StartAutomatic,
+	}, "start")
+	if err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	defer s.Close()
+
+	// Restart on failure, like Restart=on-failure under systemd
+	s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+	fmt.Println("✓")
+
+	fmt.Print("  Starting service... ")
+	if err := s.Start(); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	fmt.Println("✓")
+
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		return fmt.Errorf("PiPortal service is not installed")
+	}
+	defer s.Close()
+
+	fmt.Print("  Stopping service... ")
+	stopWindowsService(s)
+	fmt.Println("✓")
+
+	fmt.Print("  Removing Windows service... ")
+	if err := s.Delete(); err != nil {
+		fmt.Println("✗")
+		return err
+	}
+	fmt.Println("✓")
+
+	return nil
+}
+
+func printServiceStatus() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		fmt.Println("PiPortal service is not installed")
+		return nil
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return err
+	}
+	states := map[svc.State]string{
+		svc.Stopped:         "stopped",
+		svc.StartPending:    "starting",
+		svc.StopPending:     "stopping",
+		svc.Running:         "running",
+		svc.ContinuePending: "resuming",
+		svc.PausePending:    "pausing",
+		svc.Paused:          "paused",
+	}
+	fmt.Printf("PiPortal service: %s\n", states[status.State])
+	fmt.Printf("Logs: %s\n", filepath.Join(programDataDir(), "piportal.log"))
+	return nil
+}
+
+func serviceInstalled() bool {
+	m, err := mgr.Connect()
+	if err != nil {
+		return false
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		return false
+	}
+	s.Close()
+	return true
+}
+
+// serviceRunning reports whether the Windows service is running
+func serviceRunning() bool {
+	m, err := mgr.Connect()
+	if err != nil {
+		return false
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		return false
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	return err == nil && status.State == svc.Running
+}
+
+func restartService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		return fmt.Errorf("PiPortal service is not installed")
+	}
+	defer s.Close()
+
+	stopWindowsService(s)
+	return s.Start()
+}
+
+// stopWindowsService asks the service to stop and waits briefly for it to do so
+func stopWindowsService(s *mgr.Service) {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return // Not running
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for status.State != svc.Stopped && time.Now().Before(deadline) {
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return
+		}
+	}
+}
+
+func serviceHelp() []string {
+	return []string{
+		"piportal service status      # Check status",
+		"piportal service restart     # Restart",
+		"piportal service uninstall   # Remove",
+	}
+}
+
+// runServiceHost runs the tunnel under the Service Control Manager when
+// started as a Windows service. Returns false when run from a console.
+func runServiceHost(t *Tunnel) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, nil
+	}
+
+	// Services have no console; log to a file next to the config
+	if f, err := os.OpenFile(filepath.Join(programDataDir(), "piportal.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err == nil {
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	return true, svc.Run(windowsServiceName, &windowsService{tunnel: t})
+}
+
+// windowsService adapts the tunnel to svc.Handler
+type windowsService struct {
+	tunnel *Tunnel
+}
+
+func (w *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.tunnel.Run()
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("Tunnel stopped: %v", err)
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				w.tunnel.Stop()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
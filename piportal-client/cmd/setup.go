@@ -4,12 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
@@ -28,11 +28,17 @@ This will guide you through:
   3. Setting your default local port
 
 Your device will be registered automatically and configuration
-saved to ~/.config/piportal/config.yaml`,
+saved to ~/.config/piportal/config.yaml
+
+Pass --server to skip the first question; the install script served by
+your PiPortal server prints the command with it filled in.`,
 	RunE: runSetup,
 }
 
+var setupServer string
+
 func init() {
+	setupCmd.Flags().StringVar(&setupServer, "server", "", "PiPortal server URL (e.g. https://piportal.example.com)")
 	rootCmd.AddCommand(setupCmd)
 }
 
@@ -49,12 +55,17 @@ func runSetup(cmd *cobra.Command, args []string) error {
 	fmt.Println("  Step 1: PiPortal server URL")
 	fmt.Println("  ─────────────────────────────────────────")
 	fmt.Println()
-	fmt.Println("  Enter the URL of your PiPortal server")
-	fmt.Println("  (e.g. https://piportal.example.com)")
-	fmt.Println()
-	fmt.Print("  Server URL: ")
-	serverURL, _ := reader.ReadString('\n')
-	serverURL = strings.TrimSpace(serverURL)
+	serverURL := setupServer
+	if serverURL != "" {
+		fmt.Printf("  Server URL: %s\n", serverURL)
+	} else {
+		fmt.Println("  Enter the URL of your PiPortal server")
+		fmt.Println("  (e.g. https://piportal.example.com)")
+		fmt.Println()
+		fmt.Print("  Server URL: ")
+		serverURL, _ = reader.ReadString('\n')
+		serverURL = strings.TrimSpace(serverURL)
+	}
 
 	// Validate and normalize server URL
 	serverURL, err := normalizeServerURL(serverURL)
@@ -67,12 +78,22 @@ func runSetup(cmd *cobra.Command, args []string) error {
 	fmt.Println("  Step 2: Choose your subdomain")
 	fmt.Println("  ─────────────────────────────────────────")
 	fmt.Println()
-	fmt.Print("  Subdomain: ")
-	subdomain, _ := reader.ReadString('\n')
-	subdomain = strings.TrimSpace(strings.ToLower(subdomain))
+	var subdomain string
+	for {
+		fmt.Print("  Subdomain: ")
+		subdomain, _ = reader.ReadString('\n')
+		subdomain = strings.TrimSpace(strings.ToLower(subdomain))
+
+		if err := validateSubdomain(subdomain); err != nil {
+			return err
+		}
 
-	if err := validateSubdomain(subdomain); err != nil {
-		return err
+		// Catch a taken name now rather than after the remaining steps
+		available, reason, err := checkSubdomainAvailable(serverURL, subdomain)
+		if err != nil || available {
+			break // Registration will report any problem
+		}
+		fmt.Printf("  ✗ %s, try another\n", reason)
 	}
 
 	// Step 3: Default local port
@@ -82,13 +103,33 @@ func runSetup(cmd *cobra.Command, args []string) error {
 	fmt.Println()
 	fmt.Println("  Which local port should we forward to?")
 	fmt.Println("  (You can override this with --port when starting)")
+	fmt.Println("  For a service on a Unix socket, enter unix:/path/to.sock")
 	fmt.Println()
-	fmt.Print("  Port [8080]: ")
+
+	port := 8080
+	if services := detectLocalServices(); len(services) > 0 {
+		fmt.Println("  Found services listening on this device:")
+		for _, svc := range services {
+			fmt.Printf("    • %s\n", svc)
+		}
+		fmt.Println()
+		if services[0].HTTP {
+			port = services[0].Port
+		}
+	}
+
+	fmt.Printf("  Port [%d]: ", port)
 	portStr, _ := reader.ReadString('\n')
 	portStr = strings.TrimSpace(portStr)
 
-	port := 8080
-	if portStr != "" {
+	host := "127.0.0.1"
+	switch {
+	case strings.HasPrefix(portStr, unixSocketPrefix):
+		host = portStr
+		if _, path := localNetwork(host); path == "" {
+			return fmt.Errorf("invalid socket %q (use unix:/path/to.sock)", host)
+		}
+	case portStr != "":
 		fmt.Sscanf(portStr, "%d", &port)
 	}
 
@@ -102,12 +143,17 @@ func runSetup(cmd *cobra.Command, args []string) error {
 	fmt.Println("  ─────────────────────────────────────────")
 	fmt.Println()
 
-	token, err := registerDevice(serverURL, subdomain)
+	registration, err := registerDevice(serverURL, subdomain)
 	if err != nil {
 		fmt.Printf("  ✗ Registration failed: %v\n", err)
 		fmt.Println()
-		fmt.Println("  You can try a different subdomain, or register manually")
-		fmt.Println("  in the dashboard and use 'piportal start --token <token>'")
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && (apiErr.Code == "subdomain_taken" || apiErr.Code == "subdomain_invalid") {
+			fmt.Println("  Run 'piportal setup' again and choose a different subdomain")
+		} else {
+			fmt.Println("  You can try a different subdomain, or register manually")
+			fmt.Println("  in the dashboard and use 'piportal start --token <token>'")
+		}
 		return err
 	}
 
@@ -118,12 +164,18 @@ func runSetup(cmd *cobra.Command, args []string) error {
 
 	// Save config
 	config := map[string]interface{}{
-		"server":     wsURL,
-		"server_url": serverURL,
-		"token":      token,
-		"subdomain":  subdomain,
-		"local_port": port,
-		"local_host": "127.0.0.1",
+		"server":      wsURL,
+		"server_url":  serverURL,
+		"token":       registration.Token,
+		"subdomain":   subdomain,
+		"base_domain": baseDomainFromServer(serverURL),
+		"local_port":  port,
+		"local_host":  host,
+
+		// Written out so owners can see what the server may run
+		"allow_reboot":   true,
+		"allow_exec":     false,
+		"allow_terminal": false,
 	}
 
 	configPath, err := saveConfig(config)
@@ -138,14 +190,32 @@ func runSetup(cmd *cobra.Command, args []string) error {
 	fmt.Printf("  Config file: %s\n", configPath)
 	fmt.Printf("  Server:      %s\n", serverURL)
 	fmt.Printf("  Subdomain:   %s\n", subdomain)
+	fmt.Printf("  Public URL:  https://%s.%s\n", subdomain, baseDomainFromServer(serverURL))
 	fmt.Println()
+	if registration.ClaimCode != "" {
+		fmt.Printf("  Claim code:  %s\n", registration.ClaimCode)
+		fmt.Printf("  Enter it under Add Device → Claim in the dashboard (%s/dashboard)\n", serverURL)
+		fmt.Printf("  to link this device to your account. It expires at %s.\n", registration.ClaimCodeExpiresAt.Local().Format("15:04"))
+		fmt.Println()
+	}
 	fmt.Println("  To start your tunnel, run:")
 	fmt.Println()
-	fmt.Printf("    piportal start --port %d\n", port)
+	switch {
+	case configFile != "":
+		fmt.Printf("    piportal start --config %s\n", configPath)
+	case host != "127.0.0.1":
+		fmt.Printf("    piportal start --host %s\n", host)
+	default:
+		fmt.Printf("    piportal start --port %d\n", port)
+	}
 	fmt.Println()
 	fmt.Println("  Or install as a system service:")
 	fmt.Println()
-	fmt.Printf("    sudo piportal service install --port %d\n", port)
+	if host != "127.0.0.1" {
+		fmt.Println("    sudo piportal service install")
+	} else {
+		fmt.Printf("    sudo piportal service install --port %d\n", port)
+	}
 	fmt.Println()
 
 	return nil
@@ -184,8 +254,41 @@ func deriveWebSocketURL(serverURL string) string {
 	return wsURL + "/tunnel"
 }
 
+// Registration is the server's reply to registerDevice
+type Registration struct {
+	Token              string    `json:"token"`
+	Subdomain          string    `json:"subdomain"`
+	ClaimCode          string    `json:"claim_code"` // Short code for claiming the device in the dashboard
+	ClaimCodeExpiresAt time.Time `json:"claim_code_expires_at"`
+}
+
+// APIError is an error reply from the server's JSON API. Code is stable
+// (e.g. "subdomain_taken"); Message is for people.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// parseAPIError reads the "error" field of a failed API reply. Servers
+// before error codes sent just the message.
+func parseAPIError(raw json.RawMessage) *APIError {
+	var apiErr APIError
+	if err := json.Unmarshal(raw, &apiErr); err == nil && apiErr.Message != "" {
+		return &apiErr
+	}
+	var message string
+	if err := json.Unmarshal(raw, &message); err == nil && message != "" {
+		return &APIError{Message: message}
+	}
+	return &APIError{Message: "unknown error"}
+}
+
 // registerDevice calls the PiPortal API to register a new device
-func registerDevice(serverURL, subdomain string) (string, error) {
+func registerDevice(serverURL, subdomain string) (*Registration, error) {
 	reqBody, _ := json.Marshal(map[string]string{
 		"subdomain": subdomain,
 	})
@@ -197,63 +300,56 @@ func registerDevice(serverURL, subdomain string) (string, error) {
 		bytes.NewReader(reqBody),
 	)
 	if err != nil {
-		return "", fmt.Errorf("could not reach server: %w", err)
+		return nil, fmt.Errorf("could not reach server: %w", err)
 	}
 	defer resp.Body.Close()
 
 	var result struct {
-		Success   bool   `json:"success"`
-		Token     string `json:"token"`
-		Subdomain string `json:"subdomain"`
-		Error     string `json:"error"`
+		Registration
+		Success bool            `json:"success"`
+		Error   json.RawMessage `json:"error"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("invalid response from server")
+		return nil, fmt.Errorf("invalid response from server")
 	}
 
 	if !result.Success {
-		return "", fmt.Errorf("%s", result.Error)
+		return nil, parseAPIError(result.Error)
 	}
 
-	return result.Token, nil
+	return &result.Registration, nil
 }
 
-func validateSubdomain(s string) error {
-	if s == "" {
-		return fmt.Errorf("subdomain is required")
+// checkSubdomainAvailable asks the server whether a subdomain can be
+// registered. Older servers without the endpoint return an error.
+func checkSubdomainAvailable(serverURL, subdomain string) (bool, string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(serverURL + "/api/subdomain/available?name=" + url.QueryEscape(subdomain))
+	if err != nil {
+		return false, "", err
 	}
-	if len(s) < 3 || len(s) > 30 {
-		return fmt.Errorf("subdomain must be 3-30 characters")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("availability check failed: %s", resp.Status)
 	}
-	if !regexp.MustCompile(`^[a-z0-9][a-z0-9-]*[a-z0-9]$`).MatchString(s) && len(s) > 2 {
-		return fmt.Errorf("subdomain must be lowercase alphanumeric with hyphens, no leading/trailing hyphens")
+
+	var result struct {
+		Available bool   `json:"available"`
+		Reason    string `json:"reason"`
 	}
-	reserved := []string{"www", "api", "app", "admin", "mail", "ftp", "ssh", "tunnel"}
-	for _, r := range reserved {
-		if s == r {
-			return fmt.Errorf("'%s' is a reserved subdomain", s)
-		}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, "", fmt.Errorf("invalid response from server")
 	}
-	return nil
+	return result.Available, result.Reason, nil
 }
 
 func saveConfig(config map[string]interface{}) (string, error) {
-	configDir := os.Getenv("XDG_CONFIG_HOME")
-	if configDir == "" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return "", err
-		}
-		configDir = filepath.Join(home, ".config")
-	}
-	configDir = filepath.Join(configDir, "piportal")
-
-	if err := os.MkdirAll(configDir, 0700); err != nil {
+	configPath := getConfigPath()
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
 		return "", err
 	}
 
-	configPath := filepath.Join(configDir, "config.yaml")
 	data, err := yaml.Marshal(config)
 	if err != nil {
 		return "", err
@@ -266,7 +362,11 @@ func saveConfig(config map[string]interface{}) (string, error) {
 	return configPath, nil
 }
 
+// getConfigPath returns the --config path, or the per-user default
 func getConfigPath() string {
+	if configFile != "" {
+		return configFile
+	}
 	configDir := os.Getenv("XDG_CONFIG_HOME")
 	if configDir == "" {
 		home, _ := os.UserHomeDir()
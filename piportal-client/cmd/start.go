@@ -3,10 +3,15 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
@@ -17,6 +22,9 @@ var (
 	startHost   string
 	startServer string
 	startToken  string
+
+	startTerminalIdle time.Duration
+	startNoProxy      bool
 )
 
 var startCmd = &cobra.Command{
@@ -32,7 +40,13 @@ Examples:
   piportal start --port 3000
 
   # Forward to a different host
-  piportal start --port 3000 --host 192.168.1.100`,
+  piportal start --port 3000 --host 192.168.1.100
+
+  # Forward to a service listening on a Unix socket
+  piportal start --host unix:/var/run/docker.sock
+
+  # Monitoring, reboot and terminal only, no web forwarding
+  piportal start --no-proxy`,
 	RunE: runStart,
 }
 
@@ -40,9 +54,11 @@ func init() {
 	rootCmd.AddCommand(startCmd)
 
 	startCmd.Flags().IntVarP(&startPort, "port", "p", 0, "Local port to forward to")
-	startCmd.Flags().StringVar(&startHost, "host", "", "Local host to forward to (default: 127.0.0.1)")
+	startCmd.Flags().StringVar(&startHost, "host", "", "Local host to forward to, or unix:/path/to.sock (default: 127.0.0.1)")
 	startCmd.Flags().StringVar(&startServer, "server", "", "Server URL (overrides config)")
 	startCmd.Flags().StringVar(&startToken, "token", "", "Device token (overrides config)")
+	startCmd.Flags().DurationVar(&startTerminalIdle, "terminal-idle-timeout", 0, "Close terminal sessions with no input for this long (default 30m, 0 disables)")
+	startCmd.Flags().BoolVar(&startNoProxy, "no-proxy", false, "Don't forward web traffic; only send metrics and handle commands and the terminal")
 }
 
 // Config matches the config file structure
@@ -52,13 +68,177 @@ type Config struct {
 	Token     string `yaml:"token"`
 	Subdomain string `yaml:"subdomain"`
 	LocalPort int    `yaml:"local_port"`
-	LocalHost string `yaml:"local_host"`
+	LocalHost string `yaml:"local_host"` // Or unix:/path/to.sock, and local_port is unused
+
+	BaseDomain string `yaml:"base_domain"` // Public URLs are https://<subdomain>.<base_domain>
+
+	TerminalIdleTimeout time.Duration `yaml:"terminal_idle_timeout"` // Kill PTYs with no input for this long (0 = never)
+
+	TunnelCompression int `yaml:"tunnel_compression"` // permessage-deflate level: 0 off, 1 fastest .. 9 smallest
+
+	// Keepalive: ping the server this often, and reconnect when nothing at
+	// all arrives for read_timeout (0 waits forever)
+	PingInterval time.Duration `yaml:"ping_interval"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+
+	// What the server may run on this device
+	AllowReboot   bool     `yaml:"allow_reboot"`   // Remote reboot from the dashboard
+	AllowExec     bool     `yaml:"allow_exec"`     // Remote shell commands (off unless enabled here)
+	AllowTerminal bool     `yaml:"allow_terminal"` // Dashboard terminal sessions (off unless enabled here)
+	ExecAllowlist []string `yaml:"exec_allowlist"` // If set, only commands matching one of these (* = anything)
+
+	ExecDryRunOnly bool `yaml:"exec_dry_run_only"` // Dry-run every command, whatever the server asks
+
+	// Connections to the local service
+	LocalMaxIdleConns int           `yaml:"local_max_idle_conns"` // Keep-alive connections kept open (0 disables keep-alive)
+	LocalIdleTimeout  time.Duration `yaml:"local_idle_timeout"`   // Close idle connections after this long
+	LocalDialTimeout  time.Duration `yaml:"local_dial_timeout"`   // Connect timeout for the local service
+
+	// For a local service that only speaks HTTPS. Skipping verification
+	// accepts a self-signed certificate, and with it any other.
+	LocalScheme        string `yaml:"local_scheme"`          // http or https
+	LocalTLSSkipVerify bool   `yaml:"local_tls_skip_verify"` // Don't verify the local service's certificate
+
+	// Send the public hostname as Host, for apps that build URLs from Host
+	// and ignore X-Forwarded-Host. They must accept it as one of their own.
+	PreserveHost bool `yaml:"preserve_host"`
+
+	// Shadow testing: a copy of every request also goes here, and its
+	// responses are thrown away (host:port, e.g. 127.0.0.1:8081)
+	MirrorTarget string `yaml:"mirror_target"`
+
+	// Monitoring only: connect for metrics, commands and the terminal, but
+	// never forward requests, so no local service is needed
+	NoProxy bool `yaml:"no_proxy"`
+}
+
+// Validate checks the settings that don't depend on how the tunnel was
+// started. A missing token or server is reported by the caller.
+func (c *Config) Validate() error {
+	if strings.HasPrefix(c.LocalHost, unixSocketPrefix) && c.LocalSocket() == "" {
+		return fmt.Errorf("invalid local_host %q (use unix:/path/to.sock for a Unix socket)", c.LocalHost)
+	}
+	if !c.NoProxy && c.LocalSocket() == "" && (c.LocalPort <= 0 || c.LocalPort > 65535) {
+		return fmt.Errorf("invalid port: %d", c.LocalPort)
+	}
+
+	if c.TunnelCompression < 0 || c.TunnelCompression > 9 {
+		return fmt.Errorf("invalid tunnel_compression: %d (use 0-9)", c.TunnelCompression)
+	}
+
+	if c.PingInterval <= 0 {
+		return fmt.Errorf("invalid ping_interval: %s (must be positive)", c.PingInterval)
+	}
+	if c.ReadTimeout != 0 && c.ReadTimeout <= c.PingInterval {
+		return fmt.Errorf("read_timeout (%s) must be longer than ping_interval (%s)", c.ReadTimeout, c.PingInterval)
+	}
+
+	if c.LocalScheme != "http" && c.LocalScheme != "https" {
+		return fmt.Errorf("invalid local_scheme %q (use http or https)", c.LocalScheme)
+	}
+
+	if c.NoProxy && c.MirrorTarget != "" {
+		return fmt.Errorf("mirror_target can't be used with no_proxy")
+	}
+	if c.MirrorTarget != "" {
+		if _, _, err := net.SplitHostPort(c.MirrorTarget); err != nil {
+			return fmt.Errorf("invalid mirror_target %q (use host:port)", c.MirrorTarget)
+		}
+		if c.MirrorTarget == net.JoinHostPort(c.LocalHost, strconv.Itoa(c.LocalPort)) {
+			return fmt.Errorf("mirror_target is the local service itself")
+		}
+	}
+	return nil
+}
+
+// ProxyOptions returns the local connection settings for NewProxy
+func (c *Config) ProxyOptions() ProxyOptions {
+	return ProxyOptions{
+		MaxIdleConns:    c.LocalMaxIdleConns,
+		IdleConnTimeout: c.LocalIdleTimeout,
+		DialTimeout:     c.LocalDialTimeout,
+		MirrorAddr:      c.MirrorTarget,
+
+		Scheme:             c.LocalScheme,
+		InsecureSkipVerify: c.LocalTLSSkipVerify,
+
+		PreserveHost: c.PreserveHost,
+	}
+}
+
+// LocalAddr returns the local service's host:port or unix:/path/to.sock, or
+// "" in monitoring-only mode
+func (c *Config) LocalAddr() string {
+	if c.NoProxy {
+		return ""
+	}
+	if c.LocalSocket() != "" {
+		return c.LocalHost
+	}
+	return net.JoinHostPort(c.LocalHost, strconv.Itoa(c.LocalPort))
+}
+
+// LocalSocket returns the path of the Unix socket the local service listens
+// on, or "" if it's on a TCP port
+func (c *Config) LocalSocket() string {
+	if network, path := localNetwork(c.LocalHost); network == "unix" {
+		return path
+	}
+	return ""
+}
+
+// PublicURL returns the device's public URL, or "" if the subdomain isn't known
+func (c *Config) PublicURL() string {
+	if c.Subdomain == "" {
+		return ""
+	}
+	domain := c.BaseDomain
+	if domain == "" {
+		domain = baseDomainFromServer(c.ServerURL)
+	}
+	if domain == "" {
+		domain = baseDomainFromServer(c.Server)
+	}
+	if domain == "" {
+		return ""
+	}
+	return "https://" + c.Subdomain + "." + domain
+}
+
+// baseDomainFromServer guesses the tunnel base domain from a server or
+// tunnel URL: https://example.com and wss://tunnel.example.com/tunnel both
+// give example.com. The server's auth result is authoritative when available.
+func baseDomainFromServer(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Host)
+	for _, prefix := range []string{"tunnel.", "www."} {
+		host = strings.TrimPrefix(host, prefix)
+	}
+	return host
 }
 
 func loadConfig() (*Config, error) {
 	cfg := &Config{
 		LocalHost: "127.0.0.1",
 		LocalPort: 8080,
+
+		TerminalIdleTimeout: 30 * time.Minute,
+
+		TunnelCompression: defaultTunnelCompression,
+
+		PingInterval: 30 * time.Second,
+		ReadTimeout:  90 * time.Second,
+
+		AllowReboot: true,
+
+		LocalMaxIdleConns: defaultLocalMaxIdleConns,
+		LocalIdleTimeout:  defaultLocalIdleTimeout,
+		LocalDialTimeout:  defaultLocalDialTimeout,
+
+		LocalScheme: "http",
 	}
 
 	// Try to load config file
@@ -70,26 +250,59 @@ func loadConfig() (*Config, error) {
 		}
 	}
 
-	// Also check /etc/piportal for system-wide config (for service mode)
-	if cfg.Token == "" {
-		sysConfig := "/etc/piportal/config.yaml"
-		data, err := os.ReadFile(sysConfig)
+	// Also check the system-wide config written by 'service install',
+	// unless a config file was named explicitly
+	if cfg.Token == "" && configFile == "" {
+		data, err := os.ReadFile(systemConfigPath())
 		if err == nil {
 			yaml.Unmarshal(data, cfg)
 		}
 	}
 
+	if err := applyEnvConfig(cfg); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
-func runStart(cmd *cobra.Command, args []string) error {
-	// Load config
-	cfg, err := loadConfig()
-	if err != nil {
-		return err
+// applyEnvConfig overrides config file values with PIPORTAL_* environment
+// variables, so containers can be configured without writing a file.
+// Precedence is defaults < config file < environment < command-line flags.
+func applyEnvConfig(cfg *Config) error {
+	if v := os.Getenv("PIPORTAL_SERVER"); v != "" {
+		cfg.Server = v
+	}
+	if v := os.Getenv("PIPORTAL_SERVER_URL"); v != "" {
+		cfg.ServerURL = v
+	}
+	if v := os.Getenv("PIPORTAL_TOKEN"); v != "" {
+		cfg.Token = v
+	}
+	if v := os.Getenv("PIPORTAL_SUBDOMAIN"); v != "" {
+		cfg.Subdomain = v
+	}
+	if v := os.Getenv("PIPORTAL_BASE_DOMAIN"); v != "" {
+		cfg.BaseDomain = v
+	}
+	if v := os.Getenv("PIPORTAL_LOCAL_HOST"); v != "" {
+		cfg.LocalHost = v
+	}
+	if v := os.Getenv("PIPORTAL_LOCAL_SCHEME"); v != "" {
+		cfg.LocalScheme = v
+	}
+	if v := os.Getenv("PIPORTAL_LOCAL_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid PIPORTAL_LOCAL_PORT %q", v)
+		}
+		cfg.LocalPort = port
 	}
+	return nil
+}
 
-	// CLI flags override config
+// applyStartFlags overrides config with the flags given to 'piportal start'
+func applyStartFlags(cmd *cobra.Command, cfg *Config) {
 	if startPort != 0 {
 		cfg.LocalPort = startPort
 	}
@@ -102,6 +315,22 @@ func runStart(cmd *cobra.Command, args []string) error {
 	if startToken != "" {
 		cfg.Token = startToken
 	}
+	if cmd.Flags().Changed("terminal-idle-timeout") {
+		cfg.TerminalIdleTimeout = startTerminalIdle
+	}
+	if startNoProxy {
+		cfg.NoProxy = true
+	}
+}
+
+func runStart(cmd *cobra.Command, args []string) error {
+	// Load config
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	applyStartFlags(cmd, cfg)
 
 	// Validate
 	if cfg.Token == "" {
@@ -119,22 +348,44 @@ func runStart(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("server required")
 	}
 
-	if cfg.LocalPort <= 0 || cfg.LocalPort > 65535 {
-		return fmt.Errorf("invalid port: %d", cfg.LocalPort)
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
 
 	// Set up logging
 	log.SetFlags(log.Ltime)
 
+	// Two clients with one token would keep kicking each other off the server
+	lock, err := acquireInstanceLock()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	// Print startup banner
 	fmt.Println()
 	fmt.Printf("  PiPortal %s\n", Version)
 	fmt.Println("  ─────────────────────────────────────────")
 	fmt.Printf("  Server:      %s\n", cfg.Server)
-	fmt.Printf("  Forwarding:  %s:%d\n", cfg.LocalHost, cfg.LocalPort)
+	if cfg.NoProxy {
+		fmt.Println("  Forwarding:  off (monitoring only)")
+	} else if socket := cfg.LocalSocket(); socket != "" {
+		fmt.Printf("  Forwarding:  %s over unix socket %s\n", cfg.LocalScheme, socket)
+	} else {
+		fmt.Printf("  Forwarding:  %s://%s:%d\n", cfg.LocalScheme, cfg.LocalHost, cfg.LocalPort)
+	}
+	if cfg.LocalScheme == "https" && cfg.LocalTLSSkipVerify {
+		fmt.Println("  Warning:     not verifying the local service's certificate")
+	}
+	if cfg.MirrorTarget != "" {
+		fmt.Printf("  Mirroring:   %s\n", cfg.MirrorTarget)
+	}
 	if cfg.Subdomain != "" {
 		fmt.Printf("  Subdomain:   %s\n", cfg.Subdomain)
 	}
+	if publicURL := cfg.PublicURL(); publicURL != "" {
+		fmt.Printf("  Public URL:  %s\n", publicURL)
+	}
 	fmt.Println()
 
 	// Check for updates in background
@@ -143,6 +394,11 @@ func runStart(cmd *cobra.Command, args []string) error {
 	// Create and start tunnel
 	tunnel := NewTunnel(cfg)
 
+	// Started by the Windows Service Control Manager: it handles shutdown
+	if handled, err := runServiceHost(tunnel); handled {
+		return err
+	}
+
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string // local_port in the config file, if any
+		env  string // PIPORTAL_LOCAL_PORT
+		flag int    // --port
+		want int
+	}{
+		{"default", "", "", 0, 8080},
+		{"file over default", "3000", "", 0, 3000},
+		{"env over file", "3000", "4000", 0, 4000},
+		{"flag over env", "3000", "4000", 5000, 5000},
+		{"flag over file", "3000", "", 5000, 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configHome := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", configHome)
+			if tt.file != "" {
+				path := filepath.Join(configHome, "piportal", "config.yaml")
+				os.MkdirAll(filepath.Dir(path), 0700)
+				if err := os.WriteFile(path, []byte("local_port: "+tt.file+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PIPORTAL_LOCAL_PORT", tt.env)
+			startPort = tt.flag
+			t.Cleanup(func() { startPort = 0 })
+
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			applyStartFlags(startCmd, cfg)
+			if cfg.LocalPort != tt.want {
+				t.Errorf("local port = %d, want %d", cfg.LocalPort, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string // "" if it's valid
+	}{
+		{"defaults", func(c *Config) {}, ""},
+
+		{"Unix socket", func(c *Config) { c.LocalHost, c.LocalPort = "unix:/run/app.sock", 0 }, ""},
+		{"Unix socket without a path", func(c *Config) { c.LocalHost = "unix:" }, "invalid local_host"},
+
+		{"port 0", func(c *Config) { c.LocalPort = 0 }, "invalid port"},
+		{"highest port", func(c *Config) { c.LocalPort = 65535 }, ""},
+		{"port out of range", func(c *Config) { c.LocalPort = 65536 }, "invalid port"},
+		{"no port without a proxy", func(c *Config) { c.NoProxy, c.LocalPort = true, 0 }, ""},
+
+		{"compression off", func(c *Config) { c.TunnelCompression = 0 }, ""},
+		{"best compression", func(c *Config) { c.TunnelCompression = 9 }, ""},
+		{"negative compression", func(c *Config) { c.TunnelCompression = -1 }, "invalid tunnel_compression"},
+		{"compression out of range", func(c *Config) { c.TunnelCompression = 10 }, "invalid tunnel_compression"},
+
+		{"no ping interval", func(c *Config) { c.PingInterval = 0 }, "invalid ping_interval"},
+		{"read timeout off", func(c *Config) { c.ReadTimeout = 0 }, ""},
+		{"read timeout not over ping interval", func(c *Config) { c.ReadTimeout = c.PingInterval }, "must be longer than ping_interval"},
+
+		{"HTTPS local service", func(c *Config) { c.LocalScheme = "https" }, ""},
+		{"unknown local scheme", func(c *Config) { c.LocalScheme = "ftp" }, "invalid local_scheme"},
+
+		{"mirror", func(c *Config) { c.MirrorTarget = "127.0.0.1:9090" }, ""},
+		{"mirror without a proxy", func(c *Config) { c.NoProxy, c.MirrorTarget = true, "127.0.0.1:9090" }, "can't be used with no_proxy"},
+		{"mirror without a port", func(c *Config) { c.MirrorTarget = "127.0.0.1" }, "invalid mirror_target"},
+		{"mirror to the local service", func(c *Config) { c.MirrorTarget = "127.0.0.1:8080" }, "is the local service itself"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				LocalHost:         "127.0.0.1",
+				LocalPort:         8080,
+				LocalScheme:       "http",
+				TunnelCompression: defaultTunnelCompression,
+				PingInterval:      30 * time.Second,
+				ReadTimeout:       90 * time.Second,
+			}
+			tt.change(cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate: %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 'piportal stop' only signals a PID while a start holds the lock
+func TestInstanceLock(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if running, err := instanceRunning(); err != nil || running {
+		t.Fatalf("before start: running = %v, %v", running, err)
+	}
+	lock, err := acquireInstanceLock()
+	if err != nil {
+		t.Fatalf("acquireInstanceLock: %v", err)
+	}
+	if lock == nil {
+		t.Skip("file locking isn't supported here")
+	}
+	if running, err := instanceRunning(); err != nil || !running {
+		t.Errorf("while held: running = %v, %v", running, err)
+	}
+	if _, err := acquireInstanceLock(); err == nil {
+		t.Error("a second instance got the lock")
+	}
+
+	lock.Release()
+	if _, err := os.Stat(lockFilePath()); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+	if running, err := instanceRunning(); err != nil || running {
+		t.Errorf("after release: running = %v, %v", running, err)
+	}
+}
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RunState is what a running 'piportal start' records about itself, so
+// 'piportal status' (a separate process) can report on it
+type RunState struct {
+	PID            int        `json:"pid"`
+	State          string     `json:"state"`
+	Server         string     `json:"server"`
+	Subdomain      string     `json:"subdomain,omitempty"`
+	URL            string     `json:"url,omitempty"`
+	LocalAddr      string     `json:"local_addr"`
+	StartedAt      time.Time  `json:"started_at"`
+	Reconnects     int        `json:"reconnects"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	LatencyMs      float64    `json:"latency_ms,omitempty"` // Round trip of the latest ping
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// stateFilePath returns where the running tunnel's state is recorded. With
+// --config it sits next to that file, so several tunnels don't collide.
+func stateFilePath() string {
+	if configFile != "" {
+		return strings.TrimSuffix(configFile, filepath.Ext(configFile)) + ".state.json"
+	}
+	return filepath.Join(getConfigDir(), "state.json")
+}
+
+// lockFilePath returns the lock held by the running tunnel. It sits beside
+// the state file rather than locking it directly, because the state file is
+// replaced on every write and a lock on the old file would be lost.
+func lockFilePath() string {
+	return strings.TrimSuffix(stateFilePath(), ".json") + ".lock"
+}
+
+// errAlreadyLocked means another process holds the instance lock
+var errAlreadyLocked = errors.New("lock is held by another process")
+
+// instanceLock is held for as long as 'piportal start' runs, so a second
+// start with the same config can't connect as the same device
+type instanceLock struct {
+	f *os.File
+}
+
+// acquireInstanceLock takes the instance lock, or explains who holds it. If
+// the lock can't be taken for any other reason (say, a filesystem without
+// locking), the tunnel runs without one.
+func acquireInstanceLock() (*instanceLock, error) {
+	path := lockFilePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("Warning: can't create %s: %v", filepath.Dir(path), err)
+		return nil, nil
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			log.Printf("Warning: can't open lock file: %v", err)
+			return nil, nil
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			if !errors.Is(err, errAlreadyLocked) {
+				log.Printf("Warning: can't lock %s, not guarding against a second instance: %v", path, err)
+				return nil, nil
+			}
+			if st := readRunState(); st != nil {
+				return nil, fmt.Errorf("piportal is already running (PID %d) - stop it with 'piportal stop'", st.PID)
+			}
+			return nil, fmt.Errorf("piportal is already running with this config - stop it with 'piportal stop'")
+		}
+		// The previous holder may have removed the file between our open and
+		// lock, leaving us a lock nobody else can see. Start over on the new one.
+		if lockFileCurrent(f, path) {
+			return &instanceLock{f: f}, nil
+		}
+		f.Close()
+	}
+}
+
+// lockFileCurrent reports whether f is still the file at path
+func lockFileCurrent(f *os.File, path string) bool {
+	held, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(held, current)
+}
+
+// instanceRunning reports whether a 'piportal start' with this config holds
+// the instance lock. It fails if that can't be told, rather than guessing.
+func instanceRunning() (bool, error) {
+	f, err := os.OpenFile(lockFilePath(), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close() // Drops the lock if we took it
+	if err := lockFile(f); err != nil {
+		if errors.Is(err, errAlreadyLocked) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// Release drops the lock and removes the lock file. The file is closed
+// first, as Windows won't remove an open one.
+func (l *instanceLock) Release() {
+	if l == nil {
+		return
+	}
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
+
+// writeRunState records the tunnel's state. Failures are ignored: the state
+// file is informational and must never stop the tunnel.
+func writeRunState(st *RunState) {
+	st.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return
+	}
+	path := stateFilePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// removeRunState deletes the state file if it still belongs to this process
+func removeRunState() {
+	if st := readStateFile(); st != nil && st.PID == os.Getpid() {
+		os.Remove(stateFilePath())
+	}
+}
+
+// readRunState returns the state of the running tunnel, or nil if none is
+// running. A state file left behind by a crashed process is ignored.
+func readRunState() *RunState {
+	st := readStateFile()
+	if st == nil || !processAlive(st.PID) {
+		return nil
+	}
+	return st
+}
+
+func readStateFile() *RunState {
+	data, err := os.ReadFile(stateFilePath())
+	if err != nil {
+		return nil
+	}
+	var st RunState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil
+	}
+	return &st
+}
+
+// processAlive reports whether a process with this PID exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true // FindProcess fails on Windows if the process is gone
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
@@ -19,20 +19,45 @@ var statusCmd = &cobra.Command{
 	RunE:  runStatus,
 }
 
+var statusJSON bool
+
 func init() {
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print status as JSON (for scripts and monitoring)")
 	rootCmd.AddCommand(statusCmd)
 }
 
+// StatusReport is the machine-readable form of 'piportal status --json'
+type StatusReport struct {
+	Configured bool           `json:"configured"`
+	ConfigFile string         `json:"config_file"`
+	Server     string         `json:"server,omitempty"`
+	ServerURL  string         `json:"server_url,omitempty"`
+	Subdomain  string         `json:"subdomain,omitempty"`
+	URL        string         `json:"url,omitempty"`
+	LocalAddr  string         `json:"local_addr,omitempty"`
+	Token      string         `json:"token,omitempty"` // Masked
+	Running    bool           `json:"running"`
+	Tunnel     *RunState      `json:"tunnel"`
+	Usage      *UsageResponse `json:"usage"`
+	UsageError string         `json:"usage_error,omitempty"`
+}
+
 func runStatus(cmd *cobra.Command, args []string) error {
+	if statusJSON {
+		return printStatusJSON()
+	}
+
 	fmt.Println()
 	fmt.Println("  PiPortal Status")
 	fmt.Println("  ─────────────────────────────────────────")
 	fmt.Println()
 
-	// Check for config file
 	configPath := getConfigPath()
-	data, err := os.ReadFile(configPath)
+	cfg, err := loadStatusConfig(configPath)
 	if err != nil {
+		return err
+	}
+	if cfg == nil {
 		fmt.Println("  Status:      Not configured")
 		fmt.Println()
 		fmt.Println("  Run 'piportal setup' to get started.")
@@ -40,9 +65,11 @@ func runStatus(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return fmt.Errorf("invalid config file: %w", err)
+	// The running tunnel knows the server's authoritative URL
+	st := readRunState()
+	publicURL := cfg.PublicURL()
+	if st != nil && st.URL != "" {
+		publicURL = st.URL
 	}
 
 	fmt.Printf("  Config file: %s\n", configPath)
@@ -50,7 +77,14 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	if cfg.Subdomain != "" {
 		fmt.Printf("  Subdomain:   %s\n", cfg.Subdomain)
 	}
-	fmt.Printf("  Local addr:  %s:%d\n", cfg.LocalHost, cfg.LocalPort)
+	if publicURL != "" {
+		fmt.Printf("  Public URL:  %s\n", publicURL)
+	}
+	if cfg.NoProxy {
+		fmt.Println("  Local addr:  none (monitoring only)")
+	} else {
+		fmt.Printf("  Local addr:  %s\n", cfg.LocalAddr())
+	}
 	fmt.Printf("  Token:       %s...\n", maskToken(cfg.Token))
 	fmt.Println()
 
@@ -63,19 +97,95 @@ func runStatus(cmd *cobra.Command, args []string) error {
 			fmt.Printf("  Tier:        %s\n", strings.Title(usage.Tier))
 			fmt.Printf("  Month:       %s\n", usage.Month)
 			fmt.Printf("  Used:        %s / %s (%.2f%%)\n", usage.UsedHuman, usage.LimitHuman, usage.PercentUsed)
+			if usage.Warning {
+				fmt.Println("  ⚠ Nearly out of bandwidth - the tunnel stops at 100% until next month")
+			}
 			fmt.Println()
 		}
 	}
 
-	// TODO: Actually check if tunnel is running (via PID file or similar)
-	fmt.Println("  Connection:  Not running")
-	fmt.Println()
-	fmt.Println("  Run 'piportal start' to connect.")
+	if st == nil {
+		fmt.Println("  Connection:  Not running")
+		fmt.Println()
+		fmt.Println("  Run 'piportal start' to connect.")
+		fmt.Println()
+		return nil
+	}
+
+	fmt.Printf("  Connection:  %s (pid %d)\n", strings.Title(strings.ToLower(st.State)), st.PID)
+	if st.ConnectedSince != nil {
+		fmt.Printf("  Connected:   %s ago\n", time.Since(*st.ConnectedSince).Round(time.Second))
+	}
+	if st.LatencyMs > 0 {
+		fmt.Printf("  Latency:     %.1f ms\n", st.LatencyMs)
+	}
 	fmt.Println()
 
 	return nil
 }
 
+func printStatusJSON() error {
+	configPath := getConfigPath()
+	report := StatusReport{
+		ConfigFile: configPath,
+		Tunnel:     readRunState(),
+	}
+	report.Running = report.Tunnel != nil
+
+	cfg, err := loadStatusConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if cfg != nil {
+		report.Configured = true
+		report.Server = cfg.Server
+		report.ServerURL = cfg.ServerURL
+		report.Subdomain = cfg.Subdomain
+		report.URL = cfg.PublicURL()
+		if report.Tunnel != nil && report.Tunnel.URL != "" {
+			report.URL = report.Tunnel.URL
+		}
+		report.LocalAddr = cfg.LocalAddr()
+		report.Token = maskToken(cfg.Token)
+
+		if cfg.ServerURL != "" {
+			usage, err := fetchUsage(cfg.ServerURL, cfg.Token)
+			if err != nil {
+				report.UsageError = err.Error()
+			}
+			report.Usage = usage
+		}
+	}
+
+	return printJSON(report)
+}
+
+// loadStatusConfig reads the config file with environment overrides applied.
+// It returns nil if there's neither a config file nor a PIPORTAL_TOKEN.
+func loadStatusConfig(configPath string) (*Config, error) {
+	cfg := Config{LocalHost: "127.0.0.1", LocalPort: 8080}
+	data, readErr := os.ReadFile(configPath)
+	if readErr == nil {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file: %w", err)
+		}
+	}
+	if err := applyEnvConfig(&cfg); err != nil {
+		return nil, err
+	}
+	if readErr != nil && cfg.Token == "" {
+		return nil, nil
+	}
+	return &cfg, nil
+}
+
+// printJSON writes v to stdout as indented JSON, for --json output
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
 func maskToken(token string) string {
 	if len(token) <= 8 {
 		return "****"
@@ -94,6 +204,7 @@ type UsageResponse struct {
 	LimitHuman  string  `json:"limit_human"`
 	UsedHuman   string  `json:"used_human"`
 	PercentUsed float64 `json:"percent_used"`
+	Warning     bool    `json:"bandwidth_warning"` // Past the server's soft limit
 }
 
 func fetchUsage(serverURL, token string) (*UsageResponse, error) {
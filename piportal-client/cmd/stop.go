@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the running tunnel",
+	Long: `Stop a tunnel started with 'piportal start', e.g. one running in
+another terminal. With --config, stops the tunnel using that config.
+
+A tunnel run by the system service is managed by the service manager;
+stopping it here may just get it restarted.`,
+	RunE:         runStop,
+	SilenceUsage: true,
+}
+
+var stopTimeout time.Duration
+
+func init() {
+	stopCmd.Flags().DurationVar(&stopTimeout, "timeout", 10*time.Second, "How long to wait for the tunnel to exit")
+	rootCmd.AddCommand(stopCmd)
+}
+
+func runStop(cmd *cobra.Command, args []string) error {
+	// Only a PID whose process holds the lock is signalled. Otherwise nothing
+	// is running and any PID on record is stale (and may since belong to an
+	// unrelated process).
+	running, err := instanceRunning()
+	if err != nil {
+		return fmt.Errorf("can't tell whether a tunnel is running: %w", err)
+	}
+	if !running {
+		fmt.Println("No tunnel is running.")
+		return nil
+	}
+
+	st := readRunState()
+	if st == nil {
+		fmt.Println("No tunnel is running.")
+		return nil
+	}
+
+	p, err := os.FindProcess(st.PID)
+	if err != nil {
+		return fmt.Errorf("finding PID %d: %w", st.PID, err)
+	}
+	if err := terminateProcess(p); err != nil {
+		return fmt.Errorf("stopping PID %d: %w", st.PID, err)
+	}
+
+	fmt.Printf("Stopping tunnel (PID %d)...\n", st.PID)
+	deadline := time.Now().Add(stopTimeout)
+	for processAlive(st.PID) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("PID %d did not exit within %s", st.PID, stopTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Println("Stopped.")
+	return nil
+}
+
+// terminateProcess asks the tunnel to shut down as it would on Ctrl-C.
+// Windows has no SIGTERM for other processes, so it's killed outright.
+func terminateProcess(p *os.Process) error {
+	if runtime.GOOS == "windows" {
+		return p.Kill()
+	}
+	return p.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateSubdomain checks a (lowercased) subdomain is a usable DNS label:
+// 3-30 lowercase letters, digits and hyphens, with no hyphen at either end
+// or two in a row (those are reserved for punycode, e.g. "xn--"). It mirrors
+// the server's exactly. Reserved names are configured on the server, so setup
+// asks it with checkSubdomainAvailable.
+func validateSubdomain(s string) error {
+	if s == "" {
+		return fmt.Errorf("subdomain is required")
+	}
+	if len(s) < 3 || len(s) > 30 {
+		return fmt.Errorf("subdomain must be 3-30 characters")
+	}
+	for _, c := range s {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+			return fmt.Errorf("subdomain must be lowercase letters, digits and hyphens")
+		}
+	}
+	if s[0] == '-' || s[len(s)-1] == '-' || strings.Contains(s, "--") {
+		return fmt.Errorf("subdomain can't start or end with a hyphen, or have two in a row")
+	}
+	return nil
+}
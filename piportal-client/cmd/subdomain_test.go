@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+// The server has the same cases in piportal-server/subdomain_test.go
+func TestValidateSubdomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string // "" if it's valid
+	}{
+		{"mypi", ""},
+		{"pi-42", ""},
+		{"a1b", ""},
+		{strings.Repeat("a", 30), ""},
+		{"", "required"},
+		{"ab", "3-30 characters"},
+		{strings.Repeat("a", 31), "3-30 characters"},
+		{"MyPi", "lowercase"},
+		{"my_pi", "lowercase"},
+		{"my.pi", "lowercase"},
+		{"café", "lowercase"},
+		{"-mypi", "hyphen"},
+		{"mypi-", "hyphen"},
+		{"xn--mypi", "hyphen"},
+	}
+
+	for _, tt := range tests {
+		err := validateSubdomain(tt.name)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("validateSubdomain(%q) = %v, want no error", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("validateSubdomain(%q) = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -7,10 +7,30 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/creack/pty"
 )
 
+const (
+	// Recent output kept per session, replayed when a browser reattaches
+	terminalScrollback = 64 * 1024
+
+	// Resizes arriving within this window are applied as one
+	terminalResizeDebounce = 100 * time.Millisecond
+
+	// Output is sent at most this often; what arrives in between goes out
+	// together, up to terminalMaxMessage bytes per message
+	terminalFlushInterval = 20 * time.Millisecond
+	terminalMaxMessage    = 64 * 1024
+
+	// PTY reads waiting to be sent. Once it's full the shell's writes block
+	// until the tunnel catches up, so a runaway command is slowed to what
+	// the link can carry instead of flooding it.
+	terminalOutputQueue = 64
+)
+
 // TerminalSession represents an active PTY session
 type TerminalSession struct {
 	ID      string
@@ -19,6 +39,16 @@ type TerminalSession struct {
 	tunnel  *Tunnel
 	closeCh chan struct{}
 	once    sync.Once
+
+	idleTimeout time.Duration
+	idleTimer   *time.Timer // Fires after idleTimeout with no input (nil = disabled)
+
+	outMu      sync.Mutex // Orders sends of live output and scrollback replays
+	scrollback []byte     // Most recent output, at most terminalScrollback bytes
+
+	resizeMu    sync.Mutex
+	pendingSize *pty.Winsize // Latest requested size, not yet applied
+	resizeTimer *time.Timer
 }
 
 // TerminalManager manages all active terminal sessions for a tunnel
@@ -39,12 +69,22 @@ func NewTerminalManager(tunnel *Tunnel) *TerminalManager {
 // HandleOpen creates a new PTY session
 func (tm *TerminalManager) HandleOpen(msg TerminalOpenMessage) {
 	tm.mu.Lock()
-	// Close existing session with same ID if any
-	if existing, ok := tm.sessions[msg.SessionID]; ok {
-		existing.close()
-		delete(tm.sessions, msg.SessionID)
-	}
+	existing, ok := tm.sessions[msg.SessionID]
 	tm.mu.Unlock()
+	// Same session again (e.g. the browser reconnected): keep the shell and
+	// show what it printed recently
+	if ok {
+		existing.reattach(msg.Rows, msg.Cols)
+		return
+	}
+
+	if err := tm.tunnel.config.checkTerminal(); err != nil {
+		log.Printf("Terminal %s: refused: %v", msg.SessionID, err)
+		refused := NewTerminalCloseMessage(msg.SessionID)
+		refused.Reason = err.Error()
+		tm.tunnel.sendJSON(refused)
+		return
+	}
 
 	shell := getShell()
 	cmd := exec.Command(shell)
@@ -61,11 +101,21 @@ func (tm *TerminalManager) HandleOpen(msg TerminalOpenMessage) {
 	}
 
 	session := &TerminalSession{
-		ID:      msg.SessionID,
-		cmd:     cmd,
-		ptmx:    ptmx,
-		tunnel:  tm.tunnel,
-		closeCh: make(chan struct{}),
+		ID:          msg.SessionID,
+		cmd:         cmd,
+		ptmx:        ptmx,
+		tunnel:      tm.tunnel,
+		closeCh:     make(chan struct{}),
+		idleTimeout: tm.tunnel.config.TerminalIdleTimeout,
+	}
+
+	// Kill the shell if the browser goes quiet (e.g. a forgotten tab).
+	// Closing the PTY ends the process, which sends terminal_close below.
+	if session.idleTimeout > 0 {
+		session.idleTimer = time.AfterFunc(session.idleTimeout, func() {
+			log.Printf("Terminal %s: idle for %v, closing", msg.SessionID, session.idleTimeout)
+			session.close()
+		})
 	}
 
 	tm.mu.Lock()
@@ -104,6 +154,10 @@ func (tm *TerminalManager) HandleData(msg TerminalDataMessage) {
 		return
 	}
 
+	if session.idleTimer != nil {
+		session.idleTimer.Reset(session.idleTimeout)
+	}
+
 	if _, err := session.ptmx.Write(data); err != nil {
 		log.Printf("Terminal %s: write error: %v", msg.SessionID, err)
 	}
@@ -118,12 +172,7 @@ func (tm *TerminalManager) HandleResize(msg TerminalResizeMessage) {
 		return
 	}
 
-	if err := pty.Setsize(session.ptmx, &pty.Winsize{
-		Rows: uint16(msg.Rows),
-		Cols: uint16(msg.Cols),
-	}); err != nil {
-		log.Printf("Terminal %s: resize error: %v", msg.SessionID, err)
-	}
+	session.resize(msg.Rows, msg.Cols)
 }
 
 // HandleClose closes a terminal session
@@ -157,7 +206,10 @@ func (tm *TerminalManager) CloseAll() {
 }
 
 func (s *TerminalSession) readLoop() {
-	buf := make([]byte, 4096)
+	out := make(chan []byte, terminalOutputQueue)
+	defer close(out)
+	go s.sendLoop(out)
+
 	for {
 		select {
 		case <-s.closeCh:
@@ -165,10 +217,12 @@ func (s *TerminalSession) readLoop() {
 		default:
 		}
 
+		buf := make([]byte, 4096)
 		n, err := s.ptmx.Read(buf)
 		if n > 0 {
-			msg := NewTerminalDataMessage(s.ID, buf[:n])
-			if sendErr := s.tunnel.sendJSON(msg); sendErr != nil {
+			select {
+			case out <- buf[:n]:
+			case <-s.closeCh:
 				return
 			}
 		}
@@ -181,8 +235,127 @@ func (s *TerminalSession) readLoop() {
 	}
 }
 
+// sendLoop sends PTY output to the server, at most one message per
+// terminalFlushInterval. Interactive output goes out as soon as it's read;
+// during a burst, reads are gathered into one larger message.
+func (s *TerminalSession) sendLoop(out <-chan []byte) {
+	batch := make([]byte, 0, terminalMaxMessage)
+	var lastSend time.Time
+	for chunk := range out {
+		batch = append(batch[:0], chunk...)
+		wait := time.NewTimer(terminalFlushInterval - time.Since(lastSend))
+		waited := false
+	gather:
+		for len(batch) < terminalMaxMessage {
+			select {
+			case more, ok := <-out:
+				if !ok {
+					break gather
+				}
+				batch = append(batch, more...)
+			case <-wait.C:
+				waited = true
+				break gather
+			}
+		}
+		// A full message still waits its turn, holding up the reader
+		if !waited {
+			select {
+			case <-wait.C:
+			case <-s.closeCh:
+			}
+		}
+
+		s.outMu.Lock()
+		s.remember(batch)
+		err := s.tunnel.sendJSON(NewTerminalDataMessage(s.ID, batch))
+		s.outMu.Unlock()
+		lastSend = time.Now()
+		if err != nil {
+			// Keep draining so the reader can't block on a dead tunnel
+			for range out {
+			}
+			return
+		}
+	}
+}
+
+// remember appends output to the scrollback, dropping the oldest bytes once
+// it's full. Callers hold outMu.
+func (s *TerminalSession) remember(p []byte) {
+	if s.scrollback == nil {
+		s.scrollback = make([]byte, 0, terminalScrollback)
+	}
+	if len(p) >= terminalScrollback {
+		s.scrollback = append(s.scrollback[:0], p[len(p)-terminalScrollback:]...)
+		return
+	}
+	if over := len(s.scrollback) + len(p) - terminalScrollback; over > 0 {
+		s.scrollback = s.scrollback[:copy(s.scrollback, s.scrollback[over:])]
+	}
+	s.scrollback = append(s.scrollback, p...)
+}
+
+// reattach resizes the PTY for the new browser and replays the scrollback.
+// Holding outMu keeps live output from slipping in ahead of the replay.
+func (s *TerminalSession) reattach(rows, cols int) {
+	if err := pty.Setsize(s.ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}); err != nil {
+		log.Printf("Terminal %s: resize error: %v", s.ID, err)
+	}
+	if s.idleTimer != nil {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	// The oldest bytes may start mid-character; skip to the next rune
+	replay := s.scrollback
+	for len(replay) > 0 && !utf8.RuneStart(replay[0]) {
+		replay = replay[1:]
+	}
+	if len(replay) > 0 {
+		s.tunnel.sendJSON(NewTerminalDataMessage(s.ID, replay))
+	}
+	log.Printf("Terminal %s: reattached (%dx%d, replayed %d bytes)", s.ID, cols, rows, len(replay))
+}
+
+// resize applies the latest requested size once resizes stop arriving, so
+// dragging a browser window doesn't reflow the shell dozens of times
+func (s *TerminalSession) resize(rows, cols int) {
+	s.resizeMu.Lock()
+	defer s.resizeMu.Unlock()
+	s.pendingSize = &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	if s.resizeTimer != nil {
+		s.resizeTimer.Reset(terminalResizeDebounce)
+		return
+	}
+	s.resizeTimer = time.AfterFunc(terminalResizeDebounce, func() {
+		s.resizeMu.Lock()
+		size := s.pendingSize
+		s.pendingSize = nil
+		s.resizeMu.Unlock()
+		if size == nil {
+			return
+		}
+		if err := pty.Setsize(s.ptmx, size); err != nil {
+			log.Printf("Terminal %s: resize error: %v", s.ID, err)
+		}
+	})
+}
+
 func (s *TerminalSession) close() {
 	s.once.Do(func() {
+		if s.idleTimer != nil {
+			s.idleTimer.Stop()
+		}
+		s.resizeMu.Lock()
+		if s.resizeTimer != nil {
+			s.resizeTimer.Stop()
+		}
+		s.resizeMu.Unlock()
+		s.outMu.Lock()
+		s.scrollback = nil
+		s.outMu.Unlock()
 		close(s.closeCh)
 		s.ptmx.Close()
 		if s.cmd.Process != nil {
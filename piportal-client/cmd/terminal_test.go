@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startTerminalTunnel connects a tunnel with config to a stand-in server,
+// which passes on the terminal messages it gets
+func startTerminalTunnel(t *testing.T, config *Config) (*Tunnel, <-chan TerminalDataMessage, <-chan TerminalCloseMessage) {
+	t.Helper()
+	output := make(chan TerminalDataMessage, 100)
+	closed := make(chan TerminalCloseMessage, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, msgType, err := ParseMessage(data)
+			if err != nil {
+				continue
+			}
+			switch msgType {
+			case MessageTypeTerminalData:
+				output <- msg.(TerminalDataMessage)
+			case MessageTypeTerminalClose:
+				closed <- msg.(TerminalCloseMessage)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	tunnel := NewTunnel(config)
+	tunnel.conn = conn
+	t.Cleanup(tunnel.terminals.CloseAll)
+	return tunnel, output, closed
+}
+
+// A browser that reconnects to a terminal session gets the same shell back,
+// with what it printed before
+func TestTerminalReattachReplaysScrollback(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+	tunnel, output, _ := startTerminalTunnel(t, &Config{AllowTerminal: true})
+
+	// The shell prints the marker; the command it echoes doesn't contain it
+	const marker = "reattach-2"
+	awaitMarker := func(what string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-output:
+				data, _ := base64.StdEncoding.DecodeString(msg.DataBase64)
+				if strings.Contains(string(data), marker) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("%s never contained %q", what, marker)
+			}
+		}
+	}
+
+	open := TerminalOpenMessage{Type: MessageTypeTerminalOpen, SessionID: "term_test", Rows: 24, Cols: 80}
+	tunnel.terminals.HandleOpen(open)
+	tunnel.terminals.HandleData(NewTerminalDataMessage("term_test", []byte("echo reattach-$((1+1))\n")))
+	awaitMarker("output")
+
+	open.Rows, open.Cols = 40, 120
+	tunnel.terminals.HandleOpen(open)
+	awaitMarker("replay")
+}
+
+// Unless the config file enables terminals, an open is refused with the
+// reason and no shell is started
+func TestTerminalRefusedWithoutAllowTerminal(t *testing.T) {
+	// A shell that leaves a file behind if it's ever run
+	dir := t.TempDir()
+	started := filepath.Join(dir, "started")
+	shell := filepath.Join(dir, "shell")
+	if err := os.WriteFile(shell, []byte("#!/bin/sh\ntouch "+started+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SHELL", shell)
+	tunnel, _, closed := startTerminalTunnel(t, &Config{AllowExec: true})
+
+	tunnel.terminals.HandleOpen(TerminalOpenMessage{Type: MessageTypeTerminalOpen, SessionID: "term_test", Rows: 24, Cols: 80})
+	select {
+	case msg := <-closed:
+		if msg.SessionID != "term_test" || !strings.Contains(msg.Reason, "allow_terminal") {
+			data, _ := json.Marshal(msg)
+			t.Fatalf("device sent %s, want the session closed with why", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("device never closed the refused session")
+	}
+
+	tunnel.terminals.mu.Lock()
+	sessions := len(tunnel.terminals.sessions)
+	tunnel.terminals.mu.Unlock()
+	if sessions != 0 {
+		t.Errorf("%d sessions open, want none", sessions)
+	}
+	if _, err := os.Stat(started); !os.IsNotExist(err) {
+		t.Error("the shell was started")
+	}
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+)
+
+var (
+	testPort int
+	testHost string
+)
+
+var testCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Check the local service and server connection",
+	Long: `Check that everything a tunnel needs is working, without starting one:
+
+  - the local service is listening and answers HTTP
+  - the PiPortal server is reachable
+  - the device token is accepted
+
+Exits non-zero if any check fails.`,
+	RunE:         runTest,
+	SilenceUsage: true, // A failed check isn't a usage error
+}
+
+func init() {
+	rootCmd.AddCommand(testCmd)
+
+	testCmd.Flags().IntVarP(&testPort, "port", "p", 0, "Local port to test (overrides config)")
+	testCmd.Flags().StringVar(&testHost, "host", "", "Local host to test (overrides config)")
+}
+
+// checklist prints pass/warn/fail lines and counts problems
+type checklist struct {
+	failed int
+	warned int
+}
+
+func (c *checklist) pass(name, detail string) {
+	fmt.Printf("  ✓ %-14s %s\n", name, detail)
+}
+
+func (c *checklist) fail(name, detail string) {
+	c.failed++
+	fmt.Printf("  ✗ %-14s %s\n", name, detail)
+}
+
+func (c *checklist) warn(name, detail string) {
+	c.warned++
+	fmt.Printf("  ! %-14s %s\n", name, detail)
+}
+
+func (c *checklist) skip(name, detail string) {
+	fmt.Printf("  - %-14s %s\n", name, detail)
+}
+
+// hint prints a suggested fix under the previous line
+func (c *checklist) hint(text string) {
+	fmt.Printf("    %-14s → %s\n", "", text)
+}
+
+func runTest(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if testPort != 0 {
+		cfg.LocalPort = testPort
+	}
+	if testHost != "" {
+		cfg.LocalHost = testHost
+	}
+
+	fmt.Println()
+	fmt.Println("  PiPortal Test")
+	fmt.Println("  ─────────────────────────────────────────")
+	fmt.Println()
+
+	c := &checklist{}
+	testLocalService(c, cfg)
+
+	// Server and token
+	switch {
+	case cfg.Server == "" || cfg.Token == "":
+		c.fail("Server", "not configured - run 'piportal setup' first")
+		c.skip("Token", "skipped")
+	case readRunState() != nil:
+		// Authenticating would replace the running tunnel's connection
+		c.skip("Server", "skipped - a tunnel is already running ('piportal status')")
+		c.skip("Token", "skipped")
+	default:
+		testServerAuth(c, cfg)
+	}
+
+	fmt.Println()
+	if c.failed > 0 {
+		return fmt.Errorf("%d check(s) failed", c.failed)
+	}
+	fmt.Println("  All checks passed. Run 'piportal start' to connect.")
+	fmt.Println()
+	return nil
+}
+
+// testLocalService checks the local service is listening, then answers HTTP
+func testLocalService(c *checklist, cfg *Config) {
+	localAddr := net.JoinHostPort(cfg.LocalHost, strconv.Itoa(cfg.LocalPort))
+	if cfg.LocalSocket() != "" {
+		localAddr = cfg.LocalHost
+	}
+
+	network, address := localNetwork(localAddr)
+	conn, err := net.DialTimeout(network, address, 2*time.Second)
+	if err != nil {
+		c.fail("Local service", fmt.Sprintf("nothing listening on %s", localAddr))
+		c.skip("HTTP request", "skipped")
+		return
+	}
+	conn.Close()
+	c.pass("Local service", fmt.Sprintf("%s is listening", localAddr))
+	opts := cfg.ProxyOptions()
+	opts.MirrorAddr = "" // Don't send the test request to the mirror
+	testLocalHTTP(c, localAddr, opts)
+}
+
+// testLocalHTTP sends GET / through the same Proxy the tunnel uses
+func testLocalHTTP(c *checklist, localAddr string, opts ProxyOptions) {
+	proxy := NewProxy(localAddr, opts)
+	proxy.SetLimits(10*time.Second, 0)
+
+	start := time.Now()
+	result, err := proxy.Forward(context.Background(), &RequestMessage{
+		Method:  http.MethodGet,
+		Path:    "/",
+		Headers: map[string]string{"User-Agent": "piportal-test/" + Version},
+	})
+	if err != nil {
+		c.fail("HTTP request", err.Error())
+		return
+	}
+	rtt := time.Since(start).Round(time.Millisecond)
+
+	detail := fmt.Sprintf("GET / → %d %s in %s", result.StatusCode, http.StatusText(result.StatusCode), rtt)
+	if result.StatusCode >= 500 {
+		c.fail("HTTP request", detail)
+		return
+	}
+	c.pass("HTTP request", detail)
+}
+
+// testServerAuth connects to the tunnel endpoint, authenticates and hangs up
+func testServerAuth(c *checklist, cfg *Config) {
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+
+	start := time.Now()
+	conn, _, err := dialer.Dial(cfg.Server, nil)
+	if err != nil {
+		c.fail("Server", fmt.Sprintf("could not connect to %s: %v", cfg.Server, err))
+		c.skip("Token", "skipped")
+		return
+	}
+	defer conn.Close()
+	c.pass("Server", fmt.Sprintf("connected to %s in %s", cfg.Server, time.Since(start).Round(time.Millisecond)))
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.WriteJSON(NewAuthMessage(cfg.Token, Version)); err != nil {
+		c.fail("Token", fmt.Sprintf("failed to send auth: %v", err))
+		return
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		c.fail("Token", fmt.Sprintf("no auth response: %v", err))
+		return
+	}
+
+	msg, msgType, err := ParseMessage(data)
+	if err != nil {
+		c.fail("Token", fmt.Sprintf("invalid auth response: %v", err))
+		return
+	}
+	switch msgType {
+	case MessageTypeAuthResult:
+		result := msg.(AuthResultMessage)
+		if !result.Success {
+			c.fail("Token", "rejected: "+result.Message)
+			return
+		}
+		c.pass("Token", "authenticated as "+result.Subdomain)
+	case MessageTypeError:
+		errMsg := msg.(ErrorMessage)
+		c.fail("Token", fmt.Sprintf("%s - %s", errMsg.Code, errMsg.Message))
+	default:
+		c.fail("Token", "unexpected response: "+msgType)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage this device's token",
+}
+
+var tokenSetCmd = &cobra.Command{
+	Use:   "set <token>",
+	Short: "Save a new device token",
+	Long: `Save a device token in the config file, e.g. after rotating a leaked
+token from the dashboard. The rest of the config is left alone.
+
+The new token is checked with the server first unless --skip-check is
+given. A running tunnel picks it up the next time it reconnects.`,
+	Args:         cobra.ExactArgs(1),
+	RunE:         runTokenSet,
+	SilenceUsage: true,
+}
+
+var tokenSkipCheck bool
+
+func init() {
+	tokenSetCmd.Flags().BoolVar(&tokenSkipCheck, "skip-check", false, "Save the token without checking it with the server")
+	tokenCmd.AddCommand(tokenSetCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
+
+func runTokenSet(cmd *cobra.Command, args []string) error {
+	token := strings.TrimSpace(args[0])
+	if !strings.HasPrefix(token, "pp_") {
+		return fmt.Errorf("that doesn't look like a device token (they start with pp_)")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if !tokenSkipCheck {
+		serverURL := serverBaseURL(cfg)
+		if serverURL == "" {
+			return fmt.Errorf("no server URL configured - run 'piportal setup', or use --skip-check")
+		}
+		info, err := fetchDeviceInfo(serverURL, token)
+		if err != nil {
+			return err
+		}
+		if cfg.Subdomain != "" && info.Subdomain != cfg.Subdomain {
+			return fmt.Errorf("that token belongs to %s, not %s", info.Subdomain, cfg.Subdomain)
+		}
+	}
+
+	configPath, err := updateConfigFile("token", token)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("  ✓ Token saved to %s\n", configPath)
+	return nil
+}
+
+// editableConfigPath picks the config file loadConfig takes its settings
+// from: the system-wide one written by 'service install' when there is no
+// user config
+func editableConfigPath() string {
+	path := getConfigPath()
+	if configFile != "" {
+		return path
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(systemConfigPath()); err == nil {
+			return systemConfigPath()
+		}
+	}
+	return path
+}
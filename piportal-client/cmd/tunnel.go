@@ -4,17 +4,56 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
+	"net"
+	"os"
 	"os/exec"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// errInvalidToken means the server doesn't recognize the device token,
+// e.g. because it was rotated
+var errInvalidToken = errors.New("rejected token")
+
+// errClientTooOld means the server requires a newer client; retrying won't
+// help until the binary is upgraded
+var errClientTooOld = errors.New("client too old")
+
+// errServerFull means the server has as many tunnels as it allows; another
+// try soon is unlikely to get in, so the next one waits longer
+var errServerFull = errors.New("server full")
+
+// serverFullBackoff is the least a client waits after being turned away by a
+// full server
+const serverFullBackoff = 30 * time.Second
+
+// errIdleTimeout means the server closed the tunnel for carrying no traffic;
+// reconnecting straight away would only hold it open again
+var errIdleTimeout = errors.New("idle timeout")
+
+// idleTimeoutBackoff is how long a client closed for being idle stays away
+// before reconnecting
+const idleTimeoutBackoff = 30 * time.Minute
+
+const (
+	// defaultTunnelCompression trades a little CPU for less bandwidth on
+	// the tunnel link; it only takes effect if the server agrees to it
+	defaultTunnelCompression = 1
+
+	// minCompressedMessage is the smallest message worth deflating
+	minCompressedMessage = 256
+)
+
 // TunnelState represents the current connection state
 type TunnelState int
 
@@ -47,10 +86,21 @@ type Tunnel struct {
 	conn      *websocket.Conn
 	state     TunnelState
 	subdomain string
+	publicURL string // From the server's auth result
 	terminals *TerminalManager
 
 	backoffDelay   time.Duration
+	startedAt      time.Time
 	connectedSince time.Time
+	reconnects     int    // Sessions lost since startup
+	lastDisconnect string // Why the last session ended
+
+	pingSentAt time.Time     // When the unanswered ping went out
+	latency    time.Duration // Round trip of the latest ping
+
+	settings AgentSettings // Sent by the server at auth, for this session
+
+	commands map[string]context.CancelFunc // Running streaming commands, by ID (guarded by mu)
 
 	mu     sync.Mutex
 	ctx    context.Context
@@ -62,11 +112,15 @@ func NewTunnel(config *Config) *Tunnel {
 	ctx, cancel := context.WithCancel(context.Background())
 	t := &Tunnel{
 		config:       config,
-		proxy:        NewProxy(fmt.Sprintf("%s:%d", config.LocalHost, config.LocalPort)),
 		state:        StateInit,
 		backoffDelay: time.Second,
+		startedAt:    time.Now(),
 		ctx:          ctx,
 		cancel:       cancel,
+		commands:     make(map[string]context.CancelFunc),
+	}
+	if !config.NoProxy {
+		t.proxy = NewProxy(config.LocalAddr(), config.ProxyOptions())
 	}
 	t.terminals = NewTerminalManager(t)
 	return t
@@ -77,6 +131,7 @@ func (t *Tunnel) Run() error {
 	for {
 		select {
 		case <-t.ctx.Done():
+			removeRunState()
 			return nil
 		default:
 			t.runOnce()
@@ -88,29 +143,59 @@ func (t *Tunnel) runOnce() {
 	t.setState(StateConnecting)
 	log.Printf("Connecting to %s...", t.config.Server)
 
-	conn, _, err := websocket.DefaultDialer.DialContext(t.ctx, t.config.Server, nil)
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = t.config.TunnelCompression > 0
+	conn, _, err := dialer.DialContext(t.ctx, t.config.Server, nil)
 	if err != nil {
 		log.Printf("Connection failed: %v", err)
 		t.backoff()
 		return
 	}
+	if t.config.TunnelCompression > 0 {
+		conn.SetCompressionLevel(t.config.TunnelCompression)
+	}
 
 	t.mu.Lock()
 	t.conn = conn
+	t.pingSentAt = time.Time{}
+	t.latency = 0
 	t.mu.Unlock()
 
+	// The server's pings count as signs of life, like any message
+	conn.SetPingHandler(func(data string) error {
+		t.extendReadDeadline(conn)
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+		if _, ok := err.(net.Error); ok || err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
 	if err := t.authenticate(); err != nil {
 		log.Printf("Authentication failed: %v", err)
 		conn.Close()
+		if errors.Is(err, errInvalidToken) {
+			t.reloadToken()
+		}
+		if errors.Is(err, errClientTooOld) {
+			fmt.Printf("  ✗ %v\n", err)
+			fmt.Println()
+			t.backoffDelay = 60 * time.Second
+		}
+		if errors.Is(err, errServerFull) {
+			t.backoffDelay = max(t.backoffDelay, serverFullBackoff)
+		}
 		t.backoff()
 		return
 	}
 
-	t.setState(StateConnected)
 	t.connectedSince = time.Now()
+	t.setState(StateConnected)
 
 	// Update subdomain from auth response if we got one
-	if t.subdomain != "" {
+	if t.publicURL != "" {
+		fmt.Printf("  ✓ Connected as %s → %s\n", t.subdomain, t.publicURL)
+	} else if t.subdomain != "" {
 		fmt.Printf("  ✓ Connected as %s\n", t.subdomain)
 	} else {
 		fmt.Println("  ✓ Connected!")
@@ -118,8 +203,15 @@ func (t *Tunnel) runOnce() {
 	fmt.Println()
 
 	go t.pingLoop()
-	t.messageLoop()
+	err = t.messageLoop()
 	t.terminals.CloseAll()
+	t.reconnects++
+
+	if errors.Is(err, errIdleTimeout) {
+		t.backoffDelay = idleTimeoutBackoff
+		t.backoff()
+		return
+	}
 
 	if time.Since(t.connectedSince) > 5*time.Minute {
 		t.backoffDelay = time.Second
@@ -128,6 +220,10 @@ func (t *Tunnel) runOnce() {
 
 func (t *Tunnel) authenticate() error {
 	authMsg := NewAuthMessage(t.config.Token, Version)
+	authMsg.Reconnects = t.reconnects
+	authMsg.ClientUptime = int64(time.Since(t.startedAt).Seconds())
+	authMsg.LastDisconnect = t.lastDisconnect
+	authMsg.NoProxy = t.proxy == nil
 	if err := t.sendJSON(authMsg); err != nil {
 		return fmt.Errorf("failed to send auth: %w", err)
 	}
@@ -149,31 +245,63 @@ func (t *Tunnel) authenticate() error {
 			return fmt.Errorf("auth rejected: %s", result.Message)
 		}
 		t.subdomain = result.Subdomain
+		t.publicURL = result.URL
+		if result.BaseDomain != "" {
+			t.config.BaseDomain = result.BaseDomain
+		}
+		if t.proxy != nil {
+			t.proxy.SetLimits(time.Duration(result.RequestTimeout)*time.Second, result.MaxBodySize)
+		}
+		t.applySettings(result.Settings)
 		return nil
 	case MessageTypeError:
 		errMsg := msg.(ErrorMessage)
+		switch errMsg.Code {
+		case "invalid_token":
+			return fmt.Errorf("%w: %s", errInvalidToken, errMsg.Message)
+		case "client_too_old":
+			return fmt.Errorf("%w: %s", errClientTooOld, errMsg.Message)
+		case "server_full":
+			return fmt.Errorf("%w: %s", errServerFull, errMsg.Message)
+		}
 		return fmt.Errorf("server error: %s - %s", errMsg.Code, errMsg.Message)
 	default:
 		return fmt.Errorf("unexpected response type: %s", msgType)
 	}
 }
 
-func (t *Tunnel) messageLoop() {
+// reloadToken picks up a token saved with 'piportal token set' after the
+// one in use was rotated, so the tunnel recovers without a restart
+func (t *Tunnel) reloadToken() {
+	cfg, err := loadConfig()
+	if err != nil || cfg.Token == "" || cfg.Token == t.config.Token {
+		return
+	}
+	log.Printf("Token was rejected; using the new token from the config file")
+	t.config.Token = cfg.Token
+}
+
+// messageLoop handles messages until the connection ends. It returns
+// errIdleTimeout if the server closed the tunnel for being idle.
+func (t *Tunnel) messageLoop() error {
 	for {
 		select {
 		case <-t.ctx.Done():
-			return
+			return nil
 		default:
 		}
 
+		t.extendReadDeadline(t.conn)
 		_, data, err := t.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				log.Println("Server closed connection")
+				t.lastDisconnect = "server closed connection"
 			} else {
 				log.Printf("Connection lost: %v", err)
+				t.lastDisconnect = err.Error()
 			}
-			return
+			return nil
 		}
 
 		msg, msgType, err := ParseMessage(data)
@@ -187,13 +315,31 @@ func (t *Tunnel) messageLoop() {
 			req := msg.(RequestMessage)
 			go t.handleRequest(&req)
 		case MessageTypePong:
-			// OK
+			t.recordPong()
+		case MessageTypeMetricsRequest:
+			m := msg.(MetricsRequestMessage)
+			go t.sendMetrics(m.RequestID)
 		case MessageTypeCommand:
 			cmd := msg.(CommandMessage)
 			go t.handleCommand(&cmd)
+		case MessageTypeCommandCancel:
+			m := msg.(CommandCancelMessage)
+			t.cancelCommand(m.CommandID)
 		case MessageTypeError:
 			errMsg := msg.(ErrorMessage)
+			if errMsg.Code == "idle_timeout" {
+				log.Printf("Server closed the tunnel: %s", errMsg.Message)
+				t.lastDisconnect = "idle timeout"
+				t.mu.Lock()
+				t.conn.Close()
+				t.mu.Unlock()
+				return errIdleTimeout
+			}
 			log.Printf("Server error: %s - %s", errMsg.Code, errMsg.Message)
+		case MessageTypeReconnect:
+			m := msg.(ReconnectMessage)
+			t.closeForReconnect(m.Reason)
+			return nil
 		case MessageTypeTerminalOpen:
 			m := msg.(TerminalOpenMessage)
 			go t.terminals.HandleOpen(m)
@@ -211,29 +357,100 @@ func (t *Tunnel) messageLoop() {
 }
 
 func (t *Tunnel) handleRequest(req *RequestMessage) {
-	log.Printf("← %s %s", req.Method, req.Path)
+	id := req.LogID()
+	log.Printf("← %s %s [%s]", req.Method, req.Path, id)
+	if verbose {
+		logHeaders(req.Headers)
+		body, _ := req.GetBody()
+		log.Printf("  request body: %d bytes", len(body))
+	}
 
+	// The server doesn't send requests to a monitoring-only client, but an
+	// older one might
+	if t.proxy == nil {
+		t.sendJSON(NewResponseMessage(req.RequestID, 503, map[string]string{
+			"Content-Type": "text/plain",
+		}, []byte("This device doesn't forward web traffic")))
+		return
+	}
+
+	start := time.Now()
 	result, err := t.proxy.Forward(t.ctx, req)
+	elapsed := time.Since(start)
 	if err != nil {
-		log.Printf("  ✗ %v", err)
+		log.Printf("  ✗ %v [%s]", err, id)
+		if verbose {
+			log.Printf("  failed after %s", elapsed.Round(time.Microsecond))
+		}
 		resp := NewResponseMessage(req.RequestID, 502, map[string]string{
 			"Content-Type": "text/plain",
 		}, []byte(fmt.Sprintf("Failed to reach local service: %v", err)))
+		resp.UpstreamTime = elapsed.Microseconds()
 		t.sendJSON(resp)
 		return
 	}
 
-	log.Printf("→ %d %s", result.StatusCode, req.Path)
+	log.Printf("→ %d %s [%s]", result.StatusCode, req.Path, id)
+	if verbose {
+		logHeaders(result.Headers)
+		log.Printf("  response body: %d bytes, local round trip %s", len(result.Body), elapsed.Round(time.Microsecond))
+	}
 
 	resp := NewResponseMessage(req.RequestID, result.StatusCode, result.Headers, result.Body)
+	resp.UpstreamTime = elapsed.Microseconds()
 	if err := t.sendJSON(resp); err != nil {
 		log.Printf("Failed to send response: %v", err)
 	}
 }
 
+// closeForReconnect cleanly closes the current connection at the server's
+// request. Run then dials again straight away.
+func (t *Tunnel) closeForReconnect(reason string) {
+	if reason == "" {
+		reason = "requested by server"
+	}
+	log.Printf("Reconnecting: %s", reason)
+	t.lastDisconnect = "reconnect: " + reason
+
+	t.mu.Lock()
+	t.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "reconnecting"),
+		time.Now().Add(time.Second))
+	t.conn.Close()
+	t.mu.Unlock()
+}
+
+// Headers whose values are credentials, masked in --verbose output
+var redactedHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"x-api-key":           true,
+}
+
+// logHeaders prints headers for --verbose, sorted and with credentials masked
+func logHeaders(headers map[string]string) {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := headers[key]
+		if redactedHeaders[strings.ToLower(key)] {
+			value = "[redacted]"
+		}
+		log.Printf("    %s: %s", key, value)
+	}
+}
+
 func (t *Tunnel) pingLoop() {
-	ticker := time.NewTicker(30 * time.Second)
+	interval := t.pingInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	var metricsSentAt time.Time
 
 	for {
 		select {
@@ -243,20 +460,67 @@ func (t *Tunnel) pingLoop() {
 			if t.state != StateConnected {
 				return
 			}
+			t.mu.Lock()
+			t.pingSentAt = time.Now()
+			t.mu.Unlock()
 			if err := t.sendJSON(NewPingMessage()); err != nil {
 				return
 			}
-			// Send system metrics alongside ping
-			metrics := CollectMetrics()
-			if err := t.sendJSON(metrics); err != nil {
+			// Send system metrics alongside the ping, or every few pings if
+			// the dashboard asked for them less often. Half a ping's slack
+			// keeps ticker jitter from skipping one.
+			if every := t.metricsInterval(); every > 0 && time.Since(metricsSentAt) < every-interval/2 {
+				continue
+			}
+			if err := t.sendMetrics(""); err != nil {
 				return
 			}
+			metricsSentAt = time.Now()
 		}
 	}
 }
 
+// extendReadDeadline gives the server another read_timeout to send something
+// before the connection is taken for dead
+func (t *Tunnel) extendReadDeadline(conn *websocket.Conn) {
+	if t.config.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.config.ReadTimeout))
+	}
+}
+
+// recordPong notes the round trip of the ping the server just answered
+func (t *Tunnel) recordPong() {
+	t.mu.Lock()
+	if t.pingSentAt.IsZero() {
+		t.mu.Unlock()
+		return
+	}
+	t.latency = time.Since(t.pingSentAt)
+	t.pingSentAt = time.Time{}
+	state := t.state
+	t.mu.Unlock()
+	t.setState(state)
+}
+
+// sendMetrics collects system metrics and sends them, tagged with the
+// server's request ID when it asked for them
+func (t *Tunnel) sendMetrics(requestID string) error {
+	metrics := CollectMetrics()
+	metrics.RequestID = requestID
+	return t.sendJSON(metrics)
+}
+
 func (t *Tunnel) handleCommand(cmd *CommandMessage) {
 	log.Printf("Received command: %s (id: %s)", cmd.Command, cmd.CommandID)
+	err := t.config.checkCommand(cmd)
+	if err == nil && cmd.Command == "exec" {
+		err = checkAllowlist(t.serverSettings().ExecAllowlist, cmd.Shell, "the exec_allowlist set in the dashboard")
+	}
+	if err != nil {
+		log.Printf("Refused command %s: %v", cmd.CommandID, err)
+		t.sendJSON(NewCommandResultMessage(cmd.CommandID, -1, "", err.Error()))
+		return
+	}
 	switch cmd.Command {
 	case "reboot":
 		log.Println("Reboot command received, rebooting system...")
@@ -280,25 +544,38 @@ func (t *Tunnel) handleExecCommand(cmd *CommandMessage) {
 		return
 	}
 
-	if cmd.DryRun {
-		// For apt-get/apt commands, rewrite with -s (simulate) flag
-		if isAptCommand(shell) {
-			shell = insertAptSimulate(shell)
-		} else {
-			// For non-apt commands, just echo what would run
-			output := fmt.Sprintf("[dry run] would execute: %s", shell)
+	// exec_dry_run_only, in the config file or the dashboard, overrides
+	// whatever the command asked for
+	dryRunOnly := t.config.ExecDryRunOnly || t.serverSettings().ExecDryRunOnly
+	enforced := dryRunOnly && !cmd.DryRun
+	dryRun := cmd.DryRun || dryRunOnly
+
+	if dryRun {
+		run, output, err := simulateCommand(shell)
+		if err != nil || run == "" {
 			result := NewCommandResultMessage(cmd.CommandID, 0, base64Encode([]byte(output)), "")
+			if err != nil {
+				result = NewCommandResultMessage(cmd.CommandID, -1, "", err.Error())
+			}
+			result.DryRunEnforced = enforced
 			t.sendJSON(result)
 			return
 		}
+		shell = run
 	}
 
-	log.Printf("Executing shell command: %s (dry_run=%v)", shell, cmd.DryRun)
+	log.Printf("Executing shell command: %s (dry_run=%v, enforced=%v, stream=%v)", shell, dryRun, enforced, cmd.Stream)
+
+	if cmd.Stream {
+		t.handleStreamingExec(cmd, shell, enforced)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(t.ctx, 60*time.Second)
 	defer cancel()
 
 	execCmd := exec.CommandContext(ctx, "sh", "-c", shell)
+	execCmd.WaitDelay = commandWaitDelay
 	outputBytes, err := execCmd.CombinedOutput()
 
 	// Cap output at 64 KB
@@ -306,45 +583,118 @@ func (t *Tunnel) handleExecCommand(cmd *CommandMessage) {
 		outputBytes = outputBytes[:maxOutputBytes]
 	}
 
-	exitCode := 0
-	errMsg := ""
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		} else if ctx.Err() == context.DeadlineExceeded {
-			exitCode = -1
-			errMsg = "command timed out after 60s"
-		} else {
-			exitCode = -1
-			errMsg = err.Error()
-		}
+	exitCode, errMsg := exitStatus(ctx, err, 60*time.Second)
+	result := NewCommandResultMessage(cmd.CommandID, exitCode, base64Encode(outputBytes), errMsg)
+	result.DryRunEnforced = enforced
+	if sendErr := t.sendJSON(result); sendErr != nil {
+		log.Printf("Failed to send command result: %v", sendErr)
 	}
+}
 
-	result := NewCommandResultMessage(cmd.CommandID, exitCode, base64Encode(outputBytes), errMsg)
+const maxStreamBytes = 8 * 1024 * 1024 // 8 MB cap for streamed output
+
+// commandWaitDelay is how long a finished command's output pipes are read
+// before being closed. A background process the command started can keep
+// them open indefinitely, and shouldn't hold up the result.
+const commandWaitDelay = 2 * time.Second
+
+// handleStreamingExec runs a shell command, sending stdout/stderr as
+// command_output chunks while it runs and a command_result with the exit code at the end
+func (t *Tunnel) handleStreamingExec(cmd *CommandMessage, shell string, dryRunEnforced bool) {
+	timeout := time.Duration(cmd.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+
+	// The server cancels the command if nobody is watching it any more
+	t.mu.Lock()
+	t.commands[cmd.CommandID] = cancel
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.commands, cmd.CommandID)
+		t.mu.Unlock()
+	}()
+
+	dropped, err := t.runStreaming(exec.CommandContext(ctx, "sh", "-c", shell), cmd.CommandID)
+
+	exitCode, errMsg := exitStatus(ctx, err, timeout)
+	result := NewCommandResultMessage(cmd.CommandID, exitCode, "", errMsg)
+	result.DryRunEnforced = dryRunEnforced
+	result.OutputDropped = dropped
 	if sendErr := t.sendJSON(result); sendErr != nil {
 		log.Printf("Failed to send command result: %v", sendErr)
 	}
 }
 
-func isAptCommand(cmd string) bool {
-	// Check if command starts with apt-get or apt
-	for _, prefix := range []string{"apt-get ", "apt "} {
-		if len(cmd) >= len(prefix) && cmd[:len(prefix)] == prefix {
-			return true
-		}
+// cancelCommand stops a running streaming command, if there is one
+func (t *Tunnel) cancelCommand(commandID string) {
+	t.mu.Lock()
+	cancel := t.commands[commandID]
+	t.mu.Unlock()
+	if cancel != nil {
+		log.Printf("Cancelling command %s", commandID)
+		cancel()
 	}
-	return false
 }
 
-func insertAptSimulate(cmd string) string {
-	// Insert -s flag after "apt-get" or "apt"
-	if len(cmd) >= 8 && cmd[:8] == "apt-get " {
-		return "apt-get -s " + cmd[8:]
+// runStreaming runs a command, relaying its stdout and stderr until it
+// exits. It returns how many bytes of output couldn't be sent.
+func (t *Tunnel) runStreaming(execCmd *exec.Cmd, commandID string) (int64, error) {
+	var sent, dropped atomic.Int64
+	execCmd.Stdout = &outputStreamer{t: t, commandID: commandID, stream: "stdout", sent: &sent, dropped: &dropped}
+	execCmd.Stderr = &outputStreamer{t: t, commandID: commandID, stream: "stderr", sent: &sent, dropped: &dropped}
+	execCmd.WaitDelay = commandWaitDelay
+
+	err := execCmd.Run()
+	if n := dropped.Load(); n > 0 {
+		log.Printf("Command %s: %d bytes of output not sent", commandID, n)
 	}
-	if len(cmd) >= 4 && cmd[:4] == "apt " {
-		return "apt -s " + cmd[4:]
+	return dropped.Load(), err
+}
+
+// outputStreamer sends what a command writes to one of its output streams
+// to the server as command_output chunks. Output past maxStreamBytes, or
+// that fails to send, is counted in dropped rather than failing the command.
+type outputStreamer struct {
+	t         *Tunnel
+	commandID string
+	stream    string
+	sent      *atomic.Int64 // Shared between a command's streams
+	dropped   *atomic.Int64
+}
+
+func (o *outputStreamer) Write(p []byte) (int, error) {
+	if o.sent.Add(int64(len(p))) > maxStreamBytes {
+		o.dropped.Add(int64(len(p)))
+		return len(p), nil
+	}
+	if err := o.t.sendJSON(NewCommandOutputMessage(o.commandID, o.stream, p)); err != nil {
+		o.dropped.Add(int64(len(p)))
+	}
+	return len(p), nil
+}
+
+// exitStatus converts the error from running a command into an exit code and message
+func exitStatus(ctx context.Context, err error, timeout time.Duration) (int, string) {
+	// ErrWaitDelay means the command succeeded but left something behind
+	// holding its output open
+	if err == nil || errors.Is(err, exec.ErrWaitDelay) {
+		return 0, ""
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		return exitErr.ExitCode(), ""
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return -1, fmt.Sprintf("command timed out after %ds", int(timeout.Seconds()))
+	}
+	if ctx.Err() == context.Canceled {
+		return -1, "command cancelled"
 	}
-	return cmd
+	return -1, err.Error()
 }
 
 func base64Encode(data []byte) string {
@@ -383,6 +733,7 @@ func (t *Tunnel) sendJSON(msg interface{}) error {
 	if err != nil {
 		return err
 	}
+	t.conn.EnableWriteCompression(len(data) >= minCompressedMessage) // No-op unless negotiated
 	return t.conn.WriteMessage(websocket.TextMessage, data)
 }
 
@@ -390,6 +741,23 @@ func (t *Tunnel) setState(state TunnelState) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.state = state
+
+	st := &RunState{
+		PID:        os.Getpid(),
+		State:      state.String(),
+		Server:     t.config.Server,
+		Subdomain:  t.subdomain,
+		URL:        t.publicURL,
+		LocalAddr:  t.config.LocalAddr(),
+		StartedAt:  t.startedAt,
+		Reconnects: t.reconnects,
+	}
+	if state == StateConnected {
+		since := t.connectedSince
+		st.ConnectedSince = &since
+		st.LatencyMs = float64(t.latency.Microseconds()) / 1000
+	}
+	writeRunState(st)
 }
 
 // Stop gracefully shuts down the tunnel
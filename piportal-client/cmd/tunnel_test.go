@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A background process holding the output pipes open mustn't keep the
+// command from finishing
+func TestRunStreamingBackgroundProcess(t *testing.T) {
+	tun := NewTunnel(&Config{NoProxy: true})
+	defer tun.Stop()
+
+	done := make(chan error, 1)
+	var dropped int64
+	go func() {
+		var err error
+		dropped, err = tun.runStreaming(exec.Command("sh", "-c", "sleep 30 & echo started"), "cmd_test")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if code, msg := exitStatus(context.Background(), err, time.Minute); code != 0 {
+			t.Errorf("exit status = %d (%s), want 0", code, msg)
+		}
+	case <-time.After(commandWaitDelay + 5*time.Second):
+		t.Fatal("runStreaming still waiting on the background process")
+	}
+	// Not connected, so nothing could be sent
+	if dropped == 0 {
+		t.Error("output that couldn't be sent wasn't counted as dropped")
+	}
+}
+
+func TestCancelCommand(t *testing.T) {
+	tun := NewTunnel(&Config{NoProxy: true})
+	defer tun.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun.mu.Lock()
+	tun.commands["cmd_test"] = cancel
+	tun.mu.Unlock()
+
+	tun.cancelCommand("cmd_other")
+	if ctx.Err() != nil {
+		t.Fatal("cancelling another command stopped this one")
+	}
+	tun.cancelCommand("cmd_test")
+	if ctx.Err() == nil {
+		t.Error("command wasn't cancelled")
+	}
+}
+
+// A tunnel the server closed for being idle waits a long while before
+// connecting again, instead of coming straight back to hold it open
+func TestIdleTimeoutStaysDisconnected(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	var connects atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		connects.Add(1)
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		for _, msg := range []interface{}{
+			AuthResultMessage{Type: MessageTypeAuthResult, Success: true, Subdomain: "idle"},
+			ErrorMessage{Type: MessageTypeError, Code: "idle_timeout", Message: "Tunnel closed after being idle"},
+		} {
+			data, _ := json.Marshal(msg)
+			conn.WriteMessage(websocket.TextMessage, data)
+		}
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	tun := NewTunnel(&Config{NoProxy: true, Server: "ws" + strings.TrimPrefix(server.URL, "http"), PingInterval: time.Minute})
+	done := make(chan error, 1)
+	go func() { done <- tun.Run() }()
+	defer func() {
+		tun.Stop()
+		<-done
+	}()
+
+	state := func() TunnelState {
+		tun.mu.Lock()
+		defer tun.mu.Unlock()
+		return tun.state
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for connects.Load() == 0 || state() != StateBackoff {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel never connected and backed off")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// An ordinary disconnect would be retried within about a second
+	time.Sleep(2 * time.Second)
+	if n := connects.Load(); n != 1 {
+		t.Errorf("connected %d times, want 1", n)
+	}
+}
@@ -1,12 +1,17 @@
 package cmd
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -21,20 +26,50 @@ This will download the latest binary and replace the current one.`,
 	RunE: runUpgrade,
 }
 
-var checkOnly bool
+var (
+	checkOnly      bool
+	upgradeRestart bool
+	upgradeJSON    bool
+)
 
 func init() {
 	upgradeCmd.Flags().BoolVar(&checkOnly, "check", false, "Only check for updates, don't install")
+	upgradeCmd.Flags().BoolVar(&upgradeRestart, "restart", false, "Restart the system service after upgrading")
+	upgradeCmd.Flags().BoolVar(&upgradeJSON, "json", false, "With --check, print the result as JSON")
 	rootCmd.AddCommand(upgradeCmd)
 }
 
 type VersionInfo struct {
-	Version     string `json:"version"`
-	ReleaseDate string `json:"release_date"`
-	Changelog   string `json:"changelog"`
+	Version     string                `json:"version"`
+	ReleaseDate string                `json:"release_date"`
+	Changelog   string                `json:"changelog"`
+	Binaries    map[string]BinaryInfo `json:"binaries"`
+}
+
+// BinaryInfo is the published checksum and signature for one arch's binary
+type BinaryInfo struct {
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature,omitempty"`
 }
 
+// ReleasePublicKey is the base64 Ed25519 key release binaries are signed
+// with. It's baked in at build time:
+//
+//	-ldflags "-X github.com/piportal/piportal-client/cmd.ReleasePublicKey=<key>"
+//
+// When set, upgrades must carry a valid signature. When empty (dev builds),
+// only the SHA-256 checksum is verified, with a warning. Release builds
+// refuse to build without it.
+var ReleasePublicKey = ""
+
 func runUpgrade(cmd *cobra.Command, args []string) error {
+	if upgradeJSON {
+		if !checkOnly {
+			return fmt.Errorf("--json is only supported with --check")
+		}
+		return printUpgradeCheckJSON()
+	}
+
 	fmt.Println()
 	fmt.Println("  PiPortal Upgrade")
 	fmt.Println("  ─────────────────────────────────────────")
@@ -96,6 +131,12 @@ func runUpgrade(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("download failed: %w", err)
 	}
 
+	// Verify before touching the installed binary
+	fmt.Println("  Verifying...")
+	if err := verifyBinary(newBinary, latest.Binaries[arch]); err != nil {
+		return fmt.Errorf("verification failed, upgrade aborted: %w", err)
+	}
+
 	// Get current executable path
 	execPath, err := os.Executable()
 	if err != nil {
@@ -111,13 +152,71 @@ func runUpgrade(cmd *cobra.Command, args []string) error {
 	fmt.Println()
 	fmt.Printf("  ✓ Upgraded to version %s!\n", latest.Version)
 	fmt.Println()
-	fmt.Println("  If running as a service, restart it:")
-	fmt.Println("    sudo systemctl restart piportal")
-	fmt.Println()
 
+	finishUpgrade()
 	return nil
 }
 
+// printUpgradeCheckJSON reports whether an update is available, as JSON
+func printUpgradeCheckJSON() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.ServerURL == "" {
+		return fmt.Errorf("no server configured - run 'piportal setup' first")
+	}
+
+	latest, err := getLatestVersion(cfg.ServerURL)
+	if err != nil {
+		return fmt.Errorf("failed to check for updates: %w", err)
+	}
+
+	return printJSON(map[string]interface{}{
+		"current_version":  Version,
+		"latest_version":   latest.Version,
+		"update_available": latest.Version != Version,
+		"release_date":     latest.ReleaseDate,
+		"changelog":        latest.Changelog,
+	})
+}
+
+// finishUpgrade restarts the system service if asked to, or explains how.
+// The running service keeps the old binary in memory until it restarts.
+func finishUpgrade() {
+	if !serviceInstalled() {
+		fmt.Println("  Restart any running 'piportal start' to use the new version.")
+		fmt.Println()
+		return
+	}
+
+	if !upgradeRestart {
+		fmt.Println("  The service is still running the old version. Restart it with:")
+		fmt.Println("    sudo piportal service restart")
+		fmt.Println()
+		fmt.Println("  (or upgrade with 'sudo piportal upgrade --restart' next time)")
+		fmt.Println()
+		return
+	}
+
+	if err := requireServicePrivileges("restart"); err != nil {
+		fmt.Println("  Restarting the service requires root privileges. Run:")
+		fmt.Println("    sudo piportal service restart")
+		fmt.Println()
+		return
+	}
+
+	fmt.Print("  Restarting service... ")
+	if err := restartService(); err != nil {
+		fmt.Println("✗")
+		fmt.Printf("  %v\n", err)
+		fmt.Println()
+		return
+	}
+	fmt.Println("✓")
+	fmt.Println()
+}
+
 func getLatestVersion(serverURL string) (*VersionInfo, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Get(serverURL + "/api/version")
@@ -170,6 +269,35 @@ func downloadBinary(url string) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
+// verifyBinary checks a downloaded binary against its published checksum
+// and, if a release key is pinned, its signature
+func verifyBinary(data []byte, info BinaryInfo) error {
+	if info.SHA256 == "" {
+		return fmt.Errorf("server did not publish a checksum for this binary")
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), info.SHA256) {
+		return fmt.Errorf("checksum mismatch: got %x, expected %s", sum, info.SHA256)
+	}
+
+	if ReleasePublicKey == "" {
+		fmt.Println("  Warning: this build has no release key pinned, so the download's signature isn't checked")
+		return nil
+	}
+	pub, err := base64.StdEncoding.DecodeString(ReleasePublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid release public key")
+	}
+	if info.Signature == "" {
+		return fmt.Errorf("server did not publish a signature for this binary")
+	}
+	sig, err := base64.StdEncoding.DecodeString(info.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
 func replaceBinary(path string, newBinary []byte) error {
 	// Write to temp file first
 	tmpPath := path + ".new"
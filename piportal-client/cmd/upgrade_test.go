@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBinary(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("piportal binary")
+	sum := sha256.Sum256(binary)
+	checksum := hex.EncodeToString(sum[:])
+	signed := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, binary))
+	pinned := base64.StdEncoding.EncodeToString(pub)
+
+	tests := []struct {
+		name    string
+		key     string // Pinned release key
+		info    BinaryInfo
+		wantErr string
+	}{
+		{"good signature", pinned, BinaryInfo{SHA256: checksum, Signature: signed}, ""},
+		{"checksum in upper case", pinned, BinaryInfo{SHA256: strings.ToUpper(checksum), Signature: signed}, ""},
+		{"checksum mismatch", pinned, BinaryInfo{SHA256: strings.Repeat("0", 64), Signature: signed}, "checksum mismatch"},
+		{"missing checksum", pinned, BinaryInfo{Signature: signed}, "did not publish a checksum"},
+		{"bad signature", pinned, BinaryInfo{SHA256: checksum, Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(otherPriv, binary))}, "invalid signature"},
+		{"missing signature", pinned, BinaryInfo{SHA256: checksum}, "did not publish a signature"},
+		{"no key pinned", "", BinaryInfo{SHA256: checksum}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := ReleasePublicKey
+			ReleasePublicKey = tt.key
+			t.Cleanup(func() { ReleasePublicKey = previous })
+
+			err := verifyBinary(binary, tt.info)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("err = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var whoamiCmd = &cobra.Command{
+	Use:     "whoami",
+	Aliases: []string{"account"},
+	Short:   "Show what the server knows about this device",
+	Long: `Ask the PiPortal server about this device: whether it's online and
+claimed, its tier, organization and whether its tunnel is enabled.
+
+Unlike 'piportal status', which reports local configuration, this is the
+control plane's view, authenticated with the device token.`,
+	RunE:         runWhoami,
+	SilenceUsage: true, // Server errors aren't usage errors
+}
+
+var whoamiJSON bool
+
+func init() {
+	whoamiCmd.Flags().BoolVar(&whoamiJSON, "json", false, "Print the server's response as JSON")
+	rootCmd.AddCommand(whoamiCmd)
+}
+
+// DeviceInfo is the server's view of this device, from /api/device/self
+type DeviceInfo struct {
+	ID            string `json:"id"`
+	Subdomain     string `json:"subdomain"`
+	URL           string `json:"url"`
+	Tier          string `json:"tier"`
+	Claimed       bool   `json:"claimed"`
+	OrgName       string `json:"org_name,omitempty"`
+	IsOnline      bool   `json:"is_online"`
+	TunnelEnabled bool   `json:"tunnel_enabled"`
+	Maintenance   bool   `json:"maintenance"`
+	CreatedAt     string `json:"created_at"`
+	LastSeenAt    string `json:"last_seen_at,omitempty"`
+}
+
+func runWhoami(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.Token == "" {
+		return fmt.Errorf("not configured - run 'piportal setup' first")
+	}
+	serverURL := serverBaseURL(cfg)
+	if serverURL == "" {
+		return fmt.Errorf("no server URL configured")
+	}
+
+	info, err := fetchDeviceInfo(serverURL, cfg.Token)
+	if err != nil {
+		return err
+	}
+	if whoamiJSON {
+		return printJSON(info)
+	}
+
+	fmt.Println()
+	fmt.Println("  PiPortal Device")
+	fmt.Println("  ─────────────────────────────────────────")
+	fmt.Println()
+	fmt.Printf("  Server:      %s\n", serverURL)
+	fmt.Printf("  Device ID:   %s\n", info.ID)
+	fmt.Printf("  Subdomain:   %s\n", info.Subdomain)
+	fmt.Printf("  Public URL:  %s\n", info.URL)
+	fmt.Printf("  Tier:        %s\n", info.Tier)
+	if info.Claimed {
+		fmt.Println("  Claimed:     yes")
+	} else {
+		fmt.Println("  Claimed:     no - link it to an account from the dashboard")
+	}
+	if info.OrgName != "" {
+		fmt.Printf("  Org:         %s\n", info.OrgName)
+	}
+	fmt.Println()
+	if info.IsOnline {
+		fmt.Println("  Online:      yes")
+	} else {
+		fmt.Println("  Online:      no")
+		if t, err := time.Parse(time.RFC3339, info.LastSeenAt); err == nil {
+			fmt.Printf("  Last seen:   %s ago\n", time.Since(t).Round(time.Second))
+		}
+	}
+	if info.TunnelEnabled {
+		fmt.Println("  Tunnel:      enabled")
+	} else {
+		fmt.Println("  Tunnel:      disabled in the dashboard")
+	}
+	if info.Maintenance {
+		fmt.Println("  Maintenance: on - visitors see a maintenance page")
+	}
+	fmt.Println()
+	return nil
+}
+
+// fetchDeviceInfo asks the server about the device the token belongs to
+func fetchDeviceInfo(serverURL, token string) (*DeviceInfo, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("GET", serverURL+"/api/device/self", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("the server doesn't recognize this device's token")
+	default:
+		return nil, fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+
+	var info DeviceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("invalid response from server")
+	}
+	return &info, nil
+}
@@ -9,6 +9,7 @@ import SignupPage from './pages/SignupPage';
 import DashboardPage from './pages/DashboardPage';
 import DeviceDetailPage from './pages/DeviceDetailPage';
 import AddDevicePage from './pages/AddDevicePage';
+import SessionsPage from './pages/SessionsPage';
 
 function AuthProvider({ children }: { children: React.ReactNode }) {
   const [user, setUser] = useState<AuthUser | null>(null);
@@ -60,6 +61,9 @@ export default function App() {
             <Route path="add" element={
               <ProtectedRoute><AddDevicePage /></ProtectedRoute>
             } />
+            <Route path="sessions" element={
+              <ProtectedRoute><SessionsPage /></ProtectedRoute>
+            } />
           </Route>
           <Route path="*" element={<Navigate to="/dashboard" replace />} />
         </Routes>
@@ -1,15 +1,56 @@
 const BASE = '/api/v1';
 
-async function request<T>(path: string, options?: RequestInit): Promise<T> {
+// ErrorBody is a failed API response: error is { code, message }, or a
+// plain string from endpoints outside the JSON API and older servers
+interface ErrorBody {
+  error?: { code: string; message: string } | string;
+  upgrade?: boolean;
+}
+
+// ApiError carries the server's machine-readable error code (e.g.
+// 'device_limit', 'subdomain_taken') alongside the message
+export class ApiError extends Error {
+  code?: string;
+  upgrade?: boolean;
+
+  constructor(body: ErrorBody, status: number) {
+    const err = body.error;
+    super((typeof err === 'string' ? err : err?.message) || `Request failed: ${status}`);
+    this.code = typeof err === 'string' ? undefined : err?.code;
+    this.upgrade = body.upgrade;
+  }
+}
+
+// Access tokens are short-lived. One refresh is shared by every request
+// that got a 401 at the same time, since each refresh token works only once.
+let refreshing: Promise<boolean> | null = null;
+
+export function refreshSession(): Promise<boolean> {
+  if (!refreshing) {
+    refreshing = fetch(`${BASE}/refresh`, { method: 'POST', credentials: 'include' })
+      .then(res => res.ok)
+      .catch(() => false)
+      .finally(() => { refreshing = null; });
+  }
+  return refreshing;
+}
+
+const noRefreshPaths = ['/login', '/signup', '/logout', '/refresh'];
+
+async function request<T>(path: string, options?: RequestInit, retried = false): Promise<T> {
   const res = await fetch(`${BASE}${path}`, {
     headers: { 'Content-Type': 'application/json' },
     credentials: 'include',
     ...options,
   });
 
+  if (res.status === 401 && !retried && !noRefreshPaths.includes(path) && await refreshSession()) {
+    return request<T>(path, options, true);
+  }
+
   if (!res.ok) {
     const body = await res.json().catch(() => ({ error: res.statusText }));
-    throw new Error(body.error || `Request failed: ${res.status}`);
+    throw new ApiError(body, res.status);
   }
 
   return res.json();
@@ -26,6 +67,95 @@ export interface OrgInfo {
   id: string;
   name: string;
   created_at: string;
+  bandwidth_limit?: number;
+}
+
+export interface FleetCounts {
+  devices: number;
+  online: number;
+  offline: number;
+  over_bandwidth: number;
+  avg_cpu_temp?: number;
+  bytes_total: number;
+  terminal_sessions: number;
+  in_flight_requests: number;
+}
+
+export interface OrgFleetCounts extends FleetCounts {
+  org_id: string;
+  org_name: string;
+  bandwidth_limit?: number;
+  over_org_limit: boolean;
+}
+
+export interface FleetSummary {
+  month: string;
+  overall: FleetCounts;
+  orgs: OrgFleetCounts[];
+  unassigned: FleetCounts;
+}
+
+// DeviceSessions is what's open on a device right now
+export interface DeviceSessions {
+  online: boolean;
+  tunnel: {
+    connected_at: string;
+    client_version?: string;
+    in_flight_requests: number;
+    monitoring_only: boolean;
+  } | null;
+  terminals: { id: string; user: string; opened_at: string; recording: boolean; detached: boolean }[];
+}
+
+export interface ClientVersions {
+  latest: string;
+  versions: { version: string; devices: number; outdated: boolean }[];
+  outdated: number;
+}
+
+export interface MaintenanceMode {
+  enabled: boolean;
+  message?: string;
+}
+
+export interface ResponseCache {
+  enabled: boolean;
+  max_entry_size: number;
+  max_size: number;
+  stats?: {
+    entries: number;
+    bytes: number;
+    hits: number;
+    misses: number;
+  };
+}
+
+export interface RateLimit {
+  requests_per_second: number;
+  burst: number;
+  per_ip: boolean;
+}
+
+// AgentSettings are client settings pushed to the device when it connects.
+// They can restrict commands but never enable them; that's up to the device.
+export interface AgentSettings {
+  ping_interval?: number; // Seconds (0 = the device's own)
+  metrics_interval?: number; // Seconds (0 = with every ping)
+  exec_allowlist?: string[];
+  exec_dry_run_only?: boolean;
+}
+
+// Quota is what's left of an exec (commands per hour) or terminal (seconds
+// per day) quota, the tighter of the device's and its owner's
+export interface Quota {
+  limit: number;
+  used: number;
+  remaining: number;
+  resets_at: string;
+}
+
+export interface DebugSettings {
+  timing_headers: boolean; // Add upstream/tunnel timing headers to responses
 }
 
 export interface DeviceInfo {
@@ -35,12 +165,19 @@ export interface DeviceInfo {
   tier: string;
   is_online: boolean;
   tunnel_enabled: boolean;
+  suspended?: boolean; // Held for abuse review by an administrator
+  maintenance?: MaintenanceMode;
+  rate_limit?: RateLimit;
+  agent_settings?: AgentSettings;
+  response_cache?: ResponseCache;
+  debug?: DebugSettings;
   created_at: string;
   last_seen_at?: string;
   bytes_in: number;
   bytes_out: number;
   bytes_total: number;
   limit: number;
+  bandwidth_warning?: boolean;
   org_id?: string;
   org_name?: string;
   cpu_temp?: number;
@@ -50,6 +187,33 @@ export interface DeviceInfo {
   disk_free?: number;
   uptime?: number;
   load_avg?: number;
+  latency_ms?: number; // Round trip of the server's latest ping
+  quotas?: { exec?: Quota; terminal?: Quota }; // Only quotas with a limit
+  client_version?: string;
+  update_available?: boolean; // Client is older than the latest release
+  latest_client_version?: string;
+  notes?: string; // What the owner has noted about the device
+  metadata?: Record<string, string>; // e.g. location or serial number
+}
+
+// DeviceMetrics is a device's system metrics as last reported
+export interface DeviceMetrics {
+  cpu_temp: number;
+  mem_total: number;
+  mem_free: number;
+  disk_total: number;
+  disk_free: number;
+  uptime: number;
+  load_avg: number;
+}
+
+// LiveEvent is one message from the /api/v1/events WebSocket
+export interface LiveEvent {
+  type: 'device.online' | 'device.offline' | 'device.metrics';
+  device_id: string;
+  subdomain: string;
+  time: string;
+  metrics?: DeviceMetrics;
 }
 
 export interface AuthResponse {
@@ -58,6 +222,23 @@ export interface AuthResponse {
   token: string;
 }
 
+export interface SessionInfo {
+  id: string;
+  user_agent: string;
+  ip: string;
+  created_at: string;
+  last_used_at: string;
+  expires_at: string;
+  current: boolean;
+}
+
+export interface SubdomainAvailability {
+  name: string;
+  available: boolean;
+  reason?: string;
+  code?: string; // subdomain_taken or subdomain_invalid
+}
+
 export interface CreateDeviceResponse {
   success: boolean;
   id: string;
@@ -79,6 +260,7 @@ export interface CommandResult {
   exit_code: number;
   output: string;
   error: string;
+  dry_run_enforced?: boolean;
 }
 
 export interface RunCommandResponse {
@@ -103,11 +285,27 @@ export const api = {
 
   me: () => request<UserInfo>('/me'),
 
+  listSessions: () => request<SessionInfo[]>('/sessions'),
+
+  revokeSession: (id: string) =>
+    request<{ success: boolean }>(`/sessions/${id}`, { method: 'DELETE' }),
+
+  revokeOtherSessions: () =>
+    request<{ success: boolean; revoked: number }>('/sessions', { method: 'DELETE' }),
+
   listDevices: (orgId?: string) =>
     request<DeviceInfo[]>(orgId ? `/devices?org_id=${orgId}` : '/devices'),
 
   getDevice: (id: string) => request<DeviceInfo>(`/devices/${id}`),
 
+  // Outside /api/v1: the setup wizard calls it before the user has an account
+  checkSubdomain: async (name: string): Promise<SubdomainAvailability> => {
+    const res = await fetch(`/api/subdomain/available?name=${encodeURIComponent(name)}`);
+    const body = await res.json().catch(() => ({ error: res.statusText }));
+    if (!res.ok) throw new ApiError(body, res.status);
+    return body;
+  },
+
   createDevice: (subdomain: string) =>
     request<CreateDeviceResponse>('/devices', {
       method: 'POST',
@@ -120,11 +318,76 @@ export const api = {
       body: JSON.stringify({ token }),
     }),
 
-  deleteDevice: (id: string) =>
-    request<{ success: boolean }>(`/devices/${id}`, { method: 'DELETE' }),
+  claimDeviceByCode: (code: string) =>
+    request<ClaimResponse>('/devices/claim-code', {
+      method: 'POST',
+      body: JSON.stringify({ code }),
+    }),
+
+  deleteDevice: (id: string, confirm: string) =>
+    request<{ success: boolean }>(`/devices/${id}`, {
+      method: 'DELETE',
+      body: JSON.stringify({ confirm }),
+    }),
+
+  rotateToken: (id: string) =>
+    request<{ success: boolean; token: string; subdomain: string; disconnected: boolean }>(`/devices/${id}/rotate-token`, { method: 'POST' }),
+
+  reconnectDevice: (id: string) =>
+    request<{ success: boolean }>(`/devices/${id}/reconnect`, { method: 'POST' }),
+  // Asks the device for metrics now instead of waiting for its next ping
+  refreshMetrics: (id: string) =>
+    request<DeviceMetrics>(`/devices/${id}/metrics/refresh`, { method: 'POST' }),
 
-  rebootDevice: (id: string) =>
-    request<{ success: boolean }>(`/devices/${id}/reboot`, { method: 'POST' }),
+  deviceSessions: (id: string) => request<DeviceSessions>(`/devices/${id}/sessions`),
+
+  closeDeviceSession: (id: string, sessionId: string) =>
+    request<{ success: boolean }>(`/devices/${id}/sessions/${sessionId}`, { method: 'DELETE' }),
+
+  setMaintenance: (id: string, enabled: boolean, message: string) =>
+    request<{ success: boolean; maintenance: MaintenanceMode }>(`/devices/${id}/maintenance`, {
+      method: 'PUT',
+      body: JSON.stringify({ enabled, message }),
+    }),
+
+  setAgentSettings: (id: string, settings: AgentSettings) =>
+    request<{ success: boolean; settings: AgentSettings; reconnect_needed: boolean }>(`/devices/${id}/agent-settings`, {
+      method: 'PUT',
+      body: JSON.stringify(settings),
+    }),
+
+  setDeviceNotes: (id: string, notes: string, metadata: Record<string, string>) =>
+    request<{ success: boolean; notes: string; metadata: Record<string, string> }>(`/devices/${id}/notes`, {
+      method: 'PUT',
+      body: JSON.stringify({ notes, metadata }),
+    }),
+
+  setRateLimit: (id: string, limit: RateLimit) =>
+    request<{ success: boolean; rate_limit: RateLimit }>(`/devices/${id}/ratelimit`, {
+      method: 'PUT',
+      body: JSON.stringify(limit),
+    }),
+
+  setResponseCache: (id: string, enabled: boolean) =>
+    request<{ success: boolean; response_cache: ResponseCache }>(`/devices/${id}/cache`, {
+      method: 'PUT',
+      body: JSON.stringify({ enabled }),
+    }),
+
+  setDebug: (id: string, debug: DebugSettings) =>
+    request<{ success: boolean; debug: DebugSettings }>(`/devices/${id}/debug`, {
+      method: 'PUT',
+      body: JSON.stringify(debug),
+    }),
+
+  purgeResponseCache: (id: string) =>
+    request<{ success: boolean }>(`/devices/${id}/cache`, { method: 'DELETE' }),
+
+  rebootDevice: (id: string, confirm: string) =>
+    request<{ success: boolean }>(`/devices/${id}/reboot`, {
+      method: 'POST',
+      body: JSON.stringify({ confirm }),
+    }),
 
   setTunnelEnabled: (id: string, enabled: boolean) =>
     request<{ success: boolean; tunnel_enabled: boolean }>(`/devices/${id}/tunnel`, {
@@ -140,6 +403,10 @@ export const api = {
 
   listOrgs: () => request<OrgInfo[]>('/organizations'),
 
+  fleetSummary: () => request<FleetSummary>('/fleet/summary'),
+
+  clientVersions: () => request<ClientVersions>('/fleet/versions'),
+
   createOrg: (name: string) =>
     request<OrgInfo>('/organizations', {
       method: 'POST',
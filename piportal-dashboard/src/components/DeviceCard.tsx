@@ -30,6 +30,9 @@ export default function DeviceCard({ device }: { device: DeviceInfo }) {
         {device.is_online && !device.tunnel_enabled && (
           <span className="forwarding-off">Forwarding off</span>
         )}
+        {device.update_available && (
+          <span className="forwarding-off" title={`Running client ${device.client_version}`}>Update available</span>
+        )}
       </div>
       {hasMetrics && (
         <div className="device-card-metrics">
@@ -104,6 +104,10 @@ export default function Layout() {
             <span className="sidebar-nav-icon">+</span>
             Add Device
           </Link>
+          <Link to="/dashboard/sessions" className={isActive('/dashboard/sessions') ? 'active' : ''}>
+            <span className="sidebar-nav-icon">⚿</span>
+            Sessions
+          </Link>
         </nav>
 
         <div className="sidebar-orgs">
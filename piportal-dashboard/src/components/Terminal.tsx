@@ -14,6 +14,7 @@ export default function Terminal({ deviceId, onDisconnect }: TerminalProps) {
   const xtermRef = useRef<XTerm | null>(null);
   const fitRef = useRef<FitAddon | null>(null);
   const [status, setStatus] = useState<'connecting' | 'connected' | 'disconnected'>('connecting');
+  const [reconnecting, setReconnecting] = useState(false);
 
   useEffect(() => {
     if (!termRef.current) return;
@@ -56,55 +57,87 @@ export default function Terminal({ deviceId, onDisconnect }: TerminalProps) {
 
     xterm.writeln('\x1b[1;34mConnecting to device...\x1b[0m');
 
-    // Build WebSocket URL
+    // The server keeps the shell running for a while after the connection
+    // drops, so a reconnect (or a reload) can pick the same session back up
+    const sessionKey = `terminal-session-${deviceId}`;
     const proto = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const wsUrl = `${proto}//${window.location.host}/api/v1/devices/${deviceId}/terminal`;
-
-    const ws = new WebSocket(wsUrl);
-    wsRef.current = ws;
-
-    ws.onopen = () => {
-      // Send initial size
-      const dims = fitAddon.proposeDimensions();
-      ws.send(JSON.stringify({
-        rows: dims?.rows ?? 24,
-        cols: dims?.cols ?? 80,
-      }));
-      setStatus('connected');
-      xterm.writeln('\x1b[1;32mConnected.\x1b[0m\r\n');
-      xterm.focus();
-    };
-
-    ws.onmessage = (event) => {
-      try {
-        const msg = JSON.parse(event.data);
-        if (msg.type === 'terminal_data' && msg.data_base64) {
-          const bytes = Uint8Array.from(atob(msg.data_base64), c => c.charCodeAt(0));
-          xterm.write(bytes);
-        } else if (msg.type === 'terminal_close') {
-          xterm.writeln('\r\n\x1b[1;31mSession closed.\x1b[0m');
-          setStatus('disconnected');
+    let ended = false; // Closed on purpose, or the session is over
+    let attempts = 0;
+    let retryTimer: ReturnType<typeof setTimeout> | undefined;
+
+    const connect = () => {
+      const sessionId = sessionStorage.getItem(sessionKey);
+      const query = sessionId ? `?session=${encodeURIComponent(sessionId)}` : '';
+      const ws = new WebSocket(`${proto}//${window.location.host}/api/v1/devices/${deviceId}/terminal${query}`);
+      wsRef.current = ws;
+
+      ws.onopen = () => {
+        // Send initial size
+        const dims = fitAddon.proposeDimensions();
+        ws.send(JSON.stringify({
+          rows: dims?.rows ?? 24,
+          cols: dims?.cols ?? 80,
+        }));
+        attempts = 0;
+        setReconnecting(false);
+        setStatus('connected');
+        xterm.focus();
+      };
+
+      ws.onmessage = (event) => {
+        try {
+          const msg = JSON.parse(event.data);
+          if (msg.type === 'terminal_session') {
+            // Same session: the device replays its recent output, so start
+            // from a clean screen rather than showing it twice
+            if (msg.session_id === sessionId) {
+              xterm.reset();
+            } else {
+              xterm.writeln('\x1b[1;32mConnected.\x1b[0m\r\n');
+            }
+            sessionStorage.setItem(sessionKey, msg.session_id);
+          } else if (msg.type === 'terminal_data' && msg.data_base64) {
+            const bytes = Uint8Array.from(atob(msg.data_base64), c => c.charCodeAt(0));
+            xterm.write(bytes);
+          } else if (msg.type === 'terminal_close') {
+            ended = true;
+            sessionStorage.removeItem(sessionKey);
+            xterm.writeln('\r\n\x1b[1;31mSession closed.\x1b[0m');
+            setStatus('disconnected');
+          }
+        } catch {
+          // ignore parse errors
         }
-      } catch {
-        // ignore parse errors
-      }
-    };
-
-    ws.onclose = () => {
-      if (status !== 'disconnected') {
-        xterm.writeln('\r\n\x1b[1;31mDisconnected.\x1b[0m');
+      };
+
+      ws.onclose = (event) => {
+        if (ended) return;
+        // Normal closure and try-again-later are the server ending the session
+        // on purpose (idle, quota, too many terminals); anything else is a
+        // dropped connection worth retrying
+        const dropped = event.code !== 1000 && event.code !== 1013;
+        if (dropped && attempts < 5) {
+          const delay = 1000 * 2 ** attempts++;
+          setReconnecting(true);
+          setStatus('connecting');
+          retryTimer = setTimeout(connect, delay);
+          return;
+        }
+        ended = true;
+        sessionStorage.removeItem(sessionKey);
+        // The server gives a reason when it ends the session, e.g. a used up quota
+        const reason = event.reason ? ` (${event.reason})` : '';
+        xterm.writeln(`\r\n\x1b[1;31mDisconnected${reason}.\x1b[0m`);
+        setReconnecting(false);
         setStatus('disconnected');
-      }
-    };
-
-    ws.onerror = () => {
-      xterm.writeln('\r\n\x1b[1;31mConnection error.\x1b[0m');
-      setStatus('disconnected');
+      };
     };
+    connect();
 
     // Send terminal input to server
     const inputDisposable = xterm.onData((data: string) => {
-      if (ws.readyState === WebSocket.OPEN) {
+      const ws = wsRef.current;
+      if (ws && ws.readyState === WebSocket.OPEN) {
         ws.send(JSON.stringify({ data }));
       }
     });
@@ -113,7 +146,8 @@ export default function Terminal({ deviceId, onDisconnect }: TerminalProps) {
     const handleResize = () => {
       fitAddon.fit();
       const dims = fitAddon.proposeDimensions();
-      if (dims && ws.readyState === WebSocket.OPEN) {
+      const ws = wsRef.current;
+      if (dims && ws && ws.readyState === WebSocket.OPEN) {
         ws.send(JSON.stringify({
           type: 'resize',
           rows: dims.rows,
@@ -128,7 +162,11 @@ export default function Terminal({ deviceId, onDisconnect }: TerminalProps) {
     return () => {
       inputDisposable.dispose();
       resizeObserver.disconnect();
-      ws.close();
+      // Leaving the terminal ends the session rather than parking it
+      ended = true;
+      clearTimeout(retryTimer);
+      sessionStorage.removeItem(sessionKey);
+      wsRef.current?.close(1000);
       xterm.dispose();
       wsRef.current = null;
       xtermRef.current = null;
@@ -143,7 +181,7 @@ export default function Terminal({ deviceId, onDisconnect }: TerminalProps) {
           <span className={`terminal-dot terminal-dot-${status}`} />
           Terminal
           <span className="terminal-status">
-            {status === 'connecting' && 'Connecting...'}
+            {status === 'connecting' && (reconnecting ? 'Reconnecting...' : 'Connecting...')}
             {status === 'connected' && 'Connected'}
             {status === 'disconnected' && 'Disconnected'}
           </span>
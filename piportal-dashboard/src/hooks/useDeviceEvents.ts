@@ -0,0 +1,75 @@
+import { useEffect, useRef } from 'react';
+import { refreshSession, type DeviceInfo, type LiveEvent } from '../api';
+
+// useDeviceEvents subscribes to the server's live device feed
+// (/api/v1/events) and calls onEvent for each status change or metrics
+// update, reconnecting with backoff if the socket drops
+export function useDeviceEvents(onEvent: (event: LiveEvent) => void) {
+  const handler = useRef(onEvent);
+  handler.current = onEvent;
+
+  useEffect(() => {
+    let ws: WebSocket | null = null;
+    let retry: ReturnType<typeof setTimeout> | undefined;
+    let delay = 1000;
+    let stopped = false;
+
+    const connect = () => {
+      let opened = false;
+      const proto = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+      ws = new WebSocket(`${proto}//${window.location.host}/api/v1/events`);
+      ws.onopen = () => {
+        opened = true;
+        delay = 1000;
+      };
+      ws.onmessage = (msg) => {
+        try {
+          handler.current(JSON.parse(msg.data));
+        } catch {
+          // Ignore anything that isn't an event
+        }
+      };
+      ws.onclose = () => {
+        if (stopped) return;
+        // A refused handshake is usually an expired access token
+        if (!opened) refreshSession();
+        retry = setTimeout(connect, delay);
+        delay = Math.min(delay * 2, 30000);
+      };
+    };
+
+    connect();
+    return () => {
+      stopped = true;
+      clearTimeout(retry);
+      ws?.close();
+    };
+  }, []);
+}
+
+// applyLiveEvent returns the device updated with a live event, or the same
+// device if the event is for another one
+export function applyLiveEvent<T extends DeviceInfo>(device: T, event: LiveEvent): T {
+  if (device.id !== event.device_id) return device;
+  switch (event.type) {
+    case 'device.online':
+      return { ...device, is_online: true, last_seen_at: event.time };
+    case 'device.offline':
+      return { ...device, is_online: false, last_seen_at: event.time };
+    case 'device.metrics': {
+      const m = event.metrics;
+      if (!m) return device;
+      return {
+        ...device,
+        cpu_temp: m.cpu_temp,
+        mem_total: m.mem_total,
+        mem_free: m.mem_free,
+        disk_total: m.disk_total,
+        disk_free: m.disk_free,
+        uptime: m.uptime,
+        load_avg: m.load_avg,
+      };
+    }
+  }
+  return device;
+}
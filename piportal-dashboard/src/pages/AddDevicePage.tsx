@@ -1,6 +1,6 @@
-import { useState, type FormEvent } from 'react';
+import { useEffect, useState, type FormEvent } from 'react';
 import { useNavigate } from 'react-router-dom';
-import { api } from '../api';
+import { api, ApiError, type SubdomainAvailability } from '../api';
 
 export default function AddDevicePage() {
   const navigate = useNavigate();
@@ -9,23 +9,39 @@ export default function AddDevicePage() {
   // Create state
   const [subdomain, setSubdomain] = useState('');
   const [createError, setCreateError] = useState('');
+  const [needsUpgrade, setNeedsUpgrade] = useState(false);
   const [creating, setCreating] = useState(false);
   const [createdToken, setCreatedToken] = useState('');
+  const [availability, setAvailability] = useState<SubdomainAvailability | null>(null);
 
   // Claim state
   const [token, setToken] = useState('');
   const [claimError, setClaimError] = useState('');
   const [claiming, setClaiming] = useState(false);
 
+  // Check the name once the user pauses typing
+  useEffect(() => {
+    setAvailability(null);
+    if (subdomain.length < 3) return;
+    const timer = setTimeout(() => {
+      api.checkSubdomain(subdomain)
+        .then(res => setAvailability(res.name === subdomain ? res : null))
+        .catch(() => setAvailability(null)); // Creating will report the problem
+    }, 400);
+    return () => clearTimeout(timer);
+  }, [subdomain]);
+
   const handleCreate = async (e: FormEvent) => {
     e.preventDefault();
     setCreateError('');
+    setNeedsUpgrade(false);
     setCreating(true);
     try {
       const res = await api.createDevice(subdomain);
       setCreatedToken(res.token);
     } catch (err: any) {
       setCreateError(err.message);
+      setNeedsUpgrade(err instanceof ApiError && err.code === 'device_limit' && !!err.upgrade);
     } finally {
       setCreating(false);
     }
@@ -34,12 +50,18 @@ export default function AddDevicePage() {
   const handleClaim = async (e: FormEvent) => {
     e.preventDefault();
     setClaimError('');
+    setNeedsUpgrade(false);
     setClaiming(true);
     try {
-      const res = await api.claimDevice(token);
+      // Accept either the full token or the short code 'piportal setup' prints
+      const value = token.trim();
+      const res = value.startsWith('pp_')
+        ? await api.claimDevice(value)
+        : await api.claimDeviceByCode(value);
       navigate(`/dashboard/devices/${res.id}`);
     } catch (err: any) {
       setClaimError(err.message);
+      setNeedsUpgrade(err instanceof ApiError && err.code === 'device_limit' && !!err.upgrade);
     } finally {
       setClaiming(false);
     }
@@ -66,6 +88,16 @@ export default function AddDevicePage() {
     <div className="add-page">
       <h1>Add Device</h1>
 
+      {needsUpgrade && (
+        <div className="success-box">
+          <p><strong>Need more devices?</strong> Pro is a flat rate per device, with more bandwidth and longer timeouts.</p>
+          <p>Upgrade one of your existing devices to Pro, then add this one on the free plan.</p>
+          <button onClick={() => navigate('/dashboard')} className="btn">
+            View My Devices
+          </button>
+        </div>
+      )}
+
       <div className="tabs">
         <button
           className={`tab ${tab === 'create' ? 'tab-active' : ''}`}
@@ -92,14 +124,21 @@ export default function AddDevicePage() {
                 value={subdomain}
                 onChange={e => setSubdomain(e.target.value.toLowerCase())}
                 required
-                pattern="[a-z0-9][a-z0-9-]{1,28}[a-z0-9]"
+                pattern="[a-z0-9]+(-[a-z0-9]+)*"
+                minLength={3}
+                maxLength={30}
                 placeholder="my-pi"
                 autoFocus
               />
               <span className="subdomain-suffix">.{window.location.hostname}</span>
             </div>
           </label>
-          <button type="submit" className="btn" disabled={creating}>
+          {availability && (
+            <p className="form-hint">
+              {availability.available ? `✓ ${availability.name} is available` : `✗ ${availability.reason}`}
+            </p>
+          )}
+          <button type="submit" className="btn" disabled={creating || availability?.available === false}>
             {creating ? 'Creating...' : 'Create Device'}
           </button>
         </form>
@@ -107,18 +146,18 @@ export default function AddDevicePage() {
         <form onSubmit={handleClaim} className="auth-form">
           {claimError && <div className="error-msg">{claimError}</div>}
           <label>
-            Device Token
+            Claim Code or Device Token
             <input
               type="text"
               value={token}
               onChange={e => setToken(e.target.value)}
               required
-              placeholder="pp_..."
+              placeholder="ABCD-EFGH or pp_..."
               autoFocus
             />
           </label>
           <p className="form-hint">
-            Enter the token from <code>piportal setup</code> to link an existing device to your account.
+            Enter the claim code (or token) from <code>piportal setup</code> to link an existing device to your account.
           </p>
           <button type="submit" className="btn" disabled={claiming}>
             {claiming ? 'Claiming...' : 'Claim Device'}
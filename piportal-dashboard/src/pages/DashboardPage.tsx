@@ -1,14 +1,25 @@
 import { useEffect, useState } from 'react';
 import { Link, useSearchParams } from 'react-router-dom';
-import { api, type DeviceInfo, type OrgInfo, type CommandResult } from '../api';
+import { api, type DeviceInfo, type OrgInfo, type CommandResult, type FleetCounts, type OrgFleetCounts } from '../api';
+import { useDeviceEvents, applyLiveEvent } from '../hooks/useDeviceEvents';
 import DeviceCard from '../components/DeviceCard';
 
+function formatBytes(bytes: number): string {
+  if (bytes === 0) return '0 B';
+  const k = 1024;
+  const sizes = ['B', 'KB', 'MB', 'GB', 'TB'];
+  const i = Math.floor(Math.log(bytes) / Math.log(k));
+  return parseFloat((bytes / Math.pow(k, i)).toFixed(1)) + ' ' + sizes[i];
+}
+
 export default function DashboardPage() {
   const [searchParams] = useSearchParams();
   const orgId = searchParams.get('org_id');
 
   const [devices, setDevices] = useState<DeviceInfo[]>([]);
   const [orgName, setOrgName] = useState<string>('');
+  const [fleet, setFleet] = useState<FleetCounts | OrgFleetCounts | null>(null);
+  const [outdatedClients, setOutdatedClients] = useState(0);
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState('');
 
@@ -36,6 +47,15 @@ export default function DashboardPage() {
         } else {
           setOrgName('');
         }
+
+        // The summary is a nice-to-have; don't fail the page over it
+        const summary = await api.fleetSummary().catch(() => null);
+        const counts = orgId ? summary?.orgs.find(o => o.org_id === orgId) : summary?.overall;
+        setFleet(counts ?? null);
+
+        // Fleet-wide, so only meaningful on the unfiltered view
+        const versions = orgId ? null : await api.clientVersions().catch(() => null);
+        setOutdatedClients(versions?.outdated ?? 0);
       } catch (err: any) {
         setError(err.message);
       } finally {
@@ -46,6 +66,11 @@ export default function DashboardPage() {
     fetchData();
   }, [orgId]);
 
+  // Status and metrics arrive over the live feed instead of by polling
+  useDeviceEvents(event => {
+    setDevices(prev => prev.map(d => applyLiveEvent(d, event)));
+  });
+
   // Reset command panel when org changes
   useEffect(() => {
     setShowCommandPanel(false);
@@ -94,6 +119,56 @@ export default function DashboardPage() {
         </div>
       </div>
 
+      {fleet && fleet.devices > 0 && (
+        <div className="detail-section">
+          <div className="metrics-grid">
+            <div className="metric-item">
+              <div className="metric-value">{fleet.online} / {fleet.devices}</div>
+              <div className="metric-label">Online</div>
+            </div>
+            {'bandwidth_limit' in fleet && fleet.bandwidth_limit != null ? (
+              <div className="metric-item">
+                <div className="metric-value">
+                  {formatBytes(fleet.bytes_total)} / {formatBytes(fleet.bandwidth_limit)}
+                </div>
+                <div className="metric-label">
+                  {fleet.over_org_limit ? 'Tag bandwidth limit reached' : 'Tag bandwidth this month'}
+                </div>
+              </div>
+            ) : (
+              <div className="metric-item">
+                <div className="metric-value">{formatBytes(fleet.bytes_total)}</div>
+                <div className="metric-label">Bandwidth this month</div>
+              </div>
+            )}
+            {fleet.over_bandwidth > 0 && (
+              <div className="metric-item">
+                <div className="metric-value">{fleet.over_bandwidth}</div>
+                <div className="metric-label">Over bandwidth limit</div>
+              </div>
+            )}
+            {outdatedClients > 0 && (
+              <div className="metric-item">
+                <div className="metric-value">{outdatedClients}</div>
+                <div className="metric-label">Need client update</div>
+              </div>
+            )}
+            {fleet.terminal_sessions > 0 && (
+              <div className="metric-item">
+                <div className="metric-value">{fleet.terminal_sessions}</div>
+                <div className="metric-label">Open terminals</div>
+              </div>
+            )}
+            {fleet.avg_cpu_temp != null && (
+              <div className="metric-item">
+                <div className="metric-value">{fleet.avg_cpu_temp.toFixed(1)}&deg;C</div>
+                <div className="metric-label">Avg CPU Temp</div>
+              </div>
+            )}
+          </div>
+        </div>
+      )}
+
       {showCommandPanel && orgId && (
         <div className="command-panel">
           <div className="command-input-row">
@@ -146,6 +221,9 @@ export default function DashboardPage() {
                         exit {result.exit_code}
                       </span>
                     )}
+                    {result.dry_run_enforced && (
+                      <span className="badge badge-offline" title="The device only allows dry runs">dry run enforced</span>
+                    )}
                   </div>
                   {result.error && (
                     <div className="command-result-error">{result.error}</div>
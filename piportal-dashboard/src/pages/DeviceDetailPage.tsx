@@ -1,9 +1,10 @@
 import { useEffect, useState } from 'react';
 import { useParams, useNavigate } from 'react-router-dom';
-import { api, type DeviceInfo, type OrgInfo } from '../api';
+import { api, type AgentSettings, type DeviceInfo, type DeviceSessions, type OrgInfo, type RateLimit } from '../api';
 import StatusBadge from '../components/StatusBadge';
 import BandwidthBar from '../components/BandwidthBar';
 import Terminal from '../components/Terminal';
+import { useDeviceEvents, applyLiveEvent } from '../hooks/useDeviceEvents';
 
 function formatBytes(bytes: number): string {
   if (bytes === 0) return '0 B';
@@ -38,9 +39,27 @@ export default function DeviceDetailPage() {
   const [error, setError] = useState('');
   const [deleting, setDeleting] = useState(false);
   const [rebooting, setRebooting] = useState(false);
+  const [reconnecting, setReconnecting] = useState(false);
+  const [rotatingToken, setRotatingToken] = useState(false);
+  const [newToken, setNewToken] = useState('');
   const [togglingTunnel, setTogglingTunnel] = useState(false);
+  const [togglingMaintenance, setTogglingMaintenance] = useState(false);
+  const [maintenanceMessage, setMaintenanceMessage] = useState('');
+  const [rateLimit, setRateLimit] = useState<RateLimit>({ requests_per_second: 0, burst: 0, per_ip: false });
+  const [savingRateLimit, setSavingRateLimit] = useState(false);
+  const [agentSettings, setAgentSettings] = useState<AgentSettings>({});
+  const [agentAllowlist, setAgentAllowlist] = useState('');
+  const [savingAgentSettings, setSavingAgentSettings] = useState(false);
+  const [agentSettingsSaved, setAgentSettingsSaved] = useState('');
+  const [togglingCache, setTogglingCache] = useState(false);
+  const [togglingTiming, setTogglingTiming] = useState(false);
   const [changingOrg, setChangingOrg] = useState(false);
   const [terminalOpen, setTerminalOpen] = useState(false);
+  const [terminals, setTerminals] = useState<DeviceSessions['terminals']>([]);
+
+  useDeviceEvents(event => {
+    setDevice(prev => (prev ? applyLiveEvent(prev, event) : prev));
+  });
 
   useEffect(() => {
     if (!id) return;
@@ -50,17 +69,52 @@ export default function DeviceDetailPage() {
     ])
       .then(([deviceData, orgsData]) => {
         setDevice(deviceData);
+        if (deviceData.rate_limit) setRateLimit(deviceData.rate_limit);
+        if (deviceData.agent_settings) {
+          setAgentSettings(deviceData.agent_settings);
+          setAgentAllowlist((deviceData.agent_settings.exec_allowlist || []).join('\n'));
+        }
         setOrgs(orgsData);
+        // The stored metrics can be a ping interval old; fetch current ones.
+        // Older clients don't answer, which just leaves the stored ones.
+        if (deviceData.is_online) {
+          api.refreshMetrics(deviceData.id)
+            .then(m => setDevice(prev => (prev ? { ...prev, ...m } : prev)))
+            .catch(() => {});
+        }
       })
       .catch(err => setError(err.message))
       .finally(() => setLoading(false));
   }, [id]);
 
+  // Open terminals, including other people's and other tabs'
+  const loadTerminals = () => {
+    if (!id) return;
+    api.deviceSessions(id)
+      .then(s => setTerminals(s.terminals))
+      .catch(() => {});
+  };
+
+  useEffect(loadTerminals, [id, terminalOpen, device?.is_online]);
+
+  const handleEndSession = async (sessionId: string) => {
+    if (!device) return;
+    if (!confirm(`End terminal session ${sessionId}? Its shell on ${device.subdomain} is killed.`)) return;
+    try {
+      await api.closeDeviceSession(device.id, sessionId);
+    } catch (err: any) {
+      setError(err.message);
+    }
+    loadTerminals();
+  };
+
   const handleDelete = async () => {
-    if (!device || !confirm(`Delete ${device.subdomain}? This cannot be undone.`)) return;
+    if (!device) return;
+    const typed = prompt(`Delete ${device.subdomain}? This cannot be undone.\n\nType the subdomain to confirm:`);
+    if (typed === null) return;
     setDeleting(true);
     try {
-      await api.deleteDevice(device.id);
+      await api.deleteDevice(device.id, typed);
       navigate('/dashboard');
     } catch (err: any) {
       setError(err.message);
@@ -69,16 +123,42 @@ export default function DeviceDetailPage() {
   };
 
   const handleReboot = async () => {
-    if (!device || !confirm(`Reboot ${device.subdomain}? The device will go offline briefly.`)) return;
+    if (!device) return;
+    const typed = prompt(`Reboot ${device.subdomain}? The device will go offline briefly.\n\nType the subdomain to confirm:`);
+    if (typed === null) return;
     setRebooting(true);
     try {
-      await api.rebootDevice(device.id);
+      await api.rebootDevice(device.id, typed);
     } catch (err: any) {
       setError(err.message);
     }
     setRebooting(false);
   };
 
+  const handleReconnect = async () => {
+    if (!device) return;
+    setReconnecting(true);
+    try {
+      await api.reconnectDevice(device.id);
+    } catch (err: any) {
+      setError(err.message);
+    }
+    setReconnecting(false);
+  };
+
+  const handleRotateToken = async () => {
+    if (!device) return;
+    if (!confirm(`Rotate the token for ${device.subdomain}? The old token stops working immediately and the device disconnects until you give it the new one.`)) return;
+    setRotatingToken(true);
+    try {
+      const res = await api.rotateToken(device.id);
+      setNewToken(res.token);
+    } catch (err: any) {
+      setError(err.message);
+    }
+    setRotatingToken(false);
+  };
+
   const handleToggleTunnel = async () => {
     if (!device) return;
     setTogglingTunnel(true);
@@ -91,6 +171,86 @@ export default function DeviceDetailPage() {
     setTogglingTunnel(false);
   };
 
+  const handleToggleMaintenance = async () => {
+    if (!device) return;
+    setTogglingMaintenance(true);
+    try {
+      const res = await api.setMaintenance(device.id, !device.maintenance?.enabled, maintenanceMessage);
+      setDevice({ ...device, maintenance: res.maintenance });
+      setMaintenanceMessage('');
+    } catch (err: any) {
+      setError(err.message);
+    }
+    setTogglingMaintenance(false);
+  };
+
+  const handleSaveRateLimit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    if (!device) return;
+    setSavingRateLimit(true);
+    try {
+      const res = await api.setRateLimit(device.id, rateLimit);
+      setRateLimit(res.rate_limit);
+      setDevice({ ...device, rate_limit: res.rate_limit });
+    } catch (err: any) {
+      setError(err.message);
+    }
+    setSavingRateLimit(false);
+  };
+
+  const handleSaveAgentSettings = async (e: React.FormEvent) => {
+    e.preventDefault();
+    if (!device) return;
+    setSavingAgentSettings(true);
+    setAgentSettingsSaved('');
+    try {
+      const exec_allowlist = agentAllowlist.split('\n').map(line => line.trim()).filter(Boolean);
+      const res = await api.setAgentSettings(device.id, { ...agentSettings, exec_allowlist });
+      setAgentSettings(res.settings);
+      setAgentAllowlist((res.settings.exec_allowlist || []).join('\n'));
+      setDevice({ ...device, agent_settings: res.settings });
+      setAgentSettingsSaved(res.reconnect_needed ? 'Saved. Reconnect the device to apply them now.' : 'Saved.');
+    } catch (err: any) {
+      setError(err.message);
+    }
+    setSavingAgentSettings(false);
+  };
+
+  const handleToggleCache = async () => {
+    if (!device) return;
+    setTogglingCache(true);
+    try {
+      const res = await api.setResponseCache(device.id, !device.response_cache?.enabled);
+      setDevice({ ...device, response_cache: res.response_cache });
+    } catch (err: any) {
+      setError(err.message);
+    }
+    setTogglingCache(false);
+  };
+
+  const handleToggleTiming = async () => {
+    if (!device) return;
+    setTogglingTiming(true);
+    try {
+      const res = await api.setDebug(device.id, { timing_headers: !device.debug?.timing_headers });
+      setDevice({ ...device, debug: res.debug });
+    } catch (err: any) {
+      setError(err.message);
+    }
+    setTogglingTiming(false);
+  };
+
+  const handlePurgeCache = async () => {
+    if (!device?.response_cache) return;
+    try {
+      await api.purgeResponseCache(device.id);
+      const stats = device.response_cache.stats && { ...device.response_cache.stats, entries: 0, bytes: 0 };
+      setDevice({ ...device, response_cache: { ...device.response_cache, stats } });
+    } catch (err: any) {
+      setError(err.message);
+    }
+  };
+
   const handleOrgChange = async (e: React.ChangeEvent<HTMLSelectElement>) => {
     if (!device) return;
     const newOrgId = e.target.value || null;
@@ -152,6 +312,19 @@ export default function DeviceDetailPage() {
                 <dd>{new Date(device.last_seen_at).toLocaleString()}</dd>
               </>
             )}
+            {device.client_version && (
+              <>
+                <dt>Client</dt>
+                <dd>
+                  {device.client_version}
+                  {device.update_available && (
+                    <span className="forwarding-off">
+                      {device.latest_client_version} available, run 'piportal upgrade' on the device
+                    </span>
+                  )}
+                </dd>
+              </>
+            )}
           </dl>
         </div>
 
@@ -176,6 +349,187 @@ export default function DeviceDetailPage() {
               {togglingTunnel ? 'Updating...' : device.tunnel_enabled ? 'Disable Tunnel' : 'Enable Tunnel'}
             </button>
           </div>
+          {device.suspended && (
+            <p className="form-hint">
+              This tunnel is suspended pending an abuse review. Visitors see a 403 until an administrator clears it.
+            </p>
+          )}
+        </div>
+
+        <div className="detail-section">
+          <h2>Rate Limit</h2>
+          <p className="tunnel-toggle-hint">
+            Visitors over the limit get a 429 before anything reaches your device. Set 0 to turn it off.
+          </p>
+          <form onSubmit={handleSaveRateLimit} style={{ display: 'flex', gap: '12px', alignItems: 'center', flexWrap: 'wrap' }}>
+            <label>
+              Requests/sec{' '}
+              <input
+                type="number"
+                min={0}
+                step="any"
+                value={rateLimit.requests_per_second}
+                onChange={e => setRateLimit({ ...rateLimit, requests_per_second: Number(e.target.value) })}
+              />
+            </label>
+            <label>
+              Burst{' '}
+              <input
+                type="number"
+                min={0}
+                value={rateLimit.burst}
+                onChange={e => setRateLimit({ ...rateLimit, burst: Number(e.target.value) })}
+              />
+            </label>
+            <label>
+              <input
+                type="checkbox"
+                checked={rateLimit.per_ip}
+                onChange={e => setRateLimit({ ...rateLimit, per_ip: e.target.checked })}
+              />{' '}
+              Per visitor IP
+            </label>
+            <button type="submit" className="btn btn-secondary" disabled={savingRateLimit}>
+              {savingRateLimit ? 'Saving...' : 'Save'}
+            </button>
+          </form>
+        </div>
+
+        <div className="detail-section">
+          <h2>Agent Settings</h2>
+          <p className="tunnel-toggle-hint">
+            Sent to the device each time it connects, in place of its own config. They can restrict commands but
+            never enable them: remote commands stay off unless allow_exec is set on the device. Leave a field at 0
+            to keep the device's setting.
+          </p>
+          <form onSubmit={handleSaveAgentSettings} style={{ display: 'flex', gap: '12px', alignItems: 'center', flexWrap: 'wrap' }}>
+            <label>
+              Ping every (s){' '}
+              <input
+                type="number"
+                min={0}
+                max={300}
+                value={agentSettings.ping_interval || 0}
+                onChange={e => setAgentSettings({ ...agentSettings, ping_interval: Number(e.target.value) })}
+              />
+            </label>
+            <label>
+              Metrics every (s){' '}
+              <input
+                type="number"
+                min={0}
+                max={3600}
+                value={agentSettings.metrics_interval || 0}
+                onChange={e => setAgentSettings({ ...agentSettings, metrics_interval: Number(e.target.value) })}
+              />
+            </label>
+            <label>
+              <input
+                type="checkbox"
+                checked={!!agentSettings.exec_dry_run_only}
+                onChange={e => setAgentSettings({ ...agentSettings, exec_dry_run_only: e.target.checked })}
+              />{' '}
+              Dry-run commands only
+            </label>
+            <label style={{ flexBasis: '100%' }}>
+              Allowed commands, one per line (* matches anything; empty allows what the device allows)
+              <textarea
+                rows={3}
+                style={{ width: '100%' }}
+                value={agentAllowlist}
+                onChange={e => setAgentAllowlist(e.target.value)}
+              />
+            </label>
+            <button type="submit" className="btn btn-secondary" disabled={savingAgentSettings}>
+              {savingAgentSettings ? 'Saving...' : 'Save'}
+            </button>
+            {agentSettingsSaved && <span className="tunnel-toggle-hint">{agentSettingsSaved}</span>}
+          </form>
+        </div>
+
+        <div className="detail-section tunnel-toggle-section">
+          <h2>Response Cache</h2>
+          <div className="tunnel-toggle-row">
+            <div className="tunnel-toggle-status">
+              <span className={`tunnel-state ${device.response_cache?.enabled ? 'tunnel-on' : 'tunnel-off'}`}>
+                {device.response_cache?.enabled ? 'On' : 'Off'}
+              </span>
+              <span className="tunnel-toggle-hint">
+                {device.response_cache?.enabled
+                  ? device.response_cache.stats
+                    ? `${device.response_cache.stats.entries} responses cached (${formatBytes(device.response_cache.stats.bytes)}), ${device.response_cache.stats.hits} hits. Cache hits don't count toward bandwidth.`
+                    : 'Responses your service marks cacheable are served without reaching the device.'
+                  : 'Serve static files your service marks cacheable (Cache-Control, ETag) without reaching the device.'}
+              </span>
+            </div>
+            {device.response_cache?.enabled && device.response_cache.stats && (
+              <button onClick={handlePurgeCache} className="btn btn-secondary">
+                Purge
+              </button>
+            )}
+            <button
+              onClick={handleToggleCache}
+              className="btn btn-secondary"
+              disabled={togglingCache}
+            >
+              {togglingCache ? 'Updating...' : device.response_cache?.enabled ? 'Disable' : 'Enable'}
+            </button>
+          </div>
+        </div>
+
+        <div className="detail-section tunnel-toggle-section">
+          <h2>Timing Headers</h2>
+          <div className="tunnel-toggle-row">
+            <div className="tunnel-toggle-status">
+              <span className={`tunnel-state ${device.debug?.timing_headers ? 'tunnel-on' : 'tunnel-off'}`}>
+                {device.debug?.timing_headers ? 'On' : 'Off'}
+              </span>
+              <span className="tunnel-toggle-hint">
+                {device.debug?.timing_headers
+                  ? 'Responses show how long your service took (X-PiPortal-Upstream-Time) and how long the tunnel added (X-PiPortal-Tunnel-Time).'
+                  : 'Add headers to responses that split their time between your service and the tunnel, for tracking down slow requests.'}
+              </span>
+            </div>
+            <button
+              onClick={handleToggleTiming}
+              className="btn btn-secondary"
+              disabled={togglingTiming}
+            >
+              {togglingTiming ? 'Updating...' : device.debug?.timing_headers ? 'Disable' : 'Enable'}
+            </button>
+          </div>
+        </div>
+
+        <div className="detail-section tunnel-toggle-section">
+          <h2>Maintenance Mode</h2>
+          <div className="tunnel-toggle-row">
+            <div className="tunnel-toggle-status">
+              <span className={`tunnel-state ${device.maintenance?.enabled ? 'tunnel-off' : 'tunnel-on'}`}>
+                {device.maintenance?.enabled ? 'On' : 'Off'}
+              </span>
+              <span className="tunnel-toggle-hint">
+                {device.maintenance?.enabled
+                  ? `Visitors see a "be right back" page${device.maintenance.message ? `: ${device.maintenance.message}` : '.'}`
+                  : 'Show visitors a "be right back" page while you restart your service.'}
+              </span>
+              {!device.maintenance?.enabled && (
+                <input
+                  type="text"
+                  placeholder="Optional message"
+                  maxLength={500}
+                  value={maintenanceMessage}
+                  onChange={e => setMaintenanceMessage(e.target.value)}
+                />
+              )}
+            </div>
+            <button
+              onClick={handleToggleMaintenance}
+              className="btn btn-secondary"
+              disabled={togglingMaintenance}
+            >
+              {togglingMaintenance ? 'Updating...' : device.maintenance?.enabled ? 'End Maintenance' : 'Start Maintenance'}
+            </button>
+          </div>
         </div>
 
         {device.is_online && device.mem_total != null && (
@@ -216,6 +570,12 @@ export default function DeviceDetailPage() {
                   <div className="metric-label">Load Avg</div>
                 </div>
               )}
+              {device.latency_ms != null && (
+                <div className="metric-item">
+                  <div className="metric-value">{device.latency_ms.toFixed(0)} ms</div>
+                  <div className="metric-label">Latency</div>
+                </div>
+              )}
             </div>
           </div>
         )}
@@ -227,16 +587,36 @@ export default function DeviceDetailPage() {
               <Terminal deviceId={device.id} onDisconnect={() => setTerminalOpen(false)} />
             ) : (
               <div className="terminal-connect-row">
-                <span className="terminal-connect-hint">Open a shell session on this device.</span>
+                <span className="terminal-connect-hint">
+                  Open a shell session on this device.
+                  {device.quotas?.terminal && (
+                    ` ${Math.floor(device.quotas.terminal.remaining / 60)} min of terminal time left today.`
+                  )}
+                </span>
                 <button className="btn" onClick={() => setTerminalOpen(true)}>Connect</button>
               </div>
             )}
+            {terminals.map(t => (
+              <div key={t.id} className="terminal-connect-row">
+                <span className="terminal-connect-hint">
+                  Open since {new Date(t.opened_at).toLocaleString()} by {t.user}
+                  {t.recording && ' (recorded)'}
+                  {t.detached && ' (browser disconnected)'}
+                </span>
+                <button className="btn btn-danger" onClick={() => handleEndSession(t.id)}>End</button>
+              </div>
+            ))}
           </div>
         )}
 
         <div className="detail-section">
           <h2>Bandwidth (This Month)</h2>
           <BandwidthBar used={device.bytes_total} limit={device.limit} />
+          {device.bandwidth_warning && (
+            <p className="form-hint">
+              Nearly out of bandwidth. The tunnel stops serving visitors at 100% until the 1st of next month.
+            </p>
+          )}
         </div>
 
         <div className="detail-section">
@@ -246,12 +626,26 @@ export default function DeviceDetailPage() {
 
         <div className="detail-section danger-zone">
           <h2>Danger Zone</h2>
+          {newToken && (
+            <div className="success-box">
+              <p>New token — it won't be shown again. On the Pi, run:</p>
+              <pre className="code-block">piportal token set {newToken}</pre>
+            </div>
+          )}
           <div style={{ display: 'flex', gap: '12px' }}>
+            {device.is_online && (
+              <button onClick={handleReconnect} className="btn btn-secondary" disabled={reconnecting}>
+                {reconnecting ? 'Reconnecting...' : 'Force Reconnect'}
+              </button>
+            )}
             {device.is_online && (
               <button onClick={handleReboot} className="btn btn-danger" disabled={rebooting}>
                 {rebooting ? 'Rebooting...' : 'Reboot Device'}
               </button>
             )}
+            <button onClick={handleRotateToken} className="btn btn-danger" disabled={rotatingToken}>
+              {rotatingToken ? 'Rotating...' : 'Rotate Token'}
+            </button>
             <button onClick={handleDelete} className="btn btn-danger" disabled={deleting}>
               {deleting ? 'Deleting...' : 'Delete Device'}
             </button>
@@ -0,0 +1,109 @@
+import { useEffect, useState } from 'react';
+import { useNavigate } from 'react-router-dom';
+import { api, type SessionInfo } from '../api';
+import { useAuth } from '../hooks/useAuth';
+
+export default function SessionsPage() {
+  const { logout } = useAuth();
+  const navigate = useNavigate();
+  const [sessions, setSessions] = useState<SessionInfo[]>([]);
+  const [loading, setLoading] = useState(true);
+  const [error, setError] = useState('');
+  const [revoking, setRevoking] = useState<string | null>(null);
+
+  const load = async () => {
+    try {
+      setSessions(await api.listSessions());
+      setError('');
+    } catch (err: any) {
+      setError(err.message);
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  useEffect(() => {
+    load();
+  }, []);
+
+  const handleRevoke = async (session: SessionInfo) => {
+    if (session.current) {
+      await logout();
+      navigate('/dashboard/login');
+      return;
+    }
+    setRevoking(session.id);
+    try {
+      await api.revokeSession(session.id);
+      setSessions(prev => prev.filter(s => s.id !== session.id));
+    } catch (err: any) {
+      alert(err.message);
+    } finally {
+      setRevoking(null);
+    }
+  };
+
+  const handleRevokeOthers = async () => {
+    if (!confirm('Log out of every other browser?')) return;
+    setRevoking('others');
+    try {
+      await api.revokeOtherSessions();
+      await load();
+    } catch (err: any) {
+      alert(err.message);
+    } finally {
+      setRevoking(null);
+    }
+  };
+
+  if (loading) return <div className="loading">Loading sessions...</div>;
+  if (error) return <div className="error-msg">{error}</div>;
+
+  const others = sessions.filter(s => !s.current).length;
+
+  return (
+    <div className="detail-page">
+      <div className="page-header">
+        <h1>Sessions</h1>
+        <div className="page-header-actions">
+          <button
+            className="btn btn-danger"
+            onClick={handleRevokeOthers}
+            disabled={others === 0 || revoking !== null}
+          >
+            Log out other sessions
+          </button>
+        </div>
+      </div>
+
+      {sessions.map(session => (
+        <div key={session.id} className="detail-section">
+          <h2>{session.current ? 'This browser' : session.user_agent || 'Unknown browser'}</h2>
+          <dl>
+            {session.current && (
+              <>
+                <dt>Browser</dt>
+                <dd>{session.user_agent || 'Unknown'}</dd>
+              </>
+            )}
+            <dt>IP</dt>
+            <dd>{session.ip || '—'}</dd>
+            <dt>Signed in</dt>
+            <dd>{new Date(session.created_at).toLocaleString()}</dd>
+            <dt>Last active</dt>
+            <dd>{new Date(session.last_used_at).toLocaleString()}</dd>
+            <dt>Expires</dt>
+            <dd>{new Date(session.expires_at).toLocaleDateString()}</dd>
+          </dl>
+          <button
+            className="btn btn-secondary"
+            onClick={() => handleRevoke(session)}
+            disabled={revoking !== null}
+          >
+            {revoking === session.id ? 'Logging out...' : 'Log out'}
+          </button>
+        </div>
+      ))}
+    </div>
+  );
+}
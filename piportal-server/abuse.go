@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxAbuseScanBody  = 256 * 1024 // Content scanning reads this much of a response
+	maxAbusePathsSeen = 1024       // Paths remembered per tunnel before starting over
+)
+
+// AbuseSample is what an AbuseScanner sees of one tunnel response
+type AbuseSample struct {
+	URL     string            // As the visitor asked for it, e.g. https://pi.example.com/login
+	Status  int               // Status code from the device
+	Headers map[string]string // Response headers from the device
+	Body    []byte            // Start of a text body; nil unless content scanning is on
+}
+
+// AbuseScanner checks tunnel responses for phishing, malware and the like,
+// returning why a response should be flagged
+type AbuseScanner interface {
+	Scan(sample *AbuseSample) (reason string, flagged bool)
+}
+
+// blocklistScanner flags responses matching the operator's blocklist. Plain
+// terms are matched against the URL and the headers that send visitors
+// elsewhere or hand them a file; "content:" terms against the body.
+type blocklistScanner struct {
+	urlTerms     []string
+	contentTerms []string
+}
+
+// NewAbuseScanner builds the scanner from the config's blocklist, or returns
+// nil if scanning is off
+func NewAbuseScanner(c *Config) (AbuseScanner, error) {
+	if c.AbuseBlocklist == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.AbuseBlocklist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read abuse blocklist: %w", err)
+	}
+	s := &blocklistScanner{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if term, ok := strings.CutPrefix(line, "content:"); ok {
+			if term = strings.TrimSpace(term); term != "" {
+				s.contentTerms = append(s.contentTerms, term)
+			}
+			continue
+		}
+		s.urlTerms = append(s.urlTerms, line)
+	}
+	return s, nil
+}
+
+// Scan implements AbuseScanner
+func (s *blocklistScanner) Scan(sample *AbuseSample) (string, bool) {
+	url := strings.ToLower(sample.URL)
+	for _, term := range s.urlTerms {
+		if strings.Contains(url, term) {
+			return fmt.Sprintf("URL matches %q", term), true
+		}
+	}
+	for name, value := range sample.Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Location", "Refresh", "Content-Disposition", "Link":
+		default:
+			continue
+		}
+		value = strings.ToLower(value)
+		for _, term := range s.urlTerms {
+			if strings.Contains(value, term) {
+				return fmt.Sprintf("%s header matches %q", http.CanonicalHeaderKey(name), term), true
+			}
+		}
+	}
+	if len(sample.Body) > 0 && len(s.contentTerms) > 0 {
+		body := bytes.ToLower(sample.Body)
+		for _, term := range s.contentTerms {
+			if bytes.Contains(body, []byte(term)) {
+				return fmt.Sprintf("content matches %q", term), true
+			}
+		}
+	}
+	return "", false
+}
+
+// pathSet remembers which paths a tunnel has already had scanned
+type pathSet struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// Add records path, reporting whether it's new
+func (p *pathSet) Add(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.seen[path] {
+		return false
+	}
+	if p.seen == nil || len(p.seen) >= maxAbusePathsSeen {
+		p.seen = make(map[string]bool)
+	}
+	p.seen[path] = true
+	return true
+}
+
+// Reset forgets every path
+func (p *pathSet) Reset() {
+	p.mu.Lock()
+	p.seen = nil
+	p.mu.Unlock()
+}
+
+// scannableBody returns the start of body if content scanning is on and it's
+// uncompressed text a visitor's browser would render or run
+func (h *Handler) scannableBody(headers map[string]string, body []byte) []byte {
+	if !h.config.AbuseScanContent {
+		return nil
+	}
+	header := make(http.Header, len(headers))
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "text/") && !strings.HasSuffix(mediaType, "javascript") &&
+		mediaType != "application/xhtml+xml" && mediaType != "image/svg+xml" {
+		return nil
+	}
+	if len(body) > maxAbuseScanBody {
+		body = body[:maxAbuseScanBody]
+	}
+	return body
+}
+
+// scanForAbuse checks the first response on each path of a tunnel against
+// the abuse scanner, in the background so visitors aren't held up. Flagged
+// tunnels are held for review.
+func (h *Handler) scanForAbuse(tunnel *Tunnel, r *http.Request, status int, headers map[string]string, body []byte) {
+	if h.abuse == nil || !tunnel.abuseSeen.Add(r.URL.Path) {
+		return
+	}
+	sample := &AbuseSample{
+		URL:     h.visitorURL(r),
+		Status:  status,
+		Headers: headers,
+		Body:    h.scannableBody(headers, body),
+	}
+	go func() {
+		reason, flagged := h.abuse.Scan(sample)
+		if !flagged {
+			return
+		}
+		h.flagAbuse(tunnel.Device, reason, sample.URL)
+	}()
+}
+
+// visitorURL is the URL a tunnel request was made to, as the visitor sees
+// it. The query is left off: flags and admin emails keep only metadata, and
+// a query string can carry a visitor's tokens or personal details.
+func (h *Handler) visitorURL(r *http.Request) string {
+	scheme := "https"
+	if h.config.DevMode {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host + r.URL.EscapedPath()
+}
+
+// flagAbuse flags a device for review, stopping its forwarding if the
+// operator has asked for that, and lets the admin know
+func (h *Handler) flagAbuse(device *Device, reason, url string) {
+	flag := &AbuseFlag{
+		DeviceID:  device.ID,
+		Reason:    reason,
+		URL:       url,
+		Blocked:   h.config.AbuseAutoBlock,
+		FlaggedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	added, err := h.store.FlagAbuse(flag)
+	if err != nil {
+		slog.Error("flagging abuse failed", "subdomain", device.Subdomain, "error", err)
+		return
+	}
+	if !added {
+		return
+	}
+	slog.Warn("tunnel flagged for abuse review", "subdomain", device.Subdomain, "reason", reason, "url", url, "blocked", flag.Blocked)
+
+	if h.mailer == nil || h.config.AdminEmail == "" {
+		return
+	}
+	action := "It is still forwarding; block it from the admin API if needed."
+	if flag.Blocked {
+		action = "Forwarding is stopped until the flag is cleared."
+	}
+	body := fmt.Sprintf("%s.%s was flagged for abuse review.\n\nReason: %s\nURL: %s\n\n%s\n",
+		device.Subdomain, h.config.BaseDomain, reason, url, action)
+	if err := h.mailer.Send(h.config.AdminEmail, "PiPortal: "+device.Subdomain+" flagged for abuse review", body); err != nil {
+		slog.Error("sending abuse flag email failed", "subdomain", device.Subdomain, "error", err)
+	}
+}
+
+// checkAbuseBlock refuses requests to a tunnel held for abuse review,
+// returning false. A failed lookup lets the request through. With scanning
+// off no flags are raised, so the database isn't asked at all.
+func (h *Handler) checkAbuseBlock(w http.ResponseWriter, r *http.Request, tunnel *Tunnel) bool {
+	if h.abuse == nil {
+		return true
+	}
+	flag, err := h.store.GetAbuseFlag(tunnel.Device.ID)
+	if err != nil {
+		tunnel.logger.Error("abuse flag lookup failed", "error", err)
+		return true
+	}
+	if flag == nil || !flag.Blocked {
+		return true
+	}
+	h.httpError(w, r, http.StatusForbidden, "Tunnel Suspended", "This tunnel has been suspended pending review")
+	return false
+}
+
+// Path: /api/v1/admin/abuse
+func (h *Handler) handleAdminListAbuse(w http.ResponseWriter, r *http.Request) {
+	flags, err := h.store.ListAbuseFlags()
+	if err != nil {
+		slog.Error("admin list abuse flags failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	result := []map[string]interface{}{}
+	for _, f := range flags {
+		fr := map[string]interface{}{
+			"device_id":  f.DeviceID,
+			"reason":     f.Reason,
+			"url":        f.URL,
+			"blocked":    f.Blocked,
+			"flagged_at": f.FlaggedAt.Format("2006-01-02T15:04:05Z"),
+		}
+		if device, err := h.store.GetDeviceByID(f.DeviceID); err == nil && device != nil {
+			fr["subdomain"] = device.Subdomain
+			fr["is_online"] = device.IsOnline
+			if owner, err := h.store.GetUserByID(device.UserID); err == nil && owner != nil {
+				fr["owner_email"] = owner.Email
+			}
+		}
+		result = append(result, fr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// adminAbuseFlagFromPath looks up the flag for /api/v1/admin/abuse/{id}/...,
+// writing an error response if the device isn't flagged
+func (h *Handler) adminAbuseFlagFromPath(w http.ResponseWriter, r *http.Request) *AbuseFlag {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/abuse/"), "/")
+	flag, err := h.store.GetAbuseFlag(parts[0])
+	if err != nil {
+		slog.Error("admin abuse flag lookup failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return nil
+	}
+	if flag == nil {
+		jsonError(w, ErrCodeNotFound, "Device is not flagged", http.StatusNotFound)
+		return nil
+	}
+	return flag
+}
+
+// Path: /api/v1/admin/abuse/{id}/block
+func (h *Handler) handleAdminBlockAbuse(w http.ResponseWriter, r *http.Request) {
+	flag := h.adminAbuseFlagFromPath(w, r)
+	if flag == nil {
+		return
+	}
+	if err := h.store.SetAbuseBlocked(flag.DeviceID, true); err != nil {
+		slog.Error("admin block abuse failed", "device_id", flag.DeviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, "abuse.block", flag.DeviceID, flag.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// Path: /api/v1/admin/abuse/{id}
+func (h *Handler) handleAdminClearAbuse(w http.ResponseWriter, r *http.Request) {
+	flag := h.adminAbuseFlagFromPath(w, r)
+	if flag == nil {
+		return
+	}
+	if _, err := h.store.ClearAbuseFlag(flag.DeviceID); err != nil {
+		slog.Error("admin clear abuse failed", "device_id", flag.DeviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	// Scan the device's paths afresh, so whatever was flagged is caught
+	// again if it's still there
+	if device, err := h.store.GetDeviceByID(flag.DeviceID); err == nil && device != nil {
+		if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+			tunnel.abuseSeen.Reset()
+		}
+	}
+	h.audit(r, "abuse.clear", flag.DeviceID, flag.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlocklistScanner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	blocklist := "# phishing kits\nPayPal-Login\n\nwallet-drainer.example\ncontent: enter your seed phrase\ncontent:\n"
+	if err := os.WriteFile(path, []byte(blocklist), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	cfg.AbuseBlocklist = path
+	scanner, err := NewAbuseScanner(cfg)
+	if err != nil {
+		t.Fatalf("NewAbuseScanner: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		sample  AbuseSample
+		flagged bool
+	}{
+		{"clean", AbuseSample{URL: "https://pi.example.com/"}, false},
+		{"url term, any case", AbuseSample{URL: "https://pi.example.com/paypal-login/"}, true},
+		{"redirect", AbuseSample{URL: "https://pi.example.com/", Headers: map[string]string{"location": "https://wallet-drainer.example/"}}, true},
+		{"other headers ignored", AbuseSample{URL: "https://pi.example.com/", Headers: map[string]string{"X-Note": "paypal-login"}}, false},
+		{"content term", AbuseSample{URL: "https://pi.example.com/", Body: []byte("<p>Enter your SEED PHRASE</p>")}, true},
+		{"content terms only match the body", AbuseSample{URL: "https://pi.example.com/enter-your-seed-phrase"}, false},
+		{"no body", AbuseSample{URL: "https://pi.example.com/", Body: nil}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, flagged := scanner.Scan(&tt.sample)
+			if flagged != tt.flagged {
+				t.Errorf("flagged = %v (%q), want %v", flagged, reason, tt.flagged)
+			}
+			if flagged && reason == "" {
+				t.Error("flagged without a reason")
+			}
+		})
+	}
+}
+
+func TestNewAbuseScannerOff(t *testing.T) {
+	scanner, err := NewAbuseScanner(testConfig(t))
+	if scanner != nil || err != nil {
+		t.Errorf("NewAbuseScanner with no blocklist = %v, %v; want nil, nil", scanner, err)
+	}
+}
+
+func TestPathSet(t *testing.T) {
+	var paths pathSet
+	if !paths.Add("/a") {
+		t.Error("first Add of /a wasn't new")
+	}
+	if paths.Add("/a") {
+		t.Error("second Add of /a was new")
+	}
+
+	// Full sets start over rather than growing
+	for i := range maxAbusePathsSeen {
+		paths.Add("/p" + strconv.Itoa(i))
+	}
+	if len(paths.seen) > maxAbusePathsSeen {
+		t.Errorf("set holds %d paths, want at most %d", len(paths.seen), maxAbusePathsSeen)
+	}
+
+	paths.Reset()
+	if !paths.Add("/p1") {
+		t.Error("Add after Reset wasn't new")
+	}
+}
+
+// Flags and emails keep the path but not the query, which can carry a
+// visitor's tokens
+func TestVisitorURLDropsQuery(t *testing.T) {
+	h := &Handler{config: testConfig(t)}
+	r := httptest.NewRequest("GET", "http://pi.piportal.test/reset%20password?token=secret&email=a@b.c", nil)
+	if got, want := h.visitorURL(r), "http://pi.piportal.test/reset%20password"; got != want {
+		t.Errorf("visitorURL = %q, want %q", got, want)
+	}
+}
+
+// Deleting a flagged device and re-creating it would lift the suspension
+// and lose the review record
+func TestDeleteFlaggedDevice(t *testing.T) {
+	server, handler, store := startTestServer(t, testConfig(t))
+	user, token := newTestUser(t, handler, "owner@example.com")
+	device, err := store.CreateDevice("flagged", user.ID)
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	flag := &AbuseFlag{DeviceID: device.ID, Reason: "test", Blocked: true, FlaggedAt: time.Now().UTC().Truncate(time.Second)}
+	if _, err := store.FlagAbuse(flag); err != nil {
+		t.Fatalf("flag device: %v", err)
+	}
+
+	req, err := http.NewRequest("DELETE", server.URL+"/api/v1/devices/"+device.ID, strings.NewReader(`{"confirm":"flagged"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE device: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if d, _ := store.GetDeviceByID(device.ID); d == nil {
+		t.Error("flagged device was deleted")
+	}
+	if f, _ := store.GetAbuseFlag(device.ID); f == nil {
+		t.Error("abuse flag was removed")
+	}
+}
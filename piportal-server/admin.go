@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// bootstrapAdmin grants admin to the configured operator email, if that user
+// exists. Signup never grants admin: an unverified address could be claimed by
+// anyone, so the account must exist before the server starts.
+func bootstrapAdmin(store Storage, email string) {
+	if email == "" {
+		return
+	}
+	user, err := store.GetUserByEmail(email)
+	if err != nil {
+		slog.Error("admin bootstrap failed", "email", email, "error", err)
+		return
+	}
+	if user == nil {
+		slog.Warn("admin bootstrap: no account with this email yet; sign up and restart to grant admin", "email", email)
+		return
+	}
+	if user.IsAdmin {
+		return
+	}
+	if err := store.SetUserAdmin(user.ID, true); err != nil {
+		slog.Error("admin bootstrap failed", "email", email, "error", err)
+		return
+	}
+	slog.Info("admin bootstrap: granted admin", "email", email)
+}
+
+// audit records an admin action in the log and the audit trail
+func (h *Handler) audit(r *http.Request, action, target, details string) {
+	user := UserFromContext(r)
+	slog.Info("audit", "user", user.Email, "action", action, "target", target, "details", details, "client_ip", clientIP(r, h.config.BehindProxy))
+	if err := h.store.AddAuditEntry(user.ID, action, target, details); err != nil {
+		slog.Error("audit log write failed", "action", action, "target", target, "error", err)
+	}
+}
+
+// handleAdminAPI routes /api/v1/admin/* requests. Callers must already have
+// passed AdminMiddleware.
+func (h *Handler) handleAdminAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/admin")
+
+	switch {
+	case path == "/users" && r.Method == http.MethodGet:
+		h.handleAdminListUsers(w, r)
+	case path == "/devices" && r.Method == http.MethodGet:
+		h.handleAdminListDevices(w, r)
+	case path == "/stats" && r.Method == http.MethodGet:
+		h.handleAdminStats(w, r)
+	case path == "/audit" && r.Method == http.MethodGet:
+		h.handleAdminAudit(w, r)
+	case strings.HasPrefix(path, "/devices/") && strings.HasSuffix(path, "/disconnect") && r.Method == http.MethodPost:
+		h.handleAdminDisconnectDevice(w, r)
+	case strings.HasPrefix(path, "/devices/") && r.Method == http.MethodDelete:
+		h.handleAdminDeleteDevice(w, r)
+	case path == "/abuse" && r.Method == http.MethodGet:
+		h.handleAdminListAbuse(w, r)
+	case strings.HasPrefix(path, "/abuse/") && strings.HasSuffix(path, "/block") && r.Method == http.MethodPost:
+		h.handleAdminBlockAbuse(w, r)
+	case strings.HasPrefix(path, "/abuse/") && r.Method == http.MethodDelete:
+		h.handleAdminClearAbuse(w, r)
+	default:
+		jsonError(w, ErrCodeNotFound, "Not Found", http.StatusNotFound)
+	}
+}
+
+// adminDeviceFromPath looks up /api/v1/admin/devices/{id}/..., writing an
+// error response if it doesn't exist
+func (h *Handler) adminDeviceFromPath(w http.ResponseWriter, r *http.Request) *Device {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/devices/"), "/")
+
+	device, err := h.store.GetDeviceByID(parts[0])
+	if err != nil {
+		slog.Error("admin device lookup failed", "device_id", parts[0], "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return nil
+	}
+	if device == nil {
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
+		return nil
+	}
+	return device
+}
+
+func (h *Handler) handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.store.ListUsers()
+	if err != nil {
+		slog.Error("admin list users failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	result := []map[string]interface{}{}
+	for _, u := range users {
+		count, _ := h.store.CountDevicesByUser(u.ID)
+		result = append(result, map[string]interface{}{
+			"id":           u.ID,
+			"email":        u.Email,
+			"is_admin":     u.IsAdmin,
+			"device_count": count,
+			"created_at":   u.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) handleAdminListDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := h.store.ListDevices()
+	if err != nil {
+		slog.Error("admin list devices failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	users, _ := h.store.ListUsers()
+	emails := make(map[string]string)
+	for _, u := range users {
+		emails[u.ID] = u.Email
+	}
+
+	result := []map[string]interface{}{}
+	for _, d := range devices {
+		dr := map[string]interface{}{
+			"id":             d.ID,
+			"subdomain":      d.Subdomain,
+			"tier":           d.Tier,
+			"user_id":        d.UserID,
+			"owner_email":    emails[d.UserID],
+			"org_id":         d.OrgID,
+			"is_online":      d.IsOnline,
+			"tunnel_enabled": d.TunnelEnabled,
+			"created_at":     d.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		}
+		if !d.LastSeenAt.IsZero() {
+			dr["last_seen_at"] = d.LastSeenAt.Format("2006-01-02T15:04:05Z")
+		}
+		result = append(result, dr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	users, err := h.store.ListUsers()
+	if err != nil {
+		slog.Error("admin stats failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	devices, err := h.store.ListDevices()
+	if err != nil {
+		slog.Error("admin stats failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	pro := 0
+	for _, d := range devices {
+		if d.Tier == "pro" {
+			pro++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":       len(users),
+		"devices":     len(devices),
+		"pro_devices": pro,
+		"tunnels":     h.tunnels.Stats(),
+	})
+}
+
+func (h *Handler) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+
+	entries, err := h.store.ListAuditEntries(limit)
+	if err != nil {
+		slog.Error("admin list audit entries failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	result := []map[string]interface{}{}
+	for _, e := range entries {
+		result = append(result, map[string]interface{}{
+			"id":         e.ID,
+			"user_id":    e.UserID,
+			"action":     e.Action,
+			"target":     e.Target,
+			"details":    e.Details,
+			"created_at": e.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleAdminDisconnectDevice drops a device's tunnel. The client will
+// reconnect unless the device is also disabled or deleted.
+func (h *Handler) handleAdminDisconnectDevice(w http.ResponseWriter, r *http.Request) {
+	device := h.adminDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	tunnel := h.tunnels.GetTunnel(device.Subdomain)
+	if tunnel != nil {
+		tunnel.SendJSON(NewErrorMessage("disconnected", "Disconnected by an administrator"))
+		tunnel.Close()
+	}
+	h.audit(r, "device.disconnect", device.ID, device.Subdomain)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"disconnected": tunnel != nil,
+	})
+}
+
+func (h *Handler) handleAdminDeleteDevice(w http.ResponseWriter, r *http.Request) {
+	device := h.adminDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	// Let requests in flight finish first, so their usage is recorded
+	// against a device that still exists
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnel.Drain(tunnelDrainTimeout)
+	}
+
+	if err := h.store.DeleteDevice(device.ID); err != nil {
+		slog.Error("admin delete device failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, "device.delete", device.ID, device.Subdomain)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	minAgentPingInterval    = 5 * time.Second
+	maxAgentPingInterval    = 5 * time.Minute
+	minAgentMetricsInterval = 10 * time.Second
+	maxAgentMetricsInterval = time.Hour
+	maxAgentExecAllowlist   = 50
+	maxAgentExecPattern     = 200
+)
+
+// AgentSettings are client settings an owner manages from the dashboard
+// instead of on each device. They're sent in the auth result and apply for
+// that session. They can narrow what a device runs but never widen it:
+// allow_exec stays a setting only the device's own config can turn on.
+type AgentSettings struct {
+	PingInterval    int      `json:"ping_interval,omitempty"`    // Seconds between client pings (0 = the client's own)
+	MetricsInterval int      `json:"metrics_interval,omitempty"` // Seconds between metrics reports (0 = with every ping)
+	ExecAllowlist   []string `json:"exec_allowlist,omitempty"`   // Commands must also match one of these (* = anything)
+	ExecDryRunOnly  bool     `json:"exec_dry_run_only,omitempty"`
+}
+
+// IsEmpty reports whether there's nothing to push
+func (s AgentSettings) IsEmpty() bool {
+	return s.PingInterval == 0 && s.MetricsInterval == 0 && len(s.ExecAllowlist) == 0 && !s.ExecDryRunOnly
+}
+
+// normalizeAgentSettings trims the allowlist and checks the settings are
+// ones a client can use
+func normalizeAgentSettings(s *AgentSettings) error {
+	if ping := time.Duration(s.PingInterval) * time.Second; s.PingInterval != 0 && (ping < minAgentPingInterval || ping > maxAgentPingInterval) {
+		return fmt.Errorf("ping_interval must be between %d and %d seconds, or 0 for the device's own",
+			int(minAgentPingInterval.Seconds()), int(maxAgentPingInterval.Seconds()))
+	}
+	if metrics := time.Duration(s.MetricsInterval) * time.Second; s.MetricsInterval != 0 && (metrics < minAgentMetricsInterval || metrics > maxAgentMetricsInterval) {
+		return fmt.Errorf("metrics_interval must be between %d and %d seconds, or 0 to report with every ping",
+			int(minAgentMetricsInterval.Seconds()), int(maxAgentMetricsInterval.Seconds()))
+	}
+	if len(s.ExecAllowlist) > maxAgentExecAllowlist {
+		return fmt.Errorf("exec_allowlist can have at most %d commands", maxAgentExecAllowlist)
+	}
+
+	var allowlist []string
+	for _, pattern := range s.ExecAllowlist {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if len(pattern) > maxAgentExecPattern {
+			return fmt.Errorf("exec_allowlist commands can be at most %d characters", maxAgentExecPattern)
+		}
+		allowlist = append(allowlist, pattern)
+	}
+	s.ExecAllowlist = allowlist
+	return nil
+}
+
+// Path: /api/v1/devices/{id}/agent-settings
+func (h *Handler) handleGetAgentSettings(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	settings, err := h.store.GetAgentSettings(device.ID)
+	if err != nil {
+		slog.Error("get agent settings failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"settings": settings,
+	})
+}
+
+// Path: /api/v1/devices/{id}/agent-settings
+func (h *Handler) handleSetAgentSettings(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var settings AgentSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := normalizeAgentSettings(&settings); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetAgentSettings(device.ID, settings); err != nil {
+		slog.Error("set agent settings failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("agent settings updated", "subdomain", device.Subdomain,
+		"ping_interval", settings.PingInterval, "metrics_interval", settings.MetricsInterval,
+		"exec_allowlist", len(settings.ExecAllowlist), "exec_dry_run_only", settings.ExecDryRunOnly)
+
+	// The client takes settings at auth, so a connected device needs to
+	// reconnect to pick them up
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"settings":         settings,
+		"reconnect_needed": h.tunnels.GetTunnel(device.Subdomain) != nil,
+	})
+}
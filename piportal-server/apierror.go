@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Error codes in JSON API errors. Clients match on the code; the message is
+// for people and may be reworded. Codes, once published, don't change.
+const (
+	ErrCodeInvalidRequest       = "invalid_request"       // Malformed JSON, a missing or bad field
+	ErrCodeConfirmationRequired = "confirmation_required" // A destructive action wasn't confirmed
+	ErrCodeUnauthorized         = "unauthorized"          // No credentials, or wrong email or password
+	ErrCodeInvalidToken         = "invalid_token"         // An access or device token was refused
+	ErrCodeSessionEnded         = "session_ended"         // The dashboard session was revoked or expired
+	ErrCodeForbidden            = "forbidden"             // Not allowed, e.g. admin only
+	ErrCodeUpgradeRequired      = "upgrade_required"      // Needs the pro tier
+	ErrCodeDeviceLimit          = "device_limit"          // No room for another device
+	ErrCodeNotFound             = "not_found"
+	ErrCodeConflict             = "conflict" // The resource isn't in a state that allows this
+	ErrCodeSubdomainInvalid     = "subdomain_invalid"
+	ErrCodeSubdomainTaken       = "subdomain_taken"
+	ErrCodeDeviceOffline        = "device_offline"
+	ErrCodeTooLarge             = "too_large"
+	ErrCodeVerificationFailed   = "verification_failed" // Domain ownership couldn't be confirmed
+	ErrCodeRateLimited          = "rate_limited"
+	ErrCodeQuotaExceeded        = "quota_exceeded" // An exec or terminal quota is used up until it resets
+	ErrCodeInternal             = "internal_error"
+	ErrCodeUpstream             = "upstream_error" // A device or outside service failed
+	ErrCodeDeviceTimeout        = "device_timeout"
+)
+
+// APIError is the error object in a failed API response
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonError writes {"success": false, "error": {"code": ..., "message": ...}}
+func jsonError(w http.ResponseWriter, code, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   APIError{Code: code, Message: message},
+	})
+}
+
+// subdomainErrorCode tells a taken subdomain from one that can't be used
+func subdomainErrorCode(err error) string {
+	if errors.Is(err, ErrSubdomainTaken) {
+		return ErrCodeSubdomainTaken
+	}
+	return ErrCodeSubdomainInvalid
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -12,7 +14,32 @@ import (
 
 type contextKey string
 
-const userContextKey contextKey = "user"
+const (
+	userContextKey    contextKey = "user"
+	sessionContextKey contextKey = "session"
+)
+
+// Why a dashboard request's credentials were refused
+var (
+	errInvalidAccessToken = errors.New("invalid or expired token")
+	errSessionEnded       = errors.New("session has ended, please log in again")
+	errUnknownUser        = errors.New("user not found")
+)
+
+// errUnknownSigningKey means a token's kid isn't a configured key, usually
+// because the key was retired
+var errUnknownSigningKey = errors.New("token signed with an unknown key")
+
+// authErrorCode is the API error code for a refused access token
+func authErrorCode(err error) string {
+	switch err {
+	case errInvalidAccessToken:
+		return ErrCodeInvalidToken
+	case errSessionEnded:
+		return ErrCodeSessionEnded
+	}
+	return ErrCodeUnauthorized
+}
 
 // HashPassword hashes a password with bcrypt cost 10
 func HashPassword(password string) (string, error) {
@@ -25,56 +52,158 @@ func CheckPassword(password, hash string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
-// GenerateJWT creates a signed JWT with the user ID as subject
-func GenerateJWT(userID, secret string) (string, error) {
+// JWTKey is a dashboard token signing key. Tokens name the key that signed
+// them in their kid header.
+type JWTKey struct {
+	ID     string
+	Secret string
+}
+
+// parseJWTKeys parses id:secret pairs. Errors give a bad entry's position
+// rather than the entry, which may well be a secret.
+func parseJWTKeys(entries []string) ([]JWTKey, error) {
+	var keys []JWTKey
+	seen := make(map[string]bool)
+	for i, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("JWT key #%d is not id:secret", i+1)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("JWT key #%d repeats key ID %q", i+1, id)
+		}
+		seen[id] = true
+		keys = append(keys, JWTKey{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+// GenerateJWT creates a short-lived signed access token with the user ID as
+// subject and the session it was issued for as its ID
+func GenerateJWT(userID, sessionID string, key JWTKey, ttl time.Duration) (string, error) {
+	now := time.Now()
 	claims := jwt.RegisteredClaims{
 		Subject:   userID,
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ID:        sessionID,
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString([]byte(key.Secret))
 }
 
-// ValidateJWT parses and validates a JWT, returning the user ID
-func ValidateJWT(tokenStr, secret string) (string, error) {
+// ValidateJWT parses and validates a JWT signed by one of the given keys,
+// returning the user and session IDs. Tokens issued before sessions existed
+// have no session ID. A token whose key has been retired is refused.
+func ValidateJWT(tokenStr string, keys []JWTKey, opts ...jwt.ParserOption) (userID, sessionID string, err error) {
+	opts = append(opts, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+		kid, _ := t.Header["kid"].(string)
+		for _, key := range keys {
+			if key.ID == kid {
+				return []byte(key.Secret), nil
+			}
+		}
+		return nil, errUnknownSigningKey
+	}, opts...)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	claims, ok := token.Claims.(*jwt.RegisteredClaims)
 	if !ok || !token.Valid {
-		return "", jwt.ErrTokenInvalidClaims
+		return "", "", jwt.ErrTokenInvalidClaims
 	}
-	return claims.Subject, nil
+	return claims.Subject, claims.ID, nil
 }
 
-// SetAuthCookie sets the JWT as an httpOnly cookie
-func SetAuthCookie(w http.ResponseWriter, token string, devMode bool) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   !devMode,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   86400, // 24 hours
-	})
+// userFromToken checks an access token and returns its user and session,
+// refusing tokens whose session was revoked or has expired
+func (h *Handler) userFromToken(tokenStr string) (*User, string, error) {
+	userID, sessionID, err := ValidateJWT(tokenStr, h.config.jwtKeys())
+	if err != nil {
+		return nil, "", errInvalidAccessToken
+	}
+	if sessionID != "" {
+		session, err := h.store.GetSession(sessionID)
+		if err != nil || session == nil || session.UserID != userID {
+			return nil, "", errSessionEnded
+		}
+	}
+	user, err := h.store.GetUserByID(userID)
+	if err != nil || user == nil {
+		return nil, "", errUnknownUser
+	}
+	return user, sessionID, nil
 }
 
-// ClearAuthCookie removes the auth cookie
-func ClearAuthCookie(w http.ResponseWriter, devMode bool) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		Path:     "/",
+// The refresh token's cookie is only sent to the refresh endpoint
+const (
+	refreshCookieName = "refresh_token"
+	refreshCookiePath = "/api/v1/refresh"
+)
+
+// SetAuthCookie sets the access JWT as an httpOnly cookie. The cookie lives
+// as long as the session, outlasting the token inside it, so logout can
+// still tell which session to end once the token has expired.
+func SetAuthCookie(w http.ResponseWriter, token string, c *Config) {
+	http.SetCookie(w, c.sessionCookie("token", "/", token, int(c.SessionTTL.Seconds())))
+}
+
+// SetRefreshCookie sets the session's refresh token as an httpOnly cookie
+func SetRefreshCookie(w http.ResponseWriter, token string, c *Config) {
+	http.SetCookie(w, c.sessionCookie(refreshCookieName, refreshCookiePath, token, int(c.SessionTTL.Seconds())))
+}
+
+// ClearAuthCookie removes the auth and refresh cookies
+func ClearAuthCookie(w http.ResponseWriter, c *Config) {
+	http.SetCookie(w, c.sessionCookie("token", "/", "", -1))
+	http.SetCookie(w, c.sessionCookie(refreshCookieName, refreshCookiePath, "", -1))
+}
+
+// sessionCookie builds a dashboard session cookie. Without -cookie-domain
+// it's host-only, so it never reaches tunnel subdomains running users' apps.
+func (c *Config) sessionCookie(name, path, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   c.CookieDomain,
 		HttpOnly: true,
-		Secure:   !devMode,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   -1,
-	})
+		Secure:   c.cookieSecure(),
+		SameSite: cookieSameSite(c.CookieSameSite),
+		MaxAge:   maxAge,
+	}
+}
+
+// cookieSecure reports whether the session cookie is HTTPS-only
+func (c *Config) cookieSecure() bool {
+	return !c.DevMode && !c.CookieInsecure
+}
+
+// cookieSameSite maps a -cookie-samesite value to its mode (Lax by default)
+func cookieSameSite(mode string) http.SameSite {
+	switch strings.ToLower(mode) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// cookieDomainCoversTunnels reports whether a cookie for domain would also
+// be sent to <subdomain>.<baseDomain>
+func cookieDomainCoversTunnels(domain, baseDomain string) bool {
+	domain = strings.TrimPrefix(strings.ToLower(domain), ".")
+	baseDomain = strings.ToLower(baseDomain)
+	return domain == baseDomain || strings.HasSuffix(baseDomain, "."+domain)
 }
 
 // AuthMiddleware extracts the user from JWT (Bearer header or cookie) and adds to context.
@@ -96,29 +225,42 @@ func (h *Handler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		if tokenStr == "" {
-			jsonError(w, "Authentication required", http.StatusUnauthorized)
+			jsonError(w, ErrCodeUnauthorized, "Authentication required", http.StatusUnauthorized)
 			return
 		}
 
-		userID, err := ValidateJWT(tokenStr, h.config.JWTSecret)
+		user, sessionID, err := h.userFromToken(tokenStr)
 		if err != nil {
-			jsonError(w, "Invalid or expired token", http.StatusUnauthorized)
-			return
-		}
-
-		user, err := h.store.GetUserByID(userID)
-		if err != nil || user == nil {
-			jsonError(w, "User not found", http.StatusUnauthorized)
+			jsonError(w, authErrorCode(err), err.Error(), http.StatusUnauthorized)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, sessionContextKey, sessionID)
 		next(w, r.WithContext(ctx))
 	}
 }
 
+// AdminMiddleware is AuthMiddleware restricted to admin users
+func (h *Handler) AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return h.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if !UserFromContext(r).IsAdmin {
+			jsonError(w, ErrCodeForbidden, "Admin access required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
 // UserFromContext extracts the user from the request context
 func UserFromContext(r *http.Request) *User {
 	user, _ := r.Context().Value(userContextKey).(*User)
 	return user
 }
+
+// SessionFromContext returns the ID of the session the request's token was
+// issued for, or "" for tokens from before sessions
+func SessionFromContext(r *http.Request) string {
+	sessionID, _ := r.Context().Value(sessionContextKey).(string)
+	return sessionID
+}
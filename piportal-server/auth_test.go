@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestSessionCookieAttributes(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantSecure bool
+		wantSite   http.SameSite
+		wantDomain string
+	}{
+		{"defaults", nil, true, http.SameSiteLaxMode, ""},
+		{"dev mode", []string{"-dev"}, false, http.SameSiteLaxMode, ""},
+		{"insecure", []string{"-cookie-insecure"}, false, http.SameSiteLaxMode, ""},
+		{"strict", []string{"-cookie-samesite", "strict"}, true, http.SameSiteStrictMode, ""},
+		{"none", []string{"-cookie-samesite", "None"}, true, http.SameSiteNoneMode, ""},
+		{"shared domain", []string{"-cookie-domain", "example.com"}, true, http.SameSiteLaxMode, "example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, append([]string{"-session-ttl", "48h"}, tt.args...)...)
+			maxAge := int((48 * time.Hour).Seconds())
+
+			rec := httptest.NewRecorder()
+			SetAuthCookie(rec, "access", cfg)
+			SetRefreshCookie(rec, "refresh", cfg)
+			ClearAuthCookie(rec, cfg)
+
+			want := []struct {
+				name, value, path string
+				maxAge            int
+			}{
+				{"token", "access", "/", maxAge},
+				{refreshCookieName, "refresh", refreshCookiePath, maxAge},
+				{"token", "", "/", -1}, // Max-Age=0 on the wire
+				{refreshCookieName, "", refreshCookiePath, -1},
+			}
+			cookies := rec.Result().Cookies()
+			if len(cookies) != len(want) {
+				t.Fatalf("set %d cookies, want %d", len(cookies), len(want))
+			}
+			for i, c := range cookies {
+				w := want[i]
+				if c.Name != w.name || c.Value != w.value || c.Path != w.path || c.MaxAge != w.maxAge {
+					t.Errorf("cookie %d = %s=%q Path=%s Max-Age=%d, want %s=%q Path=%s Max-Age=%d",
+						i, c.Name, c.Value, c.Path, c.MaxAge, w.name, w.value, w.path, w.maxAge)
+				}
+				if !c.HttpOnly {
+					t.Errorf("%s isn't HttpOnly", c.Raw)
+				}
+				if c.Secure != tt.wantSecure {
+					t.Errorf("%s: Secure = %v, want %v", c.Raw, c.Secure, tt.wantSecure)
+				}
+				if c.SameSite != tt.wantSite {
+					t.Errorf("%s: SameSite = %v, want %v", c.Raw, c.SameSite, tt.wantSite)
+				}
+				if c.Domain != tt.wantDomain {
+					t.Errorf("%s: Domain = %q, want %q", c.Raw, c.Domain, tt.wantDomain)
+				}
+			}
+		})
+	}
+}
+
+// After a rotation, tokens from the keys still listed keep working and
+// tokens from a retired key don't
+func TestJWTKeyRotation(t *testing.T) {
+	current := JWTKey{ID: "2026-10", Secret: "current-secret"}
+	previous := JWTKey{ID: "2026-04", Secret: "previous-secret"}
+	retired := JWTKey{ID: "2025-10", Secret: "retired-secret"}
+	legacy := JWTKey{Secret: "legacy-secret"} // jwt_secret, from before key IDs
+
+	tests := []struct {
+		name      string
+		jwtSecret string // jwt_secret, if it's still set
+		signedBy  JWTKey
+		wantErr   error
+	}{
+		{"current key", "", current, nil},
+		{"previous key", "", previous, nil},
+		{"retired key", "", retired, errUnknownSigningKey},
+		{"listed ID, wrong secret", "", JWTKey{ID: previous.ID, Secret: retired.Secret}, jwt.ErrSignatureInvalid},
+		{"jwt_secret", legacy.Secret, legacy, nil},
+		{"jwt_secret removed", "", legacy, errUnknownSigningKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				JWTKeys:   []string{current.ID + ":" + current.Secret, previous.ID + ":" + previous.Secret},
+				JWTSecret: tt.jwtSecret,
+			}
+			if signing := cfg.jwtKeys()[0]; signing != current {
+				t.Fatalf("signing key = %s, want %s", signing.ID, current.ID)
+			}
+
+			token, err := GenerateJWT("user-1", "session-1", tt.signedBy, time.Hour)
+			if err != nil {
+				t.Fatalf("GenerateJWT: %v", err)
+			}
+			userID, sessionID, err := ValidateJWT(token, cfg.jwtKeys())
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ValidateJWT error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateJWT: %v", err)
+			}
+			if userID != "user-1" || sessionID != "session-1" {
+				t.Errorf("got user %q session %q, want user-1 session-1", userID, sessionID)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stripe is called over its REST API directly; we only need two endpoints
+// and the webhook signature scheme, which isn't worth the SDK dependency.
+const (
+	stripeAPIBase          = "https://api.stripe.com/v1"
+	stripeWebhookTolerance = 5 * time.Minute
+	maxStripeWebhookBody   = 64 * 1024
+)
+
+var errBadStripeSignature = errors.New("invalid Stripe signature")
+
+// stripeEvent is the envelope of a Stripe webhook event
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// stripeCheckoutSession holds the fields we use from a Checkout Session
+type stripeCheckoutSession struct {
+	ID                string            `json:"id"`
+	URL               string            `json:"url"`
+	ClientReferenceID string            `json:"client_reference_id"`
+	Customer          string            `json:"customer"`
+	Subscription      string            `json:"subscription"`
+	Metadata          map[string]string `json:"metadata"`
+}
+
+// stripeSubscription holds the fields we use from a Subscription
+type stripeSubscription struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// createCheckoutSession starts a Stripe Checkout for one device's pro subscription
+func (h *Handler) createCheckoutSession(user *User, device *Device) (*stripeCheckoutSession, error) {
+	dashboardURL := "https://" + h.config.BaseDomain + "/dashboard"
+
+	form := url.Values{}
+	form.Set("mode", "subscription")
+	form.Set("line_items[0][price]", h.config.StripePriceID)
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("success_url", dashboardURL+"?upgraded="+url.QueryEscape(device.ID))
+	form.Set("cancel_url", dashboardURL)
+	form.Set("client_reference_id", user.ID)
+	form.Set("metadata[device_id]", device.ID)
+	form.Set("subscription_data[metadata][device_id]", device.ID)
+	form.Set("subscription_data[metadata][subdomain]", device.Subdomain)
+	if user.StripeCustomerID != "" {
+		form.Set("customer", user.StripeCustomerID)
+	} else {
+		form.Set("customer_email", user.Email)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, stripeAPIBase+"/checkout/sessions", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(h.config.StripeSecretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var stripeErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(body, &stripeErr)
+		return nil, fmt.Errorf("stripe returned %d: %s", resp.StatusCode, stripeErr.Error.Message)
+	}
+
+	var session stripeCheckoutSession
+	if err := json.Unmarshal(body, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// verifyStripeSignature checks a Stripe-Signature header ("t=<unix>,v1=<hex>,...")
+// against the payload, rejecting timestamps outside the tolerance window
+func verifyStripeSignature(payload []byte, header, secret string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errBadStripeSignature
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errBadStripeSignature
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > stripeWebhookTolerance || age < -stripeWebhookTolerance {
+		return errBadStripeSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+
+	for _, sig := range signatures {
+		decoded, err := hex.DecodeString(sig)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return errBadStripeSignature
+}
+
+// --- Handlers ---
+
+// handleBillingCheckout creates a Checkout session to move a device to pro
+func (h *Handler) handleBillingCheckout(w http.ResponseWriter, r *http.Request) {
+	if !h.config.BillingEnabled() {
+		jsonError(w, ErrCodeNotFound, "Billing is not enabled", http.StatusNotFound)
+		return
+	}
+	user := UserFromContext(r)
+
+	var req struct {
+		DeviceID string `json:"device_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.store.GetDeviceByID(req.DeviceID)
+	if err != nil {
+		slog.Error("checkout device lookup failed", "device_id", req.DeviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if device == nil || device.UserID != user.ID {
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
+		return
+	}
+	if device.Tier == "pro" {
+		jsonError(w, ErrCodeConflict, "Device is already on the pro tier", http.StatusConflict)
+		return
+	}
+
+	session, err := h.createCheckoutSession(user, device)
+	if err != nil {
+		slog.Error("stripe checkout failed", "subdomain", device.Subdomain, "error", err)
+		jsonError(w, ErrCodeUpstream, "Failed to start checkout", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"url":        session.URL,
+	})
+}
+
+// handleBillingWebhook applies Stripe subscription events to device tiers.
+// Non-2xx responses make Stripe retry, so only internal errors return one.
+func (h *Handler) handleBillingWebhook(w http.ResponseWriter, r *http.Request) {
+	if !h.config.BillingEnabled() {
+		jsonError(w, ErrCodeNotFound, "Billing is not enabled", http.StatusNotFound)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStripeWebhookBody))
+	if err != nil {
+		jsonError(w, ErrCodeTooLarge, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := verifyStripeSignature(payload, r.Header.Get("Stripe-Signature"), h.config.StripeWebhookSecret, time.Now()); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var event stripeEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	switch event.Type {
+	case "checkout.session.completed":
+		err = h.handleCheckoutCompleted(event.Data.Object)
+	case "customer.subscription.updated", "customer.subscription.deleted":
+		err = h.handleSubscriptionChanged(event.Type, event.Data.Object)
+	}
+	if err != nil {
+		slog.Error("stripe webhook failed", "event_id", event.ID, "event_type", event.Type, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"received": true})
+}
+
+// handleCheckoutCompleted upgrades the device a completed checkout paid for
+func (h *Handler) handleCheckoutCompleted(object json.RawMessage) error {
+	var session stripeCheckoutSession
+	if err := json.Unmarshal(object, &session); err != nil {
+		return err
+	}
+
+	deviceID := session.Metadata["device_id"]
+	device, err := h.store.GetDeviceByID(deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil || device.UserID != session.ClientReferenceID {
+		slog.Warn("stripe checkout device not found", "session_id", session.ID, "device_id", deviceID, "user_id", session.ClientReferenceID)
+		return nil
+	}
+
+	if session.Customer != "" {
+		if err := h.store.SetStripeCustomerID(device.UserID, session.Customer); err != nil {
+			return err
+		}
+	}
+	if err := h.store.SetDeviceSubscription(device.ID, session.Subscription); err != nil {
+		return err
+	}
+	if err := h.store.UpgradeDevice(device.ID); err != nil {
+		return err
+	}
+
+	slog.Info("device upgraded to pro", "subdomain", device.Subdomain, "subscription", session.Subscription)
+	return nil
+}
+
+// handleSubscriptionChanged moves a device between tiers as its subscription
+// becomes active or ends. past_due keeps pro while Stripe retries payment.
+func (h *Handler) handleSubscriptionChanged(eventType string, object json.RawMessage) error {
+	var sub stripeSubscription
+	if err := json.Unmarshal(object, &sub); err != nil {
+		return err
+	}
+
+	deviceID, err := h.store.GetDeviceIDBySubscription(sub.ID)
+	if err != nil {
+		return err
+	}
+	if deviceID == "" {
+		return nil // Checkout hasn't completed yet, or not one of ours
+	}
+
+	if eventType == "customer.subscription.deleted" {
+		sub.Status = "canceled"
+	}
+
+	switch sub.Status {
+	case "active", "trialing":
+		return h.store.UpgradeDevice(deviceID)
+	case "canceled", "unpaid", "incomplete_expired":
+		if err := h.store.DowngradeDevice(deviceID); err != nil {
+			return err
+		}
+		if sub.Status == "canceled" {
+			if err := h.store.SetDeviceSubscription(deviceID, ""); err != nil {
+				return err
+			}
+		}
+		slog.Info("device downgraded to free", "device_id", deviceID, "subscription", sub.ID, "status", sub.Status)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stripeSignature builds a Stripe-Signature header for payload, the way
+// Stripe signs webhook events
+func stripeSignature(secret string, at time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyStripeSignature(t *testing.T) {
+	const secret = "whsec_test"
+	payload := []byte(`{"id":"evt_1","type":"customer.subscription.deleted"}`)
+	now := time.Now()
+	valid := stripeSignature(secret, now, payload)
+
+	tests := []struct {
+		name    string
+		payload []byte
+		header  string
+		wantErr bool
+	}{
+		{"valid", payload, valid, false},
+		{"wrong secret", payload, stripeSignature("whsec_other", now, payload), true},
+		{"tampered payload", []byte(`{"id":"evt_1","type":"checkout.session.completed"}`), valid, true},
+		{"expired timestamp", payload, stripeSignature(secret, now.Add(-stripeWebhookTolerance-time.Minute), payload), true},
+		{"future timestamp", payload, stripeSignature(secret, now.Add(stripeWebhookTolerance+time.Minute), payload), true},
+		// Stripe sends one v1 per active secret while one is being rolled
+		{"several v1 values, one matching", payload, strings.Replace(valid, ",v1=", ",v1="+strings.Repeat("0", 64)+",v1=", 1), false},
+		{"several v1 values, none matching", payload, "t=" + strconv.FormatInt(now.Unix(), 10) + ",v1=" + strings.Repeat("0", 64) + ",v1=zz", true},
+		{"missing header", payload, "", true},
+		{"no v1", payload, "t=" + strconv.FormatInt(now.Unix(), 10), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyStripeSignature(tt.payload, tt.header, secret, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A cancelled subscription takes the device it paid for back to free and
+// forgets the subscription
+func TestStripeSubscriptionDeleted(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StripeSecretKey = "sk_test"
+	cfg.StripeWebhookSecret = "whsec_test"
+	server, handler, store := startTestServer(t, cfg)
+	user, _ := newTestUser(t, handler, "pro@example.com")
+
+	device, err := store.CreateDevice("paid", user.ID)
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	if err := store.UpgradeDevice(device.ID); err != nil {
+		t.Fatalf("upgrade device: %v", err)
+	}
+	if err := store.SetDeviceSubscription(device.ID, "sub_123"); err != nil {
+		t.Fatalf("set subscription: %v", err)
+	}
+
+	payload := []byte(`{"id":"evt_1","type":"customer.subscription.deleted","data":{"object":{"id":"sub_123","status":"canceled"}}}`)
+	req, err := http.NewRequest("POST", server.URL+"/api/v1/billing/webhook", strings.NewReader(string(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Stripe-Signature", stripeSignature(cfg.StripeWebhookSecret, time.Now(), payload))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST webhook: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	device, err = store.GetDeviceByID(device.ID)
+	if err != nil {
+		t.Fatalf("get device: %v", err)
+	}
+	if device.Tier != "free" {
+		t.Errorf("tier = %q, want free", device.Tier)
+	}
+	if id, err := store.GetDeviceIDBySubscription("sub_123"); err != nil || id != "" {
+		t.Errorf("subscription still points at device %q (err %v)", id, err)
+	}
+}
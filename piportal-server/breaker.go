@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BreakerHeader is set on requests the circuit breaker turned away
+const BreakerHeader = "X-PiPortal-Breaker"
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"    // Forwarding normally
+	breakerOpen     = "open"      // Failing fast until the cooldown ends
+	breakerHalfOpen = "half_open" // One request is testing whether the device recovered
+)
+
+// circuitBreaker stops forwarding to a device whose local service keeps
+// failing, so visitors get a fast 503 instead of a round trip to the Pi for
+// a 502. It lives on the Tunnel, so reconnecting starts it afresh.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int           // Consecutive failures that open it (0 disables)
+	cooldown  time.Duration // How long it stays open before testing again
+	state     string
+	failures  int
+	openedAt  time.Time
+}
+
+// BreakerStatus describes a tunnel's breaker for the dashboard API
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// Allow reports whether a request may be forwarded, or how long until the
+// breaker lets one through. Once the cooldown is over a single request is
+// let through to test the device; the rest keep failing fast until it's
+// answered.
+func (b *circuitBreaker) Allow(now time.Time) (bool, time.Duration) {
+	if b.threshold <= 0 {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openedAt.Add(b.cooldown).Sub(now); wait > 0 {
+			return false, wait
+		}
+		b.state = breakerHalfOpen
+		return true, 0
+	case breakerHalfOpen:
+		return false, time.Second
+	}
+	return true, 0
+}
+
+// Record notes how a forwarded request went and returns the new state if it
+// changed, so the caller can log it
+func (b *circuitBreaker) Record(now time.Time, failed bool) (string, bool) {
+	if b.threshold <= 0 {
+		return "", false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	before := b.state
+	if !failed {
+		b.failures = 0
+		b.state = breakerClosed
+	} else {
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= b.threshold {
+			b.state = breakerOpen
+			b.openedAt = now
+		}
+	}
+	return b.state, b.state != before
+}
+
+// Status returns the breaker's current state
+func (b *circuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state == breakerOpen {
+		until := b.openedAt.Add(b.cooldown)
+		status.OpenUntil = &until
+	}
+	return status
+}
+
+// forwardFailed reports whether a forwarded request shows the device's
+// service to be down: no usable answer from the tunnel, or a 502, which is
+// what the client sends when it can't reach the local service. Requests we
+// refused ourselves say nothing about the device.
+func forwardFailed(resp *ResponseMessage, err error) bool {
+	if err != nil {
+		return !errors.Is(err, ErrBodyTooLarge) && !errors.Is(err, ErrTunnelBusy)
+	}
+	return resp.StatusCode == http.StatusBadGateway
+}
+
+// checkBreaker turns the request away with a 503 if the tunnel's breaker is
+// open, returning false
+func (h *Handler) checkBreaker(w http.ResponseWriter, r *http.Request, tunnel *Tunnel) bool {
+	ok, wait := tunnel.breaker.Allow(time.Now())
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	w.Header().Set(BreakerHeader, "open")
+	h.httpError(w, r, http.StatusServiceUnavailable, "Service Unavailable",
+		"The device's service keeps failing, so requests are paused for a moment. Try again shortly.")
+	return false
+}
+
+// recordBreaker feeds a forwarded request's outcome to the tunnel's breaker
+func (h *Handler) recordBreaker(tunnel *Tunnel, resp *ResponseMessage, err error) {
+	state, changed := tunnel.breaker.Record(time.Now(), forwardFailed(resp, err))
+	if !changed {
+		return
+	}
+	switch state {
+	case breakerOpen:
+		tunnel.logger.Warn("circuit breaker opened", "cooldown", tunnel.breaker.cooldown)
+	case breakerClosed:
+		tunnel.logger.Info("circuit breaker closed")
+	}
+}
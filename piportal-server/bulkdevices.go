@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxBulkDevices = 500     // Devices per bulk create
+	maxBulkBody    = 1 << 20 // Bulk create request body
+)
+
+// bulkDeviceProblem is why one entry of a bulk create can't be created
+type bulkDeviceProblem struct {
+	Index     int    `json:"index"`
+	Subdomain string `json:"subdomain"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// Path: /api/v1/devices/bulk
+func (h *Handler) handleBulkCreateDevices(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+
+	var req struct {
+		OrgID   string `json:"org_id"`
+		Devices []struct {
+			Subdomain string            `json:"subdomain"`
+			Notes     string            `json:"notes"`
+			Metadata  map[string]string `json:"metadata"`
+		} `json:"devices"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBulkBody)).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Devices) == 0 {
+		jsonError(w, ErrCodeInvalidRequest, "devices is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Devices) > maxBulkDevices {
+		jsonError(w, ErrCodeInvalidRequest, fmt.Sprintf("At most %d devices can be created at once", maxBulkDevices), http.StatusBadRequest)
+		return
+	}
+
+	if req.OrgID != "" {
+		org, err := h.store.GetOrganizationByID(req.OrgID)
+		if err != nil {
+			slog.Error("bulk create org lookup failed", "error", err)
+			jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if org == nil || org.UserID != user.ID {
+			jsonError(w, ErrCodeNotFound, "Organization not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	// Check every entry before creating any, so one response lists all
+	// there is to fix
+	batch := make([]NewDevice, 0, len(req.Devices))
+	problems := []bulkDeviceProblem{}
+	seen := make(map[string]bool, len(req.Devices))
+	for i, d := range req.Devices {
+		subdomain := strings.ToLower(strings.TrimSpace(d.Subdomain))
+		notes := DeviceNotes{Notes: d.Notes, Metadata: d.Metadata}
+		problem := func(code, message string) {
+			problems = append(problems, bulkDeviceProblem{Index: i, Subdomain: subdomain, Code: code, Message: message})
+		}
+
+		if err := h.subdomains.Check(subdomain); err != nil {
+			problem(ErrCodeSubdomainInvalid, err.Error())
+			continue
+		}
+		if seen[subdomain] {
+			problem(ErrCodeSubdomainInvalid, "subdomain is listed more than once")
+			continue
+		}
+		seen[subdomain] = true
+		existing, err := h.store.GetDeviceBySubdomain(subdomain)
+		if err != nil {
+			slog.Error("bulk create subdomain lookup failed", "subdomain", subdomain, "error", err)
+			jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			problem(ErrCodeSubdomainTaken, fmt.Sprintf("subdomain '%s' is %v", subdomain, ErrSubdomainTaken))
+			continue
+		}
+		if err := normalizeDeviceNotes(&notes); err != nil {
+			problem(ErrCodeInvalidRequest, err.Error())
+			continue
+		}
+		batch = append(batch, NewDevice{Subdomain: subdomain, Notes: notes})
+	}
+	if len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  false,
+			"error":    APIError{Code: ErrCodeInvalidRequest, Message: fmt.Sprintf("%d of %d devices can't be created; none were", len(problems), len(req.Devices))},
+			"problems": problems,
+		})
+		return
+	}
+
+	// The whole batch counts against the limit, so it's created in full or
+	// not at all. The store checks it in the same transaction, so batches
+	// sent at once can't get past it together.
+	devices, err := h.store.CreateDevices(user.ID, req.OrgID, batch, h.deviceLimits("free"))
+	if err != nil {
+		var limitErr *DeviceLimitError
+		if errors.As(err, &limitErr) {
+			writeDeviceLimit(w, user, limitErr, len(batch))
+			return
+		}
+		if errors.Is(err, ErrSubdomainTaken) {
+			jsonError(w, ErrCodeSubdomainTaken, err.Error(), http.StatusConflict)
+			return
+		}
+		slog.Error("bulk create devices failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("devices created in bulk", "user_id", user.ID, "devices", len(devices))
+	h.audit(r, "device.bulk_create", user.ID, fmt.Sprintf("%d devices", len(devices)))
+
+	created := make([]map[string]interface{}, 0, len(devices))
+	for _, device := range devices {
+		created = append(created, map[string]interface{}{
+			"id":        device.ID,
+			"token":     device.Token,
+			"subdomain": device.Subdomain,
+			"url":       "https://" + device.Subdomain + "." + h.config.BaseDomain,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"devices": created,
+	})
+}
+
+// deviceExportRow is one device in an export. Tokens aren't included; a
+// device's token can only be replaced, with rotate-token.
+type deviceExportRow struct {
+	ID            string            `json:"id"`
+	Subdomain     string            `json:"subdomain"`
+	URL           string            `json:"url"`
+	Tier          string            `json:"tier"`
+	OrgID         string            `json:"org_id,omitempty"`
+	OrgName       string            `json:"org_name,omitempty"`
+	TunnelEnabled bool              `json:"tunnel_enabled"`
+	IsOnline      bool              `json:"is_online"`
+	ClientVersion string            `json:"client_version,omitempty"`
+	CreatedAt     string            `json:"created_at"`
+	LastSeenAt    string            `json:"last_seen_at,omitempty"`
+	Notes         string            `json:"notes,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// Path: /api/v1/devices/export
+func (h *Handler) handleExportDevices(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		jsonError(w, ErrCodeInvalidRequest, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	devices, err := h.store.ListDevicesByUser(user.ID)
+	if err != nil {
+		slog.Error("device export failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	orgs, _ := h.store.ListOrganizationsByUser(user.ID)
+	orgNames := make(map[string]string)
+	for _, org := range orgs {
+		orgNames[org.ID] = org.Name
+	}
+
+	rows := []deviceExportRow{}
+	for _, d := range devices {
+		notes, err := h.store.GetDeviceNotes(d.ID)
+		if err != nil {
+			slog.Error("device export notes lookup failed", "device_id", d.ID, "error", err)
+			jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		row := deviceExportRow{
+			ID:            d.ID,
+			Subdomain:     d.Subdomain,
+			URL:           "https://" + d.Subdomain + "." + h.config.BaseDomain,
+			Tier:          d.Tier,
+			OrgID:         d.OrgID,
+			OrgName:       orgNames[d.OrgID],
+			TunnelEnabled: d.TunnelEnabled,
+			IsOnline:      d.IsOnline,
+			ClientVersion: d.ClientVersion,
+			CreatedAt:     d.CreatedAt.Format("2006-01-02T15:04:05Z"),
+			Notes:         notes.Notes,
+			Metadata:      notes.Metadata,
+		}
+		if !d.LastSeenAt.IsZero() {
+			row.LastSeenAt = d.LastSeenAt.Format("2006-01-02T15:04:05Z")
+		}
+		rows = append(rows, row)
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"exported_at": time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+			"devices":     rows,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "piportal-devices.csv"))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "subdomain", "url", "tier", "org_id", "org_name", "tunnel_enabled", "is_online",
+		"client_version", "created_at", "last_seen_at", "notes", "metadata"})
+	for _, row := range rows {
+		// Metadata keys vary by device, so it goes in one column as JSON
+		metadata, _ := encodeMetadata(row.Metadata)
+		cw.Write([]string{
+			row.ID,
+			row.Subdomain,
+			row.URL,
+			row.Tier,
+			row.OrgID,
+			row.OrgName,
+			strconv.FormatBool(row.TunnelEnabled),
+			strconv.FormatBool(row.IsOnline),
+			row.ClientVersion,
+			row.CreatedAt,
+			row.LastSeenAt,
+			row.Notes,
+			metadata,
+		})
+	}
+	cw.Flush()
+}
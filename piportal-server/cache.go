@@ -0,0 +1,438 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheHeader tells the visitor (and the owner, in their browser's dev tools)
+// whether a response came from the device's response cache
+const CacheHeader = "X-PiPortal-Cache"
+
+// cacheEntry is one cached response, stored uncompressed with canonical
+// header names
+type cacheEntry struct {
+	key      string
+	status   int
+	headers  map[string]string
+	body     []byte
+	storedAt time.Time
+	expires  time.Time
+}
+
+// fresh reports whether the entry can be served without asking the device
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// header looks up a cached response header. Keys are stored canonicalized.
+func (e *cacheEntry) header(name string) string {
+	return e.headers[http.CanonicalHeaderKey(name)]
+}
+
+// size approximates the memory an entry holds
+func (e *cacheEntry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for k, v := range e.headers {
+		n += len(k) + len(v)
+	}
+	return int64(n)
+}
+
+// responseCache is a tunnel's LRU cache of static responses. Like the rate
+// limiter it lives on the Tunnel, so it's emptied when the device disconnects
+// and does nothing until the owner opts in.
+type responseCache struct {
+	mu       sync.Mutex
+	enabled  bool
+	maxEntry int64
+	maxSize  int64
+	size     int64
+	lru      *list.List // Front is most recently used
+	entries  map[string]*list.Element
+	hits     int64
+	misses   int64
+}
+
+// CacheStats is a snapshot of a tunnel's response cache
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// Configure turns the cache on or off with the given size limits. Turning it
+// off drops everything cached.
+func (c *responseCache) Configure(enabled bool, maxEntry, maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = enabled
+	c.maxEntry = maxEntry
+	c.maxSize = maxSize
+	if !enabled {
+		c.lru, c.entries, c.size = nil, nil, 0
+	}
+}
+
+// Enabled reports whether the owner has opted in
+func (c *responseCache) Enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enabled
+}
+
+// Get returns the entry for key, fresh or not, marking it recently used
+func (c *responseCache) Get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled {
+		return nil
+	}
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// Hit counts a response served from the cache
+func (c *responseCache) Hit() {
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+}
+
+// Put stores an entry, evicting the least recently used to make room.
+// Bodies over the entry limit aren't cached.
+func (c *responseCache) Put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled || int64(len(e.body)) > c.maxEntry {
+		return
+	}
+	if c.entries == nil {
+		c.lru = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Delete drops the entry for key, if any
+func (c *responseCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Purge empties the cache without turning it off
+func (c *responseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru, c.entries, c.size = nil, nil, 0
+}
+
+// Stats returns the cache's current size and hit counts
+func (c *responseCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: len(c.entries), Bytes: c.size, Hits: c.hits, Misses: c.misses}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+// cacheKey identifies a cacheable request. Only GETs are cached, so the
+// method is implied, but it keeps keys unambiguous if HEAD is added later.
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.URL.RequestURI()
+}
+
+// cacheableRequest reports whether a request may be answered from, or
+// stored in, the cache. Anything with credentials is personal to the visitor.
+func cacheableRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		r.Header.Get("Authorization") == "" &&
+		r.Header.Get("Range") == ""
+}
+
+// bypassCache reports whether the visitor asked for a fresh copy (e.g. a
+// hard reload). The response is still stored for everyone else.
+func bypassCache(r *http.Request) bool {
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := cc["no-cache"]
+	return noCache || r.Header.Get("Pragma") == "no-cache"
+}
+
+// newCacheEntry builds a cache entry for a response, or returns nil if the
+// origin didn't mark it as shareable. Responses that set cookies or vary on
+// anything but encoding are never cached; ones with a validator but no
+// lifetime are cached so they can be revalidated cheaply.
+func newCacheEntry(key string, status int, headers map[string]string, body []byte, now time.Time) *cacheEntry {
+	if status != http.StatusOK {
+		return nil
+	}
+	header := make(map[string]string, len(headers))
+	for k, v := range headers {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	if header["Set-Cookie"] != "" || header["Content-Encoding"] != "" {
+		return nil
+	}
+	for _, v := range strings.Split(header["Vary"], ",") {
+		if v = strings.TrimSpace(v); v != "" && !strings.EqualFold(v, "Accept-Encoding") {
+			return nil
+		}
+	}
+
+	cc := parseCacheControl(header["Cache-Control"])
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return nil
+		}
+	}
+	lifetime, ok := freshnessLifetime(header, cc, now)
+	if !ok && header["Etag"] == "" && header["Last-Modified"] == "" {
+		return nil
+	}
+
+	return &cacheEntry{
+		key:      key,
+		status:   status,
+		headers:  header,
+		body:     body,
+		storedAt: now,
+		expires:  now.Add(lifetime),
+	}
+}
+
+// revalidated refreshes an entry after the device answered 304 Not Modified
+func (e *cacheEntry) revalidated(headers map[string]string, now time.Time) *cacheEntry {
+	updated := *e
+	updated.headers = make(map[string]string, len(e.headers))
+	for k, v := range e.headers {
+		updated.headers[k] = v
+	}
+	for k, v := range headers {
+		switch k = http.CanonicalHeaderKey(k); k {
+		case "Cache-Control", "Expires", "Etag", "Last-Modified", "Date":
+			updated.headers[k] = v
+		}
+	}
+	lifetime, _ := freshnessLifetime(updated.headers, parseCacheControl(updated.headers["Cache-Control"]), now)
+	updated.storedAt = now
+	updated.expires = now.Add(lifetime)
+	return &updated
+}
+
+// freshnessLifetime reads s-maxage, max-age or Expires, in that order
+func freshnessLifetime(header map[string]string, cc map[string]string, now time.Time) (time.Duration, bool) {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs < 0 {
+				return 0, false
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if v := header["Expires"]; v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0, false
+		}
+		if date, err := http.ParseTime(header["Date"]); err == nil {
+			now = date
+		}
+		if lifetime := expires.Sub(now); lifetime > 0 {
+			return lifetime, true
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// parseCacheControl splits a Cache-Control header into lowercase directives
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return cc
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// weakly as the header requires
+func etagMatches(inm, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether the visitor's conditional headers match the entry
+func notModified(r *http.Request, e *cacheEntry) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, e.header("ETag"))
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(e.header("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+// addValidators makes a forwarded request conditional on the cached copy, so
+// a stale entry costs a 304 over the tunnel rather than the whole body. The
+// visitor's own conditional headers are left alone.
+func addValidators(r *http.Request, e *cacheEntry) bool {
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	etag, modified := e.header("ETag"), e.header("Last-Modified")
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if modified != "" {
+		r.Header.Set("If-Modified-Since", modified)
+	}
+	return etag != "" || modified != ""
+}
+
+// writeCachedResponse serves an entry without touching the tunnel, with
+// the device's extra response headers on top
+func (h *Handler) writeCachedResponse(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string, extra map[string]string) {
+	for k, v := range e.headers {
+		w.Header().Set(k, v)
+	}
+	applyResponseHeaders(w, extra)
+	w.Header().Set(RequestIDHeader, r.Header.Get(RequestIDHeader))
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.storedAt).Seconds())))
+	w.Header().Set(CacheHeader, status)
+
+	if notModified(r, e) {
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeProxiedBody(w, r, e.status, e.body)
+}
+
+// Path: /api/v1/devices/{id}/cache
+func (h *Handler) handleGetResponseCache(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	enabled, err := h.store.GetResponseCache(device.ID)
+	if err != nil {
+		slog.Error("get response cache failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.responseCacheStatus(device, enabled))
+}
+
+// Path: /api/v1/devices/{id}/cache
+func (h *Handler) handleSetResponseCache(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetResponseCache(device.ID, req.Enabled); err != nil {
+		slog.Error("set response cache failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply to the live tunnel straight away
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnel.cache.Configure(req.Enabled, h.config.CacheMaxEntrySize, h.config.CacheMaxSize)
+	}
+
+	slog.Info("response cache updated", "subdomain", device.Subdomain, "enabled", req.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"response_cache": h.responseCacheStatus(device, req.Enabled),
+	})
+}
+
+// Path: /api/v1/devices/{id}/cache
+func (h *Handler) handlePurgeResponseCache(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnel.cache.Purge()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// responseCacheStatus describes a device's cache setting, with live stats
+// when it's connected
+func (h *Handler) responseCacheStatus(device *Device, enabled bool) map[string]interface{} {
+	status := map[string]interface{}{
+		"enabled":        enabled,
+		"max_entry_size": h.config.CacheMaxEntrySize,
+		"max_size":       h.config.CacheMaxSize,
+	}
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil && enabled {
+		status["stats"] = tunnel.cache.Stats()
+	}
+	return status
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificates in use are re-read
+const certCheckInterval = time.Hour
+
+// Certificate states on /status and /api/status
+const (
+	certStateOK      = "ok"
+	certStateWarning = "warning" // Expiring soon, expired, or unreadable
+	certStateUnknown = "unknown" // Not checked yet, or no certificate issued yet
+)
+
+// CertStatus is what the last certificate check found. It's shown on the
+// public /api/status, so hostnames are left out and only logged.
+type CertStatus struct {
+	State         string    `json:"state"`
+	Certificates  int       `json:"certificates"`
+	NearestHost   string    `json:"-"`
+	NearestExpiry time.Time `json:"nearest_expiry,omitempty"`
+	DaysLeft      int       `json:"days_left,omitempty"`
+	Problems      []string  `json:"-"`
+	CheckedAt     time.Time `json:"checked_at,omitempty"`
+}
+
+// CertMonitor keeps track of when the server's TLS certificates expire:
+// those in the autocert cache with -auto-tls, or the -tls-cert file
+type CertMonitor struct {
+	config *Config
+	served func(host string) bool // Skips cached certificates for hosts no longer served
+
+	mu     sync.Mutex
+	status CertStatus
+	loaded map[string]bool // Hosts autocert has handed a certificate out for
+}
+
+// NewCertMonitor returns a monitor for the certificates the server serves,
+// or nil if TLS is terminated elsewhere (or not at all)
+func NewCertMonitor(config *Config, served func(host string) bool) *CertMonitor {
+	if config.DevMode || config.BehindProxy || (!config.AutoTLS && config.TLSCert == "") {
+		return nil
+	}
+	return &CertMonitor{config: config, served: served, status: CertStatus{State: certStateUnknown}, loaded: make(map[string]bool)}
+}
+
+// Track wraps autocert's GetCertificate to note the hosts it hands out
+// certificates for. Autocert keeps those in memory and renews them ahead of
+// expiry. A certificate only sitting in its cache, for a host nobody has
+// visited since the server started, is renewed on the next visit, so an
+// expired one there isn't a problem and isn't checked.
+func (m *CertMonitor) Track(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := get(hello)
+		if err == nil && cert.Leaf != nil {
+			m.mu.Lock()
+			m.loaded[certHost(cert.Leaf)] = true
+			m.mu.Unlock()
+		}
+		return cert, err
+	}
+}
+
+// Run checks the certificates now and then every certCheckInterval
+func (m *CertMonitor) Run() {
+	for {
+		m.Check(time.Now())
+		time.Sleep(certCheckInterval)
+	}
+}
+
+// Status returns the result of the last check
+func (m *CertMonitor) Status() CertStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Check reads the certificates in use and updates the status. Autocert
+// renews a certificate 30 days before it expires, so one inside the warning
+// window means renewal has been failing.
+func (m *CertMonitor) Check(now time.Time) {
+	certs, problems := m.load()
+	status := CertStatus{State: certStateOK, Certificates: len(certs), Problems: problems, CheckedAt: now.UTC()}
+
+	hosts := make([]string, 0, len(certs))
+	for host := range certs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	warnBefore := time.Duration(m.config.CertWarnDays) * 24 * time.Hour
+	for _, host := range hosts {
+		expiry := certs[host]
+		if status.NearestHost == "" || expiry.Before(status.NearestExpiry) {
+			status.NearestHost = host
+			status.NearestExpiry = expiry.UTC()
+		}
+		left := expiry.Sub(now)
+		switch {
+		case left <= 0:
+			status.Problems = append(status.Problems, fmt.Sprintf("%s expired %s", host, expiry.UTC().Format("2006-01-02")))
+		case left < warnBefore:
+			status.Problems = append(status.Problems, fmt.Sprintf("%s expires in %d days", host, int(left.Hours()/24)))
+		}
+	}
+	if status.NearestHost != "" {
+		status.DaysLeft = int(status.NearestExpiry.Sub(now).Hours() / 24)
+	}
+
+	switch {
+	case len(status.Problems) > 0:
+		status.State = certStateWarning
+		slog.Warn("tls certificate check found problems", "problems", strings.Join(status.Problems, "; "))
+	case len(certs) == 0:
+		status.State = certStateUnknown // Autocert hasn't served anything yet
+	}
+	if status.NearestHost != "" {
+		slog.Info("tls certificate check", "certificates", len(certs), "nearest_host", status.NearestHost, "days_left", status.DaysLeft)
+	}
+
+	m.mu.Lock()
+	m.status = status
+	m.mu.Unlock()
+}
+
+// load returns the expiry of each certificate in use by host, and any that
+// couldn't be read. With autocert, that's the cached certificates for the
+// hosts it has served since startup.
+func (m *CertMonitor) load() (map[string]time.Time, []string) {
+	certs := make(map[string]time.Time)
+	var problems []string
+
+	if !m.config.AutoTLS {
+		cert, err := readCertFile(m.config.TLSCert)
+		if err != nil {
+			return certs, []string{fmt.Sprintf("reading %s: %v", m.config.TLSCert, err)}
+		}
+		certs[certHost(cert)] = cert.NotAfter
+		return certs, nil
+	}
+
+	entries, err := os.ReadDir(m.config.CertCacheDir)
+	if os.IsNotExist(err) {
+		return certs, nil
+	}
+	if err != nil {
+		return certs, []string{fmt.Sprintf("reading certificate cache: %v", err)}
+	}
+	for _, entry := range entries {
+		// Autocert names cached certificates after their host, with +rsa
+		// for RSA ones. The account key and challenge tokens (+token,
+		// +http-01) aren't certificates.
+		name := entry.Name()
+		host := strings.TrimSuffix(name, "+rsa")
+		if entry.IsDir() || strings.HasPrefix(name, "acme_account") || strings.Contains(host, "+") {
+			continue
+		}
+		m.mu.Lock()
+		loaded := m.loaded[host]
+		m.mu.Unlock()
+		if !loaded || (m.served != nil && !m.served(host)) {
+			continue
+		}
+		cert, err := readCertFile(filepath.Join(m.config.CertCacheDir, name))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("reading certificate for %s: %v", host, err))
+			continue
+		}
+		if expiry, ok := certs[host]; !ok || cert.NotAfter.Before(expiry) {
+			certs[host] = cert.NotAfter
+		}
+	}
+	return certs, problems
+}
+
+// readCertFile returns the first certificate in a PEM file, skipping keys
+func readCertFile(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// certHost names a certificate by its first DNS name
+func certHost(cert *x509.Certificate) string {
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// certServed reports whether the server still serves host, so certificates
+// left in the cache for removed devices and domains aren't reported
+func (h *Handler) certServed(host string) bool {
+	return h.CertHostPolicy(context.Background(), host) == nil
+}
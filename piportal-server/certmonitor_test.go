@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An expired certificate left in autocert's cache only counts once it's
+// been served, and its host never reaches the public status
+func TestCertMonitorChecksServedCertificates(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DevMode = false
+	cfg.AutoTLS = true
+	cfg.CertCacheDir = t.TempDir()
+	cfg.CertWarnDays = 14
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idle.piportal.test"},
+		DNSNames:     []string{"idle.piportal.test"},
+		NotBefore:    time.Now().Add(-100 * 24 * time.Hour),
+		NotAfter:     time.Now().Add(-24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(cfg.CertCacheDir, "idle.piportal.test"), data, 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+
+	m := NewCertMonitor(cfg, nil)
+	m.Check(time.Now())
+	if status := m.Status(); status.State != certStateUnknown || len(status.Problems) > 0 {
+		t.Errorf("status before serving = %+v, want unknown with no problems", status)
+	}
+
+	get := m.Track(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{Leaf: leaf}, nil
+	})
+	if _, err := get(&tls.ClientHelloInfo{ServerName: "idle.piportal.test"}); err != nil {
+		t.Fatalf("get certificate: %v", err)
+	}
+	m.Check(time.Now())
+	status := m.Status()
+	if status.State != certStateWarning {
+		t.Errorf("state after serving = %q, want %q", status.State, certStateWarning)
+	}
+	public, _ := json.Marshal(status)
+	if strings.Contains(string(public), "idle.piportal.test") {
+		t.Errorf("public status names the host: %s", public)
+	}
+}
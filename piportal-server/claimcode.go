@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	claimCodeTTL    = 15 * time.Minute
+	claimCodeLength = 8
+
+	// No 0/O or 1/I/L, so codes read back off a terminal unambiguously
+	claimCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+)
+
+// claimCodeAttempts allows a few typos, then one guess every 10 seconds. With
+// 31^8 possible codes and a short TTL, guessing someone else's is hopeless.
+var claimCodeAttempts = RateLimit{RequestsPerSecond: 0.1, Burst: 5, PerIP: true}
+
+// newClaimCode stores a fresh claim code for a device and returns it
+// formatted for display, e.g. "ABCD-EFGH"
+func (h *Handler) newClaimCode(deviceID string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(claimCodeTTL)
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		code := generateClaimCode()
+		if err = h.store.CreateClaimCode(code, deviceID, expiresAt); err == nil {
+			return code[:4] + "-" + code[4:], expiresAt, nil
+		}
+		if !isUniqueViolation(err) {
+			break
+		}
+	}
+	return "", time.Time{}, err
+}
+
+// generateClaimCode picks characters uniformly, skipping random bytes past
+// the last whole multiple of the alphabet size
+func generateClaimCode() string {
+	limit := byte(256 - 256%len(claimCodeAlphabet))
+	code := make([]byte, 0, claimCodeLength)
+	buf := make([]byte, 1)
+	for len(code) < claimCodeLength {
+		rand.Read(buf)
+		if buf[0] < limit {
+			code = append(code, claimCodeAlphabet[int(buf[0])%len(claimCodeAlphabet)])
+		}
+	}
+	return string(code)
+}
+
+// normalizeClaimCode accepts codes typed in any case, with or without the
+// dash or spaces
+func normalizeClaimCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// handleClaimDeviceByCode claims a device with the short code printed by
+// 'piportal setup', as an alternative to pasting the token
+func (h *Handler) handleClaimDeviceByCode(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+
+	for _, key := range []string{"user:" + user.ID, "ip:" + clientIP(r, h.config.BehindProxy)} {
+		if ok, wait := h.claimAttempts.Allow(key); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			jsonError(w, ErrCodeRateLimited, "Too many attempts, try again shortly", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	code := normalizeClaimCode(req.Code)
+	if code == "" {
+		jsonError(w, ErrCodeInvalidRequest, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	deviceID, err := h.store.GetClaimCodeDevice(code)
+	if err != nil {
+		slog.Error("claim code lookup failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if deviceID == "" {
+		jsonError(w, ErrCodeNotFound, "Invalid or expired code", http.StatusNotFound)
+		return
+	}
+	device, err := h.store.GetDeviceByID(deviceID)
+	if err != nil {
+		slog.Error("claim device lookup failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if device == nil {
+		jsonError(w, ErrCodeNotFound, "Invalid or expired code", http.StatusNotFound)
+		return
+	}
+
+	h.claimDevice(w, user, device)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// cgnatPrefix is carrier-grade NAT space (RFC 6598), shared like private space
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// clientIP returns the visitor's IP address. X-Forwarded-For and X-Real-IP
+// are only trusted behind a reverse proxy, since anyone can send them. Even
+// then only the right-hand end of X-Forwarded-For is trustworthy: each proxy
+// appends the address it saw, but the visitor can put anything before that.
+// So the chain is read from the right, skipping the proxies' own hops on
+// private addresses, and the first public address is the visitor.
+func clientIP(r *http.Request, behindProxy bool) string {
+	if behindProxy {
+		chain := forwardedChain(r)
+		for i := len(chain) - 1; i >= 0; i-- {
+			if isPublicIP(chain[i]) {
+				return chain[i].String()
+			}
+		}
+		if ip := parseIP(r.Header.Get("X-Real-IP")); ip.IsValid() {
+			return ip.String()
+		}
+		if len(chain) > 0 {
+			return chain[len(chain)-1].String()
+		}
+	}
+	if ip := parseIP(r.RemoteAddr); ip.IsValid() {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor is the X-Forwarded-For value to pass to the device. Behind a
+// proxy the chain is kept, minus anything that isn't an address; otherwise
+// a client-supplied header is replaced with the visitor's address.
+func forwardedFor(r *http.Request, behindProxy bool) string {
+	if behindProxy {
+		if chain := forwardedChain(r); len(chain) > 0 {
+			addrs := make([]string, len(chain))
+			for i, ip := range chain {
+				addrs[i] = ip.String()
+			}
+			return strings.Join(addrs, ", ")
+		}
+	}
+	return clientIP(r, behindProxy)
+}
+
+// forwardedProto is the scheme the visitor used, for the device to build
+// absolute URLs with. Behind a proxy, TLS ends there, so it's https unless
+// the proxy says otherwise.
+func forwardedProto(r *http.Request, behindProxy bool) string {
+	if behindProxy {
+		if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			return proto
+		}
+		return "https"
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedChain parses every X-Forwarded-For header, skipping invalid entries
+func forwardedChain(r *http.Request) []netip.Addr {
+	var chain []netip.Addr
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(header, ",") {
+			if ip := parseIP(entry); ip.IsValid() {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	return chain
+}
+
+// parseIP accepts a bare address or host:port, with or without IPv6
+// brackets, and returns the zero Addr if it isn't an IP. IPv4-mapped IPv6
+// addresses come back as IPv4 so one visitor has one spelling.
+func parseIP(s string) netip.Addr {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap().WithZone("")
+}
+
+// isPublicIP reports whether ip is routable on the internet
+func isPublicIP(ip netip.Addr) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnatPrefix.Contains(ip)
+}
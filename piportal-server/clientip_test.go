@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		remoteAddr  string
+		xff         []string // X-Forwarded-For headers
+		realIP      string
+		behindProxy bool
+		want        string
+	}{
+		{"IPv4", "203.0.113.7:51234", nil, "", false, "203.0.113.7"},
+		{"IPv6 with port", "[2001:db8::1]:51234", nil, "", false, "2001:db8::1"},
+		{"IPv4-mapped IPv6", "[::ffff:203.0.113.7]:51234", nil, "", false, "203.0.113.7"},
+		{"IPv6 with zone", "[fe80::1%eth0]:51234", nil, "", false, "fe80::1"},
+		{"not host:port", "203.0.113.7", nil, "", false, "203.0.113.7"},
+		{"not an address", "pipe", nil, "", false, "pipe"},
+
+		// Without a proxy in front, anyone could have sent these
+		{"spoofed X-Forwarded-For", "203.0.113.7:51234", []string{"198.51.100.1"}, "", false, "203.0.113.7"},
+		{"spoofed X-Real-IP", "203.0.113.7:51234", nil, "198.51.100.1", false, "203.0.113.7"},
+
+		// Behind a proxy, which sets them
+		{"trusted proxy", "10.0.0.2:51234", []string{"198.51.100.1"}, "", true, "198.51.100.1"},
+		{"trusted proxy, IPv6", "10.0.0.2:51234", []string{"2001:db8::5"}, "", true, "2001:db8::5"},
+		{"trusted proxy, bracketed IPv6 with port", "10.0.0.2:51234", []string{"[2001:db8::5]:443"}, "", true, "2001:db8::5"},
+		{"right-most public address wins", "10.0.0.2:51234", []string{"192.168.1.10, 198.51.100.1, 203.0.113.9"}, "", true, "203.0.113.9"},
+		{"spoofed entries before the proxy's", "10.0.0.2:51234", []string{"198.51.100.66, 198.51.100.67, 203.0.113.9"}, "", true, "203.0.113.9"},
+		{"proxy hops skipped", "10.0.0.2:51234", []string{"203.0.113.9, 10.0.0.5, 172.16.0.3"}, "", true, "203.0.113.9"},
+		{"spread over headers", "10.0.0.2:51234", []string{"198.51.100.66", "198.51.100.1", "192.168.1.10"}, "", true, "198.51.100.1"},
+		{"CGNAT isn't public", "10.0.0.2:51234", []string{"198.51.100.1, 100.64.1.1"}, "", true, "198.51.100.1"},
+		{"invalid entries skipped", "10.0.0.2:51234", []string{"198.51.100.1, unknown"}, "", true, "198.51.100.1"},
+		{"X-Real-IP when none is public", "10.0.0.2:51234", []string{"192.168.1.10"}, "198.51.100.1", true, "198.51.100.1"},
+		{"last private address otherwise", "10.0.0.2:51234", []string{"192.168.1.10, 10.1.1.1"}, "", true, "10.1.1.1"},
+		{"no headers", "10.0.0.2:51234", nil, "", true, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, xff := range tt.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r, tt.behindProxy); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		xff         []string
+		behindProxy bool
+		want        string
+	}{
+		{"replaced without a proxy", []string{"198.51.100.1"}, false, "203.0.113.7"},
+		{"kept behind a proxy", []string{"198.51.100.1, 10.0.0.1"}, true, "198.51.100.1, 10.0.0.1"},
+		{"joined and cleaned up", []string{"[2001:db8::5]:443, junk", "198.51.100.1"}, true, "2001:db8::5, 198.51.100.1"},
+		{"visitor when there's none", nil, true, "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "203.0.113.7:51234"
+			for _, xff := range tt.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			if got := forwardedFor(r, tt.behindProxy); got != tt.want {
+				t.Errorf("forwardedFor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		tls         bool
+		behindProxy bool
+		want        string
+	}{
+		{"plain HTTP", "", false, false, "http"},
+		{"TLS", "", true, false, "https"},
+		{"spoofed without a proxy", "https", false, false, "http"},
+		{"proxy says http", "http", false, true, "http"},
+		{"proxy says HTTPS", "HTTPS", false, true, "https"},
+		{"proxy says nothing", "", false, true, "https"},
+		{"proxy says nonsense", "gopher", false, true, "https"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.header)
+			}
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if got := forwardedProto(r, tt.behindProxy); got != tt.want {
+				t.Errorf("forwardedProto = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
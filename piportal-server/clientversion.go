@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseVersion splits a version such as "0.1.4", "v1.2" or "1.3.0-rc1" into
+// its numeric parts. Pre-release and build suffixes are ignored.
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	if v == "" {
+		return nil, false
+	}
+	var parts []int
+	for _, field := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or newer
+// than b. Missing parts count as zero, so "1.2" equals "1.2.0".
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// clientOutdated reports whether a device's client is older than the latest
+// release. Unknown or unparseable versions (e.g. dev builds) are never
+// flagged, since there's no telling what they contain.
+func clientOutdated(version string) bool {
+	current, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	latest, ok := parseVersion(ClientVersion)
+	if !ok {
+		return false
+	}
+	return compareVersions(current, latest) < 0
+}
+
+// clientMeetsMinimum reports whether a client may connect under a minimum
+// version. Clients that don't report a version, or report one that doesn't
+// parse (e.g. dev builds), are refused, since they can't be shown to be new
+// enough.
+func clientMeetsMinimum(version, minimum string) bool {
+	required, ok := parseVersion(minimum)
+	if !ok {
+		return true
+	}
+	current, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	return compareVersions(current, required) >= 0
+}
+
+// ClientVersionCount is one line of the fleet's client version breakdown
+type ClientVersionCount struct {
+	Version  string `json:"version"` // "" for devices that have never reported one
+	Devices  int    `json:"devices"`
+	Outdated bool   `json:"outdated"`
+}
+
+// handleClientVersions counts the user's devices per client version, newest
+// first, so an update rollout can be followed.
+// Path: /api/v1/fleet/versions
+func (h *Handler) handleClientVersions(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+
+	counts, err := h.store.CountClientVersions(user.ID)
+	if err != nil {
+		slog.Error("client version counts failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	versions := make([]ClientVersionCount, 0, len(counts))
+	outdated := 0
+	for version, n := range counts {
+		vc := ClientVersionCount{Version: version, Devices: n, Outdated: clientOutdated(version)}
+		if vc.Outdated {
+			outdated += n
+		}
+		versions = append(versions, vc)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		a, aok := parseVersion(versions[i].Version)
+		b, bok := parseVersion(versions[j].Version)
+		if aok != bok {
+			return aok // Unknown versions last
+		}
+		if c := compareVersions(a, b); c != 0 {
+			return c > 0
+		}
+		return versions[i].Version < versions[j].Version
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"latest":   ClientVersion,
+		"versions": versions,
+		"outdated": outdated,
+	})
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestClientMeetsMinimum(t *testing.T) {
+	tests := []struct {
+		version, minimum string
+		want             bool
+	}{
+		{"0.1.4", "", true},
+		{"dev", "", true},
+		{"0.1.4", "0.1.4", true},
+		{"v0.2", "0.1.4", true},
+		{"0.1.3", "0.1.4", false},
+		{"", "0.1.4", false},
+		{"dev", "0.1.4", false},
+		{"1.x", "0.1.4", false},
+	}
+	for _, tt := range tests {
+		if got := clientMeetsMinimum(tt.version, tt.minimum); got != tt.want {
+			t.Errorf("clientMeetsMinimum(%q, %q) = %v, want %v", tt.version, tt.minimum, got, tt.want)
+		}
+	}
+}
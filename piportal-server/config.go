@@ -1,53 +1,302 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// defaultReservedSubdomains are names the service uses itself or that would look official
+const defaultReservedSubdomains = "www,api,app,admin,mail,ftp,ssh,tunnel,dev,staging,test"
+
 // Config holds server configuration
 type Config struct {
 	// HTTP server settings
-	HTTPAddr  string // Address for HTTP server (e.g., ":80")
-	HTTPSAddr string // Address for HTTPS server (e.g., ":443")
+	HTTPAddr  string `yaml:"http_addr"`  // Address for HTTP server (e.g., ":80")
+	HTTPSAddr string `yaml:"https_addr"` // Address for HTTPS server (e.g., ":443")
 
 	// TLS settings
-	TLSCert string // Path to TLS certificate
-	TLSKey  string // Path to TLS private key
-	AutoTLS bool   // Use automatic TLS with Let's Encrypt
+	TLSCert string `yaml:"tls_cert"` // Path to TLS certificate
+	TLSKey  string `yaml:"tls_key"`  // Path to TLS private key
+	AutoTLS bool   `yaml:"auto_tls"` // Use automatic TLS with Let's Encrypt
+
+	CertCacheDir string `yaml:"cert_cache_dir"` // Where -auto-tls keeps issued certificates
+	CertWarnDays int    `yaml:"cert_warn_days"` // Status turns to warning when a certificate has fewer days left
+
+	// HTTP server limits, so slow or stalled clients can't hold connections open
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"` // Time allowed to send request headers
+	WriteTimeout      time.Duration `yaml:"write_timeout"`       // Time allowed to write a response (0 = no limit)
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`    // Largest request header block accepted
 
 	// Domain settings
-	BaseDomain string // Base domain (e.g., "piportal.dev")
+	BaseDomain string `yaml:"base_domain"` // Base domain (e.g., "piportal.dev")
 
 	// Database
-	DatabasePath string // Path to SQLite database
+	DatabaseDriver    string        `yaml:"database_driver"`     // "sqlite" or "postgres" (empty = detect from path)
+	DatabasePath      string        `yaml:"database_path"`       // Path to SQLite database or Postgres DSN
+	SQLiteWAL         bool          `yaml:"sqlite_wal"`          // Enable WAL journal mode
+	SQLiteBusyTimeout time.Duration `yaml:"sqlite_busy_timeout"` // Wait time for locked database
+	DBMaxConns        int           `yaml:"db_max_conns"`        // Max open database connections
 
 	// JWT secret for dashboard auth
-	JWTSecret string
+	JWTSecret string `yaml:"jwt_secret"`
+
+	// Signing keys as id:secret pairs, newest first (comma-separated in
+	// PIPORTAL_JWT_KEYS). The first signs new tokens; the rest (and
+	// jwt_secret) are only accepted, so a secret can be rotated without
+	// logging everyone out.
+	JWTKeys []string `yaml:"jwt_keys"`
+
+	// Dashboard logins: short-lived access tokens, renewed from a session
+	// that slides forward each time it's used
+	AccessTokenTTL time.Duration `yaml:"access_token_ttl"`
+	SessionTTL     time.Duration `yaml:"session_ttl"`
+
+	// Email of the operator granted admin on startup (or when they sign up)
+	AdminEmail string `yaml:"admin_email"`
+
+	// Logging
+	LogLevel  string `yaml:"log_level"`  // debug, info, warn or error
+	LogFormat string `yaml:"log_format"` // text or json
 
 	// Development mode
-	DevMode bool // Skip TLS, allow localhost
+	DevMode bool `yaml:"dev_mode"` // Skip TLS, allow localhost
 
 	// Reverse proxy mode (TLS handled by Caddy/nginx)
-	BehindProxy bool
+	BehindProxy bool `yaml:"behind_proxy"`
+
+	// Subdomains nobody can register, on top of the structural rules
+	ReservedSubdomains       string `yaml:"reserved_subdomains"`        // Comma-separated names
+	ReservedSubdomainPattern string `yaml:"reserved_subdomain_pattern"` // Regexp; matching names are reserved too
+	SubdomainDenylist        string `yaml:"subdomain_denylist"`         // File of terms (one per line) names may not contain
+
+	// Abuse scanning of tunnel responses (phishing, malware). Off unless a
+	// blocklist is set; only URLs and headers are checked unless content
+	// scanning is switched on too.
+	AbuseBlocklist   string `yaml:"abuse_blocklist"`    // File of blocked URL terms and content: patterns
+	AbuseScanContent bool   `yaml:"abuse_scan_content"` // Also check the bodies of text responses
+	AbuseAutoBlock   bool   `yaml:"abuse_auto_block"`   // Stop forwarding for flagged tunnels until an admin reviews them
+
+	// CORS allowlist for /api/v1/* (comma-separated origins, "*" only in dev mode)
+	CORSOrigins string `yaml:"cors_origins"`
+
+	// Dashboard session cookie. It's host-only unless a domain is given.
+	CookieDomain   string `yaml:"cookie_domain"`   // Share the session across this domain's hosts
+	CookieSameSite string `yaml:"cookie_samesite"` // lax, strict or none
+	CookieInsecure bool   `yaml:"cookie_insecure"` // Also send it over plain HTTP
+
+	// Proxied request limits (free tier, and pro tier overrides)
+	RequestTimeout    time.Duration `yaml:"request_timeout"`
+	MaxBodySize       int64         `yaml:"max_body_size"`
+	ProRequestTimeout time.Duration `yaml:"pro_request_timeout"`
+	ProMaxBodySize    int64         `yaml:"pro_max_body_size"`
+
+	// Tunnel liveness: close tunnels that go silent or sit unused
+	LivenessTimeout time.Duration `yaml:"liveness_timeout"` // No frames (incl. pongs) for this long = dead client
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`     // No requests or terminals for this long (0 = never)
+
+	// Keepalive pings to clients, which also measure link latency. A tunnel
+	// read with nothing arriving for TunnelReadTimeout fails.
+	PingInterval      time.Duration `yaml:"ping_interval"`
+	TunnelReadTimeout time.Duration `yaml:"tunnel_read_timeout"`
+
+	// Refuse tunnels from clients older than this version ("" accepts any)
+	MinClientVersion string `yaml:"min_client_version"`
+
+	// Wait this long after a disconnect before marking a device offline (0 = immediately)
+	OfflineGracePeriod time.Duration `yaml:"offline_grace_period"`
+
+	// Devices per user: free-tier ones (only enforced with billing) and all of them (0 = unlimited)
+	FreeDeviceLimit   int `yaml:"free_device_limit"`
+	MaxDevicesPerUser int `yaml:"max_devices_per_user"`
+
+	// Let webhooks post to private and local addresses, e.g. a service on
+	// the operator's LAN. Off, they may only reach public addresses.
+	WebhookAllowPrivate bool `yaml:"webhook_allow_private"`
+
+	// Warn owners once a month when usage passes this share of the limit (0 = never)
+	BandwidthWarnPercent int `yaml:"bandwidth_warn_percent"`
+
+	// Opt-in per-device response cache for static content
+	CacheMaxEntrySize int64 `yaml:"cache_max_entry_size"` // Largest response body cached
+	CacheMaxSize      int64 `yaml:"cache_max_size"`       // Total cached bodies per device
+
+	// permessage-deflate level for tunnel links (0 disables, 1 fastest, 9 smallest)
+	TunnelCompression int `yaml:"tunnel_compression"`
+
+	// Concurrent proxied requests per tunnel; more get a 503 instead of queuing
+	MaxInFlight int `yaml:"max_inflight_requests"`
+
+	// Connected tunnels across the server; more clients are turned away with
+	// a 503 until one disconnects (0 = unlimited)
+	MaxTunnels int `yaml:"max_tunnels"`
+
+	// Circuit breaker: after this many failed requests in a row a tunnel
+	// answers 503 without forwarding until the cooldown ends (0 disables)
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+
+	// Retries for proxied requests that time out or lose their tunnel
+	RetryCount   int    `yaml:"retry_count"`   // Extra attempts per request (0 disables)
+	RetryMethods string `yaml:"retry_methods"` // Comma-separated methods eligible for retry
+
+	// Safe requests whose tunnel drops wait this long for the device to
+	// reconnect and are then sent again (0 disables), at most
+	// ReplayMaxRequests per device at a time
+	ReplayWindow      time.Duration `yaml:"replay_window"`
+	ReplayMaxRequests int           `yaml:"replay_max_requests"`
+
+	// Web terminal limits
+	MaxTerminalSessions     int           `yaml:"max_terminal_sessions"`      // Concurrent terminals per device
+	MaxUserTerminalSessions int           `yaml:"max_user_terminal_sessions"` // Of those, how many one user may hold (0 = all of them)
+	TerminalIdleTimeout     time.Duration `yaml:"terminal_idle_timeout"`      // Close after no input for this long (0 = never)
+	TerminalReattachGrace   time.Duration `yaml:"terminal_reattach_grace"`    // Keep the shell this long for a dropped browser to reconnect (0 = don't)
+	RecordingsDir           string        `yaml:"recordings_dir"`             // Where opted-in terminal sessions are recorded
+
+	// Usage quotas, per device and across each user's devices (0 = unlimited).
+	// Exec commands are counted per hour and terminal time per day, in UTC.
+	ExecQuotaPerHour        int           `yaml:"exec_quota_per_hour"`
+	TerminalQuotaPerDay     time.Duration `yaml:"terminal_quota_per_day"`
+	UserExecQuotaPerHour    int           `yaml:"user_exec_quota_per_hour"`
+	UserTerminalQuotaPerDay time.Duration `yaml:"user_terminal_quota_per_day"`
+
+	// Max run time for commands streamed via /api/v1/devices/{id}/exec
+	ExecStreamTimeout time.Duration `yaml:"exec_stream_timeout"`
+
+	// Stripe billing for the pro tier (disabled unless the secret key is set)
+	StripeSecretKey     string `yaml:"stripe_secret_key"`
+	StripeWebhookSecret string `yaml:"stripe_webhook_secret"` // Signing secret for /api/v1/billing/webhook
+	StripePriceID       string `yaml:"stripe_price_id"`       // Recurring per-device pro price
+
+	// Monthly usage maintenance
+	UsageRetentionMonths int  `yaml:"usage_retention_months"` // Completed months of usage history to keep (0 = forever)
+	UsageReportEmails    bool `yaml:"usage_report_emails"`    // Email each user last month's usage on the 1st
+
+	// Outgoing mail (SMTP)
+	SMTPAddr     string `yaml:"smtp_addr"` // host:port
+	SMTPFrom     string `yaml:"smtp_from"`
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+}
+
+// RequestLimits bounds a single request proxied through a tunnel
+type RequestLimits struct {
+	Timeout     time.Duration // How long to wait for the device to respond
+	MaxBodySize int64         // Max request/response body in bytes
+}
+
+// LoadConfig loads configuration from flags, an optional YAML file, and environment.
+// Precedence (lowest to highest): defaults < config file < environment < explicit flags.
+func LoadConfig() (*Config, error) {
+	return loadConfig(flag.CommandLine, os.Args[1:])
 }
 
-// LoadConfig loads configuration from flags and environment
-func LoadConfig() *Config {
+// loadConfig is LoadConfig with the flags defined on fs and parsed from args
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
 	cfg := &Config{}
+	var configPath string
 
-	flag.StringVar(&cfg.HTTPAddr, "http", ":80", "HTTP listen address")
-	flag.StringVar(&cfg.HTTPSAddr, "https", ":443", "HTTPS listen address")
-	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "Path to TLS certificate")
-	flag.StringVar(&cfg.TLSKey, "tls-key", "", "Path to TLS private key")
-	flag.BoolVar(&cfg.AutoTLS, "auto-tls", false, "Use Let's Encrypt for TLS")
-	flag.StringVar(&cfg.BaseDomain, "domain", "piportal.dev", "Base domain for tunnels")
-	flag.StringVar(&cfg.DatabasePath, "db", "piportal.db", "Path to SQLite database")
-	flag.BoolVar(&cfg.DevMode, "dev", false, "Development mode (no TLS, allows localhost)")
-	flag.BoolVar(&cfg.BehindProxy, "behind-proxy", false, "Running behind reverse proxy (TLS handled externally)")
+	fs.StringVar(&configPath, "config", "", "Path to YAML config file (e.g. /etc/piportal/server.yaml)")
+	fs.StringVar(&cfg.HTTPAddr, "http", ":80", "HTTP listen address")
+	fs.StringVar(&cfg.HTTPSAddr, "https", ":443", "HTTPS listen address")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "Path to TLS certificate")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "Path to TLS private key")
+	fs.BoolVar(&cfg.AutoTLS, "auto-tls", false, "Use Let's Encrypt for TLS")
+	fs.StringVar(&cfg.CertCacheDir, "cert-cache", "certs", "Directory for Let's Encrypt certificates (with -auto-tls)")
+	fs.IntVar(&cfg.CertWarnDays, "cert-warn-days", 14, "Report a TLS warning on /status when a certificate has fewer days left")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Time allowed for a client to send request headers")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 2*time.Minute, "Time allowed to write a response; tunnel requests also get their request timeout (0 disables)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", 1<<20, "Largest request header block accepted, in bytes")
+	fs.StringVar(&cfg.BaseDomain, "domain", "piportal.dev", "Base domain for tunnels")
+	fs.StringVar(&cfg.DatabaseDriver, "db-driver", "", "Database driver: sqlite or postgres (default: detect from -db)")
+	fs.StringVar(&cfg.DatabasePath, "db", "piportal.db", "Path to SQLite database or postgres:// DSN")
+	fs.BoolVar(&cfg.SQLiteWAL, "sqlite-wal", true, "Enable SQLite WAL mode (journal_mode=WAL, synchronous=NORMAL)")
+	fs.DurationVar(&cfg.SQLiteBusyTimeout, "sqlite-busy-timeout", 5*time.Second, "How long SQLite waits on a locked database")
+	fs.IntVar(&cfg.DBMaxConns, "db-max-conns", 8, "Maximum open database connections (SQLite with WAL opens one more, for writes)")
+	fs.StringVar(&cfg.AdminEmail, "admin-email", "", "Grant admin access at startup to the existing account with this email")
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "Minimum log level: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", "text", "Log output format: text or json")
+	fs.BoolVar(&cfg.DevMode, "dev", false, "Development mode (no TLS, allows localhost)")
+	fs.BoolVar(&cfg.BehindProxy, "behind-proxy", false, "Running behind reverse proxy (TLS handled externally)")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", 30*time.Second, "Timeout for proxied requests (free tier)")
+	fs.Int64Var(&cfg.MaxBodySize, "max-body-size", 10*1024*1024, "Max proxied body size in bytes (free tier)")
+	fs.DurationVar(&cfg.ProRequestTimeout, "pro-request-timeout", 120*time.Second, "Timeout for proxied requests (pro tier)")
+	fs.Int64Var(&cfg.ProMaxBodySize, "pro-max-body-size", 100*1024*1024, "Max proxied body size in bytes (pro tier)")
+	fs.DurationVar(&cfg.LivenessTimeout, "liveness-timeout", 65*time.Second, "Close a tunnel after this long without any traffic or pong")
+	fs.DurationVar(&cfg.PingInterval, "ping-interval", 30*time.Second, "How often to ping tunnel clients; lower detects dead links sooner")
+	fs.DurationVar(&cfg.TunnelReadTimeout, "tunnel-read-timeout", 90*time.Second, "Drop a tunnel after this long without receiving anything, pongs included")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 0, "Close tunnels with no requests or terminal sessions for this long (0 disables)")
+	fs.DurationVar(&cfg.OfflineGracePeriod, "offline-grace", 15*time.Second, "Wait this long for a disconnected device to reconnect before marking it offline (0 disables)")
+	fs.IntVar(&cfg.RetryCount, "retry-count", 1, "Times to retry an idempotent request that timed out (0 disables)")
+	fs.StringVar(&cfg.RetryMethods, "retry-methods", "GET,HEAD,OPTIONS", "Comma-separated HTTP methods eligible for retry")
+	fs.DurationVar(&cfg.ReplayWindow, "replay-window", 2*time.Second, "How long GET, HEAD and OPTIONS requests cut off by a dropped tunnel wait for the device to reconnect before failing (0 disables)")
+	fs.IntVar(&cfg.ReplayMaxRequests, "replay-max-requests", 32, "Requests per device that may wait for a reconnect at once")
+	fs.IntVar(&cfg.MaxInFlight, "max-inflight", 100, "Maximum concurrent proxied requests per tunnel")
+	fs.IntVar(&cfg.MaxTunnels, "max-tunnels", 0, "Maximum connected tunnels; more clients are refused until one disconnects (0 = unlimited)")
+	fs.IntVar(&cfg.BreakerThreshold, "breaker-threshold", 10, "Consecutive failed requests (502s, timeouts) that pause forwarding to a tunnel (0 disables)")
+	fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", 30*time.Second, "How long forwarding stays paused before a test request is let through")
+	fs.IntVar(&cfg.FreeDeviceLimit, "free-device-limit", 1, "Free-tier devices per user when billing is enabled (0 = unlimited)")
+	fs.IntVar(&cfg.MaxDevicesPerUser, "max-devices-per-user", 0, "Maximum devices per user, any tier (0 = unlimited)")
+	fs.IntVar(&cfg.BandwidthWarnPercent, "bandwidth-warn-percent", 80, "Warn device owners when monthly usage passes this percentage of the limit (0 disables)")
+	fs.Int64Var(&cfg.CacheMaxEntrySize, "cache-max-entry-size", 1024*1024, "Largest response body kept in a device's response cache, in bytes")
+	fs.Int64Var(&cfg.CacheMaxSize, "cache-max-size", 16*1024*1024, "Response cache size per device, in bytes")
+	fs.StringVar(&cfg.MinClientVersion, "min-client-version", "", "Refuse tunnels from clients older than this version, e.g. 0.1.4 (default accepts any)")
+	fs.IntVar(&cfg.TunnelCompression, "tunnel-compression", 1, "Compression level for tunnel links, 1 (fastest) to 9 (smallest); 0 disables")
+	fs.IntVar(&cfg.MaxTerminalSessions, "max-terminals", 3, "Maximum concurrent terminal sessions per device")
+	fs.IntVar(&cfg.MaxUserTerminalSessions, "max-user-terminals", 0, "Maximum concurrent terminal sessions one user may hold on a device, so teammates sharing it aren't locked out (0 = up to -max-terminals)")
+	fs.DurationVar(&cfg.TerminalIdleTimeout, "terminal-idle-timeout", 30*time.Minute, "Close terminal sessions with no input for this long (0 disables)")
+	fs.DurationVar(&cfg.TerminalReattachGrace, "terminal-reattach-grace", time.Minute, "Keep a terminal's shell running this long after its browser connection drops, so the browser can reconnect to it (0 ends it straight away)")
+	fs.IntVar(&cfg.ExecQuotaPerHour, "exec-quota", 0, "Commands each device may run per hour (0 = unlimited)")
+	fs.DurationVar(&cfg.TerminalQuotaPerDay, "terminal-quota", 0, "Terminal time each device may use per day, e.g. 2h (0 = unlimited)")
+	fs.IntVar(&cfg.UserExecQuotaPerHour, "user-exec-quota", 0, "Commands each user may run per hour across their devices (0 = unlimited)")
+	fs.DurationVar(&cfg.UserTerminalQuotaPerDay, "user-terminal-quota", 0, "Terminal time each user may use per day across their devices (0 = unlimited)")
+	fs.StringVar(&cfg.RecordingsDir, "recordings-dir", "recordings", "Directory for terminal recordings (asciicast v2)")
+	fs.DurationVar(&cfg.ExecStreamTimeout, "exec-stream-timeout", 10*time.Minute, "Maximum run time for streamed exec commands")
+	fs.StringVar(&cfg.StripePriceID, "stripe-price", "", "Stripe price ID for the pro per-device plan")
+	fs.IntVar(&cfg.UsageRetentionMonths, "usage-retention-months", 12, "Completed months of bandwidth usage history to keep (0 keeps everything)")
+	fs.BoolVar(&cfg.UsageReportEmails, "usage-report-emails", false, "Email users a summary of last month's usage on the 1st (requires -smtp-addr)")
+	fs.BoolVar(&cfg.WebhookAllowPrivate, "webhook-allow-private", false, "Let webhooks post to private and local addresses (default only public ones)")
+	fs.StringVar(&cfg.SMTPAddr, "smtp-addr", "", "SMTP server for outgoing mail (host:port)")
+	fs.StringVar(&cfg.SMTPFrom, "smtp-from", "", "From address for outgoing mail")
+	fs.StringVar(&cfg.SMTPUsername, "smtp-username", "", "SMTP username (password via PIPORTAL_SMTP_PASSWORD)")
+	fs.StringVar(&cfg.ReservedSubdomains, "reserved-subdomains", defaultReservedSubdomains, "Comma-separated subdomains that can't be registered")
+	fs.StringVar(&cfg.ReservedSubdomainPattern, "reserved-subdomain-pattern", "", "Regular expression for more reserved subdomains (e.g. ^(staff|support)-)")
+	fs.StringVar(&cfg.SubdomainDenylist, "subdomain-denylist", "", "File of blocked terms, one per line; subdomains containing any can't be registered")
+	fs.StringVar(&cfg.AbuseBlocklist, "abuse-blocklist", "", "File of URL terms and content: patterns that flag a tunnel for abuse review (enables scanning)")
+	fs.BoolVar(&cfg.AbuseScanContent, "abuse-scan-content", false, "Scan the bodies of text responses too, not just URLs and headers")
+	fs.BoolVar(&cfg.AbuseAutoBlock, "abuse-auto-block", false, "Stop forwarding for flagged tunnels until an admin reviews them")
+	fs.DurationVar(&cfg.AccessTokenTTL, "access-token-ttl", 15*time.Minute, "Lifetime of dashboard access tokens")
+	fs.DurationVar(&cfg.SessionTTL, "session-ttl", 30*24*time.Hour, "Dashboard sessions end after going unused for this long")
+	fs.StringVar(&cfg.CookieDomain, "cookie-domain", "", "Domain for the dashboard session cookie, e.g. example.com (default: host-only)")
+	fs.StringVar(&cfg.CookieSameSite, "cookie-samesite", "lax", "SameSite mode for the dashboard session cookie: lax, strict or none")
+	fs.BoolVar(&cfg.CookieInsecure, "cookie-insecure", false, "Send the dashboard session cookie over plain HTTP too (only for setups without HTTPS)")
+	fs.StringVar(&cfg.CORSOrigins, "cors-origins", "", "Comma-separated origins allowed to call /api/v1/* (\"*\" allowed only with -dev)")
 
-	flag.Parse()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Remember flags given on the command line so they can win over file and env
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	// Config file overrides defaults
+	if configPath == "" {
+		configPath = os.Getenv("PIPORTAL_CONFIG")
+	}
+	if configPath != "" {
+		if err := cfg.loadFile(configPath); err != nil {
+			return nil, err
+		}
+	}
 
 	// Environment overrides
 	if v := os.Getenv("PIPORTAL_DOMAIN"); v != "" {
@@ -56,16 +305,68 @@ func LoadConfig() *Config {
 	if v := os.Getenv("PIPORTAL_DB"); v != "" {
 		cfg.DatabasePath = v
 	}
+	if v := os.Getenv("PIPORTAL_LOG_LEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := os.Getenv("PIPORTAL_LOG_FORMAT"); v != "" {
+		cfg.LogFormat = v
+	}
 	if os.Getenv("PIPORTAL_DEV") == "1" {
 		cfg.DevMode = true
 	}
 	if v := os.Getenv("PIPORTAL_JWT_SECRET"); v != "" {
 		cfg.JWTSecret = v
-	} else if cfg.DevMode {
+	}
+	if v := os.Getenv("PIPORTAL_JWT_KEYS"); v != "" {
+		cfg.JWTKeys = strings.Split(v, ",")
+	}
+	if v := os.Getenv("PIPORTAL_ADMIN_EMAIL"); v != "" {
+		cfg.AdminEmail = v
+	}
+	if v := os.Getenv("PIPORTAL_STRIPE_SECRET_KEY"); v != "" {
+		cfg.StripeSecretKey = v
+	}
+	if v := os.Getenv("PIPORTAL_STRIPE_WEBHOOK_SECRET"); v != "" {
+		cfg.StripeWebhookSecret = v
+	}
+	if v := os.Getenv("PIPORTAL_STRIPE_PRICE_ID"); v != "" {
+		cfg.StripePriceID = v
+	}
+	if v := os.Getenv("PIPORTAL_SMTP_PASSWORD"); v != "" {
+		cfg.SMTPPassword = v
+	}
+
+	// Explicit flags override everything
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value for -%s: %w", name, err)
+		}
+	}
+
+	if cfg.JWTSecret == "" && len(cfg.JWTKeys) == 0 && cfg.DevMode {
 		cfg.JWTSecret = "piportal-dev-secret-do-not-use-in-prod"
 	}
 
-	return cfg
+	cfg.AdminEmail = strings.ToLower(strings.TrimSpace(cfg.AdminEmail))
+
+	return cfg, nil
+}
+
+// loadFile reads a YAML config file on top of the current values. A key
+// that isn't a setting is an error rather than ignored, so a typo such as
+// max_tunnel: 100 doesn't silently leave the default in place.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer f.Close()
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) { // EOF: the file is empty
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
 }
 
 // Validate checks the configuration
@@ -77,8 +378,194 @@ func (c *Config) Validate() error {
 	if !c.DevMode && !c.BehindProxy && !c.AutoTLS && (c.TLSCert == "" || c.TLSKey == "") {
 		return fmt.Errorf("TLS certificate and key required (or use -auto-tls, -behind-proxy, or -dev)")
 	}
-	if c.JWTSecret == "" {
-		return fmt.Errorf("PIPORTAL_JWT_SECRET is required (or use -dev mode)")
+	if c.AutoTLS && c.CertCacheDir == "" {
+		return fmt.Errorf("certificate cache directory is required with -auto-tls")
+	}
+	if c.CertWarnDays < 0 {
+		return fmt.Errorf("cert warn days cannot be negative")
+	}
+	if _, err := parseJWTKeys(c.JWTKeys); err != nil {
+		return err
+	}
+	if len(c.jwtKeys()) == 0 {
+		return fmt.Errorf("PIPORTAL_JWT_SECRET or PIPORTAL_JWT_KEYS is required (or use -dev mode)")
+	}
+	if c.ReadHeaderTimeout <= 0 {
+		return fmt.Errorf("read header timeout must be positive")
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write timeout cannot be negative")
+	}
+	if c.MaxHeaderBytes < 4096 {
+		return fmt.Errorf("max header bytes must be at least 4096")
+	}
+	if c.RequestTimeout <= 0 || c.ProRequestTimeout <= 0 {
+		return fmt.Errorf("request timeouts must be positive")
+	}
+	if c.MaxBodySize <= 0 || c.ProMaxBodySize <= 0 {
+		return fmt.Errorf("max body sizes must be positive")
+	}
+	if c.ExecStreamTimeout <= 0 {
+		return fmt.Errorf("exec stream timeout must be positive")
+	}
+	if c.FreeDeviceLimit < 0 || c.MaxDevicesPerUser < 0 {
+		return fmt.Errorf("device limits cannot be negative")
+	}
+	if c.BandwidthWarnPercent < 0 || c.BandwidthWarnPercent >= 100 {
+		return fmt.Errorf("bandwidth warning percentage must be between 0 and 99")
+	}
+	if c.CacheMaxEntrySize <= 0 || c.CacheMaxSize < c.CacheMaxEntrySize {
+		return fmt.Errorf("cache sizes must be positive, with the total at least the max entry size")
+	}
+	if c.TunnelCompression < 0 || c.TunnelCompression > 9 {
+		return fmt.Errorf("tunnel compression level must be between 0 and 9")
+	}
+	if c.PingInterval <= 0 {
+		return fmt.Errorf("ping interval must be positive")
+	}
+	if c.TunnelReadTimeout <= c.PingInterval {
+		return fmt.Errorf("tunnel read timeout must be longer than the ping interval")
+	}
+	if c.LivenessTimeout > 0 && c.LivenessTimeout <= c.PingInterval {
+		return fmt.Errorf("liveness timeout must be longer than the ping interval, or 0 to disable it")
+	}
+	if c.MaxInFlight < 1 {
+		return fmt.Errorf("max in-flight requests must be at least 1")
+	}
+	if c.MaxTunnels < 0 {
+		return fmt.Errorf("max tunnels cannot be negative")
+	}
+	if c.BreakerThreshold < 0 {
+		return fmt.Errorf("breaker threshold cannot be negative")
+	}
+	if c.BreakerThreshold > 0 && c.BreakerCooldown <= 0 {
+		return fmt.Errorf("breaker cooldown must be positive")
+	}
+	if c.ExecQuotaPerHour < 0 || c.UserExecQuotaPerHour < 0 || c.TerminalQuotaPerDay < 0 || c.UserTerminalQuotaPerDay < 0 {
+		return fmt.Errorf("quotas cannot be negative")
+	}
+	if (c.AbuseScanContent || c.AbuseAutoBlock) && c.AbuseBlocklist == "" {
+		return fmt.Errorf("abuse scanning needs an abuse blocklist")
+	}
+	if c.MaxTerminalSessions < 1 {
+		return fmt.Errorf("max terminal sessions must be at least 1")
+	}
+	if c.MaxUserTerminalSessions < 0 {
+		return fmt.Errorf("max user terminal sessions cannot be negative")
+	}
+	if c.TerminalReattachGrace < 0 {
+		return fmt.Errorf("terminal reattach grace cannot be negative")
+	}
+	if c.AccessTokenTTL <= 0 || c.SessionTTL < c.AccessTokenTTL {
+		return fmt.Errorf("access token TTL must be positive and no longer than the session TTL")
+	}
+	switch strings.ToLower(c.CookieSameSite) {
+	case "", "lax", "strict":
+	case "none":
+		if !c.cookieSecure() {
+			return fmt.Errorf("-cookie-samesite none requires a secure cookie (not -dev or -cookie-insecure)")
+		}
+	default:
+		return fmt.Errorf("invalid cookie SameSite mode %q (use lax, strict or none)", c.CookieSameSite)
+	}
+	if c.CookieDomain != "" && cookieDomainCoversTunnels(c.CookieDomain, c.BaseDomain) {
+		return fmt.Errorf("cookie domain %s would send dashboard sessions to tunnel subdomains (*.%s)", c.CookieDomain, c.BaseDomain)
+	}
+	if _, ok := parseVersion(c.MinClientVersion); c.MinClientVersion != "" && !ok {
+		return fmt.Errorf("invalid minimum client version %q", c.MinClientVersion)
+	}
+	if c.OfflineGracePeriod < 0 {
+		return fmt.Errorf("offline grace period cannot be negative")
+	}
+	if c.RetryCount < 0 {
+		return fmt.Errorf("retry count cannot be negative")
+	}
+	if c.ReplayWindow < 0 {
+		return fmt.Errorf("replay window cannot be negative")
+	}
+	if c.ReplayWindow > 0 && c.ReplayMaxRequests < 1 {
+		return fmt.Errorf("replay max requests must be at least 1")
+	}
+	for _, method := range strings.Split(c.RetryMethods, ",") {
+		switch strings.ToUpper(strings.TrimSpace(method)) {
+		case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		default:
+			return fmt.Errorf("-retry-methods: %s is not idempotent", strings.TrimSpace(method))
+		}
+	}
+	if c.BillingEnabled() && (c.StripeWebhookSecret == "" || c.StripePriceID == "") {
+		return fmt.Errorf("billing requires PIPORTAL_STRIPE_WEBHOOK_SECRET and a Stripe price ID")
+	}
+	if c.UsageRetentionMonths < 0 {
+		return fmt.Errorf("usage retention months cannot be negative")
+	}
+	if c.UsageReportEmails && (c.SMTPAddr == "" || c.SMTPFrom == "") {
+		return fmt.Errorf("-usage-report-emails requires -smtp-addr and -smtp-from")
+	}
+	for _, origin := range c.corsOrigins() {
+		if origin == "*" && !c.DevMode {
+			return fmt.Errorf("-cors-origins \"*\" is only allowed in -dev mode")
+		}
 	}
 	return nil
 }
+
+// LimitsForTier returns the proxy limits for a device tier
+func (c *Config) LimitsForTier(tier string) RequestLimits {
+	if tier == "pro" {
+		return RequestLimits{Timeout: c.ProRequestTimeout, MaxBodySize: c.ProMaxBodySize}
+	}
+	return RequestLimits{Timeout: c.RequestTimeout, MaxBodySize: c.MaxBodySize}
+}
+
+// BandwidthWarning reports whether usage has passed the soft limit
+func (c *Config) BandwidthWarning(used, limit int64) bool {
+	return c.BandwidthWarnPercent > 0 && limit > 0 && used*100 >= limit*int64(c.BandwidthWarnPercent)
+}
+
+// BillingEnabled reports whether Stripe billing is configured
+func (c *Config) BillingEnabled() bool {
+	return c.StripeSecretKey != ""
+}
+
+// RetriesFor returns how many times a request with this method may be retried
+func (c *Config) RetriesFor(method string) int {
+	for _, m := range strings.Split(c.RetryMethods, ",") {
+		if strings.EqualFold(strings.TrimSpace(m), method) {
+			return c.RetryCount
+		}
+	}
+	return 0
+}
+
+// corsOrigins returns the parsed CORS allowlist
+func (c *Config) corsOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(c.CORSOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// jwtKeys returns the keys dashboard tokens may be signed with, the signing
+// key first. jwt_secret comes last with no ID, for tokens issued before
+// key IDs were used.
+func (c *Config) jwtKeys() []JWTKey {
+	keys, _ := parseJWTKeys(c.JWTKeys)
+	if c.JWTSecret != "" {
+		keys = append(keys, JWTKey{Secret: c.JWTSecret})
+	}
+	return keys
+}
+
+// AllowsOrigin reports whether a browser origin may call the dashboard API
+func (c *Config) AllowsOrigin(origin string) bool {
+	for _, allowed := range c.corsOrigins() {
+		if allowed == origin || (allowed == "*" && c.DevMode) {
+			return true
+		}
+	}
+	return false
+}
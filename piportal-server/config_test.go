@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig runs loadConfig on args with a fresh flag set
+func loadTestConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	fs := flag.NewFlagSet("piportal-server", flag.ContinueOnError)
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		t.Fatalf("loadConfig(%q): %v", args, err)
+	}
+	return cfg
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string   // base_domain in the config file, if any
+		env  string   // PIPORTAL_DOMAIN
+		args []string // Command line
+		want string
+	}{
+		{"default", "", "", nil, "piportal.dev"},
+		{"file over default", "file.example", "", nil, "file.example"},
+		{"env over file", "file.example", "env.example", nil, "env.example"},
+		{"flag over env", "file.example", "env.example", []string{"-domain", "flag.example"}, "flag.example"},
+		{"flag over file", "file.example", "", []string{"-domain", "flag.example"}, "flag.example"},
+		// Given explicitly, even the default value wins
+		{"explicit default flag over env", "", "env.example", []string{"-domain", "piportal.dev"}, "piportal.dev"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := ""
+			if tt.file != "" {
+				configPath = filepath.Join(t.TempDir(), "server.yaml")
+				if err := os.WriteFile(configPath, []byte("base_domain: "+tt.file+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PIPORTAL_CONFIG", configPath)
+			t.Setenv("PIPORTAL_DOMAIN", tt.env)
+
+			cfg := loadTestConfig(t, tt.args...)
+			if cfg.BaseDomain != tt.want {
+				t.Errorf("base domain = %q, want %q", cfg.BaseDomain, tt.want)
+			}
+		})
+	}
+}
+
+// The -config flag names the file as well as PIPORTAL_CONFIG
+func TestConfigFileFlag(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(configPath, []byte("base_domain: file.example\nmax_body_size: 7\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PIPORTAL_CONFIG", "")
+	t.Setenv("PIPORTAL_DOMAIN", "")
+
+	cfg := loadTestConfig(t, "-config", configPath, "-max-body-size", "9")
+	if cfg.BaseDomain != "file.example" {
+		t.Errorf("base domain = %q, want file.example", cfg.BaseDomain)
+	}
+	if cfg.MaxBodySize != 9 {
+		t.Errorf("max body size = %d, want 9", cfg.MaxBodySize)
+	}
+}
+
+// A misspelled setting is an error, not silently ignored; an empty file is
+// fine
+func TestConfigFileUnknownKey(t *testing.T) {
+	var cfg Config
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(configPath, []byte("base_domain: file.example\nmax_tunnel: 100\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.loadFile(configPath); err == nil || !strings.Contains(err.Error(), "max_tunnel") {
+		t.Errorf("loadFile = %v, want an error naming max_tunnel", err)
+	}
+
+	if err := os.WriteFile(configPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.loadFile(configPath); err != nil {
+		t.Errorf("loadFile of an empty file: %v", err)
+	}
+}
+
+// jwt_keys is a list in the config file and comma-separated in the
+// environment
+func TestJWTKeysConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(configPath, []byte("jwt_keys:\n  - \"2026-10:new\"\n  - \"2026-04:old\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PIPORTAL_CONFIG", configPath)
+	t.Setenv("PIPORTAL_JWT_KEYS", "")
+
+	keys := loadTestConfig(t).jwtKeys()
+	if len(keys) != 2 || keys[0] != (JWTKey{ID: "2026-10", Secret: "new"}) || keys[1].ID != "2026-04" {
+		t.Errorf("keys from the file = %+v", keys)
+	}
+
+	t.Setenv("PIPORTAL_JWT_KEYS", "env:secret, older:secret2")
+	keys = loadTestConfig(t).jwtKeys()
+	if len(keys) != 2 || keys[0].ID != "env" || keys[1] != (JWTKey{ID: "older", Secret: "secret2"}) {
+		t.Errorf("keys from the environment = %+v", keys)
+	}
+}
+
+// A malformed key is reported by position, so the secret isn't logged
+func TestParseJWTKeysError(t *testing.T) {
+	_, err := parseJWTKeys([]string{"2026-10:new", "no-colon-secret"})
+	if err == nil || err.Error() != "JWT key #2 is not id:secret" {
+		t.Errorf("err = %v, want JWT key #2 is not id:secret", err)
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -21,6 +28,11 @@ var dashboardFS embed.FS
 func (h *Handler) handleDashboardAPI(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 
+	// CORS for third-party frontends (preflights end here)
+	if h.handleCORS(w, r) {
+		return
+	}
+
 	// Public routes
 	switch {
 	case path == "/api/v1/signup" && r.Method == http.MethodPost:
@@ -32,30 +44,128 @@ func (h *Handler) handleDashboardAPI(w http.ResponseWriter, r *http.Request) {
 	case path == "/api/v1/logout" && r.Method == http.MethodPost:
 		h.handleLogout(w, r)
 		return
+	case path == "/api/v1/refresh" && r.Method == http.MethodPost:
+		h.handleRefresh(w, r)
+		return
+	case path == "/api/v1/billing/webhook" && r.Method == http.MethodPost:
+		h.handleBillingWebhook(w, r)
+		return
 	}
 
 	// Protected routes
 	switch {
 	case path == "/api/v1/me" && r.Method == http.MethodGet:
 		h.AuthMiddleware(h.handleMe)(w, r)
+	case path == "/api/v1/sessions" && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleListSessions)(w, r)
+	case path == "/api/v1/sessions" && r.Method == http.MethodDelete:
+		h.AuthMiddleware(h.handleRevokeOtherSessions)(w, r)
+	case strings.HasPrefix(path, "/api/v1/sessions/") && r.Method == http.MethodDelete:
+		h.AuthMiddleware(h.handleRevokeSession)(w, r)
+	case strings.HasPrefix(path, "/api/v1/admin/"):
+		h.AdminMiddleware(h.handleAdminAPI)(w, r)
 	case path == "/api/v1/organizations" && r.Method == http.MethodGet:
 		h.AuthMiddleware(h.handleListOrgs)(w, r)
 	case path == "/api/v1/organizations" && r.Method == http.MethodPost:
 		h.AuthMiddleware(h.handleCreateOrg)(w, r)
+	case strings.HasPrefix(path, "/api/v1/organizations/") && strings.HasSuffix(path, "/limit") && r.Method == http.MethodPut:
+		h.AdminMiddleware(h.handleSetOrgBandwidthLimit)(w, r)
 	case strings.HasPrefix(path, "/api/v1/organizations/") && r.Method == http.MethodPut:
 		h.AuthMiddleware(h.handleUpdateOrg)(w, r)
 	case strings.HasPrefix(path, "/api/v1/organizations/") && r.Method == http.MethodDelete:
 		h.AuthMiddleware(h.handleDeleteOrg)(w, r)
+	case path == "/api/v1/webhooks" && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleListWebhooks)(w, r)
+	case path == "/api/v1/webhooks" && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleCreateWebhook)(w, r)
+	case strings.HasPrefix(path, "/api/v1/webhooks/") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleUpdateWebhook)(w, r)
+	case strings.HasPrefix(path, "/api/v1/webhooks/") && r.Method == http.MethodDelete:
+		h.AuthMiddleware(h.handleDeleteWebhook)(w, r)
+	case path == "/api/v1/events" && websocket.IsWebSocketUpgrade(r):
+		h.AuthMiddleware(h.handleEvents)(w, r)
+	case path == "/api/v1/fleet/summary" && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleFleetSummary)(w, r)
+	case path == "/api/v1/fleet/versions" && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleClientVersions)(w, r)
 	case path == "/api/v1/devices" && r.Method == http.MethodGet:
 		h.AuthMiddleware(h.handleListDevices)(w, r)
 	case path == "/api/v1/devices" && r.Method == http.MethodPost:
 		h.AuthMiddleware(h.handleCreateDevice)(w, r)
+	case path == "/api/v1/devices/bulk" && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleBulkCreateDevices)(w, r)
+	case path == "/api/v1/devices/export" && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleExportDevices)(w, r)
 	case path == "/api/v1/devices/claim" && r.Method == http.MethodPost:
 		h.AuthMiddleware(h.handleClaimDevice)(w, r)
+	case path == "/api/v1/devices/claim-code" && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleClaimDeviceByCode)(w, r)
 	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/terminal") && websocket.IsWebSocketUpgrade(r):
 		h.handleTerminalWebSocket(w, r)
 	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/tunnel") && r.Method == http.MethodPut:
 		h.AuthMiddleware(h.handleSetTunnelEnabled)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/limit") && r.Method == http.MethodPut:
+		h.AdminMiddleware(h.handleSetBandwidthLimit)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/recording") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetRecording)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/recordings") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleListRecordings)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.Contains(path, "/recordings/") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleDownloadRecording)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/usage/export") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleUsageExport)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/domains") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleListCustomDomains)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/domains") && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleAddCustomDomain)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.Contains(path, "/domains/") && strings.HasSuffix(path, "/verify") && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleVerifyCustomDomain)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.Contains(path, "/domains/") && r.Method == http.MethodDelete:
+		h.AuthMiddleware(h.handleDeleteCustomDomain)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/sessions") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleListDeviceSessions)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.Contains(path, "/sessions/") && r.Method == http.MethodDelete:
+		h.AuthMiddleware(h.handleCloseDeviceSession)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/exec") && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleExecStream)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/ratelimit") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleGetRateLimit)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/ratelimit") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetRateLimit)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/metrics/refresh") && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleRefreshMetrics)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/cache") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleGetResponseCache)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/cache") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetResponseCache)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/cache") && r.Method == http.MethodDelete:
+		h.AuthMiddleware(h.handlePurgeResponseCache)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/timeouts") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleGetRouteTimeouts)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/timeouts") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetRouteTimeouts)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/debug") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetDebug)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/agent-settings") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleGetAgentSettings)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/agent-settings") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetAgentSettings)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/notes") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetDeviceNotes)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/headers") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleGetResponseHeaders)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/headers") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetResponseHeaders)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/policy") && r.Method == http.MethodGet:
+		h.AuthMiddleware(h.handleGetRequestPolicy)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/policy") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetRequestPolicy)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/maintenance") && r.Method == http.MethodPut:
+		h.AuthMiddleware(h.handleSetMaintenance)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/rotate-token") && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleRotateDeviceToken)(w, r)
+	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/reconnect") && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleReconnectDevice)(w, r)
 	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/reboot") && r.Method == http.MethodPost:
 		h.AuthMiddleware(h.handleRebootDevice)(w, r)
 	case strings.HasPrefix(path, "/api/v1/devices/") && strings.HasSuffix(path, "/org") && r.Method == http.MethodPut:
@@ -64,13 +174,53 @@ func (h *Handler) handleDashboardAPI(w http.ResponseWriter, r *http.Request) {
 		h.AuthMiddleware(h.handleGetDevice)(w, r)
 	case strings.HasPrefix(path, "/api/v1/devices/") && r.Method == http.MethodDelete:
 		h.AuthMiddleware(h.handleDeleteDevice)(w, r)
+	case path == "/api/v1/billing/checkout" && r.Method == http.MethodPost:
+		h.AuthMiddleware(h.handleBillingCheckout)(w, r)
 	case path == "/api/v1/commands/run" && r.Method == http.MethodPost:
 		h.AuthMiddleware(h.handleRunCommand)(w, r)
 	default:
-		jsonError(w, "Not Found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Not Found", http.StatusNotFound)
 	}
 }
 
+// handleCORS sets CORS headers when the request comes from an allowed origin.
+// It returns true if the request was a preflight and has been answered.
+func (h *Handler) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	w.Header().Add("Vary", "Origin")
+	if !h.config.AllowsOrigin(origin) {
+		return false
+	}
+
+	// Echo the origin rather than "*" so credentialed requests (JWT cookie) work
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+// dashboardGzip caches compressed dashboard assets by name.
+// The embedded FS never changes, so each asset is compressed once.
+var dashboardGzip sync.Map
+
+// dashboardETags caches the ETag of each dashboard file by name
+var dashboardETags sync.Map
+
+// dashboardAssetsDir holds the build's fingerprinted bundles. A changed
+// bundle gets a new name, so what's at a name never changes.
+const dashboardAssetsDir = "assets/"
+
 // serveDashboard serves the React SPA
 func (h *Handler) serveDashboard(w http.ResponseWriter, r *http.Request) {
 	dist, err := fs.Sub(dashboardFS, "dashboard/dist")
@@ -84,26 +234,76 @@ func (h *Handler) serveDashboard(w http.ResponseWriter, r *http.Request) {
 	if path == "" || path == "/" {
 		path = "/index.html"
 	}
+	name := strings.TrimPrefix(path, "/")
 
-	// Check if file exists in embedded FS
-	f, err := dist.Open(strings.TrimPrefix(path, "/"))
-	if err == nil {
-		f.Close()
-		// Serve the file
-		fileServer := http.FileServer(http.FS(dist))
-		// Strip /dashboard prefix so file server finds the files
-		http.StripPrefix("/dashboard", fileServer).ServeHTTP(w, r)
-		return
+	data, err := fs.ReadFile(dist, name)
+	if err != nil {
+		// For SPA routing: serve index.html for any non-file path
+		name = "index.html"
+		data, err = fs.ReadFile(dist, name)
+		if err != nil {
+			http.Error(w, "Dashboard not available", http.StatusInternalServerError)
+			return
+		}
 	}
 
-	// For SPA routing: serve index.html for any non-file path
-	index, err := fs.ReadFile(dist, "index.html")
-	if err != nil {
-		http.Error(w, "Dashboard not available", http.StatusInternalServerError)
-		return
+	if strings.HasPrefix(name, dashboardAssetsDir) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		// index.html names the current bundles, so browsers check it on
+		// every load and get a 304 while it's unchanged
+		w.Header().Set("Cache-Control", "no-cache")
 	}
-	w.Header().Set("Content-Type", "text/html")
-	w.Write(index)
+
+	serveAsset(w, r, name, data)
+}
+
+// dashboardETag returns the ETag for an embedded dashboard file, from a hash
+// of its contents
+func dashboardETag(name string, data []byte) string {
+	if etag, ok := dashboardETags.Load(name); ok {
+		return etag.(string)
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	dashboardETags.Store(name, etag)
+	return etag
+}
+
+// serveAsset writes an embedded dashboard file, gzip-compressed when the
+// browser accepts it. http.ServeContent answers conditional and Range
+// requests. A Range is served from the uncompressed file, so its offsets
+// mean the same whatever the browser accepts, and the gzipped copy has its
+// own ETag since it's a different set of bytes.
+func serveAsset(w http.ResponseWriter, r *http.Request, name string, data []byte) {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	w.Header().Set("Content-Type", contentType)
+	etag := dashboardETag(name, data)
+
+	compress := shouldGzip(r, w.Header(), data)
+	if compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if compress && r.Header.Get("Range") == "" {
+		compressed, ok := dashboardGzip.Load(name)
+		if !ok {
+			if gz, err := gzipBytes(data); err == nil {
+				compressed, _ = dashboardGzip.LoadOrStore(name, gz)
+			}
+		}
+		if compressed != nil {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+`-gzip"`)
+			http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(compressed.([]byte)))
+			return
+		}
+	}
+
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
 }
 
 // --- Auth Handlers ---
@@ -114,42 +314,40 @@ func (h *Handler) handleSignup(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
 	if req.Email == "" || !strings.Contains(req.Email, "@") {
-		jsonError(w, "Valid email is required", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Valid email is required", http.StatusBadRequest)
 		return
 	}
 	if len(req.Password) < 8 {
-		jsonError(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Password must be at least 8 characters", http.StatusBadRequest)
 		return
 	}
 
 	hash, err := HashPassword(req.Password)
 	if err != nil {
-		log.Printf("Password hash error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("password hash failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
 	user, err := h.store.CreateUser(req.Email, hash)
 	if err != nil {
-		jsonError(w, err.Error(), http.StatusConflict)
+		jsonError(w, ErrCodeConflict, err.Error(), http.StatusConflict)
 		return
 	}
 
-	token, err := GenerateJWT(user.ID, h.config.JWTSecret)
+	token, err := h.startSession(w, r, user)
 	if err != nil {
-		log.Printf("JWT generation error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("starting session failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
-	SetAuthCookie(w, token, h.config.DevMode)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
@@ -167,36 +365,34 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
 	if req.Email == "" || req.Password == "" {
-		jsonError(w, "Email and password are required", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Email and password are required", http.StatusBadRequest)
 		return
 	}
 
 	user, err := h.store.GetUserByEmail(req.Email)
 	if err != nil {
-		log.Printf("Login lookup error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("login lookup failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if user == nil || !CheckPassword(req.Password, user.PasswordHash) {
-		jsonError(w, "Invalid email or password", http.StatusUnauthorized)
+		jsonError(w, ErrCodeUnauthorized, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
-	token, err := GenerateJWT(user.ID, h.config.JWTSecret)
+	token, err := h.startSession(w, r, user)
 	if err != nil {
-		log.Printf("JWT generation error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("starting session failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
-	SetAuthCookie(w, token, h.config.DevMode)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
@@ -209,7 +405,8 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
-	ClearAuthCookie(w, h.config.DevMode)
+	h.endSession(r)
+	ClearAuthCookie(w, h.config)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 }
@@ -221,8 +418,8 @@ func (h *Handler) handleMe(w http.ResponseWriter, r *http.Request) {
 
 	count, err := h.store.CountDevicesByUser(user.ID)
 	if err != nil {
-		log.Printf("Count devices error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("count devices failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
@@ -232,6 +429,7 @@ func (h *Handler) handleMe(w http.ResponseWriter, r *http.Request) {
 		"email":        user.Email,
 		"created_at":   user.CreatedAt,
 		"device_count": count,
+		"is_admin":     user.IsAdmin,
 	})
 }
 
@@ -250,8 +448,8 @@ func (h *Handler) handleListDevices(w http.ResponseWriter, r *http.Request) {
 		devices, err = h.store.ListDevicesByUser(user.ID)
 	}
 	if err != nil {
-		log.Printf("List devices error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("list devices failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
@@ -269,6 +467,7 @@ func (h *Handler) handleListDevices(w http.ResponseWriter, r *http.Request) {
 		BytesOut      int64    `json:"bytes_out"`
 		BytesTotal    int64    `json:"bytes_total"`
 		Limit         int64    `json:"limit"`
+		LimitOverride bool     `json:"limit_override,omitempty"` // Limit set per device rather than by tier
 		OrgID         string   `json:"org_id,omitempty"`
 		OrgName       string   `json:"org_name,omitempty"`
 		CPUTemp       *float64 `json:"cpu_temp,omitempty"`
@@ -278,6 +477,12 @@ func (h *Handler) handleListDevices(w http.ResponseWriter, r *http.Request) {
 		DiskFree      *uint64  `json:"disk_free,omitempty"`
 		DevUptime     *int64   `json:"uptime,omitempty"`
 		LoadAvg       *float64 `json:"load_avg,omitempty"`
+		ClientVersion string   `json:"client_version,omitempty"`
+		UpdateNeeded  bool     `json:"update_available,omitempty"` // Client is older than the latest release
+
+		// What the owner has noted about the device
+		Notes    string            `json:"notes,omitempty"`
+		Metadata map[string]string `json:"metadata,omitempty"`
 	}
 
 	// Build org name lookup map
@@ -298,6 +503,8 @@ func (h *Handler) handleListDevices(w http.ResponseWriter, r *http.Request) {
 			TunnelEnabled: d.TunnelEnabled,
 			CreatedAt:     d.CreatedAt.Format("2006-01-02T15:04:05Z"),
 			OrgID:         d.OrgID,
+			ClientVersion: d.ClientVersion,
+			UpdateNeeded:  clientOutdated(d.ClientVersion),
 		}
 		if d.OrgID != "" {
 			dr.OrgName = orgNames[d.OrgID]
@@ -316,6 +523,13 @@ func (h *Handler) handleListDevices(w http.ResponseWriter, r *http.Request) {
 		if err == nil {
 			dr.Limit = limit
 		}
+		if override, err := h.store.GetBandwidthLimitOverride(d.ID); err == nil && override != nil {
+			dr.LimitOverride = true
+		}
+		if notes, err := h.store.GetDeviceNotes(d.ID); err == nil {
+			dr.Notes = notes.Notes
+			dr.Metadata = notes.Metadata
+		}
 
 		// Include metrics if device is online and has an active tunnel
 		if d.IsOnline {
@@ -349,17 +563,18 @@ func (h *Handler) handleGetDevice(w http.ResponseWriter, r *http.Request) {
 
 	device, err := h.store.GetDeviceByID(deviceID)
 	if err != nil {
-		log.Printf("Get device error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("get device failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if device == nil || device.UserID != user.ID {
-		jsonError(w, "Device not found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
 		return
 	}
 
 	usage, _ := h.store.GetMonthlyUsage(device.ID)
-	limit, _ := h.store.GetBandwidthLimit(device.ID)
+	limit, limitErr := h.store.GetBandwidthLimit(device.ID)
+	override, _ := h.store.GetBandwidthLimitOverride(device.ID)
 
 	resp := map[string]interface{}{
 		"id":             device.ID,
@@ -373,13 +588,22 @@ func (h *Handler) handleGetDevice(w http.ResponseWriter, r *http.Request) {
 	if !device.LastSeenAt.IsZero() {
 		resp["last_seen_at"] = device.LastSeenAt.Format("2006-01-02T15:04:05Z")
 	}
+	if device.ClientVersion != "" {
+		resp["client_version"] = device.ClientVersion
+		resp["update_available"] = clientOutdated(device.ClientVersion)
+		resp["latest_client_version"] = ClientVersion
+	}
 	if usage != nil {
 		resp["bytes_in"] = usage.BytesIn
 		resp["bytes_out"] = usage.BytesOut
 		resp["bytes_total"] = usage.BytesIn + usage.BytesOut
 	}
-	if limit > 0 {
+	if limitErr == nil {
 		resp["limit"] = limit
+		resp["limit_override"] = override != nil
+		if usage != nil {
+			resp["bandwidth_warning"] = h.config.BandwidthWarning(usage.BytesIn+usage.BytesOut, limit)
+		}
 	}
 
 	// Include org info
@@ -390,9 +614,65 @@ func (h *Handler) handleGetDevice(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if notes, err := h.store.GetDeviceNotes(device.ID); err == nil && !notes.IsEmpty() {
+		resp["notes"] = notes.Notes
+		resp["metadata"] = notes.Metadata
+	}
+
+	if recording, err := h.store.GetRecordingSettings(device.ID); err == nil && recording != nil {
+		resp["recording"] = recording
+	}
+
+	if maintenance, err := h.store.GetMaintenance(device.ID); err == nil && maintenance != nil {
+		resp["maintenance"] = maintenance
+	}
+
+	if limit, err := h.store.GetRateLimit(device.ID); err == nil {
+		resp["rate_limit"] = limit
+	}
+
+	if settings, err := h.store.GetAgentSettings(device.ID); err == nil {
+		resp["agent_settings"] = settings
+	}
+
+	if enabled, err := h.store.GetResponseCache(device.ID); err == nil {
+		resp["response_cache"] = h.responseCacheStatus(device, enabled)
+	}
+
+	if enabled, err := h.store.GetTimingHeaders(device.ID); err == nil {
+		resp["debug"] = map[string]bool{"timing_headers": enabled}
+	}
+
+	if stats, err := h.store.GetConnectionStats(device.ID); err == nil && stats != nil {
+		conn := map[string]interface{}{
+			"reconnects":        stats.Reconnects,
+			"client_started_at": stats.ClientStartedAt.Format("2006-01-02T15:04:05Z"),
+			"last_disconnect":   stats.LastDisconnect,
+		}
+		if device.IsOnline {
+			conn["client_uptime"] = int64(time.Since(stats.ClientStartedAt).Seconds())
+		}
+		resp["connection"] = conn
+	}
+
+	// Owners learn their tunnel is held, not which rule caught it
+	if flag, err := h.store.GetAbuseFlag(device.ID); err == nil && flag != nil && flag.Blocked {
+		resp["suspended"] = true
+	}
+
+	if quotas := h.deviceQuotas(device); len(quotas) > 0 {
+		resp["quotas"] = quotas
+	}
+
 	// Include metrics if device is online
 	if device.IsOnline {
 		if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+			resp["in_flight_requests"] = tunnel.InFlight()
+			resp["breaker"] = tunnel.breaker.Status()
+			resp["monitoring_only"] = tunnel.noProxy
+			if latency := tunnel.Latency(); latency > 0 {
+				resp["latency_ms"] = float64(latency.Microseconds()) / 1000
+			}
 			if m := tunnel.GetMetrics(); m != nil {
 				resp["cpu_temp"] = m.CPUTemp
 				resp["mem_total"] = m.MemTotal
@@ -409,6 +689,44 @@ func (h *Handler) handleGetDevice(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// ownedDeviceFromPath looks up /api/v1/devices/{id}/... and checks it belongs
+// to the current user, writing an error response if not
+func (h *Handler) ownedDeviceFromPath(w http.ResponseWriter, r *http.Request) (*Device, []string) {
+	user := UserFromContext(r)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/devices/"), "/")
+	if len(parts) < 2 {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	device, err := h.store.GetDeviceByID(parts[0])
+	if err != nil {
+		slog.Error("device lookup failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return nil, nil
+	}
+	if device == nil || device.UserID != user.ID {
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
+		return nil, nil
+	}
+	return device, parts
+}
+
+// confirmed checks that a destructive request's body names what it acts on,
+// e.g. {"confirm": "my-pi"}, writing a 400 if not. It's a guard against
+// clicking the wrong device, not a security boundary.
+func confirmed(w http.ResponseWriter, r *http.Request, name, what string) bool {
+	var req struct {
+		Confirm string `json:"confirm"`
+	}
+	json.NewDecoder(r.Body).Decode(&req) // A missing body is just unconfirmed
+	if !strings.EqualFold(strings.TrimSpace(req.Confirm), name) {
+		jsonError(w, ErrCodeConfirmationRequired, fmt.Sprintf(`Confirmation required: send "confirm" set to the %s (%s)`, what, name), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
 func (h *Handler) handleCreateDevice(w http.ResponseWriter, r *http.Request) {
 	user := UserFromContext(r)
 
@@ -416,19 +734,28 @@ func (h *Handler) handleCreateDevice(w http.ResponseWriter, r *http.Request) {
 		Subdomain string `json:"subdomain"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	if req.Subdomain == "" {
-		jsonError(w, "subdomain is required", http.StatusBadRequest)
+	req.Subdomain = strings.ToLower(strings.TrimSpace(req.Subdomain))
+	if err := h.subdomains.Check(req.Subdomain); err != nil {
+		jsonError(w, ErrCodeSubdomainInvalid, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	device, err := h.store.CreateDevice(req.Subdomain, user.ID)
+	// The limit is checked in the same transaction as the insert, so
+	// requests sent at once can't get past it together
+	devices, err := h.store.CreateDevices(user.ID, "", []NewDevice{{Subdomain: req.Subdomain}}, h.deviceLimits("free"))
 	if err != nil {
-		jsonError(w, err.Error(), http.StatusBadRequest)
+		var limitErr *DeviceLimitError
+		if errors.As(err, &limitErr) {
+			writeDeviceLimit(w, user, limitErr, 1)
+			return
+		}
+		jsonError(w, subdomainErrorCode(err), err.Error(), http.StatusBadRequest)
 		return
 	}
+	device := devices[0]
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -448,33 +775,46 @@ func (h *Handler) handleClaimDevice(w http.ResponseWriter, r *http.Request) {
 		Token string `json:"token"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 	if req.Token == "" {
-		jsonError(w, "token is required", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "token is required", http.StatusBadRequest)
 		return
 	}
 
 	device, err := h.store.GetDeviceByTokenValue(req.Token)
 	if err != nil {
-		log.Printf("Claim device lookup error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("claim device lookup failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if device == nil {
-		jsonError(w, "Invalid token", http.StatusNotFound)
+		jsonError(w, ErrCodeInvalidToken, "Invalid token", http.StatusNotFound)
 		return
 	}
+	h.claimDevice(w, user, device)
+}
+
+// claimDevice assigns an unclaimed device to user and writes the response
+func (h *Handler) claimDevice(w http.ResponseWriter, user *User, device *Device) {
 	if device.UserID != "" {
-		jsonError(w, "Device is already claimed", http.StatusConflict)
+		jsonError(w, ErrCodeConflict, "Device is already claimed", http.StatusConflict)
 		return
 	}
 
-	if err := h.store.AssignDeviceToUser(device.ID, user.ID); err != nil {
-		jsonError(w, err.Error(), http.StatusConflict)
+	if err := h.store.AssignDeviceToUser(device.ID, user.ID, h.deviceLimits(device.Tier)); err != nil {
+		var limitErr *DeviceLimitError
+		if errors.As(err, &limitErr) {
+			writeDeviceLimit(w, user, limitErr, 1)
+			return
+		}
+		jsonError(w, ErrCodeConflict, err.Error(), http.StatusConflict)
 		return
 	}
+	if err := h.store.DeleteClaimCodes(device.ID); err != nil {
+		slog.Error("deleting claim codes failed", "device_id", device.ID, "error", err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -490,58 +830,162 @@ func (h *Handler) handleRebootDevice(w http.ResponseWriter, r *http.Request) {
 	// Path: /api/v1/devices/{id}/reboot
 	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/devices/"), "/")
 	if len(parts) < 2 {
-		jsonError(w, "Invalid path", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
 		return
 	}
 	deviceID := parts[0]
 
 	device, err := h.store.GetDeviceByID(deviceID)
 	if err != nil {
-		log.Printf("Reboot device error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("reboot device failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if device == nil || device.UserID != user.ID {
-		jsonError(w, "Device not found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	if !confirmed(w, r, device.Subdomain, "device's subdomain") {
 		return
 	}
 
 	tunnel := h.tunnels.GetTunnel(device.Subdomain)
 	if tunnel == nil {
-		jsonError(w, "Device is offline", http.StatusConflict)
+		jsonError(w, ErrCodeDeviceOffline, "Device is offline", http.StatusConflict)
 		return
 	}
 
 	if err := tunnel.SendCommand("reboot"); err != nil {
-		log.Printf("Failed to send reboot command to %s: %v", device.Subdomain, err)
-		jsonError(w, "Failed to send reboot command", http.StatusInternalServerError)
+		slog.Warn("sending reboot command failed", "subdomain", device.Subdomain, "error", err)
+		jsonError(w, ErrCodeInternal, "Failed to send reboot command", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("reboot command sent", "subdomain", device.Subdomain, "device_id", device.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// How long a metrics refresh waits for the device. Collecting them takes the
+// client a few milliseconds, so this mostly covers the round trip.
+const metricsRefreshTimeout = 5 * time.Second
+
+// Path: /api/v1/devices/{id}/metrics/refresh
+func (h *Handler) handleRefreshMetrics(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
 		return
 	}
 
-	log.Printf("Reboot command sent to device %s (%s)", device.Subdomain, device.ID[:8])
+	tunnel := h.tunnels.GetTunnel(device.Subdomain)
+	if tunnel == nil {
+		jsonError(w, ErrCodeDeviceOffline, "Device is offline", http.StatusConflict)
+		return
+	}
+
+	m, err := tunnel.RequestMetrics(metricsRefreshTimeout)
+	if err != nil {
+		slog.Warn("metrics refresh failed", "subdomain", device.Subdomain, "error", err)
+		if errors.Is(err, ErrRequestTimeout) {
+			jsonError(w, ErrCodeDeviceTimeout, "The device didn't send metrics in time (clients before this feature never do)", http.StatusGatewayTimeout)
+		} else {
+			jsonError(w, ErrCodeUpstream, "Failed to request metrics", http.StatusBadGateway)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cpu_temp":   m.CPUTemp,
+		"mem_total":  m.MemTotal,
+		"mem_free":   m.MemFree,
+		"disk_total": m.DiskTotal,
+		"disk_free":  m.DiskFree,
+		"uptime":     m.Uptime,
+		"load_avg":   m.LoadAvg,
+	})
+}
+
+// Path: /api/v1/devices/{id}/reconnect
+func (h *Handler) handleReconnectDevice(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	tunnel := h.tunnels.GetTunnel(device.Subdomain)
+	if tunnel == nil {
+		jsonError(w, ErrCodeDeviceOffline, "Device is offline, so there is no connection to reset", http.StatusConflict)
+		return
+	}
+
+	if err := tunnel.SendJSON(NewReconnectMessage("requested from the dashboard")); err != nil {
+		slog.Warn("sending reconnect failed", "subdomain", device.Subdomain, "error", err)
+		jsonError(w, ErrCodeInternal, "Failed to send reconnect command", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("reconnect requested", "subdomain", device.Subdomain, "device_id", device.ID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 }
 
+// handleRotateDeviceToken replaces a leaked device token. The old token
+// stops working at once and its tunnel is drained, so requests in flight
+// finish before it's dropped; the new one is only ever shown in this
+// response.
+// Path: /api/v1/devices/{id}/rotate-token
+func (h *Handler) handleRotateDeviceToken(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	token, err := h.store.RotateDeviceToken(device.ID)
+	if err != nil {
+		slog.Error("rotate device token failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	tunnel := h.tunnels.GetTunnel(device.Subdomain)
+	if tunnel != nil {
+		tunnel.SendJSON(NewErrorMessage("token_rotated", "Device token was rotated; save the new one with 'piportal token set'"))
+		// In the background, so the new token isn't held up by a slow request
+		go tunnel.Drain(tunnelDrainTimeout)
+	}
+	h.audit(r, "device.rotate_token", device.ID, device.Subdomain)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"token":        token,
+		"subdomain":    device.Subdomain,
+		"disconnected": tunnel != nil,
+	})
+}
+
 func (h *Handler) handleSetTunnelEnabled(w http.ResponseWriter, r *http.Request) {
 	user := UserFromContext(r)
 	// Path: /api/v1/devices/{id}/tunnel
 	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/devices/"), "/")
 	if len(parts) < 2 {
-		jsonError(w, "Invalid path", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
 		return
 	}
 	deviceID := parts[0]
 
 	device, err := h.store.GetDeviceByID(deviceID)
 	if err != nil {
-		log.Printf("Set tunnel enabled error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("set tunnel enabled failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if device == nil || device.UserID != user.ID {
-		jsonError(w, "Device not found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
 		return
 	}
 
@@ -549,13 +993,13 @@ func (h *Handler) handleSetTunnelEnabled(w http.ResponseWriter, r *http.Request)
 		Enabled bool `json:"enabled"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
 	if err := h.store.SetTunnelEnabled(deviceID, req.Enabled); err != nil {
-		log.Printf("Set tunnel enabled error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("set tunnel enabled failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
@@ -566,29 +1010,160 @@ func (h *Handler) handleSetTunnelEnabled(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// handleSetBandwidthLimit sets or clears (limit_bytes: null) a device's
+// monthly bandwidth override. Admin only, so any device may be targeted.
+func (h *Handler) handleSetBandwidthLimit(w http.ResponseWriter, r *http.Request) {
+	// Path: /api/v1/devices/{id}/limit
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/devices/"), "/")
+	if len(parts) < 2 {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.store.GetDeviceByID(parts[0])
+	if err != nil {
+		slog.Error("set bandwidth limit failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if device == nil {
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		LimitBytes *int64 `json:"limit_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.LimitBytes != nil && *req.LimitBytes < 0 {
+		jsonError(w, ErrCodeInvalidRequest, "limit_bytes cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetBandwidthLimitOverride(device.ID, req.LimitBytes); err != nil {
+		slog.Error("set bandwidth limit failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	limit, err := h.store.GetBandwidthLimit(device.ID)
+	if err != nil {
+		slog.Error("set bandwidth limit failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, "device.limit", device.ID, fmt.Sprintf("%s limit override %v", device.Subdomain, formatLimitOverride(req.LimitBytes)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"limit":          limit,
+		"limit_override": req.LimitBytes != nil,
+	})
+}
+
+// handleSetOrgBandwidthLimit sets or clears (limit_bytes: null) the monthly
+// bandwidth limit shared by an organization's devices. Admin only, like
+// device limits.
+func (h *Handler) handleSetOrgBandwidthLimit(w http.ResponseWriter, r *http.Request) {
+	// Path: /api/v1/organizations/{id}/limit
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/organizations/"), "/")
+	if len(parts) < 2 {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	org, err := h.store.GetOrganizationByID(parts[0])
+	if err != nil {
+		slog.Error("set org bandwidth limit failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if org == nil {
+		jsonError(w, ErrCodeNotFound, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		LimitBytes *int64 `json:"limit_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.LimitBytes != nil && *req.LimitBytes < 0 {
+		jsonError(w, ErrCodeInvalidRequest, "limit_bytes cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetOrgBandwidthLimit(org.ID, req.LimitBytes); err != nil {
+		slog.Error("set org bandwidth limit failed", "org_id", org.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	limit := "none"
+	if req.LimitBytes != nil {
+		limit = FormatBytes(*req.LimitBytes)
+	}
+	h.audit(r, "org.limit", org.ID, fmt.Sprintf("%s limit %s", org.Name, limit))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"bandwidth_limit": req.LimitBytes,
+	})
+}
+
+// formatLimitOverride describes an override for logs
+func formatLimitOverride(limitBytes *int64) string {
+	if limitBytes == nil {
+		return "tier default"
+	}
+	return FormatBytes(*limitBytes)
+}
+
 func (h *Handler) handleDeleteDevice(w http.ResponseWriter, r *http.Request) {
 	user := UserFromContext(r)
 	deviceID := strings.TrimPrefix(r.URL.Path, "/api/v1/devices/")
 
 	device, err := h.store.GetDeviceByID(deviceID)
 	if err != nil {
-		log.Printf("Delete device error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("delete device failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if device == nil || device.UserID != user.ID {
-		jsonError(w, "Device not found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
+		return
+	}
+	// Deleting and re-creating the device would lift a suspension
+	flag, err := h.store.GetAbuseFlag(device.ID)
+	if err != nil {
+		slog.Error("delete device failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if flag != nil {
+		jsonError(w, ErrCodeConflict, "Device is under review and can't be deleted", http.StatusConflict)
+		return
+	}
+	if !confirmed(w, r, device.Subdomain, "device's subdomain") {
 		return
 	}
 
-	// Disconnect active tunnel if any
+	// Disconnect active tunnel if any, letting requests in flight finish
+	// first so their usage is recorded against a device that still exists
 	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
-		tunnel.Close()
+		tunnel.Drain(tunnelDrainTimeout)
 	}
 
 	if err := h.store.DeleteDevice(device.ID); err != nil {
-		log.Printf("Delete device error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("delete device failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
@@ -603,23 +1178,25 @@ func (h *Handler) handleListOrgs(w http.ResponseWriter, r *http.Request) {
 
 	orgs, err := h.store.ListOrganizationsByUser(user.ID)
 	if err != nil {
-		log.Printf("List orgs error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("list orgs failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
 	type orgResponse struct {
-		ID        string `json:"id"`
-		Name      string `json:"name"`
-		CreatedAt string `json:"created_at"`
+		ID             string `json:"id"`
+		Name           string `json:"name"`
+		CreatedAt      string `json:"created_at"`
+		BandwidthLimit *int64 `json:"bandwidth_limit,omitempty"`
 	}
 
 	var result []orgResponse
 	for _, org := range orgs {
 		result = append(result, orgResponse{
-			ID:        org.ID,
-			Name:      org.Name,
-			CreatedAt: org.CreatedAt.Format("2006-01-02T15:04:05Z"),
+			ID:             org.ID,
+			Name:           org.Name,
+			CreatedAt:      org.CreatedAt.Format("2006-01-02T15:04:05Z"),
+			BandwidthLimit: org.BandwidthLimit,
 		})
 	}
 
@@ -638,17 +1215,17 @@ func (h *Handler) handleCreateOrg(w http.ResponseWriter, r *http.Request) {
 		Name string `json:"name"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 	if req.Name == "" {
-		jsonError(w, "name is required", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "name is required", http.StatusBadRequest)
 		return
 	}
 
 	org, err := h.store.CreateOrganization(req.Name, user.ID)
 	if err != nil {
-		jsonError(w, err.Error(), http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -668,12 +1245,12 @@ func (h *Handler) handleUpdateOrg(w http.ResponseWriter, r *http.Request) {
 	// Verify ownership
 	org, err := h.store.GetOrganizationByID(orgID)
 	if err != nil {
-		log.Printf("Update org error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("update org failed", "org_id", orgID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if org == nil || org.UserID != user.ID {
-		jsonError(w, "Organization not found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Organization not found", http.StatusNotFound)
 		return
 	}
 
@@ -681,16 +1258,16 @@ func (h *Handler) handleUpdateOrg(w http.ResponseWriter, r *http.Request) {
 		Name string `json:"name"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 	if req.Name == "" {
-		jsonError(w, "name is required", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "name is required", http.StatusBadRequest)
 		return
 	}
 
 	if err := h.store.UpdateOrganization(orgID, req.Name); err != nil {
-		jsonError(w, err.Error(), http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -709,18 +1286,18 @@ func (h *Handler) handleDeleteOrg(w http.ResponseWriter, r *http.Request) {
 	// Verify ownership
 	org, err := h.store.GetOrganizationByID(orgID)
 	if err != nil {
-		log.Printf("Delete org error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("delete org failed", "org_id", orgID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if org == nil || org.UserID != user.ID {
-		jsonError(w, "Organization not found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Organization not found", http.StatusNotFound)
 		return
 	}
 
 	if err := h.store.DeleteOrganization(orgID); err != nil {
-		log.Printf("Delete org error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("delete org failed", "org_id", orgID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
@@ -733,19 +1310,19 @@ func (h *Handler) handleSetDeviceOrg(w http.ResponseWriter, r *http.Request) {
 	// Path: /api/v1/devices/{id}/org
 	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/devices/"), "/")
 	if len(parts) < 2 {
-		jsonError(w, "Invalid path", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
 		return
 	}
 	deviceID := parts[0]
 
 	device, err := h.store.GetDeviceByID(deviceID)
 	if err != nil {
-		log.Printf("Set device org error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("set device org failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if device == nil || device.UserID != user.ID {
-		jsonError(w, "Device not found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Device not found", http.StatusNotFound)
 		return
 	}
 
@@ -753,7 +1330,7 @@ func (h *Handler) handleSetDeviceOrg(w http.ResponseWriter, r *http.Request) {
 		OrgID *string `json:"org_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
@@ -761,19 +1338,19 @@ func (h *Handler) handleSetDeviceOrg(w http.ResponseWriter, r *http.Request) {
 	if req.OrgID != nil && *req.OrgID != "" {
 		org, err := h.store.GetOrganizationByID(*req.OrgID)
 		if err != nil {
-			log.Printf("Set device org error: %v", err)
-			jsonError(w, "Internal error", http.StatusInternalServerError)
+			slog.Error("set device org failed", "device_id", deviceID, "error", err)
+			jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 			return
 		}
 		if org == nil || org.UserID != user.ID {
-			jsonError(w, "Organization not found", http.StatusNotFound)
+			jsonError(w, ErrCodeNotFound, "Organization not found", http.StatusNotFound)
 			return
 		}
 	}
 
 	if err := h.store.SetDeviceOrganization(deviceID, req.OrgID); err != nil {
-		log.Printf("Set device org error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("set device org failed", "device_id", deviceID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
@@ -795,35 +1372,35 @@ func (h *Handler) handleRunCommand(w http.ResponseWriter, r *http.Request) {
 		DryRun  bool   `json:"dry_run"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 	if req.Command == "" {
-		jsonError(w, "command is required", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "command is required", http.StatusBadRequest)
 		return
 	}
 	if req.OrgID == "" {
-		jsonError(w, "org_id is required", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "org_id is required", http.StatusBadRequest)
 		return
 	}
 
 	// Verify user owns the org
 	org, err := h.store.GetOrganizationByID(req.OrgID)
 	if err != nil {
-		log.Printf("Run command org lookup error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("run command org lookup failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if org == nil || org.UserID != user.ID {
-		jsonError(w, "Organization not found", http.StatusNotFound)
+		jsonError(w, ErrCodeNotFound, "Organization not found", http.StatusNotFound)
 		return
 	}
 
 	// Fetch all devices in the org owned by the user
 	devices, err := h.store.ListDevicesByUserAndOrg(user.ID, &req.OrgID)
 	if err != nil {
-		log.Printf("Run command list devices error: %v", err)
-		jsonError(w, "Internal error", http.StatusInternalServerError)
+		slog.Error("run command list devices failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
@@ -841,6 +1418,8 @@ func (h *Handler) handleRunCommand(w http.ResponseWriter, r *http.Request) {
 		ExitCode  int    `json:"exit_code"`
 		Output    string `json:"output"`
 		Error     string `json:"error,omitempty"`
+
+		DryRunEnforced bool `json:"dry_run_enforced,omitempty"`
 	}
 
 	results := make([]deviceResult, len(devices))
@@ -859,6 +1438,16 @@ func (h *Handler) handleRunCommand(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		// Charged before the command is sent, so one that can't be paid for
+		// never runs
+		if !req.DryRun {
+			if message, _, usedUp := h.takeQuota(d, quotaExec, 1); usedUp {
+				results[i].ExitCode = -1
+				results[i].Error = message
+				continue
+			}
+		}
+
 		wg.Add(1)
 		go func(idx int, t *Tunnel) {
 			defer wg.Done()
@@ -872,6 +1461,7 @@ func (h *Handler) handleRunCommand(w http.ResponseWriter, r *http.Request) {
 
 			results[idx].ExitCode = cmdResult.ExitCode
 			results[idx].Error = cmdResult.Error
+			results[idx].DryRunEnforced = cmdResult.DryRunEnforced
 
 			// Decode base64 output to plain text for the API response
 			if cmdResult.Output != "" {
@@ -887,11 +1477,100 @@ func (h *Handler) handleRunCommand(w http.ResponseWriter, r *http.Request) {
 
 	wg.Wait()
 
-	log.Printf("Command executed on %d devices in org %s: %s (dry_run=%v)",
-		len(devices), org.Name, req.Command, req.DryRun)
+	slog.Info("command executed", "org", org.Name, "devices", len(devices), "command", req.Command, "dry_run", req.DryRun)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"results": results,
 	})
 }
+
+// handleExecStream runs a shell command on one device and streams its output
+// back as newline-delimited JSON while it runs:
+//
+//	{"type":"output","stream":"stdout","data":"..."}
+//	{"type":"exit","exit_code":0}
+//
+// The exit event carries output_dropped (bytes) if some output was lost on
+// the way. A caller that disconnects stops the command.
+func (h *Handler) handleExecStream(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req struct {
+		Command string `json:"command"`
+		DryRun  bool   `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Command == "" {
+		jsonError(w, ErrCodeInvalidRequest, "command is required", http.StatusBadRequest)
+		return
+	}
+
+	tunnel := h.tunnels.GetTunnel(device.Subdomain)
+	if tunnel == nil {
+		jsonError(w, ErrCodeDeviceOffline, "Device is offline", http.StatusConflict)
+		return
+	}
+	if !req.DryRun {
+		if !h.checkQuota(w, device, quotaExec) {
+			return
+		}
+	}
+
+	h.extendWriteDeadline(w, h.config.ExecStreamTimeout)
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	send := func(event map[string]interface{}) {
+		enc.Encode(event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	slog.Info("streaming command", "subdomain", device.Subdomain, "command", req.Command, "dry_run", req.DryRun)
+
+	result, err := tunnel.StreamExecCommand(r.Context(), req.Command, req.DryRun, h.config.ExecStreamTimeout, func(chunk *CommandOutputMessage) {
+		if data, err := chunk.GetData(); err == nil {
+			send(map[string]interface{}{"type": "output", "stream": chunk.Stream, "data": string(data)})
+		}
+	})
+	if r.Context().Err() != nil {
+		slog.Info("streaming command cancelled, client went away", "subdomain", device.Subdomain)
+		return
+	}
+	if err != nil {
+		send(map[string]interface{}{"type": "exit", "exit_code": -1, "error": fmt.Sprintf("command failed: %v", err)})
+		return
+	}
+
+	// Results that never ran (e.g. a dry run) carry their output inline
+	if result.Output != "" {
+		if data, err := base64.StdEncoding.DecodeString(result.Output); err == nil {
+			send(map[string]interface{}{"type": "output", "stream": "stdout", "data": string(data)})
+		}
+	}
+
+	exit := map[string]interface{}{"type": "exit", "exit_code": result.ExitCode}
+	if result.Error != "" {
+		exit["error"] = result.Error
+	}
+	if result.DryRunEnforced {
+		exit["dry_run_enforced"] = true
+	}
+	if result.OutputDropped > 0 {
+		exit["output_dropped"] = result.OutputDropped
+	}
+	send(exit)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A caller that goes away mid-stream stops the command on the device,
+// rather than leaving it running to its timeout
+func TestExecStreamCancelledByCaller(t *testing.T) {
+	tt := startTestTunnel(t, testConfig(t), func(req RequestMessage) ResponseMessage {
+		return bodyResponse(http.StatusOK, nil, nil)
+	})
+	token := tt.terminalOwner(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", tt.server.URL+"/api/v1/devices/"+tt.device.ID+"/exec", strings.NewReader(`{"command":"sleep 600"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	go func() {
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	commandID := tt.expectCommand(t, MessageTypeCommand, "")
+	cancel()
+	tt.expectCommand(t, MessageTypeCommandCancel, commandID)
+}
+
+// expectCommand waits for the device to get a command message of msgType,
+// for commandID if it's set, and returns the message's command ID
+func (tt *testTunnel) expectCommand(t *testing.T, msgType, commandID string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case data := <-tt.received:
+			var msg CommandMessage
+			if json.Unmarshal(data, &msg) != nil || msg.Type != msgType {
+				continue
+			}
+			if commandID == "" || msg.CommandID == commandID {
+				return msg.CommandID
+			}
+		case <-timeout:
+			t.Fatalf("device never got %s", msgType)
+			return ""
+		}
+	}
+}
+
+// Dashboard files answer Range and conditional requests, with the gzipped
+// copy told apart from the plain one
+func TestServeAsset(t *testing.T) {
+	data := []byte(strings.Repeat("console.log('piportal');\n", 200))
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/dashboard/assets/app.js", nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		serveAsset(w, r, "assets/app.js", data)
+		return w
+	}
+
+	w := serve(map[string]string{"Range": "bytes=0-99", "Accept-Encoding": "gzip"})
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 100 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("range: %d, %d bytes, encoding %q; want 206 with 100 plain bytes", w.Code, w.Body.Len(), w.Header().Get("Content-Encoding"))
+	}
+
+	plain := serve(nil).Header().Get("ETag")
+	gzipped := serve(map[string]string{"Accept-Encoding": "gzip"})
+	if gzipped.Header().Get("Content-Encoding") != "gzip" || gzipped.Header().Get("ETag") == plain {
+		t.Errorf("gzipped copy: encoding %q, ETag %q (plain %q)", gzipped.Header().Get("Content-Encoding"), gzipped.Header().Get("ETag"), plain)
+	}
+
+	if w := serve(map[string]string{"If-None-Match": plain}); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d, want 304", w.Code)
+	}
+	w = serve(map[string]string{"If-None-Match": gzipped.Header().Get("ETag"), "Accept-Encoding": "gzip"})
+	if w.Code != http.StatusNotModified || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("If-None-Match, gzipped: %d, encoding %q; want a bare 304", w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// DeviceLimitError means adding devices would take a user past one of
+// their DeviceLimits
+type DeviceLimitError struct {
+	Limit       int  // The limit that would be passed
+	Devices     int  // The user's devices so far
+	FreeDevices int  // How many of them are free-tier
+	Free        bool // It's the free plan's allowance rather than the overall cap
+}
+
+func (e *DeviceLimitError) Error() string {
+	if e.Free {
+		return fmt.Sprintf("free device limit reached (%d)", e.Limit)
+	}
+	return fmt.Sprintf("device limit reached (%d)", e.Limit)
+}
+
+// check reports whether a user with devices, free of them free-tier, can
+// add adding more free-tier devices
+func (l DeviceLimits) check(devices, free, adding int) error {
+	switch {
+	case l.Total > 0 && devices+adding > l.Total:
+		return &DeviceLimitError{Limit: l.Total, Devices: devices, FreeDevices: free}
+	case l.Free > 0 && free+adding > l.Free:
+		return &DeviceLimitError{Limit: l.Free, Devices: devices, FreeDevices: free, Free: true}
+	}
+	return nil
+}
+
+// deviceLimits returns the limits on adding devices of the given tier.
+// Pro devices are paid for individually, so only the overall cap applies
+// to them; the free allowance is only enforced when billing is configured,
+// since otherwise there's no way to upgrade.
+func (h *Handler) deviceLimits(tier string) DeviceLimits {
+	limits := DeviceLimits{Free: h.config.FreeDeviceLimit, Total: h.config.MaxDevicesPerUser}
+	if !h.config.BillingEnabled() || tier == "pro" {
+		limits.Free = 0
+	}
+	return limits
+}
+
+// writeDeviceLimit writes the response for a device limit that adding
+// devices would pass
+func writeDeviceLimit(w http.ResponseWriter, user *User, limitErr *DeviceLimitError, adding int) {
+	status := http.StatusForbidden
+	message := fmt.Sprintf("Accounts are limited to %d devices", limitErr.Limit)
+	if limitErr.Free {
+		status = http.StatusPaymentRequired
+		message = "The free plan includes 1 device. Upgrade it to Pro to add another."
+		if limitErr.Limit > 1 {
+			message = fmt.Sprintf("The free plan includes %d devices. Upgrade one to Pro to add another.", limitErr.Limit)
+		}
+	}
+	if adding > 1 {
+		message = fmt.Sprintf("%s Adding %d devices would go over the limit.", strings.TrimSuffix(message, ".")+".", adding)
+	}
+
+	slog.Info("device limit reached", "user_id", user.ID, "devices", limitErr.Devices, "free_devices", limitErr.FreeDevices, "limit", limitErr.Limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   APIError{Code: ErrCodeDeviceLimit, Message: message},
+		"limit":   limitErr.Limit,
+		"devices": limitErr.Devices,
+		"upgrade": status == http.StatusPaymentRequired,
+	})
+}
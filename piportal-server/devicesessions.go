@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// TunnelSessionInfo describes a device's tunnel connection for the dashboard API
+type TunnelSessionInfo struct {
+	ConnectedAt      time.Time `json:"connected_at"`
+	ClientVersion    string    `json:"client_version,omitempty"`
+	InFlightRequests int       `json:"in_flight_requests"`
+	MonitoringOnly   bool      `json:"monitoring_only"`
+}
+
+// handleListDeviceSessions lists what's open on a device: its tunnel connection,
+// with requests in flight, and its terminal sessions. An offline device has
+// neither.
+// Path: /api/v1/devices/{id}/sessions
+func (h *Handler) handleListDeviceSessions(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var tunnelInfo *TunnelSessionInfo
+	terminals := []TerminalSessionInfo{}
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnelInfo = &TunnelSessionInfo{
+			ConnectedAt:      tunnel.connectedAt,
+			ClientVersion:    tunnel.Device.ClientVersion,
+			InFlightRequests: tunnel.InFlight(),
+			MonitoringOnly:   tunnel.noProxy,
+		}
+		terminals = tunnel.ListTerminalSessions()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"online":    tunnelInfo != nil,
+		"tunnel":    tunnelInfo,
+		"terminals": terminals,
+	})
+}
+
+// handleCloseDeviceSession ends a terminal session, e.g. a forgotten or suspicious
+// shell. The browser is disconnected and the client kills the shell.
+// Path: /api/v1/devices/{id}/sessions/{sessionID}
+func (h *Handler) handleCloseDeviceSession(w http.ResponseWriter, r *http.Request) {
+	device, parts := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+	if len(parts) != 3 || parts[1] != "sessions" || parts[2] == "" {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	sessionID := parts[2]
+
+	tunnel := h.tunnels.GetTunnel(device.Subdomain)
+	if tunnel == nil || !tunnel.closeTerminalSession(sessionID, "session ended by owner") {
+		jsonError(w, ErrCodeNotFound, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	tunnel.logger.Info("terminal session terminated", "session_id", sessionID, "by", UserFromContext(r).Email)
+	h.audit(r, "terminal.terminate", device.ID, device.Subdomain+" session "+sessionID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
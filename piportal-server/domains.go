@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	maxCustomDomainsPerDevice = 5
+	domainChallengePrefix     = "_piportal-challenge."
+
+	// Pending claims that haven't verified by then are dropped, so an
+	// abandoned claim doesn't count against the device's limit forever
+	customDomainClaimTTL = 7 * 24 * time.Hour
+)
+
+var hostnameLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// CustomDomain maps a user's own hostname (CNAMEd to the device's subdomain)
+// to a device. It only serves traffic once its TXT challenge has been verified.
+// Until then it is one device's pending claim, and other devices may claim the
+// same hostname; only one can verify it.
+type CustomDomain struct {
+	Hostname          string
+	DeviceID          string
+	VerificationToken string // Must appear in a TXT record at _piportal-challenge.<hostname>
+	Verified          bool
+	CreatedAt         time.Time
+	VerifiedAt        time.Time
+}
+
+type customDomainResponse struct {
+	Hostname     string `json:"hostname"`
+	Verified     bool   `json:"verified"`
+	CNAMETarget  string `json:"cname_target"`
+	Verification struct {
+		Type  string `json:"type"`
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"verification"`
+	CreatedAt  string `json:"created_at"`
+	VerifiedAt string `json:"verified_at,omitempty"`
+}
+
+func (h *Handler) newCustomDomainResponse(device *Device, domain *CustomDomain) customDomainResponse {
+	resp := customDomainResponse{
+		Hostname:    domain.Hostname,
+		Verified:    domain.Verified,
+		CNAMETarget: device.Subdomain + "." + h.config.BaseDomain,
+		CreatedAt:   domain.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+	resp.Verification.Type = "TXT"
+	resp.Verification.Name = domainChallengePrefix + domain.Hostname
+	resp.Verification.Value = domain.VerificationToken
+	if !domain.VerifiedAt.IsZero() {
+		resp.VerifiedAt = domain.VerifiedAt.Format("2006-01-02T15:04:05Z")
+	}
+	return resp
+}
+
+// normalizeHostname lowercases a hostname and checks it's a plausible custom
+// domain: a valid multi-label name that isn't ours
+func (h *Handler) normalizeHostname(hostname string) (string, error) {
+	hostname = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+	if hostname == "" {
+		return "", errors.New("hostname is required")
+	}
+	if len(hostname) > 253 || net.ParseIP(hostname) != nil {
+		return "", errors.New("invalid hostname")
+	}
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return "", errors.New("hostname must be a fully-qualified domain")
+	}
+	for _, label := range labels {
+		if len(label) > 63 || !hostnameLabel.MatchString(label) {
+			return "", errors.New("invalid hostname")
+		}
+	}
+	base := h.config.BaseDomain
+	if hostname == base || strings.HasSuffix(hostname, "."+base) {
+		return "", fmt.Errorf("hostnames under %s can't be custom domains", base)
+	}
+	return hostname, nil
+}
+
+// customDomainSubdomain returns the subdomain of the device a verified custom
+// domain points at, or "" if host isn't one. Only pro devices are served.
+func (h *Handler) customDomainSubdomain(host string) string {
+	domain, err := h.store.GetCustomDomain(strings.ToLower(host))
+	if err != nil {
+		slog.Error("custom domain lookup failed", "host", host, "error", err)
+		return ""
+	}
+	if domain == nil {
+		return ""
+	}
+	device, err := h.store.GetDeviceByID(domain.DeviceID)
+	if err != nil || device == nil || device.Tier != "pro" {
+		return ""
+	}
+	return device.Subdomain
+}
+
+// CertHostPolicy decides which hostnames get certificates issued on demand:
+// the base domain, existing device subdomains and verified custom domains.
+// Refusing everything else stops strangers burning our ACME rate limits.
+func (h *Handler) CertHostPolicy(ctx context.Context, host string) error {
+	host = strings.ToLower(host)
+	base := h.config.BaseDomain
+
+	if host == base || host == "www."+base {
+		return nil
+	}
+	if strings.HasSuffix(host, "."+base) {
+		device, err := h.store.GetDeviceBySubdomain(strings.TrimSuffix(host, "."+base))
+		if err != nil {
+			return err
+		}
+		if device != nil {
+			return nil
+		}
+		return fmt.Errorf("no device for %s", host)
+	}
+	if h.customDomainSubdomain(host) != "" {
+		return nil
+	}
+	return fmt.Errorf("%s is not a verified custom domain", host)
+}
+
+// --- Handlers ---
+
+// Path: /api/v1/devices/{id}/domains
+func (h *Handler) handleListCustomDomains(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	domains, err := h.store.ListCustomDomains(device.ID)
+	if err != nil {
+		slog.Error("list custom domains failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	result := []customDomainResponse{}
+	for _, domain := range domains {
+		result = append(result, h.newCustomDomainResponse(device, domain))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Path: /api/v1/devices/{id}/domains
+func (h *Handler) handleAddCustomDomain(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+	if device.Tier != "pro" {
+		jsonError(w, ErrCodeUpgradeRequired, "Custom domains require the pro tier", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Hostname string `json:"hostname"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	hostname, err := h.normalizeHostname(req.Hostname)
+	if err != nil {
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.store.ListCustomDomains(device.ID)
+	if err != nil {
+		slog.Error("add custom domain failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxCustomDomainsPerDevice {
+		jsonError(w, ErrCodeForbidden, fmt.Sprintf("custom domain limit reached (%d)", maxCustomDomainsPerDevice), http.StatusForbidden)
+		return
+	}
+
+	domain, err := h.store.AddCustomDomain(device.ID, hostname)
+	if err != nil {
+		jsonError(w, ErrCodeConflict, err.Error(), http.StatusConflict)
+		return
+	}
+
+	slog.Info("custom domain added, pending verification", "hostname", hostname, "subdomain", device.Subdomain)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(h.newCustomDomainResponse(device, domain))
+}
+
+// Path: /api/v1/devices/{id}/domains/{hostname}/verify
+func (h *Handler) handleVerifyCustomDomain(w http.ResponseWriter, r *http.Request) {
+	device, domain := h.ownedDomainFromPath(w, r)
+	if domain == nil {
+		return
+	}
+
+	if !domain.Verified {
+		records, err := net.LookupTXT(domainChallengePrefix + domain.Hostname)
+		if err != nil {
+			jsonError(w, ErrCodeVerificationFailed, fmt.Sprintf("TXT record %s%s not found", domainChallengePrefix, domain.Hostname), http.StatusUnprocessableEntity)
+			return
+		}
+		found := false
+		for _, record := range records {
+			if strings.TrimSpace(record) == domain.VerificationToken {
+				found = true
+				break
+			}
+		}
+		if !found {
+			jsonError(w, ErrCodeVerificationFailed, "TXT record does not contain the verification token", http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err := h.store.MarkCustomDomainVerified(device.ID, domain.Hostname); err != nil {
+			if errors.Is(err, ErrDomainInUse) {
+				jsonError(w, ErrCodeConflict, err.Error(), http.StatusConflict)
+				return
+			}
+			slog.Error("verify custom domain failed", "hostname", domain.Hostname, "error", err)
+			jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		domain.Verified = true
+		domain.VerifiedAt = time.Now()
+		slog.Info("custom domain verified", "hostname", domain.Hostname, "subdomain", device.Subdomain)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.newCustomDomainResponse(device, domain))
+}
+
+// Path: /api/v1/devices/{id}/domains/{hostname}
+func (h *Handler) handleDeleteCustomDomain(w http.ResponseWriter, r *http.Request) {
+	device, domain := h.ownedDomainFromPath(w, r)
+	if domain == nil {
+		return
+	}
+
+	if err := h.store.DeleteCustomDomain(device.ID, domain.Hostname); err != nil {
+		slog.Error("delete custom domain failed", "hostname", domain.Hostname, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("custom domain removed", "hostname", domain.Hostname, "subdomain", device.Subdomain)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// ownedDomainFromPath looks up /api/v1/devices/{id}/domains/{hostname}/...,
+// checking both belong to the current user
+func (h *Handler) ownedDomainFromPath(w http.ResponseWriter, r *http.Request) (*Device, *CustomDomain) {
+	device, parts := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return nil, nil
+	}
+	if len(parts) < 3 || parts[1] != "domains" {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	domain, err := h.store.GetDeviceCustomDomain(device.ID, strings.ToLower(parts[2]))
+	if err != nil {
+		slog.Error("custom domain lookup failed", "host", parts[2], "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return nil, nil
+	}
+	if domain == nil {
+		jsonError(w, ErrCodeNotFound, "Domain not found", http.StatusNotFound)
+		return nil, nil
+	}
+	return device, domain
+}
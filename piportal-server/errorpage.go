@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// wantsHTML reports whether the client is a browser asking for a page.
+// curl, fetch and API clients send */* or application/json and get plain
+// text instead.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// httpError reports an error as a styled page to browsers and as plain text
+// (the message alone) to everything else
+func (h *Handler) httpError(w http.ResponseWriter, r *http.Request, status int, title, message string) {
+	if !wantsHTML(r) {
+		http.Error(w, message, status)
+		return
+	}
+	h.errorPage(w, status, title, message)
+}
+
+// errorPage writes an HTML error page in the same style as the rest of the
+// site. It's never cached, so a device coming back online shows up at once.
+func (h *Handler) errorPage(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <meta name="robots" content="noindex">
+    <title>%[2]s — PiPortal</title>
+    <style>
+        *, *::before, *::after { box-sizing: border-box; margin: 0; padding: 0; }
+        body { font-family: system-ui, -apple-system, sans-serif; color: #1e293b; background: #f8fafc; line-height: 1.6; }
+        a { color: #0075ff; text-decoration: none; }
+        nav { padding: 16px 0; border-bottom: 1px solid #e2e8f0; background: #fff; }
+        nav .inner { max-width: 720px; margin: 0 auto; padding: 0 24px; }
+        nav .logo { font-weight: 700; font-size: 1.25rem; color: #0f172a; }
+        .container { max-width: 560px; margin: 0 auto; padding: 72px 24px; text-align: center; }
+        .code { font-size: 0.85rem; font-weight: 600; text-transform: uppercase; letter-spacing: 0.08em; color: #0075ff; margin-bottom: 8px; }
+        h1 { font-size: 2rem; font-weight: 700; color: #0f172a; margin-bottom: 16px; }
+        p { font-size: 1.05rem; color: #64748b; margin-bottom: 32px; }
+        .btn { display: inline-block; background: #0075ff; color: #fff; padding: 12px 28px; border-radius: 8px; font-size: 0.95rem; font-weight: 600; }
+        .btn:hover { background: #0060d0; }
+    </style>
+</head>
+<body>
+    <nav><div class="inner"><a href="https://%[4]s/" class="logo">PiPortal</a></div></nav>
+    <div class="container">
+        <div class="code">Error %[1]d</div>
+        <h1>%[2]s</h1>
+        <p>%[3]s</p>
+        <a class="btn" href="https://%[4]s/">Go to PiPortal</a>
+    </div>
+</body>
+</html>`, status, html.EscapeString(title), html.EscapeString(message), html.EscapeString(h.config.BaseDomain))
+}
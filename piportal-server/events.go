@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// EventDeviceMetrics is only sent to live dashboards, never to webhooks
+const EventDeviceMetrics = "device.metrics"
+
+const (
+	liveEventBuffer   = 64               // Events queued per dashboard before new ones are dropped
+	liveEventPing     = 30 * time.Second // Keeps proxies from closing a quiet feed
+	liveEventWriteTTL = 10 * time.Second
+)
+
+// LiveEvent is a device update pushed to dashboards on /api/v1/events
+type LiveEvent struct {
+	Type      string          `json:"type"` // device.online, device.offline or device.metrics
+	DeviceID  string          `json:"device_id"`
+	Subdomain string          `json:"subdomain"`
+	Time      string          `json:"time"`
+	Metrics   *MetricsMessage `json:"metrics,omitempty"`
+}
+
+// EventHub fans device status and metrics out to the dashboards watching
+// those devices
+type EventHub struct {
+	mu   sync.RWMutex
+	subs map[string]map[*eventSubscriber]struct{} // device ID -> subscribers
+}
+
+// eventSubscriber is one dashboard socket. A slow browser loses events
+// rather than holding up the tunnel that published them.
+type eventSubscriber struct {
+	events    chan LiveEvent
+	deviceIDs []string
+}
+
+// NewEventHub creates an empty hub
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[string]map[*eventSubscriber]struct{})}
+}
+
+// Subscribe starts delivering events for the given devices
+func (hub *EventHub) Subscribe(deviceIDs []string) *eventSubscriber {
+	sub := &eventSubscriber{
+		events:    make(chan LiveEvent, liveEventBuffer),
+		deviceIDs: deviceIDs,
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, id := range deviceIDs {
+		if hub.subs[id] == nil {
+			hub.subs[id] = make(map[*eventSubscriber]struct{})
+		}
+		hub.subs[id][sub] = struct{}{}
+	}
+	return sub
+}
+
+// Unsubscribe stops delivering events to a subscriber
+func (hub *EventHub) Unsubscribe(sub *eventSubscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, id := range sub.deviceIDs {
+		delete(hub.subs[id], sub)
+		if len(hub.subs[id]) == 0 {
+			delete(hub.subs, id)
+		}
+	}
+}
+
+// Publish sends an event to every dashboard watching the device
+func (hub *EventHub) Publish(device *Device, eventType string, metrics *MetricsMessage) {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	subs := hub.subs[device.ID]
+	if len(subs) == 0 {
+		return
+	}
+
+	event := LiveEvent{
+		Type:      eventType,
+		DeviceID:  device.ID,
+		Subdomain: device.Subdomain,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Metrics:   metrics,
+	}
+	for sub := range subs {
+		select {
+		case sub.events <- event:
+		default:
+			slog.Debug("live event dropped for slow dashboard", "subdomain", device.Subdomain, "type", eventType)
+		}
+	}
+}
+
+// sameOriginOrAllowed accepts WebSocket handshakes from the dashboard's own
+// origin or a configured CORS origin, so other sites can't open the event
+// feed or a terminal with the user's cookie
+func (h *Handler) sameOriginOrAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // Not a browser
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return h.config.AllowsOrigin(origin)
+}
+
+// handleEvents streams status changes and metrics for the user's devices
+// over a WebSocket, one JSON event per message, so the dashboard doesn't
+// have to poll:
+//
+//	{"type":"device.offline","device_id":"...","subdomain":"mypi","time":"..."}
+//	{"type":"device.metrics","device_id":"...","subdomain":"mypi","time":"...","metrics":{...}}
+//
+// The device list is fixed when the socket opens; reconnect to pick up
+// devices added since.
+// Path: /api/v1/events
+func (h *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+
+	devices, err := h.store.ListDevicesByUser(user.ID)
+	if err != nil {
+		slog.Error("event feed devices failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	deviceIDs := make([]string, 0, len(devices))
+	for _, d := range devices {
+		deviceIDs = append(deviceIDs, d.ID)
+	}
+
+	eventsUpgrader := upgrader
+	eventsUpgrader.CheckOrigin = h.sameOriginOrAllowed
+	conn, err := eventsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("event feed upgrade failed", "user_id", user.ID, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	sub := h.tunnels.events.Subscribe(deviceIDs)
+	defer h.tunnels.events.Unsubscribe(sub)
+	slog.Debug("event feed opened", "user_id", user.ID, "devices", len(deviceIDs))
+
+	// The browser never sends anything; reading only notices when it leaves
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(liveEventPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-gone:
+			slog.Debug("event feed closed", "user_id", user.ID)
+			return
+		case event := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(liveEventWriteTTL))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveEventWriteTTL)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// FleetCounts summarizes a group of devices
+type FleetCounts struct {
+	Devices       int      `json:"devices"`
+	Online        int      `json:"online"`
+	Offline       int      `json:"offline"`
+	OverBandwidth int      `json:"over_bandwidth"`
+	AvgCPUTemp    *float64 `json:"avg_cpu_temp,omitempty"` // Online devices that report it
+	BytesTotal    int64    `json:"bytes_total"`            // This month
+
+	// Open right now on online devices
+	TerminalSessions int `json:"terminal_sessions"`
+	InFlightRequests int `json:"in_flight_requests"`
+
+	tempSum   float64
+	tempCount int
+}
+
+// add counts one device; usage is nil if it hasn't been recorded, and tunnel
+// is nil if it's offline
+func (c *FleetCounts) add(device *Device, usage *DeviceBandwidth, tunnel *Tunnel) {
+	c.Devices++
+	if device.IsOnline {
+		c.Online++
+	} else {
+		c.Offline++
+	}
+	if usage != nil {
+		used := usage.BytesIn + usage.BytesOut
+		c.BytesTotal += used
+		if used >= usage.Limit {
+			c.OverBandwidth++
+		}
+	}
+	if tunnel == nil {
+		return
+	}
+	c.TerminalSessions += tunnel.TerminalSessionCount()
+	c.InFlightRequests += tunnel.InFlight()
+	if metrics := tunnel.GetMetrics(); metrics != nil && metrics.CPUTemp >= 0 {
+		c.tempSum += metrics.CPUTemp
+		c.tempCount++
+		avg := c.tempSum / float64(c.tempCount)
+		c.AvgCPUTemp = &avg
+	}
+}
+
+// OrgFleetCounts is one organization's line in the fleet summary. Its
+// bytes_total is what counts against the organization's own limit.
+type OrgFleetCounts struct {
+	OrgID          string `json:"org_id"`
+	OrgName        string `json:"org_name"`
+	BandwidthLimit *int64 `json:"bandwidth_limit,omitempty"`
+	OverOrgLimit   bool   `json:"over_org_limit"`
+	FleetCounts
+}
+
+// handleFleetSummary reports device counts, temperatures and bandwidth for
+// the user's whole fleet and each of their organizations. Everything comes
+// from three queries plus live tunnel state, however many devices there are.
+// Path: /api/v1/fleet/summary
+func (h *Handler) handleFleetSummary(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+	month := currentMonth()
+
+	devices, err := h.store.ListDevicesByUser(user.ID)
+	if err != nil {
+		slog.Error("fleet summary devices failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	bandwidth, err := h.store.ListDeviceBandwidthByUser(user.ID, month)
+	if err != nil {
+		slog.Error("fleet summary bandwidth failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	orgs, err := h.store.ListOrganizationsByUser(user.ID)
+	if err != nil {
+		slog.Error("fleet summary orgs failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	usageByDevice := make(map[string]*DeviceBandwidth, len(bandwidth))
+	for _, b := range bandwidth {
+		usageByDevice[b.DeviceID] = b
+	}
+	byOrg := make(map[string]*OrgFleetCounts, len(orgs))
+	orgCounts := make([]*OrgFleetCounts, 0, len(orgs))
+	for _, org := range orgs {
+		oc := &OrgFleetCounts{OrgID: org.ID, OrgName: org.Name, BandwidthLimit: org.BandwidthLimit}
+		byOrg[org.ID] = oc
+		orgCounts = append(orgCounts, oc)
+	}
+
+	var overall, unassigned FleetCounts
+	for _, d := range devices {
+		tunnel := h.tunnels.GetTunnel(d.Subdomain)
+		usage := usageByDevice[d.ID]
+		overall.add(d, usage, tunnel)
+		if oc, ok := byOrg[d.OrgID]; ok {
+			oc.add(d, usage, tunnel)
+		} else {
+			unassigned.add(d, usage, tunnel)
+		}
+	}
+
+	for _, oc := range orgCounts {
+		oc.OverOrgLimit = oc.BandwidthLimit != nil && oc.BytesTotal >= *oc.BandwidthLimit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"month":      month,
+		"overall":    overall,
+		"orgs":       orgCounts,
+		"unassigned": unassigned,
+	})
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
@@ -20,20 +29,60 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// minCompressedMessage is the smallest tunnel message worth deflating;
+// pings, acks and tiny responses cost more CPU to compress than they save
+const minCompressedMessage = 256
+
+// Clients turned away by MaxTunnels are told why
+const serverFullMessage = "Server is at its tunnel limit, try again later"
+
+// maxDisconnectReason caps, in characters, the client's account of why its
+// last session ended. It's stored and shown as sent, so a client can't fill
+// the devices table with it.
+const maxDisconnectReason = 200
+
+// maxClientVersion caps, in characters, the version a client reports
+const maxClientVersion = 64
+
+// maxClientUptime caps, in seconds, the uptime a client reports, keeping the
+// start time it implies sensible (and the duration from overflowing)
+const maxClientUptime = 10 * 365 * 24 * 60 * 60
+
 // Handler holds HTTP handlers
 type Handler struct {
 	config  *Config
-	store   *Store
+	store   Storage
 	tunnels *TunnelManager
+
+	mailer          *Mailer      // nil without SMTP
+	claimAttempts   *rateLimiter // Claim code guesses, per user and per IP
+	subdomainChecks *rateLimiter // Subdomain availability checks, per IP
+
+	subdomains *SubdomainPolicy // Reserved and blocked subdomains
+	abuse      AbuseScanner     // nil unless abuse scanning is configured
+	certs      *CertMonitor     // nil unless this server terminates TLS
+
+	bandwidthWarned sync.Map // Device ID -> month its soft-limit warning went out
+
+	shuttingDown atomic.Bool
 }
 
 // NewHandler creates a new handler
-func NewHandler(config *Config, store *Store, tunnels *TunnelManager) *Handler {
-	return &Handler{
-		config:  config,
-		store:   store,
-		tunnels: tunnels,
+func NewHandler(config *Config, store Storage, tunnels *TunnelManager, subdomains *SubdomainPolicy, abuse AbuseScanner) *Handler {
+	h := &Handler{
+		config:          config,
+		store:           store,
+		tunnels:         tunnels,
+		subdomains:      subdomains,
+		abuse:           abuse,
+		mailer:          NewMailer(config),
+		claimAttempts:   &rateLimiter{},
+		subdomainChecks: &rateLimiter{},
 	}
+	h.claimAttempts.SetLimit(claimCodeAttempts)
+	h.subdomainChecks.SetLimit(subdomainCheckRate)
+	h.certs = NewCertMonitor(config, h.certServed)
+	return h
 }
 
 // ServeHTTP routes requests
@@ -81,24 +130,62 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A user's own domain, CNAMEd to one of their devices
+	if subdomain := h.customDomainSubdomain(host); subdomain != "" {
+		h.handleTunnelRequest(w, r, subdomain)
+		return
+	}
+
 	http.Error(w, "Not Found", http.StatusNotFound)
 }
 
+// writeBandwidthExceeded tells visitors a monthly bandwidth limit has been
+// reached. who is the subject of the sentence ("This tunnel"). Pro only
+// raises a device's own limit, so it's only offered for those.
+func (h *Handler) writeBandwidthExceeded(w http.ResponseWriter, who string, used, limit int64, offerUpgrade bool) {
+	upgrade := ""
+	if offerUpgrade {
+		upgrade = fmt.Sprintf(`<p><a href="https://%s/upgrade">Upgrade to Pro</a> for 100GB/month.</p>
+`, h.config.BaseDomain)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusPaymentRequired)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><title>Bandwidth Limit Exceeded</title></head>
+<body style="font-family: system-ui; max-width: 500px; margin: 50px auto; text-align: center;">
+<h1>Bandwidth Limit Exceeded</h1>
+<p>%s has used <strong>%s</strong> of its <strong>%s</strong> monthly limit.</p>
+<p>The limit resets on the 1st of each month.</p>
+%s</body>
+</html>`, who, FormatBytes(used), FormatBytes(limit), upgrade)
+}
+
 // handleTunnelConnect handles WebSocket connections from tunnel clients
 func (h *Handler) handleTunnelConnect(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// The tunnel limit is checked after auth rather than here, so a device
+	// reconnecting to replace its own stale tunnel isn't turned away
+
+	// permessage-deflate is only negotiated when the client offers it too
+	tunnelUpgrader := upgrader
+	tunnelUpgrader.EnableCompression = h.config.TunnelCompression > 0
+	conn, err := tunnelUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		slog.Warn("tunnel websocket upgrade failed", "client_ip", clientIP(r, h.config.BehindProxy), "error", err)
 		return
 	}
 
-	log.Printf("New tunnel connection from %s", r.RemoteAddr)
+	if h.config.TunnelCompression > 0 {
+		conn.SetCompressionLevel(h.config.TunnelCompression)
+	}
+
+	slog.Debug("new tunnel connection", "client_ip", clientIP(r, h.config.BehindProxy))
 
 	// Wait for auth message
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	_, data, err := conn.ReadMessage()
 	if err != nil {
-		log.Printf("Auth read failed: %v", err)
+		slog.Warn("tunnel auth read failed", "client_ip", clientIP(r, h.config.BehindProxy), "error", err)
 		conn.Close()
 		return
 	}
@@ -112,10 +199,23 @@ func (h *Handler) handleTunnelConnect(w http.ResponseWriter, r *http.Request) {
 
 	authMsg := msg.(AuthMessage)
 
+	if !clientMeetsMinimum(authMsg.ClientVersion, h.config.MinClientVersion) {
+		slog.Warn("tunnel auth refused: client too old", "client_ip", clientIP(r, h.config.BehindProxy),
+			"client_version", authMsg.ClientVersion, "min_client_version", h.config.MinClientVersion)
+		reported := authMsg.ClientVersion
+		if reported == "" {
+			reported = "(unknown)"
+		}
+		sendError(conn, "client_too_old", fmt.Sprintf("Client version %s is not %s or newer, the minimum this server accepts. Run 'piportal upgrade' to update.",
+			reported, h.config.MinClientVersion))
+		conn.Close()
+		return
+	}
+
 	// Validate token
 	device, err := h.store.GetDeviceByToken(authMsg.Token)
 	if err != nil {
-		log.Printf("Token lookup error: %v", err)
+		slog.Error("token lookup failed", "error", err)
 		sendError(conn, "internal_error", "Token lookup failed")
 		conn.Close()
 		return
@@ -126,135 +226,453 @@ func (h *Handler) handleTunnelConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Send success response
-	sendJSON(conn, NewAuthResult(true, device.Subdomain, fmt.Sprintf("Connected as %s.%s", device.Subdomain, h.config.BaseDomain)))
+	if authMsg.Reconnects != nil && (*authMsg.Reconnects < 0 || authMsg.ClientUptime < 0) {
+		slog.Warn("ignoring negative connection stats", "subdomain", device.Subdomain,
+			"reconnects", *authMsg.Reconnects, "client_uptime", authMsg.ClientUptime)
+	} else if authMsg.Reconnects != nil {
+		uptime := min(authMsg.ClientUptime, maxClientUptime)
+		stats := ConnectionStats{
+			Reconnects:      *authMsg.Reconnects,
+			ClientStartedAt: time.Now().Add(-time.Duration(uptime) * time.Second),
+			LastDisconnect:  truncateText(authMsg.LastDisconnect, maxDisconnectReason),
+		}
+		if err := h.store.SetConnectionStats(device.ID, stats); err != nil {
+			slog.Error("saving connection stats failed", "subdomain", device.Subdomain, "error", err)
+		}
+	}
+
+	// Older clients may not report a version; keep the last one we saw.
+	// Anything that isn't a version number isn't stored.
+	version := truncateText(authMsg.ClientVersion, maxClientVersion)
+	if _, ok := parseVersion(version); ok && version != device.ClientVersion {
+		if err := h.store.SetClientVersion(device.ID, version); err != nil {
+			slog.Error("saving client version failed", "subdomain", device.Subdomain, "error", err)
+		}
+		device.ClientVersion = version
+	}
 
-	// Create and register tunnel
+	// Full unless this device is replacing its own tunnel. The slot is held
+	// from here, so a client told it's connected is never then turned away.
+	if !h.tunnels.ReserveSlot(device.Subdomain) {
+		slog.Warn("tunnel refused: server full", "subdomain", device.Subdomain, "max_tunnels", h.config.MaxTunnels)
+		sendError(conn, "server_full", serverFullMessage)
+		conn.Close()
+		return
+	}
+
+	// Forwarding without its policy could expose paths the owner closed off,
+	// so a device whose settings can't be read is asked to try again
 	tunnel := NewTunnel(device, conn, h.tunnels)
+	tunnel.noProxy = authMsg.NoProxy
+	if err := h.loadTunnelSettings(tunnel); err != nil {
+		tunnel.logger.Error("tunnel settings lookup failed", "error", err)
+		h.tunnels.ReleaseSlot()
+		sendError(conn, "internal_error", "Device settings lookup failed")
+		tunnel.Close()
+		return
+	}
+
+	// Send success response, including the limits the client's proxy should use
+	limits := h.config.LimitsForTier(device.Tier)
+	result := NewAuthResult(true, device.Subdomain, fmt.Sprintf("Connected as %s.%s", device.Subdomain, h.config.BaseDomain))
+	result.RequestTimeout = int(limits.Timeout.Seconds())
+	result.MaxBodySize = limits.MaxBodySize
+	result.BaseDomain = h.config.BaseDomain
+	result.URL = "https://" + device.Subdomain + "." + h.config.BaseDomain
+	if settings, err := h.store.GetAgentSettings(device.ID); err != nil {
+		slog.Error("agent settings lookup failed", "subdomain", device.Subdomain, "error", err)
+	} else if !settings.IsEmpty() {
+		result.Settings = &settings
+	}
+	if err := sendJSON(conn, result); err != nil {
+		h.tunnels.ReleaseSlot()
+		tunnel.Close()
+		return
+	}
 	h.tunnels.RegisterTunnel(tunnel)
 
 	// Run the tunnel (blocks until disconnect)
 	tunnel.Run()
 }
 
+// loadTunnelSettings gives a new tunnel the device's forwarding settings, so
+// requests don't each look them up. Their handlers update a connected tunnel
+// when they change. Only a failure to read the request policy is returned;
+// other settings fall back to their defaults.
+func (h *Handler) loadTunnelSettings(tunnel *Tunnel) error {
+	deviceID := tunnel.Device.ID
+	policy, err := h.store.GetRequestPolicy(deviceID)
+	if err != nil {
+		return fmt.Errorf("request policy: %w", err)
+	}
+	tunnel.policy.Store(policy)
+
+	if limit, err := h.store.GetRateLimit(deviceID); err != nil {
+		tunnel.logger.Error("rate limit lookup failed", "error", err)
+	} else {
+		tunnel.limiter.SetLimit(limit)
+	}
+	if enabled, err := h.store.GetResponseCache(deviceID); err != nil {
+		tunnel.logger.Error("response cache lookup failed", "error", err)
+	} else {
+		tunnel.cache.Configure(enabled, h.config.CacheMaxEntrySize, h.config.CacheMaxSize)
+	}
+	if enabled, err := h.store.GetTimingHeaders(deviceID); err != nil {
+		tunnel.logger.Error("timing headers lookup failed", "error", err)
+	} else {
+		tunnel.timingHeaders.Store(enabled)
+	}
+	tunnel.setMaintenance(h.activeMaintenance(deviceID))
+	if rules, err := h.store.GetRouteTimeouts(deviceID); err != nil {
+		tunnel.logger.Error("route timeout lookup failed", "error", err)
+	} else {
+		tunnel.routeTimeouts.Store(&rules)
+	}
+	if headers, err := h.store.GetResponseHeaders(deviceID); err != nil {
+		tunnel.logger.Error("response headers lookup failed", "error", err)
+	} else {
+		tunnel.headers.Store(&headers)
+	}
+	return nil
+}
+
 // handleTunnelRequest proxies a request through a tunnel
 func (h *Handler) handleTunnelRequest(w http.ResponseWriter, r *http.Request, subdomain string) {
+	// One ID for the browser, our logs and the client's logs. It travels to
+	// the client (and the local service) as a request header.
+	requestID := requestIDFromHeader(r)
+	requestHeaderBytes := requestHeaderSize(r) // As received, before we add headers
+	r.Header.Set(RequestIDHeader, requestID)
+	w.Header().Set(RequestIDHeader, requestID)
+
 	tunnel := h.tunnels.GetTunnel(subdomain)
 	if tunnel == nil {
 		// Check if device exists but is offline
 		device, _ := h.store.GetDeviceBySubdomain(subdomain)
 		if device != nil {
-			http.Error(w, fmt.Sprintf("%s.%s is currently offline", subdomain, h.config.BaseDomain), http.StatusServiceUnavailable)
+			// Maintenance covers restarting the client too
+			if mode := h.activeMaintenance(device.ID); mode != nil {
+				h.writeMaintenancePage(w, subdomain, mode)
+				return
+			}
+			h.httpError(w, r, http.StatusServiceUnavailable, "Device Offline",
+				fmt.Sprintf("%s.%s is currently offline", subdomain, h.config.BaseDomain))
 		} else {
-			http.Error(w, "Tunnel not found", http.StatusNotFound)
+			h.httpError(w, r, http.StatusNotFound, "Tunnel Not Found",
+				fmt.Sprintf("Tunnel not found: no device is using %s.%s", subdomain, h.config.BaseDomain))
 		}
 		return
 	}
 
+	// A monitoring-only client has no local service to forward to
+	if tunnel.noProxy {
+		h.httpError(w, r, http.StatusServiceUnavailable, "Forwarding Unavailable",
+			"This device is connected for monitoring only and doesn't serve web traffic")
+		return
+	}
+
+	// Held for abuse review, whatever the owner's settings
+	if !h.checkAbuseBlock(w, r, tunnel) {
+		return
+	}
+
 	// Check if tunnel forwarding is enabled
 	if !tunnel.Device.TunnelEnabled {
-		http.Error(w, "Tunnel forwarding is disabled", http.StatusForbidden)
+		h.httpError(w, r, http.StatusForbidden, "Forwarding Disabled", "Tunnel forwarding is disabled")
+		return
+	}
+
+	// Throttle before doing anything that costs the owner bandwidth
+	if !h.checkRateLimit(w, r, tunnel) {
+		return
+	}
+
+	// Serve the maintenance page without touching the local service
+	if mode := tunnel.maintenance.Load(); mode != nil {
+		h.writeMaintenancePage(w, subdomain, mode)
+		return
+	}
+
+	// Read-only tunnels and other method/path restrictions
+	if !h.checkRequestPolicy(w, r, tunnel) {
 		return
 	}
 
 	// Check bandwidth limit
 	isOver, used, limit, err := h.store.IsOverBandwidthLimit(tunnel.Device.ID)
 	if err != nil {
-		log.Printf("Bandwidth check error: %v", err)
+		tunnel.logger.Error("bandwidth check failed", "error", err)
 	} else if isOver {
-		log.Printf("Bandwidth exceeded for %s: %s / %s", subdomain, FormatBytes(used), FormatBytes(limit))
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusPaymentRequired)
-		fmt.Fprintf(w, `<!DOCTYPE html>
-<html>
-<head><title>Bandwidth Limit Exceeded</title></head>
-<body style="font-family: system-ui; max-width: 500px; margin: 50px auto; text-align: center;">
-<h1>Bandwidth Limit Exceeded</h1>
-<p>This tunnel has used <strong>%s</strong> of its <strong>%s</strong> monthly limit.</p>
-<p>The limit resets on the 1st of each month.</p>
-<p><a href="https://%s/upgrade">Upgrade to Pro</a> for 100GB/month.</p>
-</body>
-</html>`, FormatBytes(used), FormatBytes(limit), h.config.BaseDomain)
+		tunnel.logger.Info("bandwidth limit exceeded", "request_id", requestID, "used", FormatBytes(used), "limit", FormatBytes(limit))
+		h.writeBandwidthExceeded(w, "This tunnel", used, limit, true)
+		return
+	} else if h.config.BandwidthWarning(used, limit) {
+		w.Header().Set(BandwidthWarningHeader, fmt.Sprintf("%d%% of monthly bandwidth used", used*100/limit))
+		h.warnBandwidth(tunnel.Device, used, limit)
+	}
+
+	// An organization's limit covers all of its devices together
+	if orgID := tunnel.Device.OrgID; orgID != "" {
+		isOver, used, limit, err := h.store.IsOrgOverBandwidthLimit(orgID)
+		if err != nil {
+			tunnel.logger.Error("organization bandwidth check failed", "org_id", orgID, "error", err)
+		} else if isOver {
+			tunnel.logger.Info("organization bandwidth limit exceeded", "request_id", requestID, "org_id", orgID, "used", FormatBytes(used), "limit", FormatBytes(limit))
+			h.writeBandwidthExceeded(w, "This tunnel's organization", used, limit, false)
+			return
+		}
+	}
+
+	// Serve from the device's response cache if it has opted in. Hits never
+	// reach the tunnel, so they aren't metered. A stale entry turns the
+	// request into a conditional one, so the device can answer 304.
+	useCache := cacheableRequest(r) && tunnel.cache.Enabled()
+	var cached *cacheEntry
+	if useCache {
+		cached = tunnel.cache.Get(cacheKey(r))
+		if cached != nil && cached.fresh(time.Now()) && !bypassCache(r) {
+			tunnel.cache.Hit()
+			h.writeCachedResponse(w, r, cached, "HIT", tunnel.responseHeaders())
+			return
+		}
+		if cached != nil && !addValidators(r, cached) {
+			cached = nil
+		}
+	}
+
+	// A device whose service keeps failing gets a rest
+	if !h.checkBreaker(w, r, tunnel) {
 		return
 	}
 
-	// Generate request ID
-	requestID := generateRequestID()
+	tunnel.logger.Debug("proxying request", "request_id", requestID, "method", r.Method, "path", r.URL.Path, "client_ip", clientIP(r, h.config.BehindProxy))
 
-	log.Printf("Proxying %s %s -> %s", r.Method, r.URL.Path, subdomain)
+	// Tell the local service who the visitor is, without trusting a
+	// client-supplied header unless a proxy we sit behind set it
+	r.Header.Set("X-Forwarded-For", forwardedFor(r, h.config.BehindProxy))
+
+	// The wait for the device is bounded by the request timeout, once per
+	// attempt; the write timeout only starts counting after that
+	limits, timeoutRule := h.requestLimits(r, tunnel)
+	retryWait := time.Duration(h.config.RetriesFor(r.Method)) * (limits.Timeout + retryDelay)
+	if safeMethod(r.Method) {
+		retryWait += h.config.ReplayWindow + limits.Timeout
+	}
+	h.extendWriteDeadline(w, limits.Timeout+retryWait)
+
+	// Meter what actually crosses the wire, headers included and after
+	// compression, whichever way the request ends
+	requestBody := &countingReader{ReadCloser: http.NoBody}
+	if r.Body != nil {
+		requestBody.ReadCloser = r.Body
+	}
+	r.Body = requestBody
+	counter := &countingResponseWriter{ResponseWriter: w}
+	w = counter
+	defer func() {
+		if err := h.store.AddBandwidth(tunnel.Device.ID, requestHeaderBytes+requestBody.n, counter.n); err != nil {
+			tunnel.logger.Error("recording bandwidth failed", "request_id", requestID, "error", err)
+		}
+	}()
 
 	// Forward request through tunnel
-	resp, err := tunnel.ForwardRequest(r, requestID)
+	resp, tunnel, retries, err := h.forwardWithRetry(r, subdomain, tunnel, limits)
+	h.recordBreaker(tunnel, resp, err)
+	if retries > 0 {
+		w.Header().Set("X-PiPortal-Retries", strconv.Itoa(retries))
+	}
 	if err != nil {
-		log.Printf("Forward error: %v", err)
-		http.Error(w, fmt.Sprintf("Tunnel error: %v", err), http.StatusBadGateway)
+		tunnel.logger.Warn("forward failed", "request_id", requestID, "method", r.Method, "path", r.URL.Path, "retries", retries, "error", err)
+		switch {
+		case errors.Is(err, ErrBodyTooLarge):
+			h.httpError(w, r, http.StatusRequestEntityTooLarge, "Request Too Large", "Request body too large")
+		case errors.Is(err, ErrTunnelBusy):
+			w.Header().Set("Retry-After", "1")
+			h.httpError(w, r, http.StatusServiceUnavailable, "Device Busy", "Tunnel busy: too many requests in flight, try again shortly")
+		case errors.Is(err, ErrRequestTimeout):
+			if timeoutRule != nil {
+				w.Header().Set(TimeoutRuleHeader, timeoutRule.String())
+			} else {
+				w.Header().Set(TimeoutRuleHeader, fmt.Sprintf("default (%s)", limits.Timeout))
+			}
+			h.httpError(w, r, http.StatusGatewayTimeout, "Device Timed Out", "Tunnel timeout: the device did not respond in time")
+		case wantsHTML(r):
+			// The cause is for the logs, not for visitors
+			h.errorPage(w, http.StatusBadGateway, "Bad Gateway", "The device couldn't be reached. Try again in a moment.")
+		default:
+			http.Error(w, fmt.Sprintf("Tunnel error: %v", err), http.StatusBadGateway)
+		}
 		return
 	}
 
 	// Get response body
 	body, err := resp.GetBody()
 	if err != nil {
-		log.Printf("Body decode error: %v", err)
+		tunnel.logger.Warn("response body decode failed", "request_id", requestID, "error", err)
 		return
 	}
 
-	// Track bandwidth (request + response)
-	var requestSize int64 = int64(len(r.URL.String()) + 200) // Approximate request overhead
-	if r.ContentLength > 0 {
-		requestSize += r.ContentLength
+	if useCache {
+		now := time.Now()
+		if cached != nil && resp.StatusCode == http.StatusNotModified {
+			// Our conditional request: the cached copy is still good. Drop
+			// the validators we added so the visitor gets the full response.
+			r.Header.Del("If-None-Match")
+			r.Header.Del("If-Modified-Since")
+			entry := cached.revalidated(resp.Headers, now)
+			tunnel.cache.Put(entry)
+			tunnel.cache.Hit()
+			h.writeCachedResponse(w, r, entry, "REVALIDATED", tunnel.responseHeaders())
+			return
+		}
+		if entry := newCacheEntry(cacheKey(r), resp.StatusCode, resp.Headers, body, now); entry != nil {
+			tunnel.cache.Put(entry)
+		} else if cached != nil {
+			tunnel.cache.Delete(cacheKey(r))
+		}
 	}
-	responseSize := int64(len(body))
-	h.store.AddBandwidth(tunnel.Device.ID, requestSize, responseSize)
 
 	// Copy response headers
 	for key, value := range resp.Headers {
 		w.Header().Set(key, value)
 	}
+	applyResponseHeaders(w, tunnel.responseHeaders())
+	w.Header().Set(RequestIDHeader, requestID)
+	if useCache {
+		w.Header().Set(CacheHeader, "MISS")
+	}
+	if tunnel.timingHeaders.Load() {
+		setTimingHeaders(w, resp)
+	}
+
+	writeProxiedBody(w, r, resp.StatusCode, body)
+	h.scanForAbuse(tunnel, r, resp.StatusCode, resp.Headers, body)
+}
+
+// writeProxiedBody writes the status and body of a response from the device,
+// compressing it for the browser when worthwhile
+func writeProxiedBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+	if shouldGzip(r, w.Header(), body) {
+		if compressed, err := gzipBytes(body); err == nil && len(compressed) < len(body) {
+			body = compressed
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+			// Ranges of what we send wouldn't line up with the origin's
+			w.Header().Del("Accept-Ranges")
+		}
+	}
 
-	// Write status code
-	w.WriteHeader(resp.StatusCode)
+	// The origin's Content-Length needn't match what we send: we may have
+	// compressed the body, the client's HTTP stack may have decoded it, or
+	// it may have been cut off at the body size limit. A length that
+	// disagrees with the body hangs or truncates the visitor's download.
+	switch {
+	case r.Method == http.MethodHead:
+		// No body; the origin's length describes the GET response
+	case status < 200 || status == http.StatusNoContent || status == http.StatusNotModified:
+		w.Header().Del("Content-Length")
+	default:
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
 
-	// Write body
+	w.WriteHeader(status)
 	if body != nil {
 		w.Write(body)
 	}
 }
 
+// Pause between a failed attempt and its retry, giving a dropped client time to reconnect
+const retryDelay = 500 * time.Millisecond
+
+// safeMethod reports whether a method only reads, so sending a request twice
+// does no harm
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// forwardWithRetry forwards a request, re-sending idempotent requests that
+// time out or lose their tunnel. Each attempt gets a fresh protocol request ID
+// (the RequestIDHeader stays the same) and looks the tunnel up again, since a
+// reconnecting client registers a new one. Responses arrive as a single
+// message, so a retry never follows a partial response. Returns the tunnel
+// that served the final attempt.
+//
+// A safe request whose tunnel drops first waits for the device to reconnect
+// (see AwaitReconnect) and is replayed once over the new connection, without
+// using up a retry.
+func (h *Handler) forwardWithRetry(r *http.Request, subdomain string, tunnel *Tunnel, limits RequestLimits) (*ResponseMessage, *Tunnel, int, error) {
+	maxRetries := h.config.RetriesFor(r.Method)
+	replayed := false
+
+	for retries := 0; ; retries++ {
+		resp, err := tunnel.ForwardRequest(r, generateRequestID(), limits)
+		if errors.Is(err, ErrTunnelClosed) && !replayed && safeMethod(r.Method) {
+			replayed = true
+			if next := h.tunnels.AwaitReconnect(r.Context(), tunnel); next != nil {
+				tunnel = next
+				tunnel.logger.Info("replaying request after reconnect", "request_id", r.Header.Get(RequestIDHeader), "method", r.Method, "path", r.URL.Path)
+				resp, err = tunnel.ForwardRequest(r, generateRequestID(), limits)
+			}
+		}
+		if err == nil || retries >= maxRetries ||
+			!(errors.Is(err, ErrRequestTimeout) || errors.Is(err, ErrTunnelClosed)) {
+			return resp, tunnel, retries, err
+		}
+
+		select {
+		case <-time.After(retryDelay):
+		case <-r.Context().Done():
+			return nil, tunnel, retries, err
+		}
+
+		next := h.tunnels.GetTunnel(subdomain)
+		if next == nil {
+			return nil, tunnel, retries, err
+		}
+		tunnel = next
+		tunnel.logger.Info("retrying request", "request_id", r.Header.Get(RequestIDHeader), "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+}
+
 // handleMainSite serves the main website/API
 func (h *Handler) handleMainSite(w http.ResponseWriter, r *http.Request) {
+	page := findPublicPage(r.URL.Path)
+
 	switch {
-	case r.URL.Path == "/":
-		h.handleHome(w, r)
+	case r.URL.Path == "/healthz":
+		h.handleHealthz(w, r)
+	case r.URL.Path == "/readyz":
+		h.handleReadyz(w, r)
+	case page != nil:
+		page.Serve(h, w, r)
 	case strings.HasPrefix(r.URL.Path, "/api/v1/"):
 		h.handleDashboardAPI(w, r)
 	case r.URL.Path == "/api/register":
 		h.handleRegister(w, r)
-	case r.URL.Path == "/status":
-		h.handleStatusPage(w, r)
+	case r.URL.Path == "/api/subdomain/available":
+		h.handleSubdomainAvailable(w, r)
 	case r.URL.Path == "/api/status":
 		h.handleStatus(w, r)
 	case r.URL.Path == "/api/version":
 		h.handleVersion(w, r)
 	case r.URL.Path == "/api/usage":
 		h.handleUsage(w, r)
-	case r.URL.Path == "/fleet":
-		h.handleFleetPage(w, r)
-	case r.URL.Path == "/terms":
-		h.handleTermsPage(w, r)
+	case r.URL.Path == "/api/device/self" && r.Method == http.MethodGet:
+		h.handleDeviceSelf(w, r)
 	case r.URL.Path == "/sitemap.xml":
 		h.handleSitemap(w, r)
-	case r.URL.Path == "/upgrade":
-		h.handleUpgrade(w, r)
+	case r.URL.Path == "/robots.txt":
+		h.handleRobots(w, r)
 	case strings.HasPrefix(r.URL.Path, "/dashboard"):
 		h.serveDashboard(w, r)
 	case r.URL.Path == "/logo.png":
 		h.serveFile(w, r, "/var/www/piportal/logo.png", "image/png")
 	case r.URL.Path == "/install.sh":
-		h.serveFile(w, r, "/var/www/piportal/install.sh", "text/plain")
+		h.handleInstallScript(w, r)
 	case strings.HasPrefix(r.URL.Path, "/downloads/"):
 		h.serveDownload(w, r)
 	default:
-		http.Error(w, "Not Found", http.StatusNotFound)
+		h.httpError(w, r, http.StatusNotFound, "Page Not Found", "Not Found: there's no page at this address")
 	}
 }
 
@@ -268,29 +686,45 @@ func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, path, conten
 	w.Write(data)
 }
 
+// Client binaries are published here as piportal-linux-<arch>, each with an
+// optional detached Ed25519 signature in piportal-linux-<arch>.sig
+const downloadsDir = "/var/www/piportal/downloads/"
+
+// Architectures we publish client binaries for
+var downloadArchs = []string{"arm64", "arm", "amd64"}
+
 func (h *Handler) serveDownload(w http.ResponseWriter, r *http.Request) {
 	// Only allow specific filenames to prevent path traversal
 	filename := strings.TrimPrefix(r.URL.Path, "/downloads/")
-	allowed := map[string]bool{
-		"piportal-linux-arm64": true,
-		"piportal-linux-arm":   true,
-		"piportal-linux-amd64": true,
+	allowed := false
+	for _, arch := range downloadArchs {
+		if filename == "piportal-linux-"+arch {
+			allowed = true
+		}
 	}
-	if !allowed[filename] {
+	if !allowed {
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
 
-	filepath := "/var/www/piportal/downloads/" + filename
-	data, err := os.ReadFile(filepath)
+	f, err := os.Open(downloadsDir + filename)
 	if err != nil {
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
 
+	// ServeContent answers Range requests, so a download that drops on a
+	// flaky connection can resume where it stopped (curl -C -), and
+	// If-Modified-Since. The type is set here so it isn't sniffed.
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-	w.Write(data)
+	http.ServeContent(w, r, filename, info.ModTime(), f)
 }
 
 func (h *Handler) handleHome(w http.ResponseWriter, r *http.Request) {
@@ -718,41 +1152,80 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 		Subdomain string `json:"subdomain"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	if req.Subdomain == "" {
-		jsonError(w, "subdomain is required", http.StatusBadRequest)
+	req.Subdomain = strings.ToLower(strings.TrimSpace(req.Subdomain))
+	if err := h.subdomains.Check(req.Subdomain); err != nil {
+		jsonError(w, ErrCodeSubdomainInvalid, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	device, err := h.store.CreateDevice(req.Subdomain, "")
 	if err != nil {
-		jsonError(w, err.Error(), http.StatusBadRequest)
+		jsonError(w, subdomainErrorCode(err), err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	resp := map[string]interface{}{
 		"success":   true,
 		"token":     device.Token,
 		"subdomain": device.Subdomain,
 		"url":       fmt.Sprintf("https://%s.%s", device.Subdomain, h.config.BaseDomain),
-	})
+	}
+	// A short code is easier to type into the dashboard than the token.
+	// Registration still succeeds without one.
+	if code, expiresAt, err := h.newClaimCode(device.ID); err != nil {
+		slog.Error("creating claim code failed", "subdomain", device.Subdomain, "error", err)
+	} else {
+		resp["claim_code"] = code
+		resp["claim_code_expires_at"] = expiresAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	status := map[string]interface{}{
 		"status":  "ok",
 		"tunnels": h.tunnels.Stats(),
-	})
+	}
+	if h.certs != nil {
+		status["tls"] = h.certs.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// tlsStatusRow describes the TLS certificates for the status page, reporting
+// whether they need attention
+func (h *Handler) tlsStatusRow() (class, text string, warning bool) {
+	if h.certs == nil {
+		if h.config.BehindProxy {
+			return "ok", "Handled by proxy", false
+		}
+		return "", "Not in use", false
+	}
+	status := h.certs.Status()
+	switch {
+	case status.State == certStateWarning:
+		return "warn", "Attention needed", true
+	case status.State == certStateOK:
+		return "ok", fmt.Sprintf("Operational &middot; next expiry in %d days", status.DaysLeft), false
+	}
+	return "ok", "Operational", false
 }
 
 func (h *Handler) handleStatusPage(w http.ResponseWriter, r *http.Request) {
 	stats := h.tunnels.Stats()
 	activeTunnels := stats["active_tunnels"]
+	tlsClass, tlsText, tlsWarning := h.tlsStatusRow()
+	badgeClass, badgeText := "status-badge", "All Systems Operational"
+	if tlsWarning {
+		badgeClass, badgeText = "status-badge warn", "TLS Certificates Need Attention"
+	}
 	w.Header().Set("Content-Type", "text/html")
 	fmt.Fprintf(w, `<!DOCTYPE html>
 <html lang="en">
@@ -772,6 +1245,8 @@ func (h *Handler) handleStatusPage(w http.ResponseWriter, r *http.Request) {
         .status-header h1 { font-size: 1.75rem; font-weight: 700; margin-bottom: 12px; }
         .status-badge { display: inline-flex; align-items: center; gap: 8px; background: #f0fdf4; border: 1px solid #bbf7d0; padding: 8px 20px; border-radius: 20px; font-size: 0.95rem; font-weight: 600; color: #166534; }
         .status-badge .dot { width: 10px; height: 10px; border-radius: 50%%; background: #22c55e; }
+        .status-badge.warn { background: #fffbeb; border-color: #fde68a; color: #92400e; }
+        .status-badge.warn .dot { background: #f59e0b; }
         .cards { display: grid; grid-template-columns: repeat(auto-fit, minmax(200px, 1fr)); gap: 16px; margin-bottom: 32px; }
         .card { background: #fff; border: 1px solid #e2e8f0; border-radius: 10px; padding: 24px; text-align: center; }
         .card .value { font-size: 2rem; font-weight: 800; color: #0f172a; }
@@ -783,6 +1258,7 @@ func (h *Handler) handleStatusPage(w http.ResponseWriter, r *http.Request) {
         .info-row .key { color: #64748b; font-size: 0.9rem; }
         .info-row .val { font-weight: 600; font-size: 0.9rem; }
         .info-row .val.ok { color: #16a34a; }
+        .info-row .val.warn { color: #d97706; }
         footer { text-align: center; padding: 32px 24px; color: #94a3b8; font-size: 0.85rem; }
     </style>
 </head>
@@ -791,7 +1267,7 @@ func (h *Handler) handleStatusPage(w http.ResponseWriter, r *http.Request) {
 <div class="container">
   <div class="status-header">
     <h1>Service Status</h1>
-    <div class="status-badge"><div class="dot"></div> All Systems Operational</div>
+    <div class="%s"><div class="dot"></div> %s</div>
   </div>
   <div class="cards">
     <div class="card"><div class="value">%d</div><div class="label">Active Tunnels</div></div>
@@ -804,12 +1280,12 @@ func (h *Handler) handleStatusPage(w http.ResponseWriter, r *http.Request) {
     <div class="info-row"><span class="key">Dashboard</span><span class="val ok">Operational</span></div>
     <div class="info-row"><span class="key">Device API</span><span class="val ok">Operational</span></div>
     <div class="info-row"><span class="key">WebSocket Connections</span><span class="val ok">Operational</span></div>
-    <div class="info-row"><span class="key">TLS Certificates</span><span class="val ok">Operational</span></div>
+    <div class="info-row"><span class="key">TLS Certificates</span><span class="val %s">%s</span></div>
   </div>
 </div>
 <footer><a href="/">PiPortal</a> &middot; <a href="/dashboard">Dashboard</a></footer>
 </body>
-</html>`, activeTunnels, ClientVersion, h.config.BaseDomain)
+</html>`, badgeClass, badgeText, activeTunnels, ClientVersion, h.config.BaseDomain, tlsClass, tlsText)
 }
 
 // ClientVersion is the latest client version available for download
@@ -817,23 +1293,87 @@ var ClientVersion = "0.1.4"
 var ClientChangelog = "Added group command execution across tagged devices"
 
 func (h *Handler) handleVersion(w http.ResponseWriter, r *http.Request) {
+	// Checksums (and signatures, if published) let clients verify upgrades
+	binaries := make(map[string]*BinaryInfo)
+	for _, arch := range downloadArchs {
+		if info := publishedBinary(arch); info != nil {
+			binaries[arch] = info
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"version":      ClientVersion,
 		"release_date": "2026-02-04",
 		"changelog":    ClientChangelog,
+		"binaries":     binaries,
 	})
 }
 
-func (h *Handler) handleUsage(w http.ResponseWriter, r *http.Request) {
-	// Requires token auth
+// BinaryInfo describes a published client binary
+type BinaryInfo struct {
+	SHA256    string `json:"sha256"`              // Hex digest of the binary
+	Signature string `json:"signature,omitempty"` // Base64 Ed25519 signature over the binary
+}
+
+type cachedBinary struct {
+	modTime time.Time
+	size    int64
+	info    *BinaryInfo
+}
+
+// binaryCache avoids re-hashing binaries on every /api/version call
+var binaryCache sync.Map // arch -> *cachedBinary
+
+// publishedBinary returns the checksum and signature for an arch's binary, or nil if not published
+func publishedBinary(arch string) *BinaryInfo {
+	path := downloadsDir + "piportal-linux-" + arch
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if c, ok := binaryCache.Load(arch); ok {
+		cached := c.(*cachedBinary)
+		if cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+			return cached.info
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil
+	}
+	info := &BinaryInfo{SHA256: hex.EncodeToString(hash.Sum(nil))}
+
+	// Signatures are produced at release time; accept raw or base64-encoded
+	if sig, err := os.ReadFile(path + ".sig"); err == nil {
+		if len(sig) == ed25519.SignatureSize {
+			info.Signature = base64.StdEncoding.EncodeToString(sig)
+		} else {
+			info.Signature = strings.TrimSpace(string(sig))
+		}
+	}
+
+	binaryCache.Store(arch, &cachedBinary{modTime: stat.ModTime(), size: stat.Size(), info: info})
+	return info
+}
+
+// deviceFromToken authenticates a request made with a device token, for
+// endpoints the client calls itself. It writes an error and returns nil if
+// the token is missing or unknown.
+func (h *Handler) deviceFromToken(w http.ResponseWriter, r *http.Request) *Device {
 	token := r.Header.Get("Authorization")
 	if token == "" {
 		token = r.URL.Query().Get("token")
 	}
 	if token == "" {
-		jsonError(w, "Authorization required", http.StatusUnauthorized)
-		return
+		jsonError(w, ErrCodeUnauthorized, "Authorization required", http.StatusUnauthorized)
+		return nil
 	}
 
 	// Strip "Bearer " prefix if present
@@ -841,44 +1381,111 @@ func (h *Handler) handleUsage(w http.ResponseWriter, r *http.Request) {
 
 	device, err := h.store.GetDeviceByToken(token)
 	if err != nil {
-		jsonError(w, "Internal error", http.StatusInternalServerError)
-		return
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return nil
+	}
+	if device == nil {
+		jsonError(w, ErrCodeInvalidToken, "Invalid token", http.StatusUnauthorized)
+		return nil
 	}
+	return device
+}
+
+func (h *Handler) handleUsage(w http.ResponseWriter, r *http.Request) {
+	// Requires token auth
+	device := h.deviceFromToken(w, r)
 	if device == nil {
-		jsonError(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
 	usage, err := h.store.GetMonthlyUsage(device.ID)
 	if err != nil {
-		jsonError(w, "Failed to get usage", http.StatusInternalServerError)
+		jsonError(w, ErrCodeInternal, "Failed to get usage", http.StatusInternalServerError)
 		return
 	}
 
 	limit, err := h.store.GetBandwidthLimit(device.ID)
 	if err != nil {
-		jsonError(w, "Failed to get limit", http.StatusInternalServerError)
+		jsonError(w, ErrCodeInternal, "Failed to get limit", http.StatusInternalServerError)
+		return
+	}
+
+	override, err := h.store.GetBandwidthLimitOverride(device.ID)
+	if err != nil {
+		jsonError(w, ErrCodeInternal, "Failed to get limit", http.StatusInternalServerError)
 		return
 	}
 
 	totalUsed := usage.BytesIn + usage.BytesOut
+	percentUsed := 100.0
+	if limit > 0 {
+		percentUsed = float64(totalUsed) / float64(limit) * 100
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"subdomain":    device.Subdomain,
-		"tier":         device.Tier,
-		"month":        usage.Month,
-		"bytes_in":     usage.BytesIn,
-		"bytes_out":    usage.BytesOut,
-		"bytes_total":  totalUsed,
-		"limit":        limit,
-		"limit_human":  FormatBytes(limit),
-		"used_human":   FormatBytes(totalUsed),
-		"percent_used": float64(totalUsed) / float64(limit) * 100,
+		"subdomain":      device.Subdomain,
+		"tier":           device.Tier,
+		"month":          usage.Month,
+		"bytes_in":       usage.BytesIn,
+		"bytes_out":      usage.BytesOut,
+		"bytes_total":    totalUsed,
+		"limit":          limit,
+		"limit_human":    FormatBytes(limit),
+		"limit_override": override != nil,
+		"used_human":     FormatBytes(totalUsed),
+		"percent_used":   percentUsed,
+
+		"bandwidth_warning": h.config.BandwidthWarning(totalUsed, limit),
 	})
 }
 
+// handleDeviceSelf returns the server's view of the device owning the token,
+// for 'piportal whoami' on a Pi without a browser
+func (h *Handler) handleDeviceSelf(w http.ResponseWriter, r *http.Request) {
+	device := h.deviceFromToken(w, r)
+	if device == nil {
+		return
+	}
+	// The token lookup doesn't load the owner
+	device, err := h.store.GetDeviceByID(device.ID)
+	if err != nil || device == nil {
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"id":             device.ID,
+		"subdomain":      device.Subdomain,
+		"url":            "https://" + device.Subdomain + "." + h.config.BaseDomain,
+		"tier":           device.Tier,
+		"claimed":        device.UserID != "",
+		"is_online":      device.IsOnline,
+		"tunnel_enabled": device.TunnelEnabled,
+		"created_at":     device.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+	if !device.LastSeenAt.IsZero() {
+		resp["last_seen_at"] = device.LastSeenAt.Format("2006-01-02T15:04:05Z")
+	}
+	if device.OrgID != "" {
+		if org, _ := h.store.GetOrganizationByID(device.OrgID); org != nil {
+			resp["org_name"] = org.Name
+		}
+	}
+	if maintenance, _ := h.store.GetMaintenance(device.ID); maintenance != nil {
+		resp["maintenance"] = maintenance.Enabled
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (h *Handler) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	action := `<p><em>Coming soon! Email <a href="mailto:hello@piportal.dev">hello@piportal.dev</a> to get notified.</em></p>`
+	if h.config.BillingEnabled() {
+		action = `<p><a class="btn" href="/dashboard">Upgrade from your dashboard</a></p>`
+	}
+
 	w.Header().Set("Content-Type", "text/html")
 	fmt.Fprintf(w, `<!DOCTYPE html>
 <html>
@@ -921,14 +1528,14 @@ func (h *Handler) handleUpgrade(w http.ResponseWriter, r *http.Request) {
             <li>Email support</li>
             <li>Support indie development</li>
         </ul>
-        <p><em>Coming soon! Email <a href="mailto:hello@piportal.dev">hello@piportal.dev</a> to get notified.</em></p>
+        %s
     </div>
 
     <p style="color: #666; font-size: 0.9em;">
         Bandwidth resets on the 1st of each month. Check your usage with <code>piportal status</code>.
     </p>
 </body>
-</html>`)
+</html>`, action)
 }
 
 // --- Helpers ---
@@ -942,17 +1549,36 @@ func sendError(conn *websocket.Conn, code, message string) {
 	sendJSON(conn, NewErrorMessage(code, message))
 }
 
-func jsonError(w http.ResponseWriter, message string, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": false,
-		"error":   message,
-	})
-}
-
 func generateRequestID() string {
 	b := make([]byte, 8)
 	rand.Read(b)
 	return "req_" + hex.EncodeToString(b)
 }
+
+// RequestIDHeader carries a proxied request's ID to the browser and the client
+const RequestIDHeader = "X-PiPortal-Request-ID"
+
+// requestIDFromHeader reuses the browser's X-Request-ID when it's a sane
+// token, so IDs from upstream proxies carry through; otherwise it makes one
+func requestIDFromHeader(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 128 {
+		return generateRequestID()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return generateRequestID()
+		}
+	}
+	return id
+}
+
+// truncateText cuts s to at most max characters, replacing any invalid
+// UTF-8 so the cut can't leave half a character behind
+func truncateText(s string, max int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testConfig is a dev-mode config with the server's defaults, for tests
+// that run the handler
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	return loadTestConfig(t, "-dev", "-domain", "piportal.test")
+}
+
+// testTunnel is a handler on a test server with one device connected to it.
+// The device answers proxied requests with serve instead of a local service,
+// and passes every other message it gets to received.
+type testTunnel struct {
+	server   *httptest.Server
+	handler  *Handler
+	store    *SQLiteStore
+	device   *Device
+	received chan []byte
+	deflate  bool // permessage-deflate was negotiated for the tunnel
+
+	conn    *websocket.Conn // The device's end of the tunnel
+	writeMu sync.Mutex
+}
+
+func startTestTunnel(t *testing.T, cfg *Config, serve func(req RequestMessage) ResponseMessage) *testTunnel {
+	t.Helper()
+	return startTestTunnelWith(t, cfg, websocket.DefaultDialer, serve)
+}
+
+// startTestTunnelWith is startTestTunnel with the device dialing with dialer
+func startTestTunnelWith(t *testing.T, cfg *Config, dialer *websocket.Dialer, serve func(req RequestMessage) ResponseMessage) *testTunnel {
+	t.Helper()
+	server, handler, store := startTestServer(t, cfg)
+	tunnels := handler.tunnels
+	device, err := store.CreateDevice("testpi", "")
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	if err := store.SetTunnelEnabled(device.ID, true); err != nil {
+		t.Fatalf("enable tunnel: %v", err)
+	}
+
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/tunnel", nil)
+	if err != nil {
+		t.Fatalf("dial tunnel: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(AuthMessage{Type: MessageTypeAuth, Token: device.Token}); err != nil {
+		t.Fatalf("send auth: %v", err)
+	}
+	var result AuthResultMessage
+	if err := conn.ReadJSON(&result); err != nil || !result.Success {
+		t.Fatalf("auth failed: %+v, %v", result, err)
+	}
+
+	// Registered just after the result is sent
+	for deadline := time.Now().Add(5 * time.Second); tunnels.GetTunnel(device.Subdomain) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tt := &testTunnel{server: server, handler: handler, store: store, device: device,
+		received: make(chan []byte, 100), conn: conn,
+		deflate: strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")}
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req RequestMessage
+			if json.Unmarshal(data, &req) != nil || req.Type != MessageTypeRequest {
+				select {
+				case tt.received <- data:
+				default: // Nobody's looking
+				}
+				continue
+			}
+			go func() {
+				resp := serve(req)
+				resp.Type = MessageTypeResponse
+				resp.RequestID = req.RequestID
+				tt.send(resp)
+			}()
+		}
+	}()
+
+	return tt
+}
+
+// startTestServer runs a handler with its own store on a test server
+func startTestServer(t *testing.T, cfg *Config) (*httptest.Server, *Handler, *SQLiteStore) {
+	t.Helper()
+	store := newTestStore(t)
+	subdomains, err := NewSubdomainPolicy(cfg)
+	if err != nil {
+		t.Fatalf("subdomain policy: %v", err)
+	}
+	handler := NewHandler(cfg, store, NewTunnelManager(store, cfg), subdomains, nil)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, handler, store
+}
+
+// newTestUser creates a user, returning an access token for them
+func newTestUser(t *testing.T, h *Handler, email string) (*User, string) {
+	t.Helper()
+	user, err := h.store.CreateUser(email, "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	token, err := GenerateJWT(user.ID, "", h.config.jwtKeys()[0], time.Hour)
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	return user, token
+}
+
+// send sends a message from the device to the server
+func (tt *testTunnel) send(msg interface{}) error {
+	tt.writeMu.Lock()
+	defer tt.writeMu.Unlock()
+	return tt.conn.WriteJSON(msg)
+}
+
+// do sends a request for the device's subdomain
+func (tt *testTunnel) do(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+	req.Header.Set("X-PiPortal-Subdomain", tt.device.Subdomain)
+	resp, err := tt.server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// newRequest builds a request to the test server
+func (tt *testTunnel) newRequest(t *testing.T, method, path string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, tt.server.URL+path, body)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	return req
+}
+
+// bodyResponse is a device response with the given body
+func bodyResponse(status int, headers map[string]string, body []byte) ResponseMessage {
+	return ResponseMessage{StatusCode: status, Headers: headers, BodyBase64: base64.StdEncoding.EncodeToString(body)}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	const limit = 1024
+	cfg := testConfig(t)
+	cfg.MaxBodySize = limit
+
+	tt := startTestTunnel(t, cfg, func(req RequestMessage) ResponseMessage {
+		body, _ := base64.StdEncoding.DecodeString(req.BodyBase64)
+		return bodyResponse(http.StatusOK, nil, body)
+	})
+
+	tests := []struct {
+		name    string
+		size    int
+		chunked bool // No Content-Length, so the limit is found while reading
+		want    int
+	}{
+		{"at limit", limit, false, http.StatusOK},
+		{"over limit", limit + 1, false, http.StatusRequestEntityTooLarge},
+		{"at limit, chunked", limit, true, http.StatusOK},
+		{"over limit, chunked", limit + 1, true, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(strings.Repeat("x", tc.size))
+			if tc.chunked {
+				body = io.MultiReader(body) // Hides the length from NewRequest
+			}
+			resp := tt.do(t, tt.newRequest(t, "POST", "/upload", body))
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.want)
+			}
+			if tc.want != http.StatusOK {
+				return
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if len(got) != tc.size {
+				t.Errorf("device got %d bytes, want %d", len(got), tc.size)
+			}
+		})
+	}
+}
+
+// A device slower than the request timeout gets the visitor a 504; one
+// that answers in time doesn't
+func TestRequestTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	cfg := testConfig(t)
+	cfg.RequestTimeout = timeout
+	cfg.RetryCount = 0
+
+	tt := startTestTunnel(t, cfg, func(req RequestMessage) ResponseMessage {
+		if strings.HasPrefix(req.Path, "/slow") {
+			time.Sleep(timeout + 300*time.Millisecond)
+		}
+		return bodyResponse(http.StatusOK, nil, []byte("ok"))
+	})
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/fast", http.StatusOK},
+		{"/slow", http.StatusGatewayTimeout},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			start := time.Now()
+			resp := tt.do(t, tt.newRequest(t, "GET", tc.path, nil))
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.want)
+			}
+			if tc.want != http.StatusGatewayTimeout {
+				return
+			}
+			if elapsed := time.Since(start); elapsed > timeout+250*time.Millisecond {
+				t.Errorf("504 took %v, want about the %v timeout", elapsed, timeout)
+			}
+			if rule := resp.Header.Get(TimeoutRuleHeader); !strings.HasPrefix(rule, "default") {
+				t.Errorf("%s = %q, want the default timeout", TimeoutRuleHeader, rule)
+			}
+		})
+	}
+}
+
+// Messages cross the tunnel intact whether or not both ends compress them
+func TestTunnelCompression(t *testing.T) {
+	compressing := *websocket.DefaultDialer
+	compressing.EnableCompression = true
+
+	tests := []struct {
+		name        string
+		level       int // -tunnel-compression
+		dialer      *websocket.Dialer
+		wantDeflate bool
+	}{
+		{"both ends compress", 1, &compressing, true},
+		{"best compression", 9, &compressing, true},
+		{"device doesn't support it", 1, websocket.DefaultDialer, false},
+		{"server has it off", 0, &compressing, false},
+	}
+
+	// Well over minCompressedMessage, and compressible
+	body := []byte(strings.Repeat("<li>Temperature: 48.3C</li>\n", 2000))
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.TunnelCompression = tc.level
+			tt := startTestTunnelWith(t, cfg, tc.dialer, func(req RequestMessage) ResponseMessage {
+				got, _ := base64.StdEncoding.DecodeString(req.BodyBase64)
+				return bodyResponse(http.StatusOK, map[string]string{"Content-Type": "text/html"}, got)
+			})
+			if tt.deflate != tc.wantDeflate {
+				t.Fatalf("deflate negotiated = %v, want %v", tt.deflate, tc.wantDeflate)
+			}
+
+			resp := tt.do(t, tt.newRequest(t, "POST", "/echo", strings.NewReader(string(body))))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+			if string(got) != string(body) {
+				t.Errorf("body came back as %d bytes, want the %d sent", len(got), len(body))
+			}
+		})
+	}
+}
+
+// A device passing on a gzipped response, or one its HTTP stack decoded,
+// reaches the visitor with headers that match the body. The origin's
+// Content-Length is stale in both cases.
+func TestGzipOriginResponse(t *testing.T) {
+	page := []byte(strings.Repeat("<p>sensor reading 21.5C</p>\n", 500))
+	compressed, err := gzipBytes(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		deviceBody     []byte
+		deviceEncoding string
+		staleLength    int
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"gzipped by the origin", compressed, "gzip", len(page), "gzip", "gzip"},
+		{"decoded on the device", page, "", len(compressed), "gzip", "gzip"},
+		{"decoded, visitor doesn't take gzip", page, "", len(compressed), "identity", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := startTestTunnel(t, testConfig(t), func(req RequestMessage) ResponseMessage {
+				headers := map[string]string{
+					"Content-Type":   "text/html; charset=utf-8",
+					"Etag":           `"v1"`,
+					"Content-Length": strconv.Itoa(tc.staleLength),
+				}
+				if tc.deviceEncoding != "" {
+					headers["Content-Encoding"] = tc.deviceEncoding
+				}
+				return bodyResponse(http.StatusOK, headers, tc.deviceBody)
+			})
+
+			req := tt.newRequest(t, "GET", "/", nil)
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding) // Set, so the client won't decode for us
+			resp := tt.do(t, req)
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+
+			if got := resp.Header.Get("Content-Encoding"); got != tc.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tc.wantEncoding)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want the origin's", got)
+			}
+			if got := resp.Header.Get("ETag"); got != `"v1"` {
+				t.Errorf("ETag = %q, want the origin's", got)
+			}
+			if resp.ContentLength != int64(len(body)) {
+				t.Errorf("Content-Length = %d for a %d byte body", resp.ContentLength, len(body))
+			}
+
+			if tc.wantEncoding == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("gzip: %v", err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatalf("gunzip: %v", err)
+				}
+			}
+			if !bytes.Equal(body, page) {
+				t.Errorf("body decodes to %d bytes, want the %d byte page", len(body), len(page))
+			}
+		})
+	}
+}
+
+// A visitor's Range reaches the device, and its 206 comes back as sent,
+// never gzipped
+func TestRangeResponse(t *testing.T) {
+	file := []byte(strings.Repeat("0123456789", 1000))
+	var gotRange string
+	tt := startTestTunnel(t, testConfig(t), func(req RequestMessage) ResponseMessage {
+		gotRange = req.Headers["Range"]
+		return bodyResponse(http.StatusPartialContent, map[string]string{
+			"Content-Type":  "text/plain",
+			"Content-Range": "bytes 2000-2999/10000",
+			"Accept-Ranges": "bytes",
+		}, file[2000:3000])
+	})
+
+	req := tt.newRequest(t, "GET", "/notes.txt", nil)
+	req.Header.Set("Range", "bytes=2000-2999")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := tt.do(t, req)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	if gotRange != "bytes=2000-2999" {
+		t.Errorf("device got Range %q, want the visitor's", gotRange)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 2000-2999/10000" {
+		t.Errorf("Content-Range = %q, want the device's", got)
+	}
+	if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q, want bytes", got)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q, want none for a range", got)
+	}
+	if resp.ContentLength != 1000 || !bytes.Equal(body, file[2000:3000]) {
+		t.Errorf("got %d bytes (Content-Length %d), want the 1000 byte range", len(body), resp.ContentLength)
+	}
+}
+
+// Shutting down doesn't leave offline transitions waiting to fire against a
+// closed store
+// A slot held for a client that's been told it's connected can't be taken
+// by another, but its own replacement tunnel still gets in
+func TestReserveSlot(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxTunnels = 1
+	tt := startTestTunnel(t, cfg, nil)
+	tm := tt.handler.tunnels
+
+	if tm.ReserveSlot("other") {
+		t.Fatal("reserved a slot with the server full")
+	}
+	if !tm.ReserveSlot(tt.device.Subdomain) {
+		t.Fatal("a device couldn't reserve a slot to replace its own tunnel")
+	}
+	tm.ReleaseSlot()
+
+	tt.conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); tm.GetTunnel(tt.device.Subdomain) != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was never unregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !tm.ReserveSlot("other") {
+		t.Fatal("couldn't reserve the free slot")
+	}
+	if tm.ReserveSlot(tt.device.Subdomain) {
+		t.Error("reserved a slot another client holds")
+	}
+	tm.ReleaseSlot()
+}
+
+func TestDrainAllStopsOfflineTimers(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.OfflineGracePeriod = time.Hour
+	tt := startTestTunnel(t, cfg, func(req RequestMessage) ResponseMessage {
+		return bodyResponse(http.StatusOK, nil, nil)
+	})
+	tm := tt.handler.tunnels
+
+	tt.conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); tm.GetTunnel(tt.device.Subdomain) != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was never unregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tm.DrainAll(time.Second)
+	tm.mu.RLock()
+	pending := len(tm.offline)
+	tm.mu.RUnlock()
+	if pending != 0 {
+		t.Errorf("%d offline transitions still pending", pending)
+	}
+	device, err := tt.store.GetDeviceByID(tt.device.ID)
+	if err != nil {
+		t.Fatalf("get device: %v", err)
+	}
+	if device.IsOnline {
+		t.Error("device still recorded online after shutdown")
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"read timeout", 200, "read timeout"},
+		{"connection reset", 10, "connection"},
+		{"héllo wörld", 7, "héllo w"},
+		{"bad \xff byte", 200, "bad � byte"},
+		{strings.Repeat("x", 10000), maxDisconnectReason, strings.Repeat("x", maxDisconnectReason)},
+	}
+	for _, tt := range tests {
+		if got := truncateText(tt.in, tt.max); got != tt.want {
+			t.Errorf("truncateText(%.20q, %d) = %.20q, want %.20q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+// connectOnce opens a tunnel with auth and closes it once it's accepted
+func connectOnce(t *testing.T, server *httptest.Server, auth AuthMessage) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/tunnel", nil)
+	if err != nil {
+		t.Fatalf("dial tunnel: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(auth); err != nil {
+		t.Fatalf("send auth: %v", err)
+	}
+	var result AuthResultMessage
+	if err := conn.ReadJSON(&result); err != nil || !result.Success {
+		t.Fatalf("auth failed: %+v, %v", result, err)
+	}
+}
+
+// Only a client version that parses is kept for the device
+func TestTunnelAuthClientVersion(t *testing.T) {
+	server, _, store := startTestServer(t, testConfig(t))
+	device, err := store.CreateDevice("testpi", "")
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+
+	for _, tt := range []struct {
+		version string
+		want    string
+	}{
+		{"1.2.3", "1.2.3"},
+		{"<script>alert(1)</script>", "1.2.3"},
+		{"1.2.4-" + strings.Repeat("x", 10000), "1.2.4-" + strings.Repeat("x", maxClientVersion-len("1.2.4-"))},
+		{"", "1.2.4-" + strings.Repeat("x", maxClientVersion-len("1.2.4-"))},
+	} {
+		connectOnce(t, server, AuthMessage{Type: MessageTypeAuth, Token: device.Token, ClientVersion: tt.version})
+
+		got, err := store.GetDeviceByID(device.ID)
+		if err != nil {
+			t.Fatalf("get device: %v", err)
+		}
+		if got.ClientVersion != tt.want {
+			t.Errorf("after reporting %.20q, client version = %.20q, want %.20q", tt.version, got.ClientVersion, tt.want)
+		}
+	}
+}
+
+// Uptimes that can't be true are clamped or ignored rather than turned into a
+// nonsense start time
+func TestTunnelAuthClientUptime(t *testing.T) {
+	server, _, store := startTestServer(t, testConfig(t))
+	device, err := store.CreateDevice("testpi", "")
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	reconnects := 1
+
+	connectOnce(t, server, AuthMessage{Type: MessageTypeAuth, Token: device.Token, Reconnects: &reconnects, ClientUptime: -60})
+	if stats, err := store.GetConnectionStats(device.ID); err != nil || stats != nil {
+		t.Fatalf("negative uptime saved: %+v, %v", stats, err)
+	}
+
+	connectOnce(t, server, AuthMessage{Type: MessageTypeAuth, Token: device.Token, Reconnects: &reconnects, ClientUptime: math.MaxInt64})
+	stats, err := store.GetConnectionStats(device.ID)
+	if err != nil || stats == nil {
+		t.Fatalf("get connection stats: %+v, %v", stats, err)
+	}
+	if age := time.Since(stats.ClientStartedAt); age < 0 || age > (maxClientUptime+60)*time.Second {
+		t.Errorf("client started %v ago, want at most %v", age, maxClientUptime*time.Second)
+	}
+}
+
+// Forwarding settings live on the tunnel, and changing them takes effect on
+// the connected device at once
+func TestTunnelSettingsAppliedLive(t *testing.T) {
+	tt := startTestTunnel(t, testConfig(t), func(req RequestMessage) ResponseMessage {
+		return bodyResponse(http.StatusOK, nil, []byte("ok"))
+	})
+	token := tt.terminalOwner(t)
+	put := func(setting, body string) {
+		t.Helper()
+		req := tt.newRequest(t, http.MethodPut, "/api/v1/devices/"+tt.device.ID+"/"+setting, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := tt.server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("PUT %s: %v", setting, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("PUT %s = %d", setting, resp.StatusCode)
+		}
+	}
+
+	put("maintenance", `{"enabled": true}`)
+	if resp := tt.do(t, tt.newRequest(t, "GET", "/", nil)); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("in maintenance: status = %d, want 503", resp.StatusCode)
+	}
+	put("maintenance", `{"enabled": false}`)
+
+	put("policy", `{"methods": ["GET"]}`)
+	if resp := tt.do(t, tt.newRequest(t, "POST", "/", nil)); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST under a GET-only policy: status = %d, want 405", resp.StatusCode)
+	}
+
+	put("headers", `{"headers": {"X-Frame-Options": "DENY"}}`)
+	resp := tt.do(t, tt.newRequest(t, "GET", "/", nil))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("status = %d, X-Frame-Options = %q; want 200 with the configured header", resp.StatusCode, resp.Header.Get("X-Frame-Options"))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	maxResponseHeaders     = 20
+	maxResponseHeaderValue = 4096 // Room for a long Content-Security-Policy
+)
+
+// protectedResponseHeaders can't be injected: they describe how the body is
+// framed, or are ours
+var protectedResponseHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// isHeaderToken reports whether s is a valid header name (an RFC 7230 token)
+func isHeaderToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isHeaderValue reports whether s can be sent as a header value as is: no
+// control characters (so no CR or LF to start another header), tabs aside
+func isHeaderValue(s string) bool {
+	for _, c := range s {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeResponseHeaders validates the headers a user wants added to their
+// tunnel's responses and returns them with canonical names
+func normalizeResponseHeaders(headers map[string]string) (map[string]string, error) {
+	if len(headers) > maxResponseHeaders {
+		return nil, fmt.Errorf("at most %d headers are allowed", maxResponseHeaders)
+	}
+	result := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !isHeaderToken(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if protectedResponseHeaders[name] || strings.HasPrefix(name, "X-Piportal-") {
+			return nil, fmt.Errorf("%s can't be set", name)
+		}
+		if _, dup := result[name]; dup {
+			return nil, fmt.Errorf("header %s is listed twice", name)
+		}
+		value = strings.TrimSpace(value)
+		if !isHeaderValue(value) {
+			return nil, fmt.Errorf("invalid value for %s", name)
+		}
+		if len(value) > maxResponseHeaderValue {
+			return nil, fmt.Errorf("value for %s is longer than %d bytes", name, maxResponseHeaderValue)
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// applyResponseHeaders sets a device's configured headers on a response,
+// replacing the origin's. An empty value removes the header instead, e.g.
+// to hide X-Powered-By.
+func applyResponseHeaders(w http.ResponseWriter, headers map[string]string) {
+	for name, value := range headers {
+		if value == "" {
+			w.Header().Del(name)
+		} else {
+			w.Header().Set(name, value)
+		}
+	}
+}
+
+// responseHeaders returns the headers to add to the tunnel's responses
+func (t *Tunnel) responseHeaders() map[string]string {
+	if headers := t.headers.Load(); headers != nil {
+		return *headers
+	}
+	return nil
+}
+
+// Path: /api/v1/devices/{id}/headers
+func (h *Handler) handleGetResponseHeaders(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	headers, err := h.store.GetResponseHeaders(device.ID)
+	if err != nil {
+		slog.Error("get response headers failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if headers == nil {
+		headers = map[string]string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"headers": headers,
+	})
+}
+
+// Path: /api/v1/devices/{id}/headers
+func (h *Handler) handleSetResponseHeaders(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req struct {
+		Headers map[string]string `json:"headers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	headers, err := normalizeResponseHeaders(req.Headers)
+	if err != nil {
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetResponseHeaders(device.ID, headers); err != nil {
+		slog.Error("set response headers failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply to the live tunnel straight away
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnel.headers.Store(&headers)
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	slog.Info("response headers updated", "subdomain", device.Subdomain, "headers", strings.Join(names, ","))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"headers": headers,
+	})
+}
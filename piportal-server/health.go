@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// SetShuttingDown marks the server as draining so /readyz starts failing
+func (h *Handler) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// handleHealthz is the liveness probe: if we can answer, we're alive
+func (h *Handler) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, http.StatusOK, "ok")
+}
+
+// handleReadyz is the readiness probe for load balancers. It fails while
+// shutting down or when the database doesn't answer.
+func (h *Handler) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if h.shuttingDown.Load() {
+		writeProbe(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	if h.store == nil || h.tunnels == nil {
+		writeProbe(w, http.StatusServiceUnavailable, "not initialized")
+		return
+	}
+	if err := h.store.Ping(); err != nil {
+		slog.Warn("readiness check failed", "error", err)
+		writeProbe(w, http.StatusServiceUnavailable, "database unavailable")
+		return
+	}
+	writeProbe(w, http.StatusOK, "ok")
+}
+
+// writeProbe writes a tiny uncached plaintext probe response
+func writeProbe(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write([]byte(body + "\n"))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// serverURL is the address clients should use for this server: its base
+// domain over HTTPS, or in dev mode whatever host the request came in on
+func (h *Handler) serverURL(r *http.Request) string {
+	if h.config.DevMode {
+		return "http://" + r.Host
+	}
+	return "https://" + h.config.BaseDomain
+}
+
+// shellQuote quotes s as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// handleInstallScript serves the client installer with this server's URL and
+// the current client version filled in, so
+// curl -fsSL https://<domain>/install.sh | bash works on any deployment.
+// PIPORTAL_SERVER still overrides the server, e.g. behind a second hostname.
+func (h *Handler) handleInstallScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	server := h.serverURL(r)
+	fmt.Fprintf(w, installScript, shellQuote(server), shellQuote(ClientVersion), strings.Join(downloadArchs, " "), server, binaryChecksums())
+}
+
+// binaryChecksums lists the published binaries' SHA-256 digests, the same
+// ones /api/version gives, as arch:digest words for the install script
+func binaryChecksums() string {
+	var sums []string
+	for _, arch := range downloadArchs {
+		if info := publishedBinary(arch); info != nil {
+			sums = append(sums, arch+":"+info.SHA256)
+		}
+	}
+	return strings.Join(sums, " ")
+}
+
+// installScript is filled in with the server URL and client version (both
+// shell-quoted), the architectures binaries are published for, the server
+// URL again as is for the usage comment, and the binaries' checksums
+const installScript = `#!/bin/bash
+# PiPortal Installer
+#
+# Usage:
+#   curl -fsSL %[4]s/install.sh | bash
+
+set -e
+
+VERSION=%[2]s
+DEFAULT_SERVER=%[1]s
+SERVER="${PIPORTAL_SERVER:-$DEFAULT_SERVER}"
+SERVER="${SERVER%%/}"
+BASE_URL="${SERVER}/downloads"
+
+# Colors
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+RED='\033[0;31m'
+NC='\033[0m'
+
+info() { echo -e "${GREEN}✓${NC} $1"; }
+warn() { echo -e "${YELLOW}!${NC} $1"; }
+error() { echo -e "${RED}✗${NC} $1"; exit 1; }
+
+# Detect architecture. Raspberry Pi OS 32-bit runs a 64-bit kernel on
+# newer Pis, so uname says aarch64 over a 32-bit userland that needs the
+# arm build.
+detect_arch() {
+    local arch=$(uname -m)
+    case $arch in
+        aarch64|arm64)
+            if [ "$(getconf LONG_BIT 2>/dev/null)" = "32" ]; then
+                echo "arm"
+            else
+                echo "arm64"
+            fi
+            ;;
+        armv6l|armv7l|armv8l)
+            echo "arm"
+            ;;
+        x86_64)
+            echo "amd64"
+            ;;
+        *)
+            error "Unsupported architecture: $arch"
+            ;;
+    esac
+}
+
+echo ""
+echo "  ╔═══════════════════════════════════════╗"
+echo "  ║        PiPortal Installer             ║"
+echo "  ╚═══════════════════════════════════════╝"
+echo ""
+
+if [ "$(uname -s)" != "Linux" ]; then
+    error "PiPortal runs on Linux only"
+fi
+
+# Detect system
+ARCH=$(detect_arch)
+case " %[3]s " in
+    *" $ARCH "*) ;;
+    *) error "No PiPortal build for $ARCH on this server" ;;
+esac
+info "Detected architecture: $ARCH"
+
+# Determine install location
+if [[ $EUID -eq 0 ]]; then
+    INSTALL_DIR="/usr/local/bin"
+else
+    INSTALL_DIR="$HOME/.local/bin"
+    mkdir -p "$INSTALL_DIR"
+fi
+
+# Download binary. A partial download is kept and resumed when the
+# script is run again, and only replaces piportal once its checksum
+# matches the one the server publishes.
+EXPECTED_SHA256=""
+for sum in %[5]s; do
+    if [ "${sum%%%%:*}" = "$ARCH" ]; then
+        EXPECTED_SHA256="${sum#*:}"
+    fi
+done
+[ -n "$EXPECTED_SHA256" ] || error "No checksum published for the $ARCH build"
+
+DOWNLOAD_URL="${BASE_URL}/piportal-linux-${ARCH}"
+PARTIAL="${INSTALL_DIR}/.piportal-${VERSION}-${ARCH}.download"
+info "Downloading piportal ${VERSION} from ${SERVER}..."
+
+if command -v curl &> /dev/null; then
+    curl -fsSL --retry 5 -C - "$DOWNLOAD_URL" -o "$PARTIAL" || error "Download failed, run the installer again to resume"
+elif command -v wget &> /dev/null; then
+    wget -q -c --tries=5 "$DOWNLOAD_URL" -O "$PARTIAL" || error "Download failed, run the installer again to resume"
+else
+    error "Neither curl nor wget found. Please install one."
+fi
+
+# A resumed download can be stale (the binary changed in between) or
+# corrupt, so it's only kept if it matches
+if command -v sha256sum &> /dev/null; then
+    ACTUAL_SHA256=$(sha256sum "$PARTIAL" | cut -d' ' -f1)
+elif command -v shasum &> /dev/null; then
+    ACTUAL_SHA256=$(shasum -a 256 "$PARTIAL" | cut -d' ' -f1)
+else
+    rm -f "$PARTIAL"
+    error "Neither sha256sum nor shasum found, so the download can't be verified"
+fi
+if [ "$ACTUAL_SHA256" != "$EXPECTED_SHA256" ]; then
+    rm -f "$PARTIAL"
+    error "Checksum mismatch, the download was removed; run the installer again"
+fi
+info "Checksum verified"
+
+chmod +x "$PARTIAL"
+mv -f "$PARTIAL" "${INSTALL_DIR}/piportal"
+info "Installed to ${INSTALL_DIR}/piportal"
+
+# Check if in PATH
+if ! command -v piportal &> /dev/null; then
+    if [[ ":$PATH:" != *":$INSTALL_DIR:"* ]]; then
+        warn "Add to your PATH: export PATH=\"${INSTALL_DIR}:\$PATH\""
+        echo ""
+        echo "  Add this line to ~/.bashrc or ~/.profile:"
+        echo "    export PATH=\"${INSTALL_DIR}:\$PATH\""
+        echo ""
+    fi
+fi
+
+# Verify
+"${INSTALL_DIR}/piportal" --version 2>/dev/null || true
+
+echo ""
+echo "  ─────────────────────────────────────────"
+echo ""
+echo "  Installation complete!"
+echo ""
+echo "  Next, run the setup wizard:"
+echo ""
+echo "    piportal setup --server ${SERVER}"
+echo ""
+echo "  This will register your device and configure"
+echo "  your tunnel automatically."
+echo ""
+`
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain-text email through an SMTP relay
+type Mailer struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+// NewMailer returns a mailer for the configured SMTP server, or nil if none is set
+func NewMailer(config *Config) *Mailer {
+	if config.SMTPAddr == "" {
+		return nil
+	}
+	return &Mailer{
+		addr:     config.SMTPAddr,
+		from:     config.SMTPFrom,
+		username: config.SMTPUsername,
+		password: config.SMTPPassword,
+	}
+}
+
+// Send delivers a plain-text message to a single recipient
+func (m *Mailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid header value")
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, _ := net.SplitHostPort(m.addr)
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		strings.ReplaceAll(body, "\n", "\r\n"),
+	}, "\r\n")
+
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, []byte(msg))
+}
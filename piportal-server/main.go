@@ -1,65 +1,133 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	readinessDrainDelay = 5 * time.Second
+	shutdownTimeout     = 10 * time.Second
 )
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime)
 
 	// Load configuration
-	config := LoadConfig()
+	config, err := LoadConfig()
+	if err != nil {
+		fatal("configuration error", err)
+	}
 	if err := config.Validate(); err != nil {
-		log.Fatalf("Configuration error: %v", err)
+		fatal("configuration error", err)
+	}
+	if err := setupLogging(config.LogLevel, config.LogFormat); err != nil {
+		fatal("configuration error", err)
 	}
 
 	// Initialize database
-	store, err := NewStore(config.DatabasePath)
+	store, err := NewStorage(config.DatabaseDriver, config.DatabasePath, StoreOptions{
+		WAL:          config.SQLiteWAL,
+		BusyTimeout:  config.SQLiteBusyTimeout,
+		MaxOpenConns: config.DBMaxConns,
+	})
 	if err != nil {
-		log.Fatalf("Database error: %v", err)
+		fatal("database error", err)
 	}
 	defer store.Close()
 
+	// Grant admin to the operator account
+	bootstrapAdmin(store, config.AdminEmail)
+
+	// Monthly usage reset, reports and retention
+	go RunMaintenance(store, config, NewMailer(config))
+
 	// Create tunnel manager
-	tunnels := NewTunnelManager(store)
+	tunnels := NewTunnelManager(store, config)
+
+	subdomains, err := NewSubdomainPolicy(config)
+	if err != nil {
+		fatal("configuration error", err)
+	}
+
+	abuse, err := NewAbuseScanner(config)
+	if err != nil {
+		fatal("configuration error", err)
+	}
 
 	// Create handler
-	handler := NewHandler(config, store, tunnels)
+	handler := NewHandler(config, store, tunnels, subdomains, abuse)
+	if handler.certs != nil {
+		go handler.certs.Run()
+	}
+	server := newHTTPServer(config, config.HTTPAddr, handler)
 
 	// Start server
 	if config.DevMode {
-		log.Printf("Starting PiPortal server in DEVELOPMENT mode")
-		log.Printf("Listening on %s", config.HTTPAddr)
-		log.Printf("Base domain: %s", config.BaseDomain)
-		log.Printf("Database: %s", config.DatabasePath)
-		log.Println()
-		log.Println("Dev mode endpoints:")
-		log.Printf("  Main site:    http://localhost%s/", config.HTTPAddr)
-		log.Printf("  Register:     POST http://localhost%s/api/register", config.HTTPAddr)
-		log.Printf("  Status:       GET http://localhost%s/api/status", config.HTTPAddr)
-		log.Printf("  Tunnel WS:    ws://localhost%s/tunnel", config.HTTPAddr)
-		log.Printf("  Proxy test:   http://localhost%s/?subdomain=<name>", config.HTTPAddr)
-		log.Println()
+		slog.Info("starting PiPortal server in development mode", "addr", config.HTTPAddr, "domain", config.BaseDomain, "database", config.DatabasePath)
+		slog.Info("dev mode endpoints",
+			"site", "http://localhost"+config.HTTPAddr+"/",
+			"register", "POST http://localhost"+config.HTTPAddr+"/api/register",
+			"status", "GET http://localhost"+config.HTTPAddr+"/api/status",
+			"tunnel", "ws://localhost"+config.HTTPAddr+"/tunnel",
+			"proxy_test", "http://localhost"+config.HTTPAddr+"/?subdomain=<name>")
 
 		go func() {
-			if err := http.ListenAndServe(config.HTTPAddr, handler); err != nil {
-				log.Fatalf("HTTP server error: %v", err)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("HTTP server error", err)
 			}
 		}()
 	} else {
-		log.Printf("Starting PiPortal server")
-		log.Printf("Domain: %s", config.BaseDomain)
+		slog.Info("starting PiPortal server", "domain", config.BaseDomain)
 
-		// TODO: Add TLS support (Let's Encrypt or manual certs)
-		go func() {
-			if err := http.ListenAndServe(config.HTTPAddr, handler); err != nil {
-				log.Fatalf("HTTP server error: %v", err)
+		switch {
+		case config.BehindProxy:
+			slog.Info("listening", "addr", config.HTTPAddr, "tls", "reverse proxy")
+			go func() {
+				if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					fatal("HTTP server error", err)
+				}
+			}()
+
+		case config.AutoTLS:
+			// Certificates are issued on demand for the hosts CertHostPolicy
+			// allows, including verified custom domains
+			certs := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: handler.CertHostPolicy,
+				Cache:      autocert.DirCache(config.CertCacheDir),
 			}
-		}()
+			server.Addr = config.HTTPSAddr
+			server.TLSConfig = certs.TLSConfig()
+			if handler.certs != nil {
+				server.TLSConfig.GetCertificate = handler.certs.Track(certs.GetCertificate)
+			}
+			slog.Info("listening", "addr", config.HTTPSAddr, "tls", "lets-encrypt", "cert_cache", config.CertCacheDir)
+			go serveHTTPRedirect(config, certs.HTTPHandler(nil))
+			go func() {
+				if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+					fatal("HTTPS server error", err)
+				}
+			}()
+
+		default:
+			server.Addr = config.HTTPSAddr
+			slog.Info("listening", "addr", config.HTTPSAddr, "tls", "certificate", "cert", config.TLSCert)
+			go serveHTTPRedirect(config, http.HandlerFunc(redirectToHTTPS))
+			go func() {
+				if err := server.ListenAndServeTLS(config.TLSCert, config.TLSKey); err != nil && err != http.ErrServerClosed {
+					fatal("HTTPS server error", err)
+				}
+			}()
+		}
 	}
 
 	// Wait for shutdown signal
@@ -67,5 +135,64 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
-	log.Println("Shutting down...")
+	slog.Info("shutting down")
+
+	// Fail readiness first so load balancers stop routing here, then let
+	// in-flight requests finish
+	handler.SetShuttingDown()
+	if !config.DevMode {
+		time.Sleep(readinessDrainDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("shutdown failed", "error", err)
+	}
+
+	// Tunnels aren't tracked by Shutdown. Give their requests in flight
+	// what's left of the timeout, then close each tunnel cleanly.
+	deadline, _ := ctx.Deadline()
+	tunnels.DrainAll(time.Until(deadline))
+}
+
+// newHTTPServer applies the configured header, size and write limits.
+// WriteTimeout starts when the request headers have been read, so handlers
+// that legitimately run longer (tunnel requests, streamed commands) extend
+// their own deadline. Without TLS, HTTP/2 is accepted in cleartext (h2c), so
+// a reverse proxy can multiplex requests over one connection.
+func newHTTPServer(config *Config, addr string, handler http.Handler) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+		Protocols:         protocols,
+	}
+}
+
+// extendWriteDeadline gives a handler that runs for up to d before it
+// responds the full write timeout after that to send the response
+func (h *Handler) extendWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	if h.config.WriteTimeout <= 0 {
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + h.config.WriteTimeout))
+}
+
+// serveHTTPRedirect serves plain HTTP alongside HTTPS: ACME challenges (with
+// -auto-tls) and redirects to HTTPS
+func serveHTTPRedirect(config *Config, handler http.Handler) {
+	if err := newHTTPServer(config, config.HTTPAddr, handler).ListenAndServe(); err != nil {
+		slog.Error("HTTP redirect server failed", "addr", config.HTTPAddr, "error", err)
+	}
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
 }
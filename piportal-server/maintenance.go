@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// How often the maintenance loop checks for due work. Jobs are claimed per
+// period in the database, so checking often (and on every start) is safe.
+const maintenanceInterval = time.Hour
+
+// RunMaintenance performs periodic housekeeping until the process exits
+func RunMaintenance(store Storage, config *Config, mailer *Mailer) {
+	for {
+		runUsageMaintenance(store, config, mailer, time.Now())
+		pruneClaimCodes(store, time.Now())
+		pruneSessions(store, time.Now())
+		pruneQuotaUsage(store, time.Now())
+		pruneCustomDomainClaims(store, time.Now())
+		time.Sleep(maintenanceInterval)
+	}
+}
+
+// runUsageMaintenance closes out the previous month once (logging the reset
+// and optionally emailing usage summaries) and prunes expired usage history
+func runUsageMaintenance(store Storage, config *Config, mailer *Mailer, now time.Time) {
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	lastMonth := thisMonth.AddDate(0, -1, 0).Format("2006-01")
+
+	claimed, err := store.ClaimMaintenanceRun("usage-reset", lastMonth)
+	if err != nil {
+		slog.Error("usage maintenance failed", "error", err)
+		return
+	}
+	if claimed {
+		slog.Info("bandwidth usage reset", "closed", lastMonth, "counting", thisMonth.Format("2006-01"))
+		if config.UsageReportEmails && mailer != nil {
+			sendUsageReports(store, mailer, lastMonth)
+		}
+	}
+
+	if config.UsageRetentionMonths > 0 {
+		cutoff := thisMonth.AddDate(0, -config.UsageRetentionMonths, 0).Format("2006-01")
+		pruned, err := store.PruneUsage(cutoff)
+		if err != nil {
+			slog.Error("usage prune failed", "error", err)
+		} else if pruned > 0 {
+			slog.Info("pruned usage rows", "rows", pruned, "before", cutoff)
+		}
+	}
+}
+
+// pruneClaimCodes removes expired device claim codes. Lookups ignore them
+// anyway; this just keeps the table small.
+func pruneClaimCodes(store Storage, now time.Time) {
+	pruned, err := store.PruneClaimCodes(now)
+	if err != nil {
+		slog.Error("claim code prune failed", "error", err)
+	} else if pruned > 0 {
+		slog.Info("pruned expired claim codes", "count", pruned)
+	}
+}
+
+// pruneSessions removes expired dashboard sessions. Like claim codes,
+// lookups already ignore them.
+func pruneSessions(store Storage, now time.Time) {
+	pruned, err := store.PruneSessions(now)
+	if err != nil {
+		slog.Error("session prune failed", "error", err)
+	} else if pruned > 0 {
+		slog.Info("pruned expired sessions", "count", pruned)
+	}
+}
+
+// pruneQuotaUsage removes exec and terminal quota usage from before
+// yesterday (UTC); quotas only ever look at the current hour or day
+func pruneQuotaUsage(store Storage, now time.Time) {
+	cutoff := now.UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	pruned, err := store.PruneQuotaUsage(cutoff)
+	if err != nil {
+		slog.Error("quota usage prune failed", "error", err)
+	} else if pruned > 0 {
+		slog.Info("pruned quota usage rows", "rows", pruned, "before", cutoff)
+	}
+}
+
+// pruneCustomDomainClaims drops custom domain claims that never verified, so
+// a stale claim stops counting against its device's domain limit
+func pruneCustomDomainClaims(store Storage, now time.Time) {
+	pruned, err := store.PruneCustomDomainClaims(now.Add(-customDomainClaimTTL))
+	if err != nil {
+		slog.Error("custom domain claim prune failed", "error", err)
+	} else if pruned > 0 {
+		slog.Info("pruned unverified custom domain claims", "count", pruned)
+	}
+}
+
+// sendUsageReports emails each user their devices' usage for month
+func sendUsageReports(store Storage, mailer *Mailer, month string) {
+	summaries, err := store.SummarizeUsageForMonth(month)
+	if err != nil {
+		slog.Error("usage summary failed", "month", month, "error", err)
+		return
+	}
+
+	sent := 0
+	for _, summary := range summaries {
+		if err := mailer.Send(summary.Email, "PiPortal usage for "+month, formatUsageReport(summary)); err != nil {
+			slog.Warn("usage report failed", "email", summary.Email, "month", month, "error", err)
+			continue
+		}
+		sent++
+	}
+	slog.Info("sent usage reports", "count", sent, "month", month)
+}
+
+// formatUsageReport renders a usage summary as a plain-text email body
+func formatUsageReport(summary *UsageSummary) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Your PiPortal bandwidth usage for %s:\n\n", summary.Month)
+
+	var total int64
+	for _, d := range summary.Devices {
+		used := d.BytesIn + d.BytesOut
+		total += used
+		percent := 100.0
+		if d.Limit > 0 {
+			percent = float64(used) / float64(d.Limit) * 100
+		}
+		fmt.Fprintf(&b, "  %-30s %12s of %s (%.0f%%)\n", d.Subdomain, FormatBytes(used), FormatBytes(d.Limit), percent)
+	}
+	fmt.Fprintf(&b, "\n  %-30s %12s\n\n", "Total", FormatBytes(total))
+	b.WriteString("Usage has been reset for the new month.\n")
+	return b.String()
+}
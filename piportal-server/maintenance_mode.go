@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxMaintenanceMessage = 500
+	maintenanceRetryAfter = 2 * time.Minute // Hint for browsers and crawlers
+)
+
+// MaintenanceMode replaces a device's tunnel with a "be right back" page,
+// so its owner can restart the local service without visitors seeing 502s
+type MaintenanceMode struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"` // Shown on the page instead of the default text
+}
+
+// Path: /api/v1/devices/{id}/maintenance
+func (h *Handler) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req MaintenanceMode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Message) > maxMaintenanceMessage {
+		jsonError(w, ErrCodeInvalidRequest, fmt.Sprintf("message must be at most %d characters", maxMaintenanceMessage), http.StatusBadRequest)
+		return
+	}
+	if !req.Enabled {
+		req.Message = ""
+	}
+
+	if err := h.store.SetMaintenance(device.ID, req); err != nil {
+		slog.Error("set maintenance failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply to the live tunnel straight away
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnel.setMaintenance(&req)
+	}
+
+	slog.Info("maintenance mode changed", "subdomain", device.Subdomain, "enabled", req.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"maintenance": req,
+	})
+}
+
+// setMaintenance puts the tunnel in maintenance mode, or takes it out if
+// mode is nil or switched off
+func (t *Tunnel) setMaintenance(mode *MaintenanceMode) {
+	if mode != nil && !mode.Enabled {
+		mode = nil
+	}
+	t.maintenance.Store(mode)
+}
+
+// activeMaintenance returns the device's maintenance mode if it's switched on.
+// A connected device's is kept on its tunnel instead.
+func (h *Handler) activeMaintenance(deviceID string) *MaintenanceMode {
+	mode, err := h.store.GetMaintenance(deviceID)
+	if err != nil {
+		slog.Error("maintenance check failed", "device_id", deviceID, "error", err)
+		return nil
+	}
+	if mode == nil || !mode.Enabled {
+		return nil
+	}
+	return mode
+}
+
+// writeMaintenancePage serves the 503 shown while a device is in maintenance
+func (h *Handler) writeMaintenancePage(w http.ResponseWriter, subdomain string, mode *MaintenanceMode) {
+	message := "We're doing some quick maintenance and will be back shortly."
+	if mode.Message != "" {
+		message = mode.Message
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><title>Be Right Back</title></head>
+<body style="font-family: system-ui; max-width: 500px; margin: 50px auto; text-align: center;">
+<h1>Be Right Back</h1>
+<p>%s</p>
+<p style="color: #888;">%s.%s</p>
+</body>
+</html>`, html.EscapeString(message), html.EscapeString(subdomain), html.EscapeString(h.config.BaseDomain))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// A device's limit override is what its usage report measures against
+func TestUsageReportUsesOverride(t *testing.T) {
+	store := newTestStore(t)
+	user, err := store.CreateUser("report@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	device, err := store.CreateDevice("overridden", user.ID)
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	limit := int64(4 * 1024 * 1024 * 1024)
+	if err := store.SetBandwidthLimitOverride(device.ID, &limit); err != nil {
+		t.Fatalf("set override: %v", err)
+	}
+	if err := store.AddBandwidth(device.ID, 1024*1024*1024, 0); err != nil {
+		t.Fatalf("add bandwidth: %v", err)
+	}
+	usage, err := store.GetMonthlyUsage(device.ID)
+	if err != nil {
+		t.Fatalf("get usage: %v", err)
+	}
+
+	summaries, err := store.SummarizeUsageForMonth(usage.Month)
+	if err != nil {
+		t.Fatalf("summarize usage: %v", err)
+	}
+	if len(summaries) != 1 || len(summaries[0].Devices) != 1 {
+		t.Fatalf("summaries = %+v, want one device", summaries)
+	}
+	if got := summaries[0].Devices[0].Limit; got != limit {
+		t.Errorf("limit = %d, want the override %d", got, limit)
+	}
+
+	report := formatUsageReport(summaries[0])
+	if want := "of " + FormatBytes(limit) + " (25%)"; !strings.Contains(report, want) {
+		t.Errorf("report doesn't contain %q:\n%s", want, report)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// countingReader counts the bytes read through a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingResponseWriter counts the bytes sent to the browser: the status
+// line and headers when they're written, then the body as it goes out
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n           int64
+	wroteHeader bool
+}
+
+func (c *countingResponseWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		// "HTTP/1.1 200 OK\r\n" + headers + "\r\n"
+		c.n += int64(len("HTTP/1.1 ")+len(strconv.Itoa(status))+1+len(http.StatusText(status))+2) +
+			headerSize(c.Header()) + 2
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Flush passes through so streamed responses still flush
+func (c *countingResponseWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// requestHeaderSize is the size of a request's request line and headers on
+// the wire; the body is counted separately as it's read
+func requestHeaderSize(r *http.Request) int64 {
+	// "GET /path HTTP/1.1\r\n" + "Host: example.com\r\n" + headers + "\r\n"
+	size := len(r.Method) + 1 + len(r.RequestURI) + 1 + len(r.Proto) + 2 +
+		len("Host: ") + len(r.Host) + 2 + 2
+	return int64(size) + headerSize(r.Header)
+}
+
+// headerSize is the wire size of header lines ("Key: value\r\n")
+func headerSize(h http.Header) int64 {
+	var size int64
+	for key, values := range h {
+		for _, value := range values {
+			size += int64(len(key) + 2 + len(value) + 2)
+		}
+	}
+	return size
+}
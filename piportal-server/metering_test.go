@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A request and response of known size are metered at exactly what crossed
+// the wire, headers included
+func TestBandwidthRecorded(t *testing.T) {
+	const (
+		requestBody  = 3000
+		responseBody = 5000
+	)
+	tt := startTestTunnel(t, testConfig(t), func(req RequestMessage) ResponseMessage {
+		return bodyResponse(http.StatusOK, map[string]string{"Content-Type": "application/octet-stream", "Content-Length": strconv.Itoa(responseBody)},
+			bytes.Repeat([]byte("y"), responseBody))
+	})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(tt.server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	request := fmt.Sprintf("POST /upload HTTP/1.1\r\n"+
+		"Host: %s.piportal.test\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"Content-Length: %d\r\n"+
+		"\r\n%s", tt.device.Subdomain, requestBody, strings.Repeat("x", requestBody))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+
+	var raw bytes.Buffer
+	resp, err := http.ReadResponse(bufio.NewReader(io.TeeReader(conn, &raw)), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	// net/http adds Date after the headers have been counted
+	wantOut := int64(raw.Len() - len("Date: "+resp.Header.Get("Date")+"\r\n"))
+	wantIn := int64(len(request))
+
+	// Recorded once the handler returns, which may be after the response arrives
+	var usage *Usage
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if usage, err = tt.store.GetMonthlyUsage(tt.device.ID); err != nil {
+			t.Fatalf("GetMonthlyUsage: %v", err)
+		}
+		if usage.BytesIn > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if usage.BytesIn != wantIn {
+		t.Errorf("BytesIn = %d, want %d", usage.BytesIn, wantIn)
+	}
+	if usage.BytesOut != wantOut {
+		t.Errorf("BytesOut = %d, want %d", usage.BytesOut, wantOut)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// migration is a single numbered schema change. Each one runs in its own
+// transaction and is recorded in schema_migrations once it succeeds.
+// Versions must be mirrored across drivers so a given version means the
+// same schema everywhere.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// sqliteMigrations is the ordered schema history for SQLite.
+// Never edit an applied migration — append a new one instead.
+var sqliteMigrations = []migration{
+	{1, "create devices, usage and users", execStatements(`
+	CREATE TABLE IF NOT EXISTS devices (
+		id TEXT PRIMARY KEY,
+		token_hash TEXT UNIQUE NOT NULL,
+		subdomain TEXT UNIQUE NOT NULL,
+		tier TEXT DEFAULT 'free',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at DATETIME,
+		is_online BOOLEAN DEFAULT FALSE
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_devices_token_hash ON devices(token_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_devices_subdomain ON devices(subdomain)`,
+		`CREATE TABLE IF NOT EXISTS usage (
+		device_id TEXT NOT NULL,
+		month TEXT NOT NULL,
+		bytes_in INTEGER DEFAULT 0,
+		bytes_out INTEGER DEFAULT 0,
+		PRIMARY KEY (device_id, month),
+		FOREIGN KEY (device_id) REFERENCES devices(id)
+	)`,
+		`CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		email TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)},
+	{2, "add devices.user_id", sqliteAddColumn("devices", "user_id", "TEXT REFERENCES users(id)")},
+	// New devices start with forwarding disabled
+	{3, "add devices.tunnel_enabled", sqliteAddColumn("devices", "tunnel_enabled", "BOOLEAN DEFAULT FALSE")},
+	{4, "create organizations", execStatements(`
+	CREATE TABLE IF NOT EXISTS organizations (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		user_id TEXT NOT NULL REFERENCES users(id),
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_organizations_user ON organizations(user_id)`)},
+	{5, "add devices.org_id", sqliteAddColumn("devices", "org_id", "TEXT REFERENCES organizations(id)")},
+	// Terminal recording is opt-in per device
+	{6, "add devices.record_terminal", sqliteAddColumn("devices", "record_terminal", "BOOLEAN DEFAULT FALSE")},
+	{7, "add devices.record_keystrokes", sqliteAddColumn("devices", "record_keystrokes", "BOOLEAN DEFAULT FALSE")},
+	{8, "create webhooks", execStatements(`
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES users(id),
+		org_id TEXT REFERENCES organizations(id),
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhooks_user ON webhooks(user_id)`)},
+	// Stripe billing: one customer per user, one subscription per pro device
+	{9, "add users.stripe_customer_id", sqliteAddColumn("users", "stripe_customer_id", "TEXT")},
+	{10, "add devices.stripe_subscription_id", sqliteAddColumn("devices", "stripe_subscription_id", "TEXT")},
+	// Records periodic jobs so they run once per period across restarts
+	{11, "create maintenance_runs", execStatements(`
+	CREATE TABLE IF NOT EXISTS maintenance_runs (
+		job TEXT NOT NULL,
+		period TEXT NOT NULL,
+		ran_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (job, period)
+	)`)},
+	// NULL means the tier default applies
+	{12, "add devices.bandwidth_limit_override", sqliteAddColumn("devices", "bandwidth_limit_override", "INTEGER")},
+	{13, "add users.is_admin", sqliteAddColumn("users", "is_admin", "BOOLEAN DEFAULT FALSE")},
+	{14, "create audit_log", execStatements(`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT DEFAULT '',
+		details TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created ON audit_log(created_at)`)},
+	// Connection telemetry reported by the client on each auth
+	{15, "add devices connection telemetry", steps(
+		sqliteAddColumn("devices", "reconnect_count", "INTEGER DEFAULT 0"),
+		sqliteAddColumn("devices", "client_started_at", "DATETIME"),
+		sqliteAddColumn("devices", "last_disconnect_reason", "TEXT DEFAULT ''"))},
+	{16, "create custom_domains", execStatements(`
+	CREATE TABLE IF NOT EXISTS custom_domains (
+		hostname TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		verification_token TEXT NOT NULL,
+		verified BOOLEAN DEFAULT FALSE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		verified_at DATETIME
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_custom_domains_device ON custom_domains(device_id)`)},
+	{17, "add devices maintenance mode", steps(
+		sqliteAddColumn("devices", "maintenance", "BOOLEAN DEFAULT FALSE"),
+		sqliteAddColumn("devices", "maintenance_message", "TEXT DEFAULT ''"))},
+	{18, "add devices.request_policy", sqliteAddColumn("devices", "request_policy", "TEXT DEFAULT ''")},
+	{19, "add devices rate limit", steps(
+		sqliteAddColumn("devices", "rate_limit_rps", "REAL DEFAULT 0"),
+		sqliteAddColumn("devices", "rate_limit_burst", "INTEGER DEFAULT 0"),
+		sqliteAddColumn("devices", "rate_limit_per_ip", "BOOLEAN DEFAULT FALSE"))},
+	{20, "create claim_codes", execStatements(`
+	CREATE TABLE IF NOT EXISTS claim_codes (
+		code TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_claim_codes_device ON claim_codes(device_id)`)},
+	{21, "add devices.response_cache", sqliteAddColumn("devices", "response_cache", "BOOLEAN DEFAULT FALSE")},
+	{22, "add devices.route_timeouts", sqliteAddColumn("devices", "route_timeouts", "TEXT DEFAULT ''")},
+	{23, "add devices.client_version", sqliteAddColumn("devices", "client_version", "TEXT DEFAULT ''")},
+	{24, "create sessions", execStatements(`
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		refresh_hash TEXT NOT NULL UNIQUE,
+		user_agent TEXT DEFAULT '',
+		ip TEXT DEFAULT '',
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id)`)},
+	{25, "add organizations.bandwidth_limit", sqliteAddColumn("organizations", "bandwidth_limit", "INTEGER")},
+	{26, "add devices.response_headers", sqliteAddColumn("devices", "response_headers", "TEXT DEFAULT ''")},
+	{27, "create quota_usage", execStatements(`
+	CREATE TABLE IF NOT EXISTS quota_usage (
+		subject TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		period TEXT NOT NULL,
+		amount INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (subject, kind, period)
+	)`)},
+	{28, "create abuse_flags", execStatements(`
+	CREATE TABLE IF NOT EXISTS abuse_flags (
+		device_id TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		url TEXT DEFAULT '',
+		blocked INTEGER DEFAULT 0,
+		flagged_at INTEGER NOT NULL
+	)`)},
+	{29, "add devices.notes", sqliteAddColumn("devices", "notes", "TEXT DEFAULT ''")},
+	{30, "add devices.metadata", sqliteAddColumn("devices", "metadata", "TEXT DEFAULT ''")},
+	{31, "add devices.agent_settings", sqliteAddColumn("devices", "agent_settings", "TEXT DEFAULT ''")},
+	{32, "add devices.timing_headers", sqliteAddColumn("devices", "timing_headers", "BOOLEAN DEFAULT FALSE")},
+	// Pending claims are per device; only a verified hostname is unique.
+	// SQLite can't change a primary key in place, so the table is rebuilt.
+	{33, "key custom_domains by hostname and device", execStatements(`
+	CREATE TABLE custom_domains_new (
+		hostname TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		verification_token TEXT NOT NULL,
+		verified BOOLEAN DEFAULT FALSE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		verified_at DATETIME,
+		PRIMARY KEY (hostname, device_id)
+	)`,
+		`INSERT INTO custom_domains_new SELECT hostname, device_id, verification_token, verified, created_at, verified_at FROM custom_domains`,
+		`DROP TABLE custom_domains`,
+		`ALTER TABLE custom_domains_new RENAME TO custom_domains`,
+		`CREATE INDEX IF NOT EXISTS idx_custom_domains_device ON custom_domains(device_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_custom_domains_verified ON custom_domains(hostname) WHERE verified`)},
+	// abuse_flags.blocked was created as INTEGER; make it BOOLEAN like on
+	// Postgres. SQLite can't change a column's type, so the table is rebuilt.
+	{34, "make abuse_flags.blocked BOOLEAN", execStatements(`
+	CREATE TABLE abuse_flags_new (
+		device_id TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		url TEXT DEFAULT '',
+		blocked BOOLEAN DEFAULT FALSE,
+		flagged_at INTEGER NOT NULL
+	)`,
+		`INSERT INTO abuse_flags_new SELECT device_id, reason, url, blocked, flagged_at FROM abuse_flags`,
+		`DROP TABLE abuse_flags`,
+		`ALTER TABLE abuse_flags_new RENAME TO abuse_flags`)},
+}
+
+// postgresMigrations mirrors sqliteMigrations for Postgres
+var postgresMigrations = []migration{
+	{1, "create devices, usage and users", execStatements(`
+	CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		email TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+		`CREATE TABLE IF NOT EXISTS devices (
+		id TEXT PRIMARY KEY,
+		token_hash TEXT UNIQUE NOT NULL,
+		subdomain TEXT UNIQUE NOT NULL,
+		tier TEXT DEFAULT 'free',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at TIMESTAMPTZ,
+		is_online BOOLEAN DEFAULT FALSE
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_devices_token_hash ON devices(token_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_devices_subdomain ON devices(subdomain)`,
+		`CREATE TABLE IF NOT EXISTS usage (
+		device_id TEXT NOT NULL REFERENCES devices(id),
+		month TEXT NOT NULL,
+		bytes_in BIGINT DEFAULT 0,
+		bytes_out BIGINT DEFAULT 0,
+		PRIMARY KEY (device_id, month)
+	)`)},
+	{2, "add devices.user_id", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS user_id TEXT REFERENCES users(id)`)},
+	{3, "add devices.tunnel_enabled", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS tunnel_enabled BOOLEAN DEFAULT FALSE`)},
+	{4, "create organizations", execStatements(`
+	CREATE TABLE IF NOT EXISTS organizations (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		user_id TEXT NOT NULL REFERENCES users(id),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_organizations_user ON organizations(user_id)`)},
+	{5, "add devices.org_id", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS org_id TEXT REFERENCES organizations(id)`)},
+	{6, "add devices.record_terminal", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS record_terminal BOOLEAN DEFAULT FALSE`)},
+	{7, "add devices.record_keystrokes", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS record_keystrokes BOOLEAN DEFAULT FALSE`)},
+	{8, "create webhooks", execStatements(`
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES users(id),
+		org_id TEXT REFERENCES organizations(id),
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT DEFAULT '',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhooks_user ON webhooks(user_id)`)},
+	{9, "add users.stripe_customer_id", execStatements(
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS stripe_customer_id TEXT`)},
+	{10, "add devices.stripe_subscription_id", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS stripe_subscription_id TEXT`)},
+	{11, "create maintenance_runs", execStatements(`
+	CREATE TABLE IF NOT EXISTS maintenance_runs (
+		job TEXT NOT NULL,
+		period TEXT NOT NULL,
+		ran_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (job, period)
+	)`)},
+	{12, "add devices.bandwidth_limit_override", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS bandwidth_limit_override BIGINT`)},
+	{13, "add users.is_admin", execStatements(
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN DEFAULT FALSE`)},
+	{14, "create audit_log", execStatements(`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT DEFAULT '',
+		details TEXT DEFAULT '',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created ON audit_log(created_at)`)},
+	{15, "add devices connection telemetry", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS reconnect_count INTEGER DEFAULT 0`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS client_started_at TIMESTAMPTZ`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_disconnect_reason TEXT DEFAULT ''`)},
+	{16, "create custom_domains", execStatements(`
+	CREATE TABLE IF NOT EXISTS custom_domains (
+		hostname TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		verification_token TEXT NOT NULL,
+		verified BOOLEAN DEFAULT FALSE,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		verified_at TIMESTAMPTZ
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_custom_domains_device ON custom_domains(device_id)`)},
+	{17, "add devices maintenance mode", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS maintenance BOOLEAN DEFAULT FALSE`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS maintenance_message TEXT DEFAULT ''`)},
+	{18, "add devices.request_policy", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS request_policy TEXT DEFAULT ''`)},
+	{19, "add devices rate limit", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS rate_limit_rps DOUBLE PRECISION DEFAULT 0`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS rate_limit_burst INTEGER DEFAULT 0`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS rate_limit_per_ip BOOLEAN DEFAULT FALSE`)},
+	{20, "create claim_codes", execStatements(`
+	CREATE TABLE IF NOT EXISTS claim_codes (
+		code TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_claim_codes_device ON claim_codes(device_id)`)},
+	{21, "add devices.response_cache", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS response_cache BOOLEAN DEFAULT FALSE`)},
+	{22, "add devices.route_timeouts", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS route_timeouts TEXT DEFAULT ''`)},
+	{23, "add devices.client_version", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS client_version TEXT DEFAULT ''`)},
+	{24, "create sessions", execStatements(`
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		refresh_hash TEXT NOT NULL UNIQUE,
+		user_agent TEXT DEFAULT '',
+		ip TEXT DEFAULT '',
+		created_at BIGINT NOT NULL,
+		last_used_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id)`)},
+	{25, "add organizations.bandwidth_limit", execStatements(
+		`ALTER TABLE organizations ADD COLUMN IF NOT EXISTS bandwidth_limit BIGINT`)},
+	{26, "add devices.response_headers", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS response_headers TEXT DEFAULT ''`)},
+	{27, "create quota_usage", execStatements(`
+	CREATE TABLE IF NOT EXISTS quota_usage (
+		subject TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		period TEXT NOT NULL,
+		amount BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (subject, kind, period)
+	)`)},
+	{28, "create abuse_flags", execStatements(`
+	CREATE TABLE IF NOT EXISTS abuse_flags (
+		device_id TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		url TEXT DEFAULT '',
+		blocked BOOLEAN DEFAULT FALSE,
+		flagged_at BIGINT NOT NULL
+	)`)},
+	{29, "add devices.notes", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS notes TEXT DEFAULT ''`)},
+	{30, "add devices.metadata", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS metadata TEXT DEFAULT ''`)},
+	{31, "add devices.agent_settings", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS agent_settings TEXT DEFAULT ''`)},
+	{32, "add devices.timing_headers", execStatements(
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS timing_headers BOOLEAN DEFAULT FALSE`)},
+	{33, "key custom_domains by hostname and device", execStatements(
+		`ALTER TABLE custom_domains DROP CONSTRAINT IF EXISTS custom_domains_pkey`,
+		`ALTER TABLE custom_domains ADD PRIMARY KEY (hostname, device_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_custom_domains_verified ON custom_domains(hostname) WHERE verified`)},
+	// Already BOOLEAN here; kept so both lists reach the same version
+	{34, "make abuse_flags.blocked BOOLEAN", execStatements()},
+}
+
+// runMigrations applies pending migrations in order, stopping at the first failure
+func (s *sqlStore) runMigrations(migrations []migration) error {
+	if _, err := s.writer.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := s.writer.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this server supports (%d)", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := s.writer.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(s.rebind("INSERT INTO schema_migrations (version) VALUES (?)"), m.version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed to record: %w", m.version, m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d (%s) failed to commit: %w", m.version, m.name, err)
+		}
+
+		slog.Info("applied migration", "version", m.version, "name", m.name)
+	}
+
+	return nil
+}
+
+// execStatements returns a migration step that runs each statement in order
+func execStatements(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// steps returns a migration step that runs each of steps in order
+func steps(steps ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, step := range steps {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// sqliteAddColumn adds a column unless it already exists. SQLite has no
+// ADD COLUMN IF NOT EXISTS, and databases created before versioned
+// migrations may already have the column.
+func sqliteAddColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var cid, notNull, pk int
+			var name, colType string
+			var dflt sql.NullString
+			if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+				return err
+			}
+			if name == column {
+				return nil
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A database from before versioned migrations may already have the columns
+// a migration adds, so replaying them must not fail
+func TestSQLiteMigrationsReapply(t *testing.T) {
+	store := newTestStore(t)
+
+	if _, err := store.db.Exec("DELETE FROM schema_migrations WHERE version > 1"); err != nil {
+		t.Fatalf("reset schema_migrations: %v", err)
+	}
+	if err := store.migrate(); err != nil {
+		t.Fatalf("reapplying migrations: %v", err)
+	}
+
+	var current int
+	if err := store.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&current); err != nil {
+		t.Fatalf("read schema version: %v", err)
+	}
+	if latest := sqliteMigrations[len(sqliteMigrations)-1].version; current != latest {
+		t.Errorf("schema version = %d, want %d", current, latest)
+	}
+}
+
+// abuse_flags.blocked was INTEGER before migration 34, and its rows survive
+// the change
+func TestSQLiteAbuseFlagsBlockedBoolean(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.FlagAbuse(&AbuseFlag{DeviceID: "dev_1", Reason: "phishing", Blocked: true, FlaggedAt: time.Now()}); err != nil {
+		t.Fatalf("flag abuse: %v", err)
+	}
+	if _, err := store.db.Exec("DELETE FROM schema_migrations WHERE version >= 34"); err != nil {
+		t.Fatalf("reset schema_migrations: %v", err)
+	}
+	if err := store.migrate(); err != nil {
+		t.Fatalf("reapplying migration 34: %v", err)
+	}
+
+	var colType string
+	if err := store.db.QueryRow("SELECT type FROM pragma_table_info('abuse_flags') WHERE name = 'blocked'").Scan(&colType); err != nil {
+		t.Fatalf("read column type: %v", err)
+	}
+	if colType != "BOOLEAN" {
+		t.Errorf("abuse_flags.blocked is %s, want BOOLEAN", colType)
+	}
+	flag, err := store.GetAbuseFlag("dev_1")
+	if err != nil || flag == nil || !flag.Blocked {
+		t.Errorf("GetAbuseFlag = %+v, %v; want the blocked flag", flag, err)
+	}
+}
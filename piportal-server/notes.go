@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxNotesLength      = 2000 // Characters of free text
+	maxMetadataKeys     = 20
+	maxMetadataKeyLen   = 64
+	maxMetadataValueLen = 256
+	maxNotesBody        = 64 * 1024 // Request body; well over what the limits above allow
+)
+
+// DeviceNotes is what an owner has written down about a device, such as
+// where it is or what it's for, so identical-looking Pis can be told apart
+type DeviceNotes struct {
+	Notes    string            `json:"notes"`
+	Metadata map[string]string `json:"metadata"` // e.g. {"location": "shed", "serial": "1234"}
+}
+
+// IsEmpty reports whether there's nothing to keep
+func (n DeviceNotes) IsEmpty() bool {
+	return n.Notes == "" && len(n.Metadata) == 0
+}
+
+// normalizeDeviceNotes trims the notes and metadata and checks they're within
+// the size limits
+func normalizeDeviceNotes(n *DeviceNotes) error {
+	n.Notes = strings.TrimSpace(n.Notes)
+	if utf8.RuneCountInString(n.Notes) > maxNotesLength {
+		return fmt.Errorf("notes can be at most %d characters", maxNotesLength)
+	}
+	if len(n.Metadata) > maxMetadataKeys {
+		return fmt.Errorf("at most %d metadata keys are allowed", maxMetadataKeys)
+	}
+
+	metadata := make(map[string]string, len(n.Metadata))
+	for key, value := range n.Metadata {
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" {
+			return fmt.Errorf("metadata keys can't be empty")
+		}
+		if utf8.RuneCountInString(key) > maxMetadataKeyLen {
+			return fmt.Errorf("metadata key %q is longer than %d characters", key, maxMetadataKeyLen)
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueLen {
+			return fmt.Errorf("metadata value for %q is longer than %d characters", key, maxMetadataValueLen)
+		}
+		if _, dup := metadata[key]; dup {
+			return fmt.Errorf("metadata key %q is given twice", key)
+		}
+		metadata[key] = value
+	}
+	n.Metadata = metadata
+	return nil
+}
+
+// Path: /api/v1/devices/{id}/notes
+func (h *Handler) handleSetDeviceNotes(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var notes DeviceNotes
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNotesBody)).Decode(&notes); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := normalizeDeviceNotes(&notes); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetDeviceNotes(device.ID, notes); err != nil {
+		slog.Error("set device notes failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("device notes updated", "subdomain", device.Subdomain, "metadata_keys", len(notes.Metadata))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"notes":    notes.Notes,
+		"metadata": notes.Metadata,
+	})
+}
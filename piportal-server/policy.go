@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const maxPolicyPatterns = 50
+
+var methodToken = regexp.MustCompile(`^[A-Z]+$`)
+
+// RequestPolicy restricts which requests a device's tunnel forwards, e.g. a
+// read-only tunnel that only passes GET and HEAD. Path patterns use path.Match
+// syntax, plus a trailing "/**" to match everything under a prefix. Deny
+// patterns win; a non-empty allow list must match. Empty fields allow all.
+type RequestPolicy struct {
+	Methods    []string `json:"methods,omitempty"`
+	AllowPaths []string `json:"allow_paths,omitempty"`
+	DenyPaths  []string `json:"deny_paths,omitempty"`
+}
+
+// normalize uppercases methods and checks every pattern is usable
+func (p *RequestPolicy) normalize() error {
+	if len(p.Methods)+len(p.AllowPaths)+len(p.DenyPaths) > maxPolicyPatterns {
+		return fmt.Errorf("policy can have at most %d entries", maxPolicyPatterns)
+	}
+	for i, m := range p.Methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if !methodToken.MatchString(m) {
+			return fmt.Errorf("invalid method %q", p.Methods[i])
+		}
+		p.Methods[i] = m
+	}
+	for _, patterns := range [][]string{p.AllowPaths, p.DenyPaths} {
+		for _, pattern := range patterns {
+			if !strings.HasPrefix(pattern, "/") {
+				return fmt.Errorf("path pattern %q must start with /", pattern)
+			}
+			if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), "/"); err != nil {
+				return fmt.Errorf("invalid path pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// IsEmpty reports whether the policy lets everything through
+func (p *RequestPolicy) IsEmpty() bool {
+	return len(p.Methods) == 0 && len(p.AllowPaths) == 0 && len(p.DenyPaths) == 0
+}
+
+// AllowsMethod reports whether requests with this method may be forwarded
+func (p *RequestPolicy) AllowsMethod(method string) bool {
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, m := range p.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPath reports whether requests for this path may be forwarded
+func (p *RequestPolicy) AllowsPath(requestPath string) bool {
+	requestPath = path.Clean("/" + requestPath)
+	for _, pattern := range p.DenyPaths {
+		if matchPathPattern(pattern, requestPath) {
+			return false
+		}
+	}
+	if len(p.AllowPaths) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowPaths {
+		if matchPathPattern(pattern, requestPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPathPattern(pattern, requestPath string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return prefix == "" || requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+	}
+	matched, _ := path.Match(pattern, requestPath)
+	return matched
+}
+
+// checkRequestPolicy enforces the device's policy, writing a 405 or 403 and
+// returning false if the request must not be forwarded
+func (h *Handler) checkRequestPolicy(w http.ResponseWriter, r *http.Request, tunnel *Tunnel) bool {
+	policy := tunnel.policy.Load()
+	if policy == nil {
+		return true
+	}
+	if !policy.AllowsMethod(r.Method) {
+		w.Header().Set("Allow", strings.Join(policy.Methods, ", "))
+		http.Error(w, "Method not allowed on this tunnel", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !policy.AllowsPath(r.URL.Path) {
+		http.Error(w, "Path not allowed on this tunnel", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Path: /api/v1/devices/{id}/policy
+func (h *Handler) handleGetRequestPolicy(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	policy, err := h.store.GetRequestPolicy(device.ID)
+	if err != nil {
+		slog.Error("get request policy failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if policy == nil {
+		policy = &RequestPolicy{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// Path: /api/v1/devices/{id}/policy
+func (h *Handler) handleSetRequestPolicy(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req RequestPolicy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := req.normalize(); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetRequestPolicy(device.ID, req); err != nil {
+		slog.Error("set request policy failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply to the live tunnel straight away
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnel.policy.Store(&req)
+	}
+
+	slog.Info("request policy updated", "subdomain", device.Subdomain,
+		"methods", req.Methods, "allow_paths", req.AllowPaths, "deny_paths", req.DenyPaths)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"policy":  req,
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"time"
 )
 
 // Message type constants
@@ -17,6 +18,10 @@ const (
 	MessageTypeMetrics    = "metrics"
 	MessageTypeCommand       = "command"
 	MessageTypeCommandResult = "command_result"
+	MessageTypeCommandOutput = "command_output"
+	MessageTypeCommandCancel = "command_cancel"
+	MessageTypeReconnect     = "reconnect"
+	MessageTypeMetricsRequest = "metrics_request"
 
 	// Terminal message types
 	MessageTypeTerminalOpen   = "terminal_open"
@@ -37,6 +42,16 @@ type AuthMessage struct {
 	Type          string `json:"type"`
 	Token         string `json:"token"`
 	ClientVersion string `json:"client_version"`
+
+	// Connection telemetry. Older clients don't send it, so Reconnects is
+	// nil for them.
+	Reconnects     *int   `json:"reconnects,omitempty"`
+	ClientUptime   int64  `json:"client_uptime,omitempty"` // Seconds since the client started
+	LastDisconnect string `json:"last_disconnect,omitempty"`
+
+	// Monitoring only: the client runs no proxy, so requests for its
+	// subdomain aren't forwarded
+	NoProxy bool `json:"no_proxy,omitempty"`
 }
 
 // ResponseMessage is the client's response to a proxied request
@@ -46,6 +61,9 @@ type ResponseMessage struct {
 	StatusCode int               `json:"status_code"`
 	Headers    map[string]string `json:"headers"`
 	BodyBase64 string            `json:"body_base64,omitempty"`
+
+	UpstreamTime int64         `json:"upstream_time_us,omitempty"` // Microseconds the local service took, as the client measured
+	RoundTrip    time.Duration `json:"-"`                          // From sending the request to this arriving, set by ForwardRequest
 }
 
 // GetBody decodes the base64 body
@@ -65,10 +83,16 @@ type PingMessage struct {
 
 // AuthResultMessage tells the client if auth succeeded
 type AuthResultMessage struct {
-	Type      string `json:"type"`
-	Success   bool   `json:"success"`
-	Subdomain string `json:"subdomain,omitempty"`
-	Message   string `json:"message,omitempty"`
+	Type           string `json:"type"`
+	Success        bool   `json:"success"`
+	Subdomain      string `json:"subdomain,omitempty"`
+	Message        string `json:"message,omitempty"`
+	RequestTimeout int    `json:"request_timeout,omitempty"` // Seconds the server waits for a response
+	MaxBodySize    int64  `json:"max_body_size,omitempty"`   // Largest body the server will accept
+	BaseDomain     string `json:"base_domain,omitempty"`
+	URL            string `json:"url,omitempty"` // The device's public URL
+
+	Settings *AgentSettings `json:"settings,omitempty"` // Set by the owner in the dashboard, for this session
 }
 
 func NewAuthResult(success bool, subdomain, message string) AuthResultMessage {
@@ -88,6 +112,13 @@ type RequestMessage struct {
 	Path       string            `json:"path"`
 	Headers    map[string]string `json:"headers"`
 	BodyBase64 string            `json:"body_base64,omitempty"`
+	Timeout    int               `json:"timeout,omitempty"` // Seconds the server waits (0 = the session's request_timeout)
+
+	// Where the visitor sent the request, so the local service can build
+	// absolute URLs that work from outside
+	Host     string `json:"host,omitempty"`      // Public hostname, e.g. mypi.example.com or a custom domain
+	Scheme   string `json:"scheme,omitempty"`    // http or https
+	ClientIP string `json:"client_ip,omitempty"` // The visitor, as clientIP sees them
 }
 
 func NewRequestMessage(requestID, method, path string, headers map[string]string, body []byte) RequestMessage {
@@ -129,9 +160,20 @@ func NewErrorMessage(code, message string) ErrorMessage {
 	}
 }
 
+// ReconnectMessage asks the client to drop its connection and reconnect
+type ReconnectMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func NewReconnectMessage(reason string) ReconnectMessage {
+	return ReconnectMessage{Type: MessageTypeReconnect, Reason: reason}
+}
+
 // MetricsMessage contains system metrics from the client
 type MetricsMessage struct {
 	Type      string  `json:"type"`
+	RequestID string  `json:"request_id,omitempty"` // Set when answering a metrics_request
 	CPUTemp   float64 `json:"cpu_temp"`
 	MemTotal  uint64  `json:"mem_total"`
 	MemFree   uint64  `json:"mem_free"`
@@ -141,6 +183,17 @@ type MetricsMessage struct {
 	LoadAvg   float64 `json:"load_avg"`
 }
 
+// MetricsRequestMessage asks the client to collect and send its metrics now
+// rather than at the next ping. Older clients ignore it.
+type MetricsRequestMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+}
+
+func NewMetricsRequest(requestID string) MetricsRequestMessage {
+	return MetricsRequestMessage{Type: MessageTypeMetricsRequest, RequestID: requestID}
+}
+
 // CommandMessage sends a command to the client
 type CommandMessage struct {
 	Type      string `json:"type"`
@@ -148,6 +201,8 @@ type CommandMessage struct {
 	Command   string `json:"command"`
 	Shell     string `json:"shell,omitempty"`
 	DryRun    bool   `json:"dry_run,omitempty"`
+	Stream    bool   `json:"stream,omitempty"`  // Send output as command_output chunks
+	Timeout   int    `json:"timeout,omitempty"` // Seconds (0 = client default)
 }
 
 func NewCommandMessage(commandID, command string) CommandMessage {
@@ -169,6 +224,15 @@ func NewExecCommand(commandID, shell string, dryRun bool) CommandMessage {
 	}
 }
 
+// NewStreamingExecCommand creates a shell command whose output is streamed
+// back as command_output chunks, ending with a command_result
+func NewStreamingExecCommand(commandID, shell string, dryRun bool, timeout time.Duration) CommandMessage {
+	msg := NewExecCommand(commandID, shell, dryRun)
+	msg.Stream = true
+	msg.Timeout = int(timeout.Seconds())
+	return msg
+}
+
 // CommandResultMessage is sent by the client after executing a command
 type CommandResultMessage struct {
 	Type      string `json:"type"`
@@ -176,6 +240,33 @@ type CommandResultMessage struct {
 	ExitCode  int    `json:"exit_code"`
 	Output    string `json:"output"`
 	Error     string `json:"error,omitempty"`
+
+	DryRunEnforced bool  `json:"dry_run_enforced,omitempty"` // The client's exec_dry_run_only forced a dry run
+	OutputDropped  int64 `json:"output_dropped,omitempty"`   // Bytes of streamed output lost on the way
+}
+
+// CommandOutputMessage carries a chunk of output from a streaming command
+type CommandOutputMessage struct {
+	Type       string `json:"type"`
+	CommandID  string `json:"command_id"`
+	Stream     string `json:"stream"` // "stdout" or "stderr"
+	DataBase64 string `json:"data_base64"`
+}
+
+// GetData decodes the chunk
+func (m *CommandOutputMessage) GetData() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(m.DataBase64)
+}
+
+// CommandCancelMessage tells the client to stop a streaming command. Older
+// clients ignore it and let the command run to its timeout.
+type CommandCancelMessage struct {
+	Type      string `json:"type"`
+	CommandID string `json:"command_id"`
+}
+
+func NewCommandCancel(commandID string) CommandCancelMessage {
+	return CommandCancelMessage{Type: MessageTypeCommandCancel, CommandID: commandID}
 }
 
 // --- Terminal Messages (Server <-> Client) ---
@@ -233,6 +324,7 @@ func NewTerminalResizeMessage(sessionID string, rows, cols int) TerminalResizeMe
 type TerminalCloseMessage struct {
 	Type      string `json:"type"`
 	SessionID string `json:"session_id"`
+	Reason    string `json:"reason,omitempty"` // Why the device refused or ended it
 }
 
 func NewTerminalCloseMessage(sessionID string) TerminalCloseMessage {
@@ -279,6 +371,10 @@ func ParseClientMessage(data []byte) (interface{}, string, error) {
 		var m CommandResultMessage
 		err = json.Unmarshal(data, &m)
 		msg = m
+	case MessageTypeCommandOutput:
+		var m CommandOutputMessage
+		err = json.Unmarshal(data, &m)
+		msg = m
 	default:
 		msg = base
 	}
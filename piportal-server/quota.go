@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Quota kinds. Exec commands are counted per hour and terminal time, in
+// seconds, per day, both in UTC. Dry runs don't count.
+const (
+	quotaExec     = "exec"
+	quotaTerminal = "terminal"
+)
+
+// QuotaStatus is what's left of a device's quota, counting both its own limit
+// and its owner's, whichever runs out first
+type QuotaStatus struct {
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// quotaPeriod returns the period usage of kind is counted in at now, and
+// when that period ends
+func quotaPeriod(kind string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	if kind == quotaExec {
+		start := now.Truncate(time.Hour)
+		return start.Format("2006-01-02T15"), start.Add(time.Hour)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
+
+// quotaLimits returns the per-device and per-user limits for kind (0 = none)
+func (h *Handler) quotaLimits(kind string) (device, user int64) {
+	if kind == quotaExec {
+		return int64(h.config.ExecQuotaPerHour), int64(h.config.UserExecQuotaPerHour)
+	}
+	return int64(h.config.TerminalQuotaPerDay.Seconds()), int64(h.config.UserTerminalQuotaPerDay.Seconds())
+}
+
+// quotaSubjects pairs each usage counter that applies to device with its limit
+func (h *Handler) quotaSubjects(device *Device, kind string) map[string]int64 {
+	deviceLimit, userLimit := h.quotaLimits(kind)
+	subjects := make(map[string]int64, 2)
+	if deviceLimit > 0 {
+		subjects["device:"+device.ID] = deviceLimit
+	}
+	if userLimit > 0 && device.UserID != "" {
+		subjects["user:"+device.UserID] = userLimit
+	}
+	return subjects
+}
+
+// quotaStatus returns what's left of device's quota of kind, or nil if
+// neither the device nor its owner has a limit
+func (h *Handler) quotaStatus(device *Device, kind string) (*QuotaStatus, error) {
+	period, resetsAt := quotaPeriod(kind, time.Now())
+	var status *QuotaStatus
+	for subject, limit := range h.quotaSubjects(device, kind) {
+		used, err := h.store.GetQuotaUsage(subject, kind, period)
+		if err != nil {
+			return nil, err
+		}
+		remaining := max(limit-used, 0)
+		if status == nil || remaining < status.Remaining {
+			status = &QuotaStatus{Limit: limit, Used: used, Remaining: remaining, ResetsAt: resetsAt}
+		}
+	}
+	return status, nil
+}
+
+// chargeQuota counts amount against device's quotas of kind. Usage is only
+// recorded where a limit is set.
+func (h *Handler) chargeQuota(device *Device, kind string, amount int64) {
+	period, _ := quotaPeriod(kind, time.Now())
+	for subject := range h.quotaSubjects(device, kind) {
+		if err := h.store.AddQuotaUsage(subject, kind, period, amount); err != nil {
+			slog.Error("recording quota usage failed", "subject", subject, "kind", kind, "error", err)
+		}
+	}
+}
+
+// quotaUsedUp reports whether device has used up its quota of kind, and if
+// so why. A failed lookup lets the action through rather than locking
+// owners out of their devices.
+func (h *Handler) quotaUsedUp(device *Device, kind string) (string, time.Time, bool) {
+	status, err := h.quotaStatus(device, kind)
+	if err != nil {
+		slog.Error("quota lookup failed", "subdomain", device.Subdomain, "kind", kind, "error", err)
+		return "", time.Time{}, false
+	}
+	if status == nil || status.Remaining > 0 {
+		return "", time.Time{}, false
+	}
+	return quotaUsedUpMessage(kind, status.Limit, status.ResetsAt), status.ResetsAt, true
+}
+
+// takeQuota charges amount to device's quotas of kind if that fits under
+// every limit, and otherwise reports why not, like quotaUsedUp. The check
+// and the charge are one statement per counter, so actions started at once
+// can't all fit under the same last unit.
+func (h *Handler) takeQuota(device *Device, kind string, amount int64) (string, time.Time, bool) {
+	subjects := h.quotaSubjects(device, kind)
+	if len(subjects) == 0 {
+		return "", time.Time{}, false
+	}
+	period, resetsAt := quotaPeriod(kind, time.Now())
+	refused, err := h.store.TakeQuota(kind, period, amount, subjects)
+	if err != nil {
+		slog.Error("recording quota usage failed", "subdomain", device.Subdomain, "kind", kind, "error", err)
+		return "", time.Time{}, false
+	}
+	if refused == "" {
+		return "", time.Time{}, false
+	}
+	return quotaUsedUpMessage(kind, subjects[refused], resetsAt), resetsAt, true
+}
+
+// quotaUsedUpMessage explains a used up quota of kind to the user
+func quotaUsedUpMessage(kind string, limit int64, resetsAt time.Time) string {
+	resets := resetsAt.Format("15:04 MST")
+	if kind == quotaExec {
+		return fmt.Sprintf("Exec quota used up (%d commands per hour); more can run from %s", limit, resets)
+	}
+	return fmt.Sprintf("Terminal quota used up (%s per day); it resets at %s", time.Duration(limit)*time.Second, resets)
+}
+
+// checkQuota takes one unit of device's quota of kind, or refuses the
+// request with a 429 if it's used up, returning false
+func (h *Handler) checkQuota(w http.ResponseWriter, device *Device, kind string) bool {
+	message, resetsAt, usedUp := h.takeQuota(device, kind, 1)
+	if !usedUp {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(resetsAt).Seconds())+1))
+	jsonError(w, ErrCodeQuotaExceeded, message, http.StatusTooManyRequests)
+	return false
+}
+
+// deviceQuotas describes the device's exec and terminal quotas for the
+// device API, leaving out any without a limit
+func (h *Handler) deviceQuotas(device *Device) map[string]*QuotaStatus {
+	quotas := make(map[string]*QuotaStatus, 2)
+	for _, kind := range []string{quotaExec, quotaTerminal} {
+		status, err := h.quotaStatus(device, kind)
+		if err != nil {
+			slog.Error("quota lookup failed", "subdomain", device.Subdomain, "kind", kind, "error", err)
+			continue
+		}
+		if status != nil {
+			quotas[kind] = status
+		}
+	}
+	return quotas
+}
+
+// meterTerminal charges an open terminal session to the terminal quota a
+// minute at a time and closes it once the quota runs out. The returned func
+// stops metering and charges the final part-minute.
+func (h *Handler) meterTerminal(tunnel *Tunnel, device *Device, sessionID string, logger *slog.Logger) func() {
+	if len(h.quotaSubjects(device, quotaTerminal)) == 0 {
+		return func() {}
+	}
+
+	var mu sync.Mutex
+	start := time.Now()
+	charged := time.Duration(0)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			h.chargeQuota(device, quotaTerminal, 60)
+			charged += time.Minute
+			mu.Unlock()
+			if _, _, usedUp := h.quotaUsedUp(device, quotaTerminal); usedUp {
+				logger.Info("terminal quota used up, closing session")
+				tunnel.closeTerminalSession(sessionID, "terminal quota used up")
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			mu.Lock()
+			defer mu.Unlock()
+			if rest := time.Since(start) - charged; rest >= time.Second {
+				h.chargeQuota(device, quotaTerminal, int64(rest.Seconds()))
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxTrackedIPs     = 10000 // Per-IP buckets are swept once a tunnel tracks this many
+	maxRateLimitRPS   = 10000
+	maxRateLimitBurst = 100000
+)
+
+// RateLimit throttles requests to a device's tunnel with a token bucket, so
+// bots can't burn through the owner's bandwidth. Zero RequestsPerSecond
+// disables it. PerIP gives each client address its own bucket instead of
+// sharing one across all visitors.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	PerIP             bool    `json:"per_ip"`
+}
+
+// Enabled reports whether the limit throttles anything
+func (l RateLimit) Enabled() bool {
+	return l.RequestsPerSecond > 0
+}
+
+// tokenBucket holds up to burst tokens, refilled at a fixed rate
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if one is available, or returns how long until one is
+func (b *tokenBucket) take(now time.Time, limit RateLimit) (bool, time.Duration) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.RequestsPerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.RequestsPerSecond * float64(time.Second))
+}
+
+// full reports whether the bucket would have refilled by now, so dropping it
+// changes nothing
+func (b *tokenBucket) full(now time.Time, limit RateLimit) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*limit.RequestsPerSecond >= float64(limit.Burst)
+}
+
+// rateLimiter is a tunnel's limiter state. It lives on the Tunnel, so it's
+// discarded when the device disconnects.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	device *tokenBucket
+	ips    map[string]*tokenBucket
+}
+
+// SetLimit replaces the limit and resets all buckets
+func (rl *rateLimiter) SetLimit(limit RateLimit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limit = limit
+	rl.device = nil
+	rl.ips = nil
+}
+
+// Allow spends a token for a request from ip, or returns how long to wait
+func (rl *rateLimiter) Allow(ip string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if !rl.limit.Enabled() {
+		return true, 0
+	}
+
+	now := time.Now()
+	if !rl.limit.PerIP {
+		if rl.device == nil {
+			rl.device = &tokenBucket{tokens: float64(rl.limit.Burst), last: now}
+		}
+		return rl.device.take(now, rl.limit)
+	}
+
+	if rl.ips == nil {
+		rl.ips = make(map[string]*tokenBucket)
+	}
+	bucket, ok := rl.ips[ip]
+	if !ok {
+		if len(rl.ips) >= maxTrackedIPs {
+			for addr, b := range rl.ips {
+				if b.full(now, rl.limit) {
+					delete(rl.ips, addr)
+				}
+			}
+		}
+		bucket = &tokenBucket{tokens: float64(rl.limit.Burst), last: now}
+		rl.ips[ip] = bucket
+	}
+	return bucket.take(now, rl.limit)
+}
+
+// checkRateLimit writes a 429 and returns false if the request is over the
+// tunnel's rate limit
+func (h *Handler) checkRateLimit(w http.ResponseWriter, r *http.Request, tunnel *Tunnel) bool {
+	ok, wait := tunnel.limiter.Allow(clientIP(r, h.config.BehindProxy))
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests, slow down", http.StatusTooManyRequests)
+	return false
+}
+
+// Path: /api/v1/devices/{id}/ratelimit
+func (h *Handler) handleGetRateLimit(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	limit, err := h.store.GetRateLimit(device.ID)
+	if err != nil {
+		slog.Error("get rate limit failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limit)
+}
+
+// Path: /api/v1/devices/{id}/ratelimit
+func (h *Handler) handleSetRateLimit(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req RateLimit
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.RequestsPerSecond < 0 || math.IsNaN(req.RequestsPerSecond) || req.RequestsPerSecond > maxRateLimitRPS {
+		jsonError(w, ErrCodeInvalidRequest, fmt.Sprintf("requests_per_second must be between 0 and %d", maxRateLimitRPS), http.StatusBadRequest)
+		return
+	}
+	if req.Enabled() {
+		// Allow at least one request; default to one second's worth
+		if req.Burst <= 0 {
+			req.Burst = int(math.Max(1, math.Ceil(req.RequestsPerSecond)))
+		}
+		if req.Burst > maxRateLimitBurst {
+			jsonError(w, ErrCodeInvalidRequest, fmt.Sprintf("burst must be at most %d", maxRateLimitBurst), http.StatusBadRequest)
+			return
+		}
+	} else {
+		req = RateLimit{}
+	}
+
+	if err := h.store.SetRateLimit(device.ID, req); err != nil {
+		slog.Error("set rate limit failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply to the live tunnel straight away
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnel.limiter.SetLimit(req)
+	}
+
+	slog.Info("rate limit updated", "subdomain", device.Subdomain,
+		"requests_per_second", req.RequestsPerSecond, "burst", req.Burst, "per_ip", req.PerIP)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"rate_limit": req,
+	})
+}
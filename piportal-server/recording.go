@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// RecordingSettings controls terminal recording for a device. Recording is
+// opt-in; keystrokes are only captured when explicitly enabled as well.
+type RecordingSettings struct {
+	Enabled    bool `json:"enabled"`
+	Keystrokes bool `json:"keystrokes"`
+}
+
+// Recording describes a stored asciicast file
+type Recording struct {
+	SessionID string    `json:"session_id"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Session IDs come from generateSessionID; anything else is rejected so
+// request paths can't escape the recordings directory
+var recordingNameRe = regexp.MustCompile(`^term_[0-9a-f]+$`)
+
+// TerminalRecorder writes a terminal session as an asciicast v2 file:
+// a JSON header line followed by one [time, code, data] event per line.
+// See https://docs.asciinema.org/manual/asciicast/v2/
+type TerminalRecorder struct {
+	file       *os.File
+	enc        *json.Encoder
+	start      time.Time
+	keystrokes bool
+	mu         sync.Mutex
+
+	// The start of a UTF-8 character split across chunks, held back until
+	// the rest arrives so it isn't recorded as replacement characters
+	pendingOutput []byte
+	pendingInput  []byte
+}
+
+// NewTerminalRecorder creates <dir>/<deviceID>/<sessionID>.cast and writes the header
+func NewTerminalRecorder(dir, deviceID, sessionID string, cols, rows int, keystrokes bool) (*TerminalRecorder, error) {
+	deviceDir := filepath.Join(dir, deviceID)
+	if err := os.MkdirAll(deviceDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recordings directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(deviceDir, sessionID+".cast"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	r := &TerminalRecorder{
+		file:       f,
+		enc:        json.NewEncoder(f),
+		start:      time.Now(),
+		keystrokes: keystrokes,
+	}
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": r.start.Unix(),
+		"env":       map[string]string{"TERM": "xterm-256color"},
+	}
+	if err := r.enc.Encode(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Output records data written by the shell
+func (r *TerminalRecorder) Output(data []byte) {
+	r.stream("o", &r.pendingOutput, data)
+}
+
+// Input records data typed by the user, if keystroke logging is enabled
+func (r *TerminalRecorder) Input(data []byte) {
+	if r.keystrokes {
+		r.stream("i", &r.pendingInput, data)
+	}
+}
+
+// Resize records a terminal size change
+func (r *TerminalRecorder) Resize(cols, rows int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// stream records a chunk of a byte stream, after whatever was held back
+// from the last chunk, holding back a character cut off at the end
+func (r *TerminalRecorder) stream(code string, pending *[]byte, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buf := append(*pending, data...)
+	n := completeUTF8(buf)
+	if n > 0 {
+		r.event(code, string(buf[:n]))
+	}
+	*pending = append([]byte(nil), buf[n:]...)
+}
+
+// completeUTF8 returns the length of data without a UTF-8 character cut
+// off at its end. Invalid bytes aren't held back, since nothing following
+// could complete them.
+func completeUTF8(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+// event writes one event. Called with r.mu held.
+func (r *TerminalRecorder) event(code, data string) {
+	if r.file == nil {
+		return
+	}
+	r.enc.Encode([]interface{}{time.Since(r.start).Seconds(), code, data})
+}
+
+// Close finishes the recording, with anything still held back
+func (r *TerminalRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	if len(r.pendingOutput) > 0 {
+		r.event("o", string(r.pendingOutput))
+	}
+	if len(r.pendingInput) > 0 {
+		r.event("i", string(r.pendingInput))
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// listRecordings returns a device's recordings, newest first
+func listRecordings(dir, deviceID string) ([]Recording, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, deviceID))
+	if os.IsNotExist(err) {
+		return []Recording{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := []Recording{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if filepath.Ext(name) != ".cast" || !recordingNameRe.MatchString(name[:len(name)-5]) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, Recording{
+			SessionID: name[:len(name)-5],
+			Size:      info.Size(),
+			UpdatedAt: info.ModTime().UTC(),
+		})
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].UpdatedAt.After(recordings[j].UpdatedAt)
+	})
+	return recordings, nil
+}
+
+// recordingPath returns the file for a recording, or "" if the session ID is invalid
+func recordingPath(dir, deviceID, sessionID string) string {
+	if !recordingNameRe.MatchString(sessionID) {
+		return ""
+	}
+	return filepath.Join(dir, deviceID, sessionID+".cast")
+}
+
+// --- Handlers ---
+
+// handleSetRecording opts a device in or out of terminal recording
+func (h *Handler) handleSetRecording(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req RecordingSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	// Keystrokes are only ever captured as part of a recording
+	if !req.Enabled {
+		req.Keystrokes = false
+	}
+
+	if err := h.store.SetRecordingSettings(device.ID, req); err != nil {
+		slog.Error("set recording settings failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"recording": req,
+	})
+}
+
+// handleListRecordings lists a device's terminal recordings
+func (h *Handler) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	recordings, err := listRecordings(h.config.RecordingsDir, device.ID)
+	if err != nil {
+		slog.Error("list recordings failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recordings": recordings,
+	})
+}
+
+// handleDownloadRecording serves a single asciicast file
+func (h *Handler) handleDownloadRecording(w http.ResponseWriter, r *http.Request) {
+	device, parts := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+	// Path: /api/v1/devices/{id}/recordings/{session}
+	if len(parts) != 3 {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	path := recordingPath(h.config.RecordingsDir, device.ID, strings.TrimSuffix(parts[2], ".cast"))
+	if path == "" {
+		jsonError(w, ErrCodeNotFound, "Recording not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		jsonError(w, ErrCodeNotFound, "Recording not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const maxRouteTimeouts = 20
+
+// TimeoutRuleHeader names the timeout a request was given when it times out,
+// e.g. "/reports/** (120s)" or "default (30s)"
+const TimeoutRuleHeader = "X-PiPortal-Timeout-Rule"
+
+// RouteTimeout gives requests matching a path pattern their own timeout, so
+// one slow endpoint doesn't need the whole tunnel's timeout raised. Patterns
+// use the same syntax as request policies; the first matching rule wins.
+type RouteTimeout struct {
+	Path           string `json:"path"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+}
+
+// Timeout returns the rule's timeout as a duration
+func (rt RouteTimeout) Timeout() time.Duration {
+	return time.Duration(rt.TimeoutSeconds) * time.Second
+}
+
+// String describes the rule for the timeout header and logs
+func (rt RouteTimeout) String() string {
+	return fmt.Sprintf("%s (%s)", rt.Path, rt.Timeout())
+}
+
+// validateRouteTimeouts checks every rule is usable, clamping timeouts to
+// max, the device tier's request timeout, so rules can't get around it
+func validateRouteTimeouts(rules []RouteTimeout, max time.Duration) error {
+	if len(rules) > maxRouteTimeouts {
+		return fmt.Errorf("at most %d timeout rules are allowed", maxRouteTimeouts)
+	}
+	for i, rule := range rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("path pattern %q must start with /", rule.Path)
+		}
+		if _, err := path.Match(strings.TrimSuffix(rule.Path, "/**"), "/"); err != nil {
+			return fmt.Errorf("invalid path pattern %q", rule.Path)
+		}
+		if rule.TimeoutSeconds < 1 {
+			return fmt.Errorf("timeout for %s must be at least 1 second", rule.Path)
+		}
+		rules[i] = rule.clamp(max)
+	}
+	return nil
+}
+
+// clamp caps the rule's timeout at max
+func (rt RouteTimeout) clamp(max time.Duration) RouteTimeout {
+	if rt.Timeout() > max {
+		rt.TimeoutSeconds = int(max.Seconds())
+	}
+	return rt
+}
+
+// requestLimits returns the limits for a proxied request: the tier's, with
+// the timeout from the first of the device's route rules that matches. The
+// rule is nil when the default applies. Rules are clamped again here, since
+// one saved on pro outlives a downgrade.
+func (h *Handler) requestLimits(r *http.Request, tunnel *Tunnel) (RequestLimits, *RouteTimeout) {
+	limits := h.config.LimitsForTier(tunnel.Device.Tier)
+	rules := tunnel.routeTimeouts.Load()
+	if rules == nil {
+		return limits, nil
+	}
+	requestPath := path.Clean("/" + r.URL.Path)
+	for _, rule := range *rules {
+		if matchPathPattern(rule.Path, requestPath) {
+			rule = rule.clamp(limits.Timeout)
+			limits.Timeout = rule.Timeout()
+			return limits, &rule
+		}
+	}
+	return limits, nil
+}
+
+// Path: /api/v1/devices/{id}/timeouts
+func (h *Handler) handleGetRouteTimeouts(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	rules, err := h.store.GetRouteTimeouts(device.ID)
+	if err != nil {
+		slog.Error("get route timeouts failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if rules == nil {
+		rules = []RouteTimeout{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default_timeout_seconds": int(h.config.LimitsForTier(device.Tier).Timeout.Seconds()),
+		"rules":                   rules,
+	})
+}
+
+// Path: /api/v1/devices/{id}/timeouts
+func (h *Handler) handleSetRouteTimeouts(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req struct {
+		Rules []RouteTimeout `json:"rules"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateRouteTimeouts(req.Rules, h.config.LimitsForTier(device.Tier).Timeout); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetRouteTimeouts(device.ID, req.Rules); err != nil {
+		slog.Error("set route timeouts failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply to the live tunnel straight away
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		rules := req.Rules
+		tunnel.routeTimeouts.Store(&rules)
+	}
+
+	slog.Info("route timeouts updated", "subdomain", device.Subdomain, "rules", len(req.Rules))
+
+	if req.Rules == nil {
+		req.Rules = []RouteTimeout{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"rules":   req.Rules,
+	})
+}
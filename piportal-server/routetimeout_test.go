@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Route rules can't give a request longer than its tier allows
+func TestRouteTimeoutsClampedToTier(t *testing.T) {
+	rules := []RouteTimeout{{Path: "/reports/**", TimeoutSeconds: 600}, {Path: "/fast", TimeoutSeconds: 5}}
+	if err := validateRouteTimeouts(rules, 30*time.Second); err != nil {
+		t.Fatalf("validateRouteTimeouts: %v", err)
+	}
+	if rules[0].TimeoutSeconds != 30 || rules[1].TimeoutSeconds != 5 {
+		t.Errorf("rules = %+v, want 30s and 5s", rules)
+	}
+	if err := validateRouteTimeouts([]RouteTimeout{{Path: "/x", TimeoutSeconds: 0}}, 30*time.Second); err == nil {
+		t.Error("a zero timeout was accepted")
+	}
+
+	// A rule saved while the device was pro is capped once it's free
+	cfg := testConfig(t)
+	h := &Handler{config: cfg}
+	tunnel := &Tunnel{Device: &Device{Subdomain: "downgraded", Tier: "free"}}
+	tunnel.routeTimeouts.Store(&[]RouteTimeout{{Path: "/reports/**", TimeoutSeconds: 120}})
+	limits, rule := h.requestLimits(httptest.NewRequest("GET", "/reports/q3", nil), tunnel)
+	if rule == nil {
+		t.Fatal("no rule matched")
+	}
+	if limits.Timeout != cfg.RequestTimeout || rule.Timeout() != cfg.RequestTimeout {
+		t.Errorf("timeout = %v (rule %v), want the free tier's %v", limits.Timeout, rule, cfg.RequestTimeout)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// generateRefreshToken returns a new random refresh token
+func generateRefreshToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "pprt_" + hex.EncodeToString(b)
+}
+
+// hashRefreshToken is what's stored for a refresh token, so a copy of the
+// database can't be used to take over sessions
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession creates a session for a user who just logged in or signed
+// up, sets its cookies and returns the access token
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, user *User) (string, error) {
+	refresh := generateRefreshToken()
+	session, err := h.store.CreateSession(user.ID, hashRefreshToken(refresh), r.UserAgent(),
+		clientIP(r, h.config.BehindProxy), time.Now().Add(h.config.SessionTTL))
+	if err != nil {
+		return "", fmt.Errorf("creating session: %w", err)
+	}
+	return h.issueTokens(w, user.ID, session.ID, refresh)
+}
+
+// issueTokens sets the cookies for a new access token and refresh token
+func (h *Handler) issueTokens(w http.ResponseWriter, userID, sessionID, refresh string) (string, error) {
+	token, err := GenerateJWT(userID, sessionID, h.config.jwtKeys()[0], h.config.AccessTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	SetAuthCookie(w, token, h.config)
+	SetRefreshCookie(w, refresh, h.config)
+	return token, nil
+}
+
+// handleRefresh swaps the refresh token cookie for a new one and a fresh
+// access token, extending the session. Each refresh token works once.
+// Path: /api/v1/refresh
+func (h *Handler) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(refreshCookieName)
+	if err != nil || cookie.Value == "" {
+		jsonError(w, ErrCodeUnauthorized, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	// Don't clear cookies on failure: another tab may have just rotated
+	// this token and set new ones
+	refresh := generateRefreshToken()
+	session, err := h.store.RotateSession(hashRefreshToken(cookie.Value), hashRefreshToken(refresh),
+		r.UserAgent(), clientIP(r, h.config.BehindProxy), time.Now().Add(h.config.SessionTTL))
+	if err != nil {
+		slog.Error("session refresh failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if session == nil {
+		jsonError(w, ErrCodeSessionEnded, errSessionEnded.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.store.GetUserByID(session.UserID)
+	if err != nil || user == nil {
+		jsonError(w, ErrCodeUnauthorized, errUnknownUser.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	token, err := h.issueTokens(w, user.ID, session.ID, refresh)
+	if err != nil {
+		slog.Error("JWT generation failed", "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"user": map[string]interface{}{
+			"id":    user.ID,
+			"email": user.Email,
+		},
+		"token":      token,
+		"expires_in": int(h.config.AccessTokenTTL.Seconds()),
+	})
+}
+
+// endSession revokes the session behind the request's access token, if
+// any. The token may have expired; its signature still has to check out.
+func (h *Handler) endSession(r *http.Request) {
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		return
+	}
+	userID, sessionID, err := ValidateJWT(cookie.Value, h.config.jwtKeys(), jwt.WithoutClaimsValidation())
+	if err != nil || sessionID == "" {
+		return
+	}
+	if _, err := h.store.DeleteSession(userID, sessionID); err != nil {
+		slog.Error("ending session failed", "session_id", sessionID, "error", err)
+	}
+}
+
+// Path: /api/v1/sessions
+func (h *Handler) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+	current := SessionFromContext(r)
+
+	sessions, err := h.store.ListSessions(user.ID)
+	if err != nil {
+		slog.Error("list sessions failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	type sessionResponse struct {
+		ID         string `json:"id"`
+		UserAgent  string `json:"user_agent"`
+		IP         string `json:"ip"`
+		CreatedAt  string `json:"created_at"`
+		LastUsedAt string `json:"last_used_at"`
+		ExpiresAt  string `json:"expires_at"`
+		Current    bool   `json:"current"`
+	}
+	result := make([]sessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		result = append(result, sessionResponse{
+			ID:         s.ID,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt.Format("2006-01-02T15:04:05Z"),
+			LastUsedAt: s.LastUsedAt.Format("2006-01-02T15:04:05Z"),
+			ExpiresAt:  s.ExpiresAt.Format("2006-01-02T15:04:05Z"),
+			Current:    s.ID == current,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleRevokeSession logs one of the user's sessions out. Its access token
+// stops working at once.
+// Path: /api/v1/sessions/{id}
+func (h *Handler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+	sessionID := strings.TrimPrefix(r.URL.Path, "/api/v1/sessions/")
+
+	found, err := h.store.DeleteSession(user.ID, sessionID)
+	if err != nil {
+		slog.Error("revoke session failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		jsonError(w, ErrCodeNotFound, "Session not found", http.StatusNotFound)
+		return
+	}
+	if sessionID == SessionFromContext(r) {
+		ClearAuthCookie(w, h.config)
+	}
+	h.audit(r, "session.revoke", sessionID, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// handleRevokeOtherSessions logs the user out everywhere but here
+// Path: /api/v1/sessions
+func (h *Handler) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+
+	revoked, err := h.store.DeleteOtherSessions(user.ID, SessionFromContext(r))
+	if err != nil {
+		slog.Error("revoke sessions failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, "session.revoke_others", user.ID, fmt.Sprintf("%d sessions", revoked))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"revoked": revoked,
+	})
+}
@@ -1,31 +1,88 @@
 package main
 
 import (
+	"encoding/xml"
 	"fmt"
 	"net/http"
+	"time"
 )
 
+// publicPage is a crawlable page on the base domain. handleMainSite routes
+// these and the sitemap is built from them, so adding a page here is enough
+// to have it served and listed.
+type publicPage struct {
+	Path     string
+	Priority string
+	LastMod  time.Time // Zero means the page changes with each deploy
+	Serve    func(h *Handler, w http.ResponseWriter, r *http.Request)
+}
+
+var publicPages = []publicPage{
+	{Path: "/", Priority: "1.0", Serve: (*Handler).handleHome},
+	{Path: "/fleet", Priority: "0.9", Serve: (*Handler).handleFleetPage},
+	{Path: "/upgrade", Priority: "0.6", Serve: (*Handler).handleUpgrade},
+	{Path: "/status", Priority: "0.5", Serve: (*Handler).handleStatusPage},
+	{Path: "/terms", Priority: "0.3", LastMod: termsLastUpdated, Serve: (*Handler).handleTermsPage},
+}
+
+// termsLastUpdated matches the "Last Updated" date shown on /terms
+var termsLastUpdated = time.Date(2026, time.February, 4, 0, 0, 0, 0, time.UTC)
+
+// serverStarted stands in for lastmod on pages that only change on deploy
+var serverStarted = time.Now().UTC()
+
+// findPublicPage returns the registered page for a path, or nil
+func findPublicPage(path string) *publicPage {
+	for i := range publicPages {
+		if publicPages[i].Path == path {
+			return &publicPages[i]
+		}
+	}
+	return nil
+}
+
+type sitemapURL struct {
+	Loc      string `xml:"loc"`
+	LastMod  string `xml:"lastmod"`
+	Priority string `xml:"priority"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
 func (h *Handler) handleSitemap(w http.ResponseWriter, r *http.Request) {
-	domain := h.config.BaseDomain
+	set := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, page := range publicPages {
+		lastMod := page.LastMod
+		if lastMod.IsZero() {
+			lastMod = serverStarted
+		}
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:      "https://" + h.config.BaseDomain + page.Path,
+			LastMod:  lastMod.Format("2006-01-02"),
+			Priority: page.Priority,
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/xml")
-	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
-<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
-  <url>
-    <loc>https://%[1]s/</loc>
-    <priority>1.0</priority>
-  </url>
-  <url>
-    <loc>https://%[1]s/fleet</loc>
-    <priority>0.9</priority>
-  </url>
-  <url>
-    <loc>https://%[1]s/status</loc>
-    <priority>0.5</priority>
-  </url>
-  <url>
-    <loc>https://%[1]s/terms</loc>
-    <priority>0.3</priority>
-  </url>
-</urlset>
-`, domain)
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(set)
+	w.Write([]byte("\n"))
+}
+
+// handleRobots keeps crawlers out of the app and API and points them at the sitemap
+func (h *Handler) handleRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, `User-agent: *
+Disallow: /dashboard
+Disallow: /api
+Allow: /
+
+Sitemap: https://%s/sitemap.xml
+`, h.config.BaseDomain)
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// BandwidthWarningHeader is added to proxied responses once a device passes
+// its soft limit, so the owner can spot it in their own logs
+const BandwidthWarningHeader = "X-PiPortal-Bandwidth-Warning"
+
+// BandwidthWarningData is the payload detail of EventBandwidthWarning
+type BandwidthWarningData struct {
+	Month       string  `json:"month"`
+	BytesUsed   int64   `json:"bytes_used"`
+	Limit       int64   `json:"limit"`
+	PercentUsed float64 `json:"percent_used"`
+}
+
+// warnBandwidth tells the device's owner (webhooks and email) that it has
+// passed the soft limit, once per device per month. The month is claimed in
+// the database, so restarts and multiple servers don't repeat the warning;
+// bandwidthWarned saves hitting the database on every request after that.
+func (h *Handler) warnBandwidth(device *Device, used, limit int64) {
+	month := currentMonth()
+	if warned, ok := h.bandwidthWarned.Load(device.ID); ok && warned == month {
+		return
+	}
+	h.bandwidthWarned.Store(device.ID, month)
+
+	go func() {
+		claimed, err := h.store.ClaimMaintenanceRun("bandwidth-warning:"+device.ID, month)
+		if err != nil {
+			slog.Error("claiming bandwidth warning failed", "device_id", device.ID, "error", err)
+			return
+		}
+		if !claimed {
+			return
+		}
+
+		data := BandwidthWarningData{
+			Month:       month,
+			BytesUsed:   used,
+			Limit:       limit,
+			PercentUsed: float64(used) / float64(limit) * 100,
+		}
+		slog.Info("bandwidth soft limit reached", "subdomain", device.Subdomain, "used", FormatBytes(used), "limit", FormatBytes(limit))
+		h.tunnels.notifier.DeviceEventData(device, EventBandwidthWarning, data)
+
+		if h.mailer == nil {
+			return
+		}
+		// The tunnel's copy of the device doesn't carry its owner
+		owned, err := h.store.GetDeviceByID(device.ID)
+		if err != nil || owned == nil || owned.UserID == "" {
+			return
+		}
+		user, err := h.store.GetUserByID(owned.UserID)
+		if err != nil || user == nil {
+			return
+		}
+		subject := fmt.Sprintf("%s.%s has used %.0f%% of its bandwidth", device.Subdomain, h.config.BaseDomain, data.PercentUsed)
+		if err := h.mailer.Send(user.Email, subject, h.formatBandwidthWarning(device, data)); err != nil {
+			slog.Error("bandwidth warning email failed", "subdomain", device.Subdomain, "error", err)
+		}
+	}()
+}
+
+// formatBandwidthWarning renders the soft-limit email body
+func (h *Handler) formatBandwidthWarning(device *Device, data BandwidthWarningData) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s.%s has used %s of its %s bandwidth for %s (%.0f%%).\n\n",
+		device.Subdomain, h.config.BaseDomain, FormatBytes(data.BytesUsed), FormatBytes(data.Limit), data.Month, data.PercentUsed)
+	b.WriteString("When it reaches the limit, visitors get an error page until the 1st of next month.\n")
+	if device.Tier != "pro" {
+		fmt.Fprintf(&b, "Upgrade to Pro for 100 GB/month: https://%s/upgrade\n", h.config.BaseDomain)
+	}
+	return b.String()
+}
@@ -4,11 +4,16 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 // Bandwidth limits (in bytes)
@@ -17,9 +22,155 @@ const (
 	ProTierBandwidth  = 100 * 1024 * 1024 * 1024 // 100 GB/month
 )
 
-// Store handles persistent storage
-type Store struct {
-	db *sql.DB
+// ErrSubdomainTaken means another device already has the subdomain
+var ErrSubdomainTaken = errors.New("already taken")
+
+// Storage is the persistence layer used by the rest of the server.
+// SQLiteStore and PostgresStore both implement it.
+type Storage interface {
+	// Devices
+	CreateDevice(subdomain string, userID string) (*Device, error)
+	CreateDevices(userID, orgID string, batch []NewDevice, limits DeviceLimits) ([]*Device, error)
+	GetDeviceByToken(token string) (*Device, error)
+	GetDeviceBySubdomain(subdomain string) (*Device, error)
+	GetDeviceByID(id string) (*Device, error)
+	GetDeviceByTokenValue(token string) (*Device, error)
+	ListDevices() ([]*Device, error)
+	ListDevicesByUser(userID string) ([]*Device, error)
+	ListDevicesByUserAndOrg(userID string, orgID *string) ([]*Device, error)
+	CountDevicesByUser(userID string) (int, error)
+	UpdateDeviceStatus(deviceID string, online bool) error
+	RotateDeviceToken(deviceID string) (string, error)
+	UpgradeDevice(deviceID string) error
+	DowngradeDevice(deviceID string) error
+	SetDeviceSubscription(deviceID, subscriptionID string) error
+	GetDeviceIDBySubscription(subscriptionID string) (string, error)
+	SetTunnelEnabled(deviceID string, enabled bool) error
+	GetRecordingSettings(deviceID string) (*RecordingSettings, error)
+	SetRecordingSettings(deviceID string, settings RecordingSettings) error
+	GetMaintenance(deviceID string) (*MaintenanceMode, error)
+	SetMaintenance(deviceID string, mode MaintenanceMode) error
+	GetRequestPolicy(deviceID string) (*RequestPolicy, error)
+	SetRequestPolicy(deviceID string, policy RequestPolicy) error
+	GetRouteTimeouts(deviceID string) ([]RouteTimeout, error)
+	SetRouteTimeouts(deviceID string, rules []RouteTimeout) error
+	GetResponseHeaders(deviceID string) (map[string]string, error)
+	SetResponseHeaders(deviceID string, headers map[string]string) error
+	GetAgentSettings(deviceID string) (AgentSettings, error)
+	SetAgentSettings(deviceID string, settings AgentSettings) error
+	GetDeviceNotes(deviceID string) (DeviceNotes, error)
+	SetDeviceNotes(deviceID string, notes DeviceNotes) error
+	GetRateLimit(deviceID string) (RateLimit, error)
+	SetRateLimit(deviceID string, limit RateLimit) error
+	GetResponseCache(deviceID string) (bool, error)
+	SetResponseCache(deviceID string, enabled bool) error
+	GetTimingHeaders(deviceID string) (bool, error)
+	SetTimingHeaders(deviceID string, enabled bool) error
+	GetConnectionStats(deviceID string) (*ConnectionStats, error)
+	SetConnectionStats(deviceID string, stats ConnectionStats) error
+	SetClientVersion(deviceID, version string) error
+	CountClientVersions(userID string) (map[string]int, error)
+	AssignDeviceToUser(deviceID, userID string, limits DeviceLimits) error
+	SetDeviceOrganization(deviceID string, orgID *string) error
+	DeleteDevice(deviceID string) error
+
+	// Bandwidth
+	AddBandwidth(deviceID string, bytesIn, bytesOut int64) error
+	GetMonthlyUsage(deviceID string) (*Usage, error)
+	ListUsage(deviceID string, fromMonth, toMonth string) ([]*Usage, error)
+	SummarizeUsageForMonth(month string) ([]*UsageSummary, error)
+	ListDeviceBandwidthByUser(userID, month string) ([]*DeviceBandwidth, error)
+	PruneUsage(beforeMonth string) (int64, error)
+	GetBandwidthLimit(deviceID string) (int64, error)
+	GetBandwidthLimitOverride(deviceID string) (*int64, error)
+	SetBandwidthLimitOverride(deviceID string, limitBytes *int64) error
+	IsOverBandwidthLimit(deviceID string) (bool, int64, int64, error)
+	GetOrgMonthlyUsage(orgID string) (*Usage, error)
+	SetOrgBandwidthLimit(orgID string, limitBytes *int64) error
+	IsOrgOverBandwidthLimit(orgID string) (bool, int64, int64, error)
+
+	// Users
+	CreateUser(email, passwordHash string) (*User, error)
+	GetUserByEmail(email string) (*User, error)
+	GetUserByID(id string) (*User, error)
+	SetStripeCustomerID(userID, customerID string) error
+	ListUsers() ([]*User, error)
+	SetUserAdmin(userID string, admin bool) error
+
+	// Dashboard sessions
+	CreateSession(userID, refreshHash, userAgent, ip string, expiresAt time.Time) (*Session, error)
+	GetSession(id string) (*Session, error)
+	RotateSession(oldHash, newHash, userAgent, ip string, expiresAt time.Time) (*Session, error)
+	ListSessions(userID string) ([]*Session, error)
+	DeleteSession(userID, id string) (bool, error)
+	DeleteOtherSessions(userID, keepID string) (int64, error)
+	PruneSessions(now time.Time) (int64, error)
+
+	// Exec and terminal quotas
+	AddQuotaUsage(subject, kind, period string, amount int64) error
+	TakeQuota(kind, period string, amount int64, limits map[string]int64) (string, error)
+	GetQuotaUsage(subject, kind, period string) (int64, error)
+	PruneQuotaUsage(beforePeriod string) (int64, error)
+
+	// Abuse review
+	FlagAbuse(flag *AbuseFlag) (bool, error)
+	GetAbuseFlag(deviceID string) (*AbuseFlag, error)
+	ListAbuseFlags() ([]*AbuseFlag, error)
+	SetAbuseBlocked(deviceID string, blocked bool) error
+	ClearAbuseFlag(deviceID string) (bool, error)
+
+	// Organizations
+	CreateOrganization(name, userID string) (*Organization, error)
+	ListOrganizationsByUser(userID string) ([]*Organization, error)
+	GetOrganizationByID(id string) (*Organization, error)
+	UpdateOrganization(orgID, name string) error
+	DeleteOrganization(orgID string) error
+
+	// Webhooks
+	CreateWebhook(userID string, orgID *string, url string, events []string) (*Webhook, error)
+	ListWebhooksByUser(userID string) ([]*Webhook, error)
+	ListWebhooksForDevice(deviceID string) ([]*Webhook, error)
+	GetWebhookByID(id string) (*Webhook, error)
+	UpdateWebhook(id string, orgID *string, url string, events []string) error
+	DeleteWebhook(id string) error
+
+	// Custom domains
+	AddCustomDomain(deviceID, hostname string) (*CustomDomain, error)
+	ListCustomDomains(deviceID string) ([]*CustomDomain, error)
+	GetCustomDomain(hostname string) (*CustomDomain, error)
+	GetDeviceCustomDomain(deviceID, hostname string) (*CustomDomain, error)
+	MarkCustomDomainVerified(deviceID, hostname string) error
+	DeleteCustomDomain(deviceID, hostname string) error
+	PruneCustomDomainClaims(before time.Time) (int64, error)
+
+	// Claim codes
+	CreateClaimCode(code, deviceID string, expiresAt time.Time) error
+	GetClaimCodeDevice(code string) (string, error)
+	DeleteClaimCodes(deviceID string) error
+	PruneClaimCodes(now time.Time) (int64, error)
+
+	// Audit trail
+	AddAuditEntry(userID, action, target, details string) error
+	ListAuditEntries(limit int) ([]*AuditEntry, error)
+
+	// Maintenance
+	ClaimMaintenanceRun(job, period string) (bool, error)
+
+	Ping() error
+	Close() error
+}
+
+// sqlStore implements Storage on top of database/sql. Queries are written
+// with "?" placeholders and rebound for drivers that use numbered ones.
+type sqlStore struct {
+	db       *sql.DB
+	writer   *sql.DB // Writes and transactions; the same pool as db unless SQLite has its own for them
+	numbered bool    // Driver uses $1, $2, ... placeholders (Postgres)
+}
+
+// SQLiteStore is the default single-file storage backend
+type SQLiteStore struct {
+	sqlStore
 }
 
 // User represents a registered dashboard user
@@ -28,6 +179,9 @@ type User struct {
 	Email        string
 	PasswordHash string
 	CreatedAt    time.Time
+
+	StripeCustomerID string // Empty until the user's first checkout
+	IsAdmin          bool   // Operator with access to admin-only endpoints
 }
 
 // Device represents a registered device
@@ -43,14 +197,58 @@ type Device struct {
 	LastSeenAt    time.Time
 	IsOnline      bool
 	TunnelEnabled bool
+	ClientVersion string // Reported by the client on auth (empty if it never connected)
+}
+
+// NewDevice is one device in a batch created with CreateDevices
+type NewDevice struct {
+	Subdomain string
+	Notes     DeviceNotes
+}
+
+// DeviceLimits caps a user's devices: free-tier ones and all of them
+// (0 = no limit)
+type DeviceLimits struct {
+	Free  int
+	Total int
+}
+
+// ConnectionStats is the client's own view of its connection, reported on auth
+type ConnectionStats struct {
+	Reconnects      int       // Sessions the client has lost since it started
+	ClientStartedAt time.Time // When the client process started
+	LastDisconnect  string    // Why the previous session ended, as the client saw it
+}
+
+// Session is a dashboard login. Its refresh token (stored only as a hash)
+// gets new access tokens until the session expires or is revoked.
+type Session struct {
+	ID         string
+	UserID     string
+	UserAgent  string // Browser that last used the session
+	IP         string // Address it was last used from
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time // Pushed back each time the session is refreshed
+}
+
+// AbuseFlag marks a device whose tunnel served something on the abuse
+// blocklist. It stays until an admin clears it.
+type AbuseFlag struct {
+	DeviceID  string
+	Reason    string // Which rule matched, for the reviewer
+	URL       string // The response that matched
+	Blocked   bool   // Forwarding is stopped until the flag is cleared
+	FlaggedAt time.Time
 }
 
 // Organization represents a named device group owned by a user
 type Organization struct {
-	ID        string
-	Name      string
-	UserID    string
-	CreatedAt time.Time
+	ID             string
+	Name           string
+	UserID         string
+	CreatedAt      time.Time
+	BandwidthLimit *int64 // Monthly cap across all its devices (nil = none)
 }
 
 // Usage represents monthly bandwidth usage
@@ -61,93 +259,164 @@ type Usage struct {
 	BytesOut int64
 }
 
-// NewStore creates a new store with SQLite
-func NewStore(dbPath string) (*Store, error) {
-	db, err := sql.Open("sqlite", dbPath)
+// AuditEntry records an administrative action
+type AuditEntry struct {
+	ID        string
+	UserID    string // Who performed the action
+	Action    string // e.g. "device.delete"
+	Target    string // ID of the affected object
+	Details   string
+	CreatedAt time.Time
+}
+
+// UsageSummary is one user's bandwidth for a month, per device
+type UsageSummary struct {
+	UserID  string
+	Email   string
+	Month   string
+	Devices []DeviceUsage
+}
+
+// DeviceBandwidth is a device's usage for a month alongside its limit
+type DeviceBandwidth struct {
+	DeviceID string
+	BytesIn  int64
+	BytesOut int64
+	Limit    int64
+}
+
+// DeviceUsage is a device's line in a UsageSummary
+type DeviceUsage struct {
+	DeviceID  string
+	Subdomain string
+	Tier      string
+	BytesIn   int64
+	BytesOut  int64
+	Limit     int64 // The device's override if it has one, else its tier's limit
+}
+
+// StoreOptions tunes how the database is opened
+type StoreOptions struct {
+	WAL          bool          // journal_mode=WAL and synchronous=NORMAL
+	BusyTimeout  time.Duration // How long a connection waits on a lock before "database is locked"
+	MaxOpenConns int           // Connection pool size (SQLite readers run concurrently under WAL)
+}
+
+// DefaultStoreOptions returns the recommended SQLite settings
+func DefaultStoreOptions() StoreOptions {
+	return StoreOptions{
+		WAL:          true,
+		BusyTimeout:  5 * time.Second,
+		MaxOpenConns: 8,
+	}
+}
+
+// NewStorage opens the storage backend for the given driver. An empty driver
+// selects Postgres for postgres:// DSNs and SQLite otherwise.
+func NewStorage(driver, dsn string, opts StoreOptions) (Storage, error) {
+	if driver == "" {
+		driver = "sqlite"
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			driver = "postgres"
+		}
+	}
+
+	switch driver {
+	case "sqlite":
+		return NewSQLiteStore(dsn, opts)
+	case "postgres":
+		return NewPostgresStore(dsn, opts)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q (use sqlite or postgres)", driver)
+	}
+}
+
+// NewSQLiteStore creates a new store with SQLite
+func NewSQLiteStore(dbPath string, opts StoreOptions) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath, opts))
 	if err != nil {
 		return nil, err
 	}
 
-	store := &Store{db: db}
+	// WAL lets readers proceed alongside the writer. Without WAL, or for
+	// in-memory databases, stick to one connection.
+	maxConns := opts.MaxOpenConns
+	if !opts.WAL || maxConns < 1 || strings.Contains(dbPath, ":memory:") {
+		maxConns = 1
+	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// SQLite allows a single writer at a time. Writes get a pool of their own
+	// with one connection, so they wait their turn in Go rather than failing
+	// with "database is locked" once busy_timeout runs out under load, and
+	// transactions never deadlock upgrading a read lock to a write lock.
+	writer := db
+	if maxConns > 1 {
+		writer, err = sql.Open("sqlite", sqliteDSN(dbPath, opts))
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		writer.SetMaxOpenConns(1)
+		writer.SetMaxIdleConns(1)
+	}
+
+	store := &SQLiteStore{sqlStore{db: db, writer: writer}}
 	if err := store.migrate(); err != nil {
+		store.Close()
 		return nil, err
 	}
 
 	return store, nil
 }
 
-// migrate creates the database schema
-func (s *Store) migrate() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS devices (
-		id TEXT PRIMARY KEY,
-		token_hash TEXT UNIQUE NOT NULL,
-		subdomain TEXT UNIQUE NOT NULL,
-		tier TEXT DEFAULT 'free',
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		last_seen_at DATETIME,
-		is_online BOOLEAN DEFAULT FALSE
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_devices_token_hash ON devices(token_hash);
-	CREATE INDEX IF NOT EXISTS idx_devices_subdomain ON devices(subdomain);
-
-	CREATE TABLE IF NOT EXISTS usage (
-		device_id TEXT NOT NULL,
-		month TEXT NOT NULL,
-		bytes_in INTEGER DEFAULT 0,
-		bytes_out INTEGER DEFAULT 0,
-		PRIMARY KEY (device_id, month),
-		FOREIGN KEY (device_id) REFERENCES devices(id)
-	);
-
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		email TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-	if _, err := s.db.Exec(schema); err != nil {
-		return err
+// sqliteDSN appends connection pragmas to the database path. Pragmas are passed
+// in the DSN rather than executed once so every pooled connection gets them.
+func sqliteDSN(dbPath string, opts StoreOptions) string {
+	var pragmas []string
+	if opts.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("_pragma=busy_timeout(%d)", opts.BusyTimeout.Milliseconds()))
+	}
+	if opts.WAL {
+		pragmas = append(pragmas, "_pragma=journal_mode(WAL)", "_pragma=synchronous(NORMAL)")
+	}
+	if len(pragmas) == 0 {
+		return dbPath
 	}
 
-	// Add user_id column to devices (ignore error if already exists)
-	s.db.Exec("ALTER TABLE devices ADD COLUMN user_id TEXT REFERENCES users(id)")
-
-	// Add tunnel_enabled column (default FALSE — new devices start with forwarding disabled)
-	s.db.Exec("ALTER TABLE devices ADD COLUMN tunnel_enabled BOOLEAN DEFAULT FALSE")
-
-	// Organizations table
-	s.db.Exec(`CREATE TABLE IF NOT EXISTS organizations (
-		id TEXT PRIMARY KEY,
-		name TEXT NOT NULL,
-		user_id TEXT NOT NULL REFERENCES users(id),
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	)`)
-	s.db.Exec("CREATE INDEX IF NOT EXISTS idx_organizations_user ON organizations(user_id)")
-
-	// Add org_id column to devices
-	s.db.Exec("ALTER TABLE devices ADD COLUMN org_id TEXT REFERENCES organizations(id)")
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + strings.Join(pragmas, "&")
+}
 
-	return nil
+// migrate applies pending schema migrations
+func (s *SQLiteStore) migrate() error {
+	return s.runMigrations(sqliteMigrations)
 }
 
 // CreateDevice creates a new device with a random token.
 // If userID is non-empty, the device is owned by that user.
-func (s *Store) CreateDevice(subdomain string, userID string) (*Device, error) {
+func (s *sqlStore) CreateDevice(subdomain string, userID string) (*Device, error) {
 	subdomain = strings.ToLower(strings.TrimSpace(subdomain))
 	if err := validateSubdomain(subdomain); err != nil {
 		return nil, err
 	}
 
 	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM devices WHERE subdomain = ?)", subdomain).Scan(&exists)
+	err := s.queryRow("SELECT EXISTS(SELECT 1 FROM devices WHERE subdomain = ?)", subdomain).Scan(&exists)
 	if err != nil {
 		return nil, err
 	}
 	if exists {
-		return nil, fmt.Errorf("subdomain '%s' is already taken", subdomain)
+		return nil, fmt.Errorf("subdomain '%s' is %w", subdomain, ErrSubdomainTaken)
 	}
 
 	id := generateID()
@@ -155,12 +424,12 @@ func (s *Store) CreateDevice(subdomain string, userID string) (*Device, error) {
 	tokenHash := hashToken(token)
 
 	if userID != "" {
-		_, err = s.db.Exec(
+		_, err = s.exec(
 			"INSERT INTO devices (id, token_hash, subdomain, tier, user_id) VALUES (?, ?, ?, 'free', ?)",
 			id, tokenHash, subdomain, userID,
 		)
 	} else {
-		_, err = s.db.Exec(
+		_, err = s.exec(
 			"INSERT INTO devices (id, token_hash, subdomain, tier) VALUES (?, ?, ?, 'free')",
 			id, tokenHash, subdomain,
 		)
@@ -179,18 +448,115 @@ func (s *Store) CreateDevice(subdomain string, userID string) (*Device, error) {
 	}, nil
 }
 
+// CreateDevices creates a batch of devices owned by userID, in orgID unless
+// it's empty. It's one transaction, so either every device is created or
+// none is. If the batch would take the user past limits it returns a
+// *DeviceLimitError and creates nothing.
+func (s *sqlStore) CreateDevices(userID, orgID string, batch []NewDevice, limits DeviceLimits) ([]*Device, error) {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.checkDeviceLimits(tx, userID, limits, len(batch)); err != nil {
+		return nil, err
+	}
+
+	var org interface{}
+	if orgID != "" {
+		org = orgID
+	}
+	devices := make([]*Device, 0, len(batch))
+	for _, nd := range batch {
+		subdomain := strings.ToLower(strings.TrimSpace(nd.Subdomain))
+		if err := validateSubdomain(subdomain); err != nil {
+			return nil, err
+		}
+		var exists bool
+		err := tx.QueryRow(s.rebind("SELECT EXISTS(SELECT 1 FROM devices WHERE subdomain = ?)"), subdomain).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, fmt.Errorf("subdomain '%s' is %w", subdomain, ErrSubdomainTaken)
+		}
+		metadata, err := encodeMetadata(nd.Notes.Metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		id := generateID()
+		token := generateToken()
+		_, err = tx.Exec(
+			s.rebind("INSERT INTO devices (id, token_hash, subdomain, tier, user_id, org_id, notes, metadata) VALUES (?, ?, ?, 'free', ?, ?, ?, ?)"),
+			id, hashToken(token), subdomain, userID, org, nd.Notes.Notes, metadata,
+		)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return nil, fmt.Errorf("subdomain '%s' is %w", subdomain, ErrSubdomainTaken)
+			}
+			return nil, err
+		}
+		devices = append(devices, &Device{
+			ID:        id,
+			Token:     token,
+			Subdomain: subdomain,
+			Tier:      "free",
+			UserID:    userID,
+			OrgID:     orgID,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// checkDeviceLimits returns a *DeviceLimitError if userID can't take on
+// adding more devices. It counts under a lock, so two transactions for the
+// same user can't both fit under the limit and then both add devices.
+// Postgres locks the user's row until commit; SQLite has a single writer,
+// and this being a write takes the lock before anything is read.
+func (s *sqlStore) checkDeviceLimits(tx *sql.Tx, userID string, limits DeviceLimits, adding int) error {
+	if limits.Free == 0 && limits.Total == 0 {
+		return nil
+	}
+	var err error
+	if s.numbered {
+		_, err = tx.Exec("SELECT id FROM users WHERE id = $1 FOR UPDATE", userID)
+	} else {
+		_, err = tx.Exec("UPDATE users SET id = id WHERE id = ?", userID)
+	}
+	if err != nil {
+		return err
+	}
+	var total, free int
+	err = tx.QueryRow(
+		s.rebind("SELECT COUNT(*), COALESCE(SUM(CASE WHEN tier = 'pro' THEN 0 ELSE 1 END), 0) FROM devices WHERE user_id = ?"),
+		userID,
+	).Scan(&total, &free)
+	if err != nil {
+		return err
+	}
+	return limits.check(total, free, adding)
+}
+
 // GetDeviceByToken looks up a device by its token
-func (s *Store) GetDeviceByToken(token string) (*Device, error) {
+func (s *sqlStore) GetDeviceByToken(token string) (*Device, error) {
 	tokenHash := hashToken(token)
 
 	var device Device
 	var lastSeen sql.NullTime
 	var tier sql.NullString
 	var orgID sql.NullString
-	err := s.db.QueryRow(
-		"SELECT id, subdomain, tier, created_at, last_seen_at, is_online, tunnel_enabled, org_id FROM devices WHERE token_hash = ?",
+	var clientVersion sql.NullString
+	err := s.queryRow(
+		"SELECT id, subdomain, tier, created_at, last_seen_at, is_online, tunnel_enabled, org_id, client_version FROM devices WHERE token_hash = ?",
 		tokenHash,
-	).Scan(&device.ID, &device.Subdomain, &tier, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID)
+	).Scan(&device.ID, &device.Subdomain, &tier, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID, &clientVersion)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -210,20 +576,22 @@ func (s *Store) GetDeviceByToken(token string) (*Device, error) {
 	if orgID.Valid {
 		device.OrgID = orgID.String
 	}
+	device.ClientVersion = clientVersion.String
 
 	return &device, nil
 }
 
 // GetDeviceBySubdomain looks up a device by subdomain
-func (s *Store) GetDeviceBySubdomain(subdomain string) (*Device, error) {
+func (s *sqlStore) GetDeviceBySubdomain(subdomain string) (*Device, error) {
 	var device Device
 	var lastSeen sql.NullTime
 	var tier sql.NullString
 	var orgID sql.NullString
-	err := s.db.QueryRow(
-		"SELECT id, subdomain, tier, created_at, last_seen_at, is_online, tunnel_enabled, org_id FROM devices WHERE subdomain = ?",
+	var clientVersion sql.NullString
+	err := s.queryRow(
+		"SELECT id, subdomain, tier, created_at, last_seen_at, is_online, tunnel_enabled, org_id, client_version FROM devices WHERE subdomain = ?",
 		subdomain,
-	).Scan(&device.ID, &device.Subdomain, &tier, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID)
+	).Scan(&device.ID, &device.Subdomain, &tier, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID, &clientVersion)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -242,489 +610,1799 @@ func (s *Store) GetDeviceBySubdomain(subdomain string) (*Device, error) {
 	if orgID.Valid {
 		device.OrgID = orgID.String
 	}
+	device.ClientVersion = clientVersion.String
 
 	return &device, nil
 }
 
 // UpdateDeviceStatus updates the online status
-func (s *Store) UpdateDeviceStatus(deviceID string, online bool) error {
-	_, err := s.db.Exec(
+func (s *sqlStore) UpdateDeviceStatus(deviceID string, online bool) error {
+	_, err := s.exec(
 		"UPDATE devices SET is_online = ?, last_seen_at = CURRENT_TIMESTAMP WHERE id = ?",
 		online, deviceID,
 	)
 	return err
 }
 
+// RotateDeviceToken replaces a device's token, invalidating the old one,
+// and returns the new token
+func (s *sqlStore) RotateDeviceToken(deviceID string) (string, error) {
+	token := generateToken()
+	if _, err := s.exec("UPDATE devices SET token_hash = ? WHERE id = ?", hashToken(token), deviceID); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
 // UpgradeDevice upgrades a device to pro tier
-func (s *Store) UpgradeDevice(deviceID string) error {
-	_, err := s.db.Exec("UPDATE devices SET tier = 'pro' WHERE id = ?", deviceID)
+func (s *sqlStore) UpgradeDevice(deviceID string) error {
+	_, err := s.exec("UPDATE devices SET tier = 'pro' WHERE id = ?", deviceID)
 	return err
 }
 
-// SetTunnelEnabled enables or disables tunnel forwarding for a device
-func (s *Store) SetTunnelEnabled(deviceID string, enabled bool) error {
-	_, err := s.db.Exec("UPDATE devices SET tunnel_enabled = ? WHERE id = ?", enabled, deviceID)
+// DowngradeDevice returns a device to the free tier
+func (s *sqlStore) DowngradeDevice(deviceID string) error {
+	_, err := s.exec("UPDATE devices SET tier = 'free' WHERE id = ?", deviceID)
 	return err
 }
 
-// --- Bandwidth Tracking ---
-
-// currentMonth returns the current month in YYYY-MM format
-func currentMonth() string {
-	return time.Now().Format("2006-01")
+// SetDeviceSubscription records (or clears, if empty) the Stripe subscription paying for a device
+func (s *sqlStore) SetDeviceSubscription(deviceID, subscriptionID string) error {
+	_, err := s.exec("UPDATE devices SET stripe_subscription_id = ? WHERE id = ?", nullString(subscriptionID), deviceID)
+	return err
 }
 
-// AddBandwidth records bandwidth usage for a device
-func (s *Store) AddBandwidth(deviceID string, bytesIn, bytesOut int64) error {
-	month := currentMonth()
-
-	// Upsert: insert or update
-	_, err := s.db.Exec(`
-		INSERT INTO usage (device_id, month, bytes_in, bytes_out)
-		VALUES (?, ?, ?, ?)
-		ON CONFLICT(device_id, month) DO UPDATE SET
-			bytes_in = bytes_in + excluded.bytes_in,
-			bytes_out = bytes_out + excluded.bytes_out
-	`, deviceID, month, bytesIn, bytesOut)
+// GetDeviceIDBySubscription returns the device paid for by a Stripe subscription, or "" if none
+func (s *sqlStore) GetDeviceIDBySubscription(subscriptionID string) (string, error) {
+	var deviceID string
+	err := s.queryRow("SELECT id FROM devices WHERE stripe_subscription_id = ?", subscriptionID).Scan(&deviceID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return deviceID, err
+}
 
+// SetTunnelEnabled enables or disables tunnel forwarding for a device
+func (s *sqlStore) SetTunnelEnabled(deviceID string, enabled bool) error {
+	_, err := s.exec("UPDATE devices SET tunnel_enabled = ? WHERE id = ?", enabled, deviceID)
 	return err
 }
 
-// GetMonthlyUsage returns bandwidth usage for the current month
-func (s *Store) GetMonthlyUsage(deviceID string) (*Usage, error) {
-	month := currentMonth()
-
-	var usage Usage
-	err := s.db.QueryRow(
-		"SELECT device_id, month, bytes_in, bytes_out FROM usage WHERE device_id = ? AND month = ?",
-		deviceID, month,
-	).Scan(&usage.DeviceID, &usage.Month, &usage.BytesIn, &usage.BytesOut)
-
+// GetRecordingSettings returns a device's terminal recording settings
+func (s *sqlStore) GetRecordingSettings(deviceID string) (*RecordingSettings, error) {
+	var settings RecordingSettings
+	var enabled, keystrokes sql.NullBool
+	err := s.queryRow(
+		"SELECT record_terminal, record_keystrokes FROM devices WHERE id = ?", deviceID,
+	).Scan(&enabled, &keystrokes)
 	if err == sql.ErrNoRows {
-		return &Usage{DeviceID: deviceID, Month: month, BytesIn: 0, BytesOut: 0}, nil
+		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-
-	return &usage, nil
+	settings.Enabled = enabled.Bool
+	settings.Keystrokes = keystrokes.Bool
+	return &settings, nil
 }
 
-// GetBandwidthLimit returns the bandwidth limit for a device based on tier
-func (s *Store) GetBandwidthLimit(deviceID string) (int64, error) {
-	var tier sql.NullString
-	err := s.db.QueryRow("SELECT tier FROM devices WHERE id = ?", deviceID).Scan(&tier)
-	if err != nil {
-		return 0, err
-	}
-
-	if tier.Valid && tier.String == "pro" {
-		return ProTierBandwidth, nil
+// GetConnectionStats returns a device's last reported connection telemetry,
+// or nil if its client has never reported any
+func (s *sqlStore) GetConnectionStats(deviceID string) (*ConnectionStats, error) {
+	var stats ConnectionStats
+	var reconnects sql.NullInt64
+	var startedAt sql.NullTime
+	var reason sql.NullString
+	err := s.queryRow(
+		"SELECT reconnect_count, client_started_at, last_disconnect_reason FROM devices WHERE id = ?", deviceID,
+	).Scan(&reconnects, &startedAt, &reason)
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-	return FreeTierBandwidth, nil
-}
-
-// IsOverBandwidthLimit checks if a device has exceeded its monthly limit
-func (s *Store) IsOverBandwidthLimit(deviceID string) (bool, int64, int64, error) {
-	usage, err := s.GetMonthlyUsage(deviceID)
 	if err != nil {
-		return false, 0, 0, err
+		return nil, err
 	}
-
-	limit, err := s.GetBandwidthLimit(deviceID)
-	if err != nil {
-		return false, 0, 0, err
+	if !startedAt.Valid {
+		return nil, nil
 	}
+	stats.Reconnects = int(reconnects.Int64)
+	stats.ClientStartedAt = startedAt.Time
+	stats.LastDisconnect = reason.String
+	return &stats, nil
+}
 
-	totalUsed := usage.BytesIn + usage.BytesOut
-	return totalUsed >= limit, totalUsed, limit, nil
+// SetConnectionStats records a device's connection telemetry
+func (s *sqlStore) SetConnectionStats(deviceID string, stats ConnectionStats) error {
+	_, err := s.exec("UPDATE devices SET reconnect_count = ?, client_started_at = ?, last_disconnect_reason = ? WHERE id = ?",
+		stats.Reconnects, stats.ClientStartedAt.UTC(), stats.LastDisconnect, deviceID)
+	return err
 }
 
-// --- User Methods ---
+// SetClientVersion records the client version a device reported on auth
+func (s *sqlStore) SetClientVersion(deviceID, version string) error {
+	_, err := s.exec("UPDATE devices SET client_version = ? WHERE id = ?", version, deviceID)
+	return err
+}
 
-// CreateUser creates a new user account
-func (s *Store) CreateUser(email, passwordHash string) (*User, error) {
-	id := generateID()
-	_, err := s.db.Exec(
-		"INSERT INTO users (id, email, password_hash) VALUES (?, ?, ?)",
-		id, email, passwordHash,
+// CountClientVersions returns how many of a user's devices run each client
+// version. Devices that never connected are counted under "".
+func (s *sqlStore) CountClientVersions(userID string) (map[string]int, error) {
+	rows, err := s.query(
+		"SELECT COALESCE(client_version, ''), COUNT(*) FROM devices WHERE user_id = ? GROUP BY COALESCE(client_version, '')",
+		userID,
 	)
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE") {
-			return nil, fmt.Errorf("email already registered")
-		}
 		return nil, err
 	}
-	return &User{ID: id, Email: email, PasswordHash: passwordHash, CreatedAt: time.Now()}, nil
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var version string
+		var n int
+		if err := rows.Scan(&version, &n); err != nil {
+			return nil, err
+		}
+		counts[version] = n
+	}
+	return counts, rows.Err()
 }
 
-// GetUserByEmail looks up a user by email
-func (s *Store) GetUserByEmail(email string) (*User, error) {
-	var user User
-	err := s.db.QueryRow(
-		"SELECT id, email, password_hash, created_at FROM users WHERE email = ?", email,
-	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt)
+// SetRecordingSettings updates a device's terminal recording settings
+func (s *sqlStore) SetRecordingSettings(deviceID string, settings RecordingSettings) error {
+	_, err := s.exec("UPDATE devices SET record_terminal = ?, record_keystrokes = ? WHERE id = ?",
+		settings.Enabled, settings.Keystrokes, deviceID)
+	return err
+}
+
+// GetMaintenance returns a device's maintenance mode
+func (s *sqlStore) GetMaintenance(deviceID string) (*MaintenanceMode, error) {
+	var enabled sql.NullBool
+	var message sql.NullString
+	err := s.queryRow(
+		"SELECT maintenance, maintenance_message FROM devices WHERE id = ?", deviceID,
+	).Scan(&enabled, &message)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
+	return &MaintenanceMode{Enabled: enabled.Bool, Message: message.String}, nil
 }
 
-// GetUserByID looks up a user by ID
-func (s *Store) GetUserByID(id string) (*User, error) {
-	var user User
-	err := s.db.QueryRow(
-		"SELECT id, email, password_hash, created_at FROM users WHERE id = ?", id,
-	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt)
-	if err == sql.ErrNoRows {
+// SetMaintenance turns a device's maintenance mode on or off
+func (s *sqlStore) SetMaintenance(deviceID string, mode MaintenanceMode) error {
+	_, err := s.exec("UPDATE devices SET maintenance = ?, maintenance_message = ? WHERE id = ?",
+		mode.Enabled, mode.Message, deviceID)
+	return err
+}
+
+// GetRequestPolicy returns a device's request policy, or nil if it has none
+func (s *sqlStore) GetRequestPolicy(deviceID string) (*RequestPolicy, error) {
+	var raw sql.NullString
+	err := s.queryRow("SELECT request_policy FROM devices WHERE id = ?", deviceID).Scan(&raw)
+	if err == sql.ErrNoRows || (err == nil && raw.String == "") {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
-}
-
-// ListDevicesByUser returns all devices owned by a user
-func (s *Store) ListDevicesByUser(userID string) ([]*Device, error) {
-	rows, err := s.db.Query(
-		"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id FROM devices WHERE user_id = ? ORDER BY created_at DESC",
-		userID,
-	)
-	if err != nil {
-		return nil, err
+	var policy RequestPolicy
+	if err := json.Unmarshal([]byte(raw.String), &policy); err != nil {
+		return nil, fmt.Errorf("invalid request policy for %s: %w", deviceID, err)
 	}
-	defer rows.Close()
+	return &policy, nil
+}
 
-	var devices []*Device
-	for rows.Next() {
-		var device Device
-		var lastSeen sql.NullTime
-		var tier sql.NullString
-		var uid sql.NullString
-		var orgID sql.NullString
-		if err := rows.Scan(&device.ID, &device.Subdomain, &tier, &uid, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID); err != nil {
-			return nil, err
-		}
-		if lastSeen.Valid {
-			device.LastSeenAt = lastSeen.Time
-		}
-		device.Tier = "free"
-		if tier.Valid {
-			device.Tier = tier.String
-		}
-		if uid.Valid {
-			device.UserID = uid.String
+// SetRequestPolicy replaces a device's request policy; an empty policy clears it
+func (s *sqlStore) SetRequestPolicy(deviceID string, policy RequestPolicy) error {
+	var raw string
+	if !policy.IsEmpty() {
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return err
 		}
-		if orgID.Valid {
-			device.OrgID = orgID.String
-		}
-		devices = append(devices, &device)
+		raw = string(data)
 	}
-	return devices, nil
+	_, err := s.exec("UPDATE devices SET request_policy = ? WHERE id = ?", raw, deviceID)
+	return err
 }
 
-// GetDeviceByID looks up a device by its ID
-func (s *Store) GetDeviceByID(id string) (*Device, error) {
-	var device Device
-	var lastSeen sql.NullTime
-	var tier sql.NullString
-	var uid sql.NullString
-	var orgID sql.NullString
-	err := s.db.QueryRow(
-		"SELECT id, token_hash, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id FROM devices WHERE id = ?", id,
-	).Scan(&device.ID, &device.TokenHash, &device.Subdomain, &tier, &uid, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID)
-	if err == sql.ErrNoRows {
+// GetRouteTimeouts returns a device's per-path timeout rules, in match order
+func (s *sqlStore) GetRouteTimeouts(deviceID string) ([]RouteTimeout, error) {
+	var raw sql.NullString
+	err := s.queryRow("SELECT route_timeouts FROM devices WHERE id = ?", deviceID).Scan(&raw)
+	if err == sql.ErrNoRows || (err == nil && raw.String == "") {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	if lastSeen.Valid {
-		device.LastSeenAt = lastSeen.Time
-	}
-	device.Tier = "free"
-	if tier.Valid {
-		device.Tier = tier.String
-	}
-	if uid.Valid {
-		device.UserID = uid.String
+	var rules []RouteTimeout
+	if err := json.Unmarshal([]byte(raw.String), &rules); err != nil {
+		return nil, fmt.Errorf("invalid route timeouts for %s: %w", deviceID, err)
 	}
-	if orgID.Valid {
-		device.OrgID = orgID.String
+	return rules, nil
+}
+
+// SetRouteTimeouts replaces a device's per-path timeout rules; none clears them
+func (s *sqlStore) SetRouteTimeouts(deviceID string, rules []RouteTimeout) error {
+	var raw string
+	if len(rules) > 0 {
+		data, err := json.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		raw = string(data)
 	}
-	return &device, nil
+	_, err := s.exec("UPDATE devices SET route_timeouts = ? WHERE id = ?", raw, deviceID)
+	return err
 }
 
-// AssignDeviceToUser sets the user_id on a device (claiming)
-func (s *Store) AssignDeviceToUser(deviceID, userID string) error {
-	result, err := s.db.Exec(
-		"UPDATE devices SET user_id = ? WHERE id = ? AND user_id IS NULL",
-		userID, deviceID,
-	)
+// GetResponseHeaders returns the headers added to a device's tunnel responses
+func (s *sqlStore) GetResponseHeaders(deviceID string) (map[string]string, error) {
+	var raw sql.NullString
+	err := s.queryRow("SELECT response_headers FROM devices WHERE id = ?", deviceID).Scan(&raw)
+	if err == sql.ErrNoRows || (err == nil && raw.String == "") {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return fmt.Errorf("device not found or already claimed")
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw.String), &headers); err != nil {
+		return nil, fmt.Errorf("invalid response headers for %s: %w", deviceID, err)
 	}
-	return nil
+	return headers, nil
 }
 
-// DeleteDevice removes a device
-func (s *Store) DeleteDevice(deviceID string) error {
-	_, err := s.db.Exec("DELETE FROM usage WHERE device_id = ?", deviceID)
-	if err != nil {
-		return err
+// SetResponseHeaders replaces the headers added to a device's tunnel
+// responses; none clears them
+func (s *sqlStore) SetResponseHeaders(deviceID string, headers map[string]string) error {
+	var raw string
+	if len(headers) > 0 {
+		data, err := json.Marshal(headers)
+		if err != nil {
+			return err
+		}
+		raw = string(data)
 	}
-	_, err = s.db.Exec("DELETE FROM devices WHERE id = ?", deviceID)
+	_, err := s.exec("UPDATE devices SET response_headers = ? WHERE id = ?", raw, deviceID)
 	return err
 }
 
-// CountDevicesByUser returns the number of devices owned by a user
-func (s *Store) CountDevicesByUser(userID string) (int, error) {
-	var count int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM devices WHERE user_id = ?", userID).Scan(&count)
+// GetAgentSettings returns the client settings pushed to a device (empty if
+// none are set)
+func (s *sqlStore) GetAgentSettings(deviceID string) (AgentSettings, error) {
+	var raw sql.NullString
+	err := s.queryRow("SELECT agent_settings FROM devices WHERE id = ?", deviceID).Scan(&raw)
+	if err == sql.ErrNoRows || (err == nil && raw.String == "") {
+		return AgentSettings{}, nil
+	}
+	if err != nil {
+		return AgentSettings{}, err
+	}
+	var settings AgentSettings
+	if err := json.Unmarshal([]byte(raw.String), &settings); err != nil {
+		return AgentSettings{}, fmt.Errorf("invalid agent settings for %s: %w", deviceID, err)
+	}
+	return settings, nil
+}
+
+// SetAgentSettings replaces the client settings pushed to a device; empty
+// settings clear them
+func (s *sqlStore) SetAgentSettings(deviceID string, settings AgentSettings) error {
+	var raw string
+	if !settings.IsEmpty() {
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		raw = string(data)
+	}
+	_, err := s.exec("UPDATE devices SET agent_settings = ? WHERE id = ?", raw, deviceID)
+	return err
+}
+
+// GetDeviceNotes returns what the owner has noted about a device (empty if
+// nothing)
+func (s *sqlStore) GetDeviceNotes(deviceID string) (DeviceNotes, error) {
+	var notes, metadata sql.NullString
+	err := s.queryRow("SELECT notes, metadata FROM devices WHERE id = ?", deviceID).Scan(&notes, &metadata)
+	if err == sql.ErrNoRows {
+		return DeviceNotes{}, nil
+	}
+	if err != nil {
+		return DeviceNotes{}, err
+	}
+	result := DeviceNotes{Notes: notes.String}
+	if metadata.String != "" {
+		if err := json.Unmarshal([]byte(metadata.String), &result.Metadata); err != nil {
+			return DeviceNotes{}, fmt.Errorf("invalid metadata for %s: %w", deviceID, err)
+		}
+	}
+	return result, nil
+}
+
+// SetDeviceNotes replaces a device's notes and metadata; empty ones clear them
+func (s *sqlStore) SetDeviceNotes(deviceID string, notes DeviceNotes) error {
+	metadata, err := encodeMetadata(notes.Metadata)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("UPDATE devices SET notes = ?, metadata = ? WHERE id = ?", notes.Notes, metadata, deviceID)
+	return err
+}
+
+// encodeMetadata returns device metadata as stored: JSON, or empty for none
+func encodeMetadata(metadata map[string]string) (string, error) {
+	if len(metadata) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// GetRateLimit returns a device's request rate limit (zero if none is set)
+func (s *sqlStore) GetRateLimit(deviceID string) (RateLimit, error) {
+	var rps sql.NullFloat64
+	var burst sql.NullInt64
+	var perIP sql.NullBool
+	err := s.queryRow(
+		"SELECT rate_limit_rps, rate_limit_burst, rate_limit_per_ip FROM devices WHERE id = ?", deviceID,
+	).Scan(&rps, &burst, &perIP)
+	if err == sql.ErrNoRows {
+		return RateLimit{}, nil
+	}
+	if err != nil {
+		return RateLimit{}, err
+	}
+	return RateLimit{RequestsPerSecond: rps.Float64, Burst: int(burst.Int64), PerIP: perIP.Bool}, nil
+}
+
+// SetRateLimit replaces a device's request rate limit
+func (s *sqlStore) SetRateLimit(deviceID string, limit RateLimit) error {
+	_, err := s.exec("UPDATE devices SET rate_limit_rps = ?, rate_limit_burst = ?, rate_limit_per_ip = ? WHERE id = ?",
+		limit.RequestsPerSecond, limit.Burst, limit.PerIP, deviceID)
+	return err
+}
+
+// GetResponseCache reports whether a device has opted in to response caching
+func (s *sqlStore) GetResponseCache(deviceID string) (bool, error) {
+	var enabled sql.NullBool
+	err := s.queryRow("SELECT response_cache FROM devices WHERE id = ?", deviceID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled.Bool, err
+}
+
+// SetResponseCache turns response caching on or off for a device
+func (s *sqlStore) SetResponseCache(deviceID string, enabled bool) error {
+	_, err := s.exec("UPDATE devices SET response_cache = ? WHERE id = ?", enabled, deviceID)
+	return err
+}
+
+// GetTimingHeaders reports whether a device's responses get timing headers
+func (s *sqlStore) GetTimingHeaders(deviceID string) (bool, error) {
+	var enabled sql.NullBool
+	err := s.queryRow("SELECT timing_headers FROM devices WHERE id = ?", deviceID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled.Bool, err
+}
+
+// SetTimingHeaders turns timing headers on or off for a device
+func (s *sqlStore) SetTimingHeaders(deviceID string, enabled bool) error {
+	_, err := s.exec("UPDATE devices SET timing_headers = ? WHERE id = ?", enabled, deviceID)
+	return err
+}
+
+// --- Bandwidth Tracking ---
+
+// currentMonth returns the current month in YYYY-MM format
+func currentMonth() string {
+	return time.Now().Format("2006-01")
+}
+
+// AddBandwidth records bandwidth usage for a device
+func (s *sqlStore) AddBandwidth(deviceID string, bytesIn, bytesOut int64) error {
+	month := currentMonth()
+
+	// Upsert: insert or update
+	_, err := s.exec(`
+		INSERT INTO usage (device_id, month, bytes_in, bytes_out)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(device_id, month) DO UPDATE SET
+			bytes_in = usage.bytes_in + excluded.bytes_in,
+			bytes_out = usage.bytes_out + excluded.bytes_out
+	`, deviceID, month, bytesIn, bytesOut)
+
+	return err
+}
+
+// GetMonthlyUsage returns bandwidth usage for the current month
+func (s *sqlStore) GetMonthlyUsage(deviceID string) (*Usage, error) {
+	month := currentMonth()
+
+	var usage Usage
+	err := s.queryRow(
+		"SELECT device_id, month, bytes_in, bytes_out FROM usage WHERE device_id = ? AND month = ?",
+		deviceID, month,
+	).Scan(&usage.DeviceID, &usage.Month, &usage.BytesIn, &usage.BytesOut)
+
+	if err == sql.ErrNoRows {
+		return &Usage{DeviceID: deviceID, Month: month, BytesIn: 0, BytesOut: 0}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+// ListUsage returns a device's monthly usage, oldest first, for months in
+// [fromMonth, toMonth] (YYYY-MM). An empty bound is open-ended.
+func (s *sqlStore) ListUsage(deviceID string, fromMonth, toMonth string) ([]*Usage, error) {
+	query := "SELECT device_id, month, bytes_in, bytes_out FROM usage WHERE device_id = ?"
+	args := []interface{}{deviceID}
+	if fromMonth != "" {
+		query += " AND month >= ?"
+		args = append(args, fromMonth)
+	}
+	if toMonth != "" {
+		query += " AND month <= ?"
+		args = append(args, toMonth)
+	}
+	query += " ORDER BY month ASC"
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usages []*Usage
+	for rows.Next() {
+		var usage Usage
+		if err := rows.Scan(&usage.DeviceID, &usage.Month, &usage.BytesIn, &usage.BytesOut); err != nil {
+			return nil, err
+		}
+		usages = append(usages, &usage)
+	}
+	return usages, rows.Err()
+}
+
+// SummarizeUsageForMonth groups a month's usage by owning user. Devices with
+// no owner or no traffic that month are left out.
+func (s *sqlStore) SummarizeUsageForMonth(month string) ([]*UsageSummary, error) {
+	rows, err := s.query(`
+		SELECT u.id, u.email, d.id, d.subdomain, d.tier, d.bandwidth_limit_override, us.bytes_in, us.bytes_out
+		FROM usage us
+		JOIN devices d ON d.id = us.device_id
+		JOIN users u ON u.id = d.user_id
+		WHERE us.month = ?
+		ORDER BY u.id, d.subdomain`, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []*UsageSummary
+	var current *UsageSummary
+	for rows.Next() {
+		var userID, email string
+		var du DeviceUsage
+		var tier sql.NullString
+		var override sql.NullInt64
+		if err := rows.Scan(&userID, &email, &du.DeviceID, &du.Subdomain, &tier, &override, &du.BytesIn, &du.BytesOut); err != nil {
+			return nil, err
+		}
+		du.Tier = "free"
+		if tier.Valid {
+			du.Tier = tier.String
+		}
+		du.Limit = bandwidthLimit(tier, override)
+		if current == nil || current.UserID != userID {
+			current = &UsageSummary{UserID: userID, Email: email, Month: month}
+			summaries = append(summaries, current)
+		}
+		current.Devices = append(current.Devices, du)
+	}
+	return summaries, rows.Err()
+}
+
+// ListDeviceBandwidthByUser returns a month's usage and the limit for each of
+// a user's devices in one query, including devices with no traffic
+func (s *sqlStore) ListDeviceBandwidthByUser(userID, month string) ([]*DeviceBandwidth, error) {
+	rows, err := s.query(`
+		SELECT d.id, d.tier, d.bandwidth_limit_override, COALESCE(us.bytes_in, 0), COALESCE(us.bytes_out, 0)
+		FROM devices d
+		LEFT JOIN usage us ON us.device_id = d.id AND us.month = ?
+		WHERE d.user_id = ?`, month, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*DeviceBandwidth
+	for rows.Next() {
+		var db DeviceBandwidth
+		var tier sql.NullString
+		var override sql.NullInt64
+		if err := rows.Scan(&db.DeviceID, &tier, &override, &db.BytesIn, &db.BytesOut); err != nil {
+			return nil, err
+		}
+		db.Limit = bandwidthLimit(tier, override)
+		result = append(result, &db)
+	}
+	return result, rows.Err()
+}
+
+// PruneUsage deletes usage rows for months before beforeMonth (YYYY-MM)
+func (s *sqlStore) PruneUsage(beforeMonth string) (int64, error) {
+	result, err := s.exec("DELETE FROM usage WHERE month < ?", beforeMonth)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetBandwidthLimit returns the bandwidth limit for a device: its override
+// if one is set, otherwise the default for its tier
+func (s *sqlStore) GetBandwidthLimit(deviceID string) (int64, error) {
+	var tier sql.NullString
+	var override sql.NullInt64
+	err := s.queryRow("SELECT tier, bandwidth_limit_override FROM devices WHERE id = ?", deviceID).Scan(&tier, &override)
+	if err != nil {
+		return 0, err
+	}
+
+	return bandwidthLimit(tier, override), nil
+}
+
+// bandwidthLimit applies a device's override, falling back to its tier's limit
+func bandwidthLimit(tier sql.NullString, override sql.NullInt64) int64 {
+	if override.Valid {
+		return override.Int64
+	}
+	if tier.Valid && tier.String == "pro" {
+		return ProTierBandwidth
+	}
+	return FreeTierBandwidth
+}
+
+// GetBandwidthLimitOverride returns a device's limit override, or nil if it uses the tier default
+func (s *sqlStore) GetBandwidthLimitOverride(deviceID string) (*int64, error) {
+	var override sql.NullInt64
+	err := s.queryRow("SELECT bandwidth_limit_override FROM devices WHERE id = ?", deviceID).Scan(&override)
+	if err != nil {
+		return nil, err
+	}
+	if !override.Valid {
+		return nil, nil
+	}
+	return &override.Int64, nil
+}
+
+// SetBandwidthLimitOverride sets a device's monthly limit in bytes, or clears it if nil
+func (s *sqlStore) SetBandwidthLimitOverride(deviceID string, limitBytes *int64) error {
+	var value interface{}
+	if limitBytes != nil {
+		value = *limitBytes
+	}
+	_, err := s.exec("UPDATE devices SET bandwidth_limit_override = ? WHERE id = ?", value, deviceID)
+	return err
+}
+
+// IsOverBandwidthLimit checks if a device has exceeded its monthly limit
+func (s *sqlStore) IsOverBandwidthLimit(deviceID string) (bool, int64, int64, error) {
+	usage, err := s.GetMonthlyUsage(deviceID)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	limit, err := s.GetBandwidthLimit(deviceID)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	totalUsed := usage.BytesIn + usage.BytesOut
+	return totalUsed >= limit, totalUsed, limit, nil
+}
+
+// GetOrgMonthlyUsage returns the current month's usage summed across the
+// devices now in an organization. DeviceID is left empty.
+func (s *sqlStore) GetOrgMonthlyUsage(orgID string) (*Usage, error) {
+	usage := Usage{Month: currentMonth()}
+	err := s.queryRow(`
+		SELECT COALESCE(SUM(us.bytes_in), 0), COALESCE(SUM(us.bytes_out), 0)
+		FROM usage us
+		JOIN devices d ON d.id = us.device_id
+		WHERE d.org_id = ? AND us.month = ?`, orgID, usage.Month,
+	).Scan(&usage.BytesIn, &usage.BytesOut)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// SetOrgBandwidthLimit sets an organization's monthly limit in bytes, or clears it if nil
+func (s *sqlStore) SetOrgBandwidthLimit(orgID string, limitBytes *int64) error {
+	var value interface{}
+	if limitBytes != nil {
+		value = *limitBytes
+	}
+	_, err := s.exec("UPDATE organizations SET bandwidth_limit = ? WHERE id = ?", value, orgID)
+	return err
+}
+
+// IsOrgOverBandwidthLimit checks if an organization's devices together have
+// used up its monthly limit. An organization with no limit is never over.
+func (s *sqlStore) IsOrgOverBandwidthLimit(orgID string) (bool, int64, int64, error) {
+	var limit sql.NullInt64
+	err := s.queryRow("SELECT bandwidth_limit FROM organizations WHERE id = ?", orgID).Scan(&limit)
+	if err == sql.ErrNoRows || (err == nil && !limit.Valid) {
+		return false, 0, 0, nil
+	}
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	usage, err := s.GetOrgMonthlyUsage(orgID)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	totalUsed := usage.BytesIn + usage.BytesOut
+	return totalUsed >= limit.Int64, totalUsed, limit.Int64, nil
+}
+
+// --- User Methods ---
+
+// CreateUser creates a new user account
+func (s *sqlStore) CreateUser(email, passwordHash string) (*User, error) {
+	id := generateID()
+	_, err := s.exec(
+		"INSERT INTO users (id, email, password_hash) VALUES (?, ?, ?)",
+		id, email, passwordHash,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, fmt.Errorf("email already registered")
+		}
+		return nil, err
+	}
+	return &User{ID: id, Email: email, PasswordHash: passwordHash, CreatedAt: time.Now()}, nil
+}
+
+// GetUserByEmail looks up a user by email
+func (s *sqlStore) GetUserByEmail(email string) (*User, error) {
+	var user User
+	var customerID sql.NullString
+	var isAdmin sql.NullBool
+	err := s.queryRow(
+		"SELECT id, email, password_hash, created_at, stripe_customer_id, is_admin FROM users WHERE email = ?", email,
+	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt, &customerID, &isAdmin)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.StripeCustomerID = customerID.String
+	user.IsAdmin = isAdmin.Bool
+	return &user, nil
+}
+
+// GetUserByID looks up a user by ID
+func (s *sqlStore) GetUserByID(id string) (*User, error) {
+	var user User
+	var customerID sql.NullString
+	var isAdmin sql.NullBool
+	err := s.queryRow(
+		"SELECT id, email, password_hash, created_at, stripe_customer_id, is_admin FROM users WHERE id = ?", id,
+	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt, &customerID, &isAdmin)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.StripeCustomerID = customerID.String
+	user.IsAdmin = isAdmin.Bool
+	return &user, nil
+}
+
+// SetStripeCustomerID records the Stripe customer created for a user
+func (s *sqlStore) SetStripeCustomerID(userID, customerID string) error {
+	_, err := s.exec("UPDATE users SET stripe_customer_id = ? WHERE id = ?", customerID, userID)
+	return err
+}
+
+// ListUsers returns all users, oldest first
+func (s *sqlStore) ListUsers() ([]*User, error) {
+	rows, err := s.query("SELECT id, email, created_at, is_admin FROM users ORDER BY created_at ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		var user User
+		var isAdmin sql.NullBool
+		if err := rows.Scan(&user.ID, &user.Email, &user.CreatedAt, &isAdmin); err != nil {
+			return nil, err
+		}
+		user.IsAdmin = isAdmin.Bool
+		users = append(users, &user)
+	}
+	return users, rows.Err()
+}
+
+// SetUserAdmin grants or revokes admin access
+func (s *sqlStore) SetUserAdmin(userID string, admin bool) error {
+	_, err := s.exec("UPDATE users SET is_admin = ? WHERE id = ?", admin, userID)
+	return err
+}
+
+// ListDevicesByUser returns all devices owned by a user
+func (s *sqlStore) ListDevicesByUser(userID string) ([]*Device, error) {
+	rows, err := s.query(
+		"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id, client_version FROM devices WHERE user_id = ? ORDER BY created_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*Device
+	for rows.Next() {
+		var device Device
+		var lastSeen sql.NullTime
+		var tier sql.NullString
+		var uid sql.NullString
+		var orgID sql.NullString
+		var clientVersion sql.NullString
+		if err := rows.Scan(&device.ID, &device.Subdomain, &tier, &uid, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID, &clientVersion); err != nil {
+			return nil, err
+		}
+		if lastSeen.Valid {
+			device.LastSeenAt = lastSeen.Time
+		}
+		device.Tier = "free"
+		if tier.Valid {
+			device.Tier = tier.String
+		}
+		if uid.Valid {
+			device.UserID = uid.String
+		}
+		if orgID.Valid {
+			device.OrgID = orgID.String
+		}
+		device.ClientVersion = clientVersion.String
+		devices = append(devices, &device)
+	}
+	return devices, nil
+}
+
+// GetDeviceByID looks up a device by its ID
+func (s *sqlStore) GetDeviceByID(id string) (*Device, error) {
+	var device Device
+	var lastSeen sql.NullTime
+	var tier sql.NullString
+	var uid sql.NullString
+	var orgID sql.NullString
+	var clientVersion sql.NullString
+	err := s.queryRow(
+		"SELECT id, token_hash, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id, client_version FROM devices WHERE id = ?", id,
+	).Scan(&device.ID, &device.TokenHash, &device.Subdomain, &tier, &uid, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID, &clientVersion)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lastSeen.Valid {
+		device.LastSeenAt = lastSeen.Time
+	}
+	device.Tier = "free"
+	if tier.Valid {
+		device.Tier = tier.String
+	}
+	if uid.Valid {
+		device.UserID = uid.String
+	}
+	if orgID.Valid {
+		device.OrgID = orgID.String
+	}
+	device.ClientVersion = clientVersion.String
+	return &device, nil
+}
+
+// AssignDeviceToUser sets the user_id on a device (claiming). Like
+// CreateDevices it checks limits in the same transaction, returning a
+// *DeviceLimitError if the device would take the user past them.
+func (s *sqlStore) AssignDeviceToUser(deviceID, userID string, limits DeviceLimits) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.checkDeviceLimits(tx, userID, limits, 1); err != nil {
+		return err
+	}
+	result, err := tx.Exec(
+		s.rebind("UPDATE devices SET user_id = ? WHERE id = ? AND user_id IS NULL"),
+		userID, deviceID,
+	)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("device not found or already claimed")
+	}
+	return tx.Commit()
+}
+
+// DeleteDevice removes a device. An abuse flag on it is kept as the review
+// record until an admin clears it.
+func (s *sqlStore) DeleteDevice(deviceID string) error {
+	_, err := s.exec("DELETE FROM usage WHERE device_id = ?", deviceID)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("DELETE FROM custom_domains WHERE device_id = ?", deviceID)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("DELETE FROM claim_codes WHERE device_id = ?", deviceID)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("DELETE FROM devices WHERE id = ?", deviceID)
+	return err
+}
+
+// CountDevicesByUser returns the number of devices owned by a user
+func (s *sqlStore) CountDevicesByUser(userID string) (int, error) {
+	var count int
+	err := s.queryRow("SELECT COUNT(*) FROM devices WHERE user_id = ?", userID).Scan(&count)
 	return count, err
 }
 
-// GetDeviceByTokenValue looks up a device by its raw token (for claiming)
-func (s *Store) GetDeviceByTokenValue(token string) (*Device, error) {
-	tokenHash := hashToken(token)
-	var device Device
-	var lastSeen sql.NullTime
-	var tier sql.NullString
-	var uid sql.NullString
-	var orgID sql.NullString
-	err := s.db.QueryRow(
-		"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id FROM devices WHERE token_hash = ?",
-		tokenHash,
-	).Scan(&device.ID, &device.Subdomain, &tier, &uid, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID)
+// GetDeviceByTokenValue looks up a device by its raw token (for claiming)
+func (s *sqlStore) GetDeviceByTokenValue(token string) (*Device, error) {
+	tokenHash := hashToken(token)
+	var device Device
+	var lastSeen sql.NullTime
+	var tier sql.NullString
+	var uid sql.NullString
+	var orgID sql.NullString
+	var clientVersion sql.NullString
+	err := s.queryRow(
+		"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id, client_version FROM devices WHERE token_hash = ?",
+		tokenHash,
+	).Scan(&device.ID, &device.Subdomain, &tier, &uid, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID, &clientVersion)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lastSeen.Valid {
+		device.LastSeenAt = lastSeen.Time
+	}
+	device.Tier = "free"
+	if tier.Valid {
+		device.Tier = tier.String
+	}
+	if uid.Valid {
+		device.UserID = uid.String
+	}
+	if orgID.Valid {
+		device.OrgID = orgID.String
+	}
+	device.ClientVersion = clientVersion.String
+	return &device, nil
+}
+
+// ListDevices returns all devices
+func (s *sqlStore) ListDevices() ([]*Device, error) {
+	rows, err := s.query(
+		"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id, client_version FROM devices ORDER BY created_at DESC",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*Device
+	for rows.Next() {
+		var device Device
+		var lastSeen sql.NullTime
+		var tier sql.NullString
+		var userID sql.NullString
+		var orgID sql.NullString
+		var clientVersion sql.NullString
+		if err := rows.Scan(&device.ID, &device.Subdomain, &tier, &userID, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID, &clientVersion); err != nil {
+			return nil, err
+		}
+		device.UserID = userID.String
+		if lastSeen.Valid {
+			device.LastSeenAt = lastSeen.Time
+		}
+		device.Tier = "free"
+		if tier.Valid {
+			device.Tier = tier.String
+		}
+		if orgID.Valid {
+			device.OrgID = orgID.String
+		}
+		device.ClientVersion = clientVersion.String
+		devices = append(devices, &device)
+	}
+
+	return devices, nil
+}
+
+// --- Organization Methods ---
+
+// CreateOrganization creates a new organization for a user
+func (s *sqlStore) CreateOrganization(name, userID string) (*Organization, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("organization name is required")
+	}
+	if len(name) > 50 {
+		return nil, fmt.Errorf("organization name must be 50 characters or less")
+	}
+
+	id := generateID()
+	_, err := s.exec(
+		"INSERT INTO organizations (id, name, user_id) VALUES (?, ?, ?)",
+		id, name, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Organization{ID: id, Name: name, UserID: userID, CreatedAt: time.Now()}, nil
+}
+
+// ListOrganizationsByUser returns all organizations owned by a user
+func (s *sqlStore) ListOrganizationsByUser(userID string) ([]*Organization, error) {
+	rows, err := s.query(
+		"SELECT id, name, user_id, created_at, bandwidth_limit FROM organizations WHERE user_id = ? ORDER BY name ASC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []*Organization
+	for rows.Next() {
+		var org Organization
+		var limit sql.NullInt64
+		if err := rows.Scan(&org.ID, &org.Name, &org.UserID, &org.CreatedAt, &limit); err != nil {
+			return nil, err
+		}
+		if limit.Valid {
+			org.BandwidthLimit = &limit.Int64
+		}
+		orgs = append(orgs, &org)
+	}
+	return orgs, nil
+}
+
+// GetOrganizationByID looks up an organization by ID
+func (s *sqlStore) GetOrganizationByID(id string) (*Organization, error) {
+	var org Organization
+	var limit sql.NullInt64
+	err := s.queryRow(
+		"SELECT id, name, user_id, created_at, bandwidth_limit FROM organizations WHERE id = ?", id,
+	).Scan(&org.ID, &org.Name, &org.UserID, &org.CreatedAt, &limit)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if limit.Valid {
+		org.BandwidthLimit = &limit.Int64
+	}
+	return &org, nil
+}
+
+// UpdateOrganization renames an organization
+func (s *sqlStore) UpdateOrganization(orgID, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("organization name is required")
+	}
+	if len(name) > 50 {
+		return fmt.Errorf("organization name must be 50 characters or less")
+	}
+
+	result, err := s.exec("UPDATE organizations SET name = ? WHERE id = ?", name, orgID)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("organization not found")
+	}
+	return nil
+}
+
+// DeleteOrganization deletes an organization and unassigns its devices
+func (s *sqlStore) DeleteOrganization(orgID string) error {
+	// First unassign all devices from this org
+	_, err := s.exec("UPDATE devices SET org_id = NULL WHERE org_id = ?", orgID)
+	if err != nil {
+		return err
+	}
+
+	// Webhooks scoped to the org have nothing left to watch
+	_, err = s.exec("DELETE FROM webhooks WHERE org_id = ?", orgID)
+	if err != nil {
+		return err
+	}
+
+	// Then delete the org
+	_, err = s.exec("DELETE FROM organizations WHERE id = ?", orgID)
+	return err
+}
+
+// SetDeviceOrganization sets or clears a device's organization
+func (s *sqlStore) SetDeviceOrganization(deviceID string, orgID *string) error {
+	var err error
+	if orgID == nil || *orgID == "" {
+		_, err = s.exec("UPDATE devices SET org_id = NULL WHERE id = ?", deviceID)
+	} else {
+		_, err = s.exec("UPDATE devices SET org_id = ? WHERE id = ?", *orgID, deviceID)
+	}
+	return err
+}
+
+// ListDevicesByUserAndOrg returns devices filtered by user and optionally by org
+// If orgID is nil, returns all devices for the user
+// If orgID is empty string, returns devices with no org assigned
+func (s *sqlStore) ListDevicesByUserAndOrg(userID string, orgID *string) ([]*Device, error) {
+	var rows *sql.Rows
+	var err error
+
+	if orgID == nil {
+		// All devices for user
+		rows, err = s.query(
+			"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id, client_version FROM devices WHERE user_id = ? ORDER BY created_at DESC",
+			userID,
+		)
+	} else {
+		// Devices filtered by org (or NULL org if empty string)
+		rows, err = s.query(
+			"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id, client_version FROM devices WHERE user_id = ? AND org_id = ? ORDER BY created_at DESC",
+			userID, *orgID,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*Device
+	for rows.Next() {
+		var device Device
+		var lastSeen sql.NullTime
+		var tier sql.NullString
+		var uid sql.NullString
+		var oid sql.NullString
+		var clientVersion sql.NullString
+		if err := rows.Scan(&device.ID, &device.Subdomain, &tier, &uid, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &oid, &clientVersion); err != nil {
+			return nil, err
+		}
+		if lastSeen.Valid {
+			device.LastSeenAt = lastSeen.Time
+		}
+		device.Tier = "free"
+		if tier.Valid {
+			device.Tier = tier.String
+		}
+		if uid.Valid {
+			device.UserID = uid.String
+		}
+		if oid.Valid {
+			device.OrgID = oid.String
+		}
+		device.ClientVersion = clientVersion.String
+		devices = append(devices, &device)
+	}
+	return devices, nil
+}
+
+// --- Webhook Methods ---
+
+// CreateWebhook subscribes a URL to device events. A nil or empty orgID
+// covers all of the user's devices; empty events means every event.
+func (s *sqlStore) CreateWebhook(userID string, orgID *string, url string, events []string) (*Webhook, error) {
+	webhook := &Webhook{
+		ID:        generateID(),
+		UserID:    userID,
+		URL:       url,
+		Secret:    generateWebhookSecret(),
+		Events:    events,
+		CreatedAt: time.Now(),
+	}
+	if orgID != nil {
+		webhook.OrgID = *orgID
+	}
+
+	_, err := s.exec(
+		"INSERT INTO webhooks (id, user_id, org_id, url, secret, events) VALUES (?, ?, ?, ?, ?, ?)",
+		webhook.ID, userID, nullString(webhook.OrgID), url, webhook.Secret, strings.Join(events, ","),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// ListWebhooksByUser returns all webhooks owned by a user
+func (s *sqlStore) ListWebhooksByUser(userID string) ([]*Webhook, error) {
+	return s.queryWebhooks(
+		"SELECT id, user_id, org_id, url, secret, events, created_at FROM webhooks WHERE user_id = ? ORDER BY created_at ASC",
+		userID,
+	)
+}
+
+// ListWebhooksForDevice returns the webhooks that cover a device: those owned
+// by its user that are either unscoped or scoped to the device's org
+func (s *sqlStore) ListWebhooksForDevice(deviceID string) ([]*Webhook, error) {
+	return s.queryWebhooks(
+		`SELECT w.id, w.user_id, w.org_id, w.url, w.secret, w.events, w.created_at
+		FROM webhooks w JOIN devices d ON d.user_id = w.user_id
+		WHERE d.id = ? AND (w.org_id IS NULL OR w.org_id = d.org_id)`,
+		deviceID,
+	)
+}
+
+// GetWebhookByID looks up a webhook by ID
+func (s *sqlStore) GetWebhookByID(id string) (*Webhook, error) {
+	webhooks, err := s.queryWebhooks(
+		"SELECT id, user_id, org_id, url, secret, events, created_at FROM webhooks WHERE id = ?", id,
+	)
+	if err != nil || len(webhooks) == 0 {
+		return nil, err
+	}
+	return webhooks[0], nil
+}
+
+// UpdateWebhook changes a webhook's URL, org scope and event filter
+func (s *sqlStore) UpdateWebhook(id string, orgID *string, url string, events []string) error {
+	var org string
+	if orgID != nil {
+		org = *orgID
+	}
+	result, err := s.exec(
+		"UPDATE webhooks SET org_id = ?, url = ?, events = ? WHERE id = ?",
+		nullString(org), url, strings.Join(events, ","), id,
+	)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("webhook not found")
+	}
+	return nil
+}
+
+// DeleteWebhook removes a webhook
+func (s *sqlStore) DeleteWebhook(id string) error {
+	_, err := s.exec("DELETE FROM webhooks WHERE id = ?", id)
+	return err
+}
+
+func (s *sqlStore) queryWebhooks(query string, args ...interface{}) ([]*Webhook, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []*Webhook
+	for rows.Next() {
+		var webhook Webhook
+		var orgID, events sql.NullString
+		if err := rows.Scan(&webhook.ID, &webhook.UserID, &orgID, &webhook.URL, &webhook.Secret, &events, &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhook.OrgID = orgID.String
+		if events.String != "" {
+			webhook.Events = strings.Split(events.String, ",")
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// --- Custom Domains ---
+
+// ErrDomainInUse is returned when a hostname is already verified by another
+// device
+var ErrDomainInUse = errors.New("domain is already in use")
+
+const customDomainColumns = "hostname, device_id, verification_token, verified, created_at, verified_at"
+
+// AddCustomDomain claims a hostname for a device, pending DNS verification.
+// Pending claims don't reserve the hostname: several devices may claim it,
+// and whichever proves control first gets it.
+func (s *sqlStore) AddCustomDomain(deviceID, hostname string) (*CustomDomain, error) {
+	verified, err := s.GetCustomDomain(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if verified != nil {
+		return nil, ErrDomainInUse
+	}
+
+	domain := &CustomDomain{
+		Hostname:          hostname,
+		DeviceID:          deviceID,
+		VerificationToken: generateID(),
+		CreatedAt:         time.Now(),
+	}
+	_, err = s.exec(
+		"INSERT INTO custom_domains (hostname, device_id, verification_token) VALUES (?, ?, ?)",
+		hostname, deviceID, domain.VerificationToken,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, fmt.Errorf("domain is already added to this device")
+		}
+		return nil, err
+	}
+	return domain, nil
+}
+
+// ListCustomDomains returns a device's custom domains
+func (s *sqlStore) ListCustomDomains(deviceID string) ([]*CustomDomain, error) {
+	rows, err := s.query(
+		"SELECT "+customDomainColumns+" FROM custom_domains WHERE device_id = ? ORDER BY created_at ASC",
+		deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []*CustomDomain
+	for rows.Next() {
+		domain, err := scanCustomDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// GetCustomDomain returns the verified custom domain for a hostname, if any.
+// Pending claims are ignored.
+func (s *sqlStore) GetCustomDomain(hostname string) (*CustomDomain, error) {
+	domain, err := scanCustomDomain(s.queryRow(
+		"SELECT "+customDomainColumns+" FROM custom_domains WHERE hostname = ? AND verified = ?",
+		hostname, true,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return domain, err
+}
+
+// GetDeviceCustomDomain returns a device's claim on a hostname, verified or not
+func (s *sqlStore) GetDeviceCustomDomain(deviceID, hostname string) (*CustomDomain, error) {
+	domain, err := scanCustomDomain(s.queryRow(
+		"SELECT "+customDomainColumns+" FROM custom_domains WHERE device_id = ? AND hostname = ?",
+		deviceID, hostname,
+	))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
+	return domain, err
+}
+
+// MarkCustomDomainVerified records that a device's TXT challenge passed. If
+// another device verified the hostname first it returns ErrDomainInUse.
+func (s *sqlStore) MarkCustomDomainVerified(deviceID, hostname string) error {
+	_, err := s.exec(
+		"UPDATE custom_domains SET verified = ?, verified_at = CURRENT_TIMESTAMP WHERE device_id = ? AND hostname = ?",
+		true, deviceID, hostname,
+	)
+	if err != nil && isUniqueViolation(err) {
+		return ErrDomainInUse
+	}
+	return err
+}
+
+// DeleteCustomDomain removes a device's custom domain
+func (s *sqlStore) DeleteCustomDomain(deviceID, hostname string) error {
+	_, err := s.exec("DELETE FROM custom_domains WHERE device_id = ? AND hostname = ?", deviceID, hostname)
+	return err
+}
+
+// PruneCustomDomainClaims deletes pending claims created before the cutoff
+func (s *sqlStore) PruneCustomDomainClaims(before time.Time) (int64, error) {
+	result, err := s.exec(
+		"DELETE FROM custom_domains WHERE verified = ? AND created_at < ?",
+		false, before.UTC(),
+	)
 	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func scanCustomDomain(row interface{ Scan(...interface{}) error }) (*CustomDomain, error) {
+	var domain CustomDomain
+	var verified sql.NullBool
+	var verifiedAt sql.NullTime
+	if err := row.Scan(&domain.Hostname, &domain.DeviceID, &domain.VerificationToken, &verified, &domain.CreatedAt, &verifiedAt); err != nil {
 		return nil, err
 	}
-	if lastSeen.Valid {
-		device.LastSeenAt = lastSeen.Time
+	domain.Verified = verified.Bool
+	if verifiedAt.Valid {
+		domain.VerifiedAt = verifiedAt.Time
 	}
-	device.Tier = "free"
-	if tier.Valid {
-		device.Tier = tier.String
+	return &domain, nil
+}
+
+// --- Claim Codes ---
+
+// CreateClaimCode stores a short-lived code that claims a device. Expiry is
+// kept as Unix seconds so it compares the same way on every driver.
+func (s *sqlStore) CreateClaimCode(code, deviceID string, expiresAt time.Time) error {
+	_, err := s.exec(
+		"INSERT INTO claim_codes (code, device_id, expires_at) VALUES (?, ?, ?)",
+		code, deviceID, expiresAt.Unix(),
+	)
+	return err
+}
+
+// GetClaimCodeDevice returns the device a code claims, or "" if the code is
+// unknown or expired
+func (s *sqlStore) GetClaimCodeDevice(code string) (string, error) {
+	var deviceID string
+	err := s.queryRow(
+		"SELECT device_id FROM claim_codes WHERE code = ? AND expires_at > ?",
+		code, time.Now().Unix(),
+	).Scan(&deviceID)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
-	if uid.Valid {
-		device.UserID = uid.String
+	return deviceID, err
+}
+
+// DeleteClaimCodes removes every code for a device, once it's been claimed
+func (s *sqlStore) DeleteClaimCodes(deviceID string) error {
+	_, err := s.exec("DELETE FROM claim_codes WHERE device_id = ?", deviceID)
+	return err
+}
+
+// PruneClaimCodes deletes codes that expired before now
+func (s *sqlStore) PruneClaimCodes(now time.Time) (int64, error) {
+	result, err := s.exec("DELETE FROM claim_codes WHERE expires_at <= ?", now.Unix())
+	if err != nil {
+		return 0, err
 	}
-	if orgID.Valid {
-		device.OrgID = orgID.String
+	return result.RowsAffected()
+}
+
+// --- Sessions ---
+// Times are kept as Unix seconds so they compare the same way on every driver.
+
+const sessionColumns = "id, user_id, user_agent, ip, created_at, last_used_at, expires_at"
+
+func scanSession(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	var session Session
+	var createdAt, lastUsedAt, expiresAt int64
+	if err := row.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP, &createdAt, &lastUsedAt, &expiresAt); err != nil {
+		return nil, err
 	}
-	return &device, nil
+	session.CreatedAt = time.Unix(createdAt, 0).UTC()
+	session.LastUsedAt = time.Unix(lastUsedAt, 0).UTC()
+	session.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	return &session, nil
 }
 
-// ListDevices returns all devices
-func (s *Store) ListDevices() ([]*Device, error) {
-	rows, err := s.db.Query(
-		"SELECT id, subdomain, tier, created_at, last_seen_at, is_online, tunnel_enabled, org_id FROM devices ORDER BY created_at DESC",
+// CreateSession records a new login
+func (s *sqlStore) CreateSession(userID, refreshHash, userAgent, ip string, expiresAt time.Time) (*Session, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	session := &Session{
+		ID:         generateID(),
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  expiresAt.UTC().Truncate(time.Second),
+	}
+	_, err := s.exec(
+		"INSERT INTO sessions (id, user_id, refresh_hash, user_agent, ip, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		session.ID, userID, refreshHash, userAgent, ip, now.Unix(), now.Unix(), session.ExpiresAt.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetSession looks up a session, returning nil if it's unknown, revoked or expired
+func (s *sqlStore) GetSession(id string) (*Session, error) {
+	session, err := scanSession(s.queryRow(
+		"SELECT "+sessionColumns+" FROM sessions WHERE id = ? AND expires_at > ?", id, time.Now().Unix(),
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+// RotateSession swaps a session's refresh token for a new one and extends
+// it. It returns nil if the old token doesn't belong to a live session,
+// including when it has already been rotated.
+func (s *sqlStore) RotateSession(oldHash, newHash, userAgent, ip string, expiresAt time.Time) (*Session, error) {
+	now := time.Now().Unix()
+	result, err := s.exec(
+		"UPDATE sessions SET refresh_hash = ?, user_agent = ?, ip = ?, last_used_at = ?, expires_at = ? WHERE refresh_hash = ? AND expires_at > ?",
+		newHash, userAgent, ip, now, expiresAt.Unix(), oldHash, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	session, err := scanSession(s.queryRow("SELECT "+sessionColumns+" FROM sessions WHERE refresh_hash = ?", newHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+// ListSessions returns a user's live sessions, most recently used first
+func (s *sqlStore) ListSessions(userID string) ([]*Session, error) {
+	rows, err := s.query(
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_used_at DESC",
+		userID, time.Now().Unix(),
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var devices []*Device
+	var sessions []*Session
 	for rows.Next() {
-		var device Device
-		var lastSeen sql.NullTime
-		var tier sql.NullString
-		var orgID sql.NullString
-		if err := rows.Scan(&device.ID, &device.Subdomain, &tier, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &orgID); err != nil {
+		session, err := scanSession(rows)
+		if err != nil {
 			return nil, err
 		}
-		if lastSeen.Valid {
-			device.LastSeenAt = lastSeen.Time
-		}
-		device.Tier = "free"
-		if tier.Valid {
-			device.Tier = tier.String
-		}
-		if orgID.Valid {
-			device.OrgID = orgID.String
-		}
-		devices = append(devices, &device)
+		sessions = append(sessions, session)
 	}
-
-	return devices, nil
+	return sessions, rows.Err()
 }
 
-// --- Organization Methods ---
-
-// CreateOrganization creates a new organization for a user
-func (s *Store) CreateOrganization(name, userID string) (*Organization, error) {
-	name = strings.TrimSpace(name)
-	if name == "" {
-		return nil, fmt.Errorf("organization name is required")
+// DeleteSession revokes one of a user's sessions, reporting whether it existed
+func (s *sqlStore) DeleteSession(userID, id string) (bool, error) {
+	result, err := s.exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
 	}
-	if len(name) > 50 {
-		return nil, fmt.Errorf("organization name must be 50 characters or less")
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteOtherSessions revokes all of a user's sessions except keepID
+func (s *sqlStore) DeleteOtherSessions(userID, keepID string) (int64, error) {
+	result, err := s.exec("DELETE FROM sessions WHERE user_id = ? AND id <> ?", userID, keepID)
+	if err != nil {
+		return 0, err
 	}
+	return result.RowsAffected()
+}
 
-	id := generateID()
-	_, err := s.db.Exec(
-		"INSERT INTO organizations (id, name, user_id) VALUES (?, ?, ?)",
-		id, name, userID,
-	)
+// PruneSessions deletes sessions that expired before now
+func (s *sqlStore) PruneSessions(now time.Time) (int64, error) {
+	result, err := s.exec("DELETE FROM sessions WHERE expires_at <= ?", now.Unix())
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	return result.RowsAffected()
+}
 
-	return &Organization{ID: id, Name: name, UserID: userID, CreatedAt: time.Now()}, nil
+// --- Quotas ---
+
+// AddQuotaUsage adds amount to a subject's use of a quota in period. Subjects
+// are "device:<id>" or "user:<id>".
+func (s *sqlStore) AddQuotaUsage(subject, kind, period string, amount int64) error {
+	_, err := s.exec(`
+		INSERT INTO quota_usage (subject, kind, period, amount)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(subject, kind, period) DO UPDATE SET
+			amount = quota_usage.amount + excluded.amount
+	`, subject, kind, period, amount)
+	return err
 }
 
-// ListOrganizationsByUser returns all organizations owned by a user
-func (s *Store) ListOrganizationsByUser(userID string) ([]*Organization, error) {
-	rows, err := s.db.Query(
-		"SELECT id, name, user_id, created_at FROM organizations WHERE user_id = ? ORDER BY name ASC",
-		userID,
-	)
+// TakeQuota charges amount to each subject's use of a quota in period, as
+// long as none of them would go past its limit in limits (subject -> limit).
+// Each charge is one conditional upsert, and they share a transaction, so
+// requests at once can't all get in under a limit. It returns the subject
+// that refused, or "" if everything was charged.
+func (s *sqlStore) TakeQuota(kind, period string, amount int64, limits map[string]int64) (string, error) {
+	tx, err := s.writer.Begin()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var orgs []*Organization
-	for rows.Next() {
-		var org Organization
-		if err := rows.Scan(&org.ID, &org.Name, &org.UserID, &org.CreatedAt); err != nil {
-			return nil, err
+	// In a fixed order, so two transactions can't each wait on the other
+	subjects := make([]string, 0, len(limits))
+	for subject := range limits {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	for _, subject := range subjects {
+		if amount > limits[subject] {
+			return subject, nil
+		}
+		result, err := tx.Exec(s.rebind(`
+			INSERT INTO quota_usage (subject, kind, period, amount)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(subject, kind, period) DO UPDATE SET
+				amount = quota_usage.amount + excluded.amount
+			WHERE quota_usage.amount + excluded.amount <= ?
+		`), subject, kind, period, amount, limits[subject])
+		if err != nil {
+			return "", err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return "", err
+		} else if rows == 0 {
+			return subject, nil
 		}
-		orgs = append(orgs, &org)
 	}
-	return orgs, nil
+	return "", tx.Commit()
 }
 
-// GetOrganizationByID looks up an organization by ID
-func (s *Store) GetOrganizationByID(id string) (*Organization, error) {
-	var org Organization
-	err := s.db.QueryRow(
-		"SELECT id, name, user_id, created_at FROM organizations WHERE id = ?", id,
-	).Scan(&org.ID, &org.Name, &org.UserID, &org.CreatedAt)
+// GetQuotaUsage returns a subject's use of a quota in period
+func (s *sqlStore) GetQuotaUsage(subject, kind, period string) (int64, error) {
+	var amount int64
+	err := s.queryRow(
+		"SELECT amount FROM quota_usage WHERE subject = ? AND kind = ? AND period = ?",
+		subject, kind, period,
+	).Scan(&amount)
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return 0, nil
 	}
+	return amount, err
+}
+
+// PruneQuotaUsage deletes usage for periods before beforePeriod. Periods
+// are UTC dates or date-hours, which sort as strings.
+func (s *sqlStore) PruneQuotaUsage(beforePeriod string) (int64, error) {
+	result, err := s.exec("DELETE FROM quota_usage WHERE period < ?", beforePeriod)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return &org, nil
+	return result.RowsAffected()
 }
 
-// UpdateOrganization renames an organization
-func (s *Store) UpdateOrganization(orgID, name string) error {
-	name = strings.TrimSpace(name)
-	if name == "" {
-		return fmt.Errorf("organization name is required")
-	}
-	if len(name) > 50 {
-		return fmt.Errorf("organization name must be 50 characters or less")
+// --- Abuse Review ---
+
+const abuseFlagColumns = "device_id, reason, url, blocked, flagged_at"
+
+func scanAbuseFlag(row interface{ Scan(...interface{}) error }) (*AbuseFlag, error) {
+	var flag AbuseFlag
+	var url sql.NullString
+	var flaggedAt int64
+	if err := row.Scan(&flag.DeviceID, &flag.Reason, &url, &flag.Blocked, &flaggedAt); err != nil {
+		return nil, err
 	}
+	flag.URL = url.String
+	flag.FlaggedAt = time.Unix(flaggedAt, 0).UTC()
+	return &flag, nil
+}
 
-	result, err := s.db.Exec("UPDATE organizations SET name = ? WHERE id = ?", name, orgID)
+// FlagAbuse flags a device for review, reporting false if it was already
+// flagged. The first flag is kept until it's cleared.
+func (s *sqlStore) FlagAbuse(flag *AbuseFlag) (bool, error) {
+	result, err := s.exec(
+		"INSERT INTO abuse_flags ("+abuseFlagColumns+") VALUES (?, ?, ?, ?, ?) ON CONFLICT(device_id) DO NOTHING",
+		flag.DeviceID, flag.Reason, flag.URL, flag.Blocked, flag.FlaggedAt.Unix(),
+	)
 	if err != nil {
-		return err
+		return false, err
 	}
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return fmt.Errorf("organization not found")
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetAbuseFlag returns a device's abuse flag, or nil if it has none
+func (s *sqlStore) GetAbuseFlag(deviceID string) (*AbuseFlag, error) {
+	flag, err := scanAbuseFlag(s.queryRow("SELECT "+abuseFlagColumns+" FROM abuse_flags WHERE device_id = ?", deviceID))
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-	return nil
+	return flag, err
 }
 
-// DeleteOrganization deletes an organization and unassigns its devices
-func (s *Store) DeleteOrganization(orgID string) error {
-	// First unassign all devices from this org
-	_, err := s.db.Exec("UPDATE devices SET org_id = NULL WHERE org_id = ?", orgID)
+// ListAbuseFlags returns every flagged device, oldest flag first
+func (s *sqlStore) ListAbuseFlags() ([]*AbuseFlag, error) {
+	rows, err := s.query("SELECT " + abuseFlagColumns + " FROM abuse_flags ORDER BY flagged_at")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Then delete the org
-	_, err = s.db.Exec("DELETE FROM organizations WHERE id = ?", orgID)
+	var flags []*AbuseFlag
+	for rows.Next() {
+		flag, err := scanAbuseFlag(rows)
+		if err != nil {
+			return nil, err
+		}
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+// SetAbuseBlocked stops or resumes forwarding for a flagged device
+func (s *sqlStore) SetAbuseBlocked(deviceID string, blocked bool) error {
+	_, err := s.exec("UPDATE abuse_flags SET blocked = ? WHERE device_id = ?", blocked, deviceID)
 	return err
 }
 
-// SetDeviceOrganization sets or clears a device's organization
-func (s *Store) SetDeviceOrganization(deviceID string, orgID *string) error {
-	var err error
-	if orgID == nil || *orgID == "" {
-		_, err = s.db.Exec("UPDATE devices SET org_id = NULL WHERE id = ?", deviceID)
-	} else {
-		_, err = s.db.Exec("UPDATE devices SET org_id = ? WHERE id = ?", *orgID, deviceID)
+// ClearAbuseFlag removes a device's abuse flag, reporting whether it had one
+func (s *sqlStore) ClearAbuseFlag(deviceID string) (bool, error) {
+	result, err := s.exec("DELETE FROM abuse_flags WHERE device_id = ?", deviceID)
+	if err != nil {
+		return false, err
 	}
-	return err
+	n, err := result.RowsAffected()
+	return n > 0, err
 }
 
-// ListDevicesByUserAndOrg returns devices filtered by user and optionally by org
-// If orgID is nil, returns all devices for the user
-// If orgID is empty string, returns devices with no org assigned
-func (s *Store) ListDevicesByUserAndOrg(userID string, orgID *string) ([]*Device, error) {
-	var rows *sql.Rows
-	var err error
+// --- Audit Trail ---
 
-	if orgID == nil {
-		// All devices for user
-		rows, err = s.db.Query(
-			"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id FROM devices WHERE user_id = ? ORDER BY created_at DESC",
-			userID,
-		)
-	} else {
-		// Devices filtered by org (or NULL org if empty string)
-		rows, err = s.db.Query(
-			"SELECT id, subdomain, tier, user_id, created_at, last_seen_at, is_online, tunnel_enabled, org_id FROM devices WHERE user_id = ? AND org_id = ? ORDER BY created_at DESC",
-			userID, *orgID,
-		)
-	}
+// AddAuditEntry records an administrative action
+func (s *sqlStore) AddAuditEntry(userID, action, target, details string) error {
+	_, err := s.exec(
+		"INSERT INTO audit_log (id, user_id, action, target, details) VALUES (?, ?, ?, ?, ?)",
+		generateID(), userID, action, target, details,
+	)
+	return err
+}
+
+// ListAuditEntries returns the most recent audit entries, newest first
+func (s *sqlStore) ListAuditEntries(limit int) ([]*AuditEntry, error) {
+	rows, err := s.query(
+		"SELECT id, user_id, action, target, details, created_at FROM audit_log ORDER BY created_at DESC LIMIT ?",
+		limit,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var devices []*Device
+	var entries []*AuditEntry
 	for rows.Next() {
-		var device Device
-		var lastSeen sql.NullTime
-		var tier sql.NullString
-		var uid sql.NullString
-		var oid sql.NullString
-		if err := rows.Scan(&device.ID, &device.Subdomain, &tier, &uid, &device.CreatedAt, &lastSeen, &device.IsOnline, &device.TunnelEnabled, &oid); err != nil {
+		var entry AuditEntry
+		var target, details sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &target, &details, &entry.CreatedAt); err != nil {
 			return nil, err
 		}
-		if lastSeen.Valid {
-			device.LastSeenAt = lastSeen.Time
-		}
-		device.Tier = "free"
-		if tier.Valid {
-			device.Tier = tier.String
-		}
-		if uid.Valid {
-			device.UserID = uid.String
-		}
-		if oid.Valid {
-			device.OrgID = oid.String
+		entry.Target = target.String
+		entry.Details = details.String
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// ClaimMaintenanceRun records that a job ran for a period. It returns false
+// if the job already ran for that period, so callers can skip it.
+func (s *sqlStore) ClaimMaintenanceRun(job, period string) (bool, error) {
+	_, err := s.exec("INSERT INTO maintenance_runs (job, period) VALUES (?, ?)", job, period)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return false, nil
 		}
-		devices = append(devices, &device)
+		return false, err
 	}
-	return devices, nil
+	return true, nil
+}
+
+// Ping checks that the database answers a trivial query
+func (s *sqlStore) Ping() error {
+	var n int
+	return s.queryRow("SELECT 1").Scan(&n)
 }
 
 // Close closes the database connection
-func (s *Store) Close() error {
+func (s *sqlStore) Close() error {
+	if s.writer != s.db {
+		s.writer.Close()
+	}
 	return s.db.Close()
 }
 
+// --- Query helpers ---
+
+// rebind converts "?" placeholders to the driver's native style. A "?"
+// inside a quoted string or identifier is left alone; a doubled quote
+// within one just closes and reopens it, which comes to the same thing.
+func (s *sqlStore) rebind(query string) string {
+	if !s.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	var quote rune // The quote we're inside, if any
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.writer.Exec(s.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+// isUniqueViolation reports whether err is a unique or primary key
+// constraint failure, going by the driver's error code rather than its
+// message
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code()
+		return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" // unique_violation
+	}
+	return false
+}
+
 // --- Helpers ---
 
 func generateID() string {
@@ -739,31 +2417,22 @@ func generateToken() string {
 	return "pp_" + hex.EncodeToString(b)
 }
 
-func hashToken(token string) string {
-	return token
+func generateWebhookSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
 }
 
-func validateSubdomain(s string) error {
-	if len(s) < 3 || len(s) > 30 {
-		return fmt.Errorf("subdomain must be 3-30 characters")
-	}
-
-	for i, c := range s {
-		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || (c == '-' && i > 0 && i < len(s)-1)) {
-			return fmt.Errorf("subdomain must be lowercase alphanumeric with hyphens (no leading/trailing hyphens)")
-		}
-	}
-
-	reserved := map[string]bool{
-		"www": true, "api": true, "app": true, "admin": true,
-		"mail": true, "ftp": true, "ssh": true, "tunnel": true,
-		"dev": true, "staging": true, "test": true,
-	}
-	if reserved[s] {
-		return fmt.Errorf("'%s' is a reserved subdomain", s)
+// nullString stores empty strings as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
 	}
+	return s
+}
 
-	return nil
+func hashToken(token string) string {
+	return token
 }
 
 // FormatBytes returns a human-readable byte size
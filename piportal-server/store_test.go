@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a migrated SQLite store in a temporary directory, with
+// the same settings the server uses by default
+func newTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "piportal.db"), DefaultStoreOptions())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// Batches created at once for one user can't get past their device limit
+// together, as they could if each counted before any was created
+func TestCreateDevicesLimitConcurrent(t *testing.T) {
+	store := newTestStore(t)
+	user, err := store.CreateUser("limit@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	const (
+		workers = 64
+		limit   = 5
+	)
+
+	// Released together, so the transactions overlap
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	errs := make(chan error, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			batch := []NewDevice{{Subdomain: fmt.Sprintf("limit-%d", i)}}
+			_, err := store.CreateDevices(user.ID, "", batch, DeviceLimits{Total: limit})
+			var limitErr *DeviceLimitError
+			switch {
+			case err == nil:
+				created.Add(1)
+			case !errors.As(err, &limitErr):
+				errs <- err
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("CreateDevices: %v", err)
+	}
+
+	devices, err := store.ListDevicesByUser(user.ID)
+	if err != nil {
+		t.Fatalf("ListDevicesByUser: %v", err)
+	}
+	if created.Load() != limit || len(devices) != limit {
+		t.Errorf("created %d devices (%d stored), want %d", created.Load(), len(devices), limit)
+	}
+}
+
+// Claiming checks the limit in the same transaction as the claim, so claims
+// sent at once can't get past it together either
+func TestAssignDeviceToUserLimit(t *testing.T) {
+	store := newTestStore(t)
+	user, err := store.CreateUser("claims@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	const workers = 16
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	var claimed atomic.Int32
+	errs := make(chan error, workers)
+	for i := range workers {
+		device, err := store.CreateDevice(fmt.Sprintf("claim-%d", i), "")
+		if err != nil {
+			t.Fatalf("create device: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			err := store.AssignDeviceToUser(device.ID, user.ID, DeviceLimits{Free: 1})
+			var limitErr *DeviceLimitError
+			switch {
+			case err == nil:
+				claimed.Add(1)
+			case !errors.As(err, &limitErr):
+				errs <- err
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("AssignDeviceToUser: %v", err)
+	}
+	if claimed.Load() != 1 {
+		t.Errorf("claimed %d devices, want 1", claimed.Load())
+	}
+}
+
+func TestAddBandwidthConcurrent(t *testing.T) {
+	store := newTestStore(t)
+	device, err := store.CreateDevice("concurrent", "")
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+
+	const (
+		workers = 32
+		adds    = 25
+		in      = 100
+		out     = 1000
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*adds)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range adds {
+				if err := store.AddBandwidth(device.ID, in, out); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("AddBandwidth: %v", err)
+	}
+
+	usage, err := store.GetMonthlyUsage(device.ID)
+	if err != nil {
+		t.Fatalf("GetMonthlyUsage: %v", err)
+	}
+	if want := int64(workers * adds * in); usage.BytesIn != want {
+		t.Errorf("BytesIn = %d, want %d", usage.BytesIn, want)
+	}
+	if want := int64(workers * adds * out); usage.BytesOut != want {
+		t.Errorf("BytesOut = %d, want %d", usage.BytesOut, want)
+	}
+}
+
+// A pending claim doesn't reserve a hostname; the first device to verify it
+// does, and unverified claims expire
+func TestCustomDomainClaims(t *testing.T) {
+	store := newTestStore(t)
+	owner, err := store.CreateDevice("owner", "")
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	squatter, err := store.CreateDevice("squatter", "")
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+
+	if _, err := store.AddCustomDomain(squatter.ID, "app.example.com"); err != nil {
+		t.Fatalf("squatter claim: %v", err)
+	}
+	if _, err := store.AddCustomDomain(owner.ID, "app.example.com"); err != nil {
+		t.Fatalf("owner claim after a pending one: %v", err)
+	}
+	if _, err := store.AddCustomDomain(owner.ID, "app.example.com"); err == nil {
+		t.Error("claiming the same hostname twice on one device succeeded")
+	}
+	if domain, err := store.GetCustomDomain("app.example.com"); err != nil || domain != nil {
+		t.Errorf("GetCustomDomain before verification = %v, %v; want nil", domain, err)
+	}
+
+	if err := store.MarkCustomDomainVerified(owner.ID, "app.example.com"); err != nil {
+		t.Fatalf("verify owner: %v", err)
+	}
+	if err := store.MarkCustomDomainVerified(squatter.ID, "app.example.com"); !errors.Is(err, ErrDomainInUse) {
+		t.Errorf("second verification err = %v, want ErrDomainInUse", err)
+	}
+	domain, err := store.GetCustomDomain("app.example.com")
+	if err != nil || domain == nil || domain.DeviceID != owner.ID {
+		t.Fatalf("GetCustomDomain = %+v, %v; want owner's verified domain", domain, err)
+	}
+	other, err := store.CreateDevice("other", "")
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	if _, err := store.AddCustomDomain(other.ID, "app.example.com"); !errors.Is(err, ErrDomainInUse) {
+		t.Errorf("claiming a verified hostname err = %v, want ErrDomainInUse", err)
+	}
+
+	if pruned, err := store.PruneCustomDomainClaims(time.Now().Add(-time.Hour)); err != nil || pruned != 0 {
+		t.Errorf("pruning claims older than an hour = %d, %v; want none", pruned, err)
+	}
+	pruned, err := store.PruneCustomDomainClaims(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("PruneCustomDomainClaims: %v", err)
+	}
+	if pruned != 1 {
+		t.Errorf("pruned %d claims, want only the squatter's pending one", pruned)
+	}
+	if domain, _ := store.GetDeviceCustomDomain(owner.ID, "app.example.com"); domain == nil {
+		t.Error("pruning removed a verified domain")
+	}
+}
+
+// Exec commands sent at once can't all take the last of a quota, and a
+// refused charge leaves every counter as it was
+func TestTakeQuota(t *testing.T) {
+	store := newTestStore(t)
+	limits := map[string]int64{"device:a": 5, "user:u": 100}
+
+	const workers = 32
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	var taken atomic.Int32
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			refused, err := store.TakeQuota(quotaExec, "2026-01-01T00", 1, limits)
+			if err != nil {
+				t.Errorf("TakeQuota: %v", err)
+			} else if refused == "" {
+				taken.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if taken.Load() != 5 {
+		t.Errorf("took %d, want 5", taken.Load())
+	}
+
+	refused, err := store.TakeQuota(quotaExec, "2026-01-01T00", 1, map[string]int64{"device:b": 5, "user:u": 5})
+	if err != nil || refused != "user:u" {
+		t.Fatalf("TakeQuota = %q, %v; want refused by user:u", refused, err)
+	}
+	if used, _ := store.GetQuotaUsage("device:b", quotaExec, "2026-01-01T00"); used != 0 {
+		t.Errorf("device:b charged %d for a refused command", used)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	s := &sqlStore{numbered: true}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT id FROM devices WHERE id = ? AND tier = ?", "SELECT id FROM devices WHERE id = $1 AND tier = $2"},
+		{"UPDATE notes SET body = 'why?' WHERE id = ?", "UPDATE notes SET body = 'why?' WHERE id = $1"},
+		{"SELECT 'it''s ?' , ?", "SELECT 'it''s ?' , $1"},
+		{`SELECT "odd?column" FROM t WHERE x = ?`, `SELECT "odd?column" FROM t WHERE x = $1`},
+	}
+	for _, tt := range tests {
+		if got := s.rebind(tt.query); got != tt.want {
+			t.Errorf("rebind(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// Unique violations are told apart by the driver's code, so other
+// constraint failures aren't mistaken for them
+func TestIsUniqueViolation(t *testing.T) {
+	store := newTestStore(t)
+	device, err := store.CreateDevice("taken", "")
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+
+	_, err = store.exec("INSERT INTO devices (id, token_hash, subdomain, tier) VALUES (?, ?, ?, 'free')", generateID(), "hash", device.Subdomain)
+	if err == nil || !isUniqueViolation(err) {
+		t.Errorf("duplicate subdomain: isUniqueViolation(%v) = false", err)
+	}
+	_, err = store.exec("INSERT INTO devices (id, token_hash, subdomain, tier) VALUES (?, NULL, NULL, 'free')", generateID())
+	if err == nil || isUniqueViolation(err) {
+		t.Errorf("NOT NULL failure: isUniqueViolation(%v) = true", err)
+	}
+	if isUniqueViolation(errors.New("unique")) {
+		t.Error("a message mentioning unique counted as a violation")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// subdomainCheckRate lets a setup wizard or form check names as they're
+// typed, but makes listing every taken subdomain slow
+var subdomainCheckRate = RateLimit{RequestsPerSecond: 1, Burst: 20, PerIP: true}
+
+// handleSubdomainAvailable reports whether a subdomain could be registered,
+// applying the same policy as device creation without creating anything.
+// Path: GET /api/subdomain/available?name=
+func (h *Handler) handleSubdomainAvailable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ok, wait := h.subdomainChecks.Allow(clientIP(r, h.config.BehindProxy)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		jsonError(w, ErrCodeRateLimited, "Too many checks, try again shortly", http.StatusTooManyRequests)
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("name")))
+	if name == "" {
+		jsonError(w, ErrCodeInvalidRequest, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	reason, code := "", ""
+	if err := h.subdomains.Check(name); err != nil {
+		reason, code = err.Error(), ErrCodeSubdomainInvalid
+	} else {
+		device, err := h.store.GetDeviceBySubdomain(name)
+		if err != nil {
+			slog.Error("subdomain availability lookup failed", "subdomain", name, "error", err)
+			jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if device != nil {
+			reason, code = "subdomain '"+name+"' is "+ErrSubdomainTaken.Error(), ErrCodeSubdomainTaken
+		}
+	}
+
+	resp := map[string]interface{}{
+		"name":      name,
+		"available": reason == "",
+	}
+	if reason != "" {
+		resp["reason"] = reason
+		resp["code"] = code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// SubdomainPolicy holds the operator's rules for which structurally valid
+// subdomains may be registered
+type SubdomainPolicy struct {
+	reserved map[string]bool
+	pattern  *regexp.Regexp // Also reserved; nil if not configured
+	denied   []string       // Names containing any of these are blocked
+}
+
+// NewSubdomainPolicy builds the policy from the config, reading the
+// denylist file if one is set
+func NewSubdomainPolicy(c *Config) (*SubdomainPolicy, error) {
+	p := &SubdomainPolicy{reserved: make(map[string]bool)}
+	for _, name := range strings.Split(c.ReservedSubdomains, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			p.reserved[name] = true
+		}
+	}
+
+	if c.ReservedSubdomainPattern != "" {
+		pattern, err := regexp.Compile(c.ReservedSubdomainPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved subdomain pattern: %w", err)
+		}
+		p.pattern = pattern
+	}
+
+	if c.SubdomainDenylist != "" {
+		data, err := os.ReadFile(c.SubdomainDenylist)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read subdomain denylist: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.ToLower(strings.TrimSpace(line))
+			if line != "" && !strings.HasPrefix(line, "#") {
+				p.denied = append(p.denied, line)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// Check returns why a lowercased subdomain can't be registered, or nil.
+// Existing devices keep their names when the rules change.
+func (p *SubdomainPolicy) Check(s string) error {
+	if err := validateSubdomain(s); err != nil {
+		return err
+	}
+	if p.reserved[s] || (p.pattern != nil && p.pattern.MatchString(s)) {
+		return fmt.Errorf("'%s' is a reserved subdomain", s)
+	}
+	for _, term := range p.denied {
+		if strings.Contains(s, term) {
+			return fmt.Errorf("subdomain '%s' is not allowed", s)
+		}
+	}
+	return nil
+}
+
+// validateSubdomain checks a (lowercased) subdomain is a usable DNS label:
+// 3-30 lowercase letters, digits and hyphens, with no hyphen at either end
+// or two in a row (those are reserved for punycode, e.g. "xn--"). The client
+// mirrors it exactly; reserved and blocked names are the SubdomainPolicy's job.
+func validateSubdomain(s string) error {
+	if s == "" {
+		return fmt.Errorf("subdomain is required")
+	}
+	if len(s) < 3 || len(s) > 30 {
+		return fmt.Errorf("subdomain must be 3-30 characters")
+	}
+	for _, c := range s {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+			return fmt.Errorf("subdomain must be lowercase letters, digits and hyphens")
+		}
+	}
+	if s[0] == '-' || s[len(s)-1] == '-' || strings.Contains(s, "--") {
+		return fmt.Errorf("subdomain can't start or end with a hyphen, or have two in a row")
+	}
+	return nil
+}
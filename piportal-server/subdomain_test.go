@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Names the operator reserves or blocks can't be had through any of the
+// ways a device gets its subdomain
+func TestReservedSubdomainsOnEveryRegisterPath(t *testing.T) {
+	denylist := filepath.Join(t.TempDir(), "denylist.txt")
+	if err := os.WriteFile(denylist, []byte("# blocked terms\nbadword\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each path registers name with the user's token, returning the status and error code
+	paths := []struct {
+		name     string
+		register func(t *testing.T, url, token, name string) (int, string)
+	}{
+		{"client register", func(t *testing.T, url, token, name string) (int, string) {
+			return postJSON(t, url+"/api/register", "", map[string]string{"subdomain": name})
+		}},
+		{"dashboard create", func(t *testing.T, url, token, name string) (int, string) {
+			return postJSON(t, url+"/api/v1/devices", token, map[string]string{"subdomain": name})
+		}},
+		{"dashboard bulk create", func(t *testing.T, url, token, name string) (int, string) {
+			return postJSON(t, url+"/api/v1/devices/bulk", token,
+				map[string]interface{}{"devices": []map[string]string{{"subdomain": name}}})
+		}},
+	}
+
+	names := []struct {
+		name    string
+		allowed bool
+	}{
+		{"acme", false},       // In the list
+		{"support", false},    // In the list, given in capitals
+		{"staff-bob", false},  // Matches the pattern
+		{"my-badword", false}, // Contains a denied term
+		{"www", true},         // Only reserved by default, which the list replaces
+	}
+
+	for _, path := range paths {
+		t.Run(path.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, "-dev", "-domain", "piportal.test",
+				"-reserved-subdomains", "acme, Support",
+				"-reserved-subdomain-pattern", "^staff-",
+				"-subdomain-denylist", denylist)
+			server, handler, _ := startTestServer(t, cfg)
+			_, token := newTestUser(t, handler, "owner@example.com")
+
+			for _, n := range names {
+				status, code := path.register(t, server.URL, token, n.name)
+				switch {
+				case n.allowed && status/100 != 2:
+					t.Errorf("%s: status %d (%s), want it registered", n.name, status, code)
+				case !n.allowed && (status != http.StatusBadRequest || code != ErrCodeSubdomainInvalid):
+					t.Errorf("%s: status %d (%s), want 400 %s", n.name, status, code, ErrCodeSubdomainInvalid)
+				}
+			}
+		})
+	}
+}
+
+// The client has the same cases in piportal-client/cmd/subdomain_test.go
+func TestValidateSubdomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string // "" if it's valid
+	}{
+		{"mypi", ""},
+		{"pi-42", ""},
+		{"a1b", ""},
+		{strings.Repeat("a", 30), ""},
+		{"", "required"},
+		{"ab", "3-30 characters"},
+		{strings.Repeat("a", 31), "3-30 characters"},
+		{"MyPi", "lowercase"},
+		{"my_pi", "lowercase"},
+		{"my.pi", "lowercase"},
+		{"café", "lowercase"},
+		{"-mypi", "hyphen"},
+		{"mypi-", "hyphen"},
+		{"xn--mypi", "hyphen"},
+	}
+
+	for _, tt := range tests {
+		err := validateSubdomain(tt.name)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("validateSubdomain(%q) = %v, want no error", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("validateSubdomain(%q) = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// postJSON posts body as JSON, with a bearer token if one's given, and
+// returns the status and the error code, if any. A bulk create reports
+// the first problem's code.
+func postJSON(t *testing.T, url, token string, body interface{}) (int, string) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url, strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error    APIError            `json:"error"`
+		Problems []bulkDeviceProblem `json:"problems"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if len(result.Problems) > 0 {
+		return resp.StatusCode, result.Problems[0].Code
+	}
+	return resp.StatusCode, result.Error.Code
+}
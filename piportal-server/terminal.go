@@ -4,9 +4,14 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -16,7 +21,7 @@ func (h *Handler) handleTerminalWebSocket(w http.ResponseWriter, r *http.Request
 	// Extract device ID from path: /api/v1/devices/{id}/terminal
 	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/devices/"), "/")
 	if len(parts) < 2 {
-		jsonError(w, "Invalid path", http.StatusBadRequest)
+		jsonError(w, ErrCodeInvalidRequest, "Invalid path", http.StatusBadRequest)
 		return
 	}
 	deviceID := parts[0]
@@ -36,22 +41,16 @@ func (h *Handler) handleTerminalWebSocket(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	userID, err := ValidateJWT(tokenStr, h.config.JWTSecret)
+	user, _, err := h.userFromToken(tokenStr)
 	if err != nil {
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
-		return
-	}
-
-	user, err := h.store.GetUserByID(userID)
-	if err != nil || user == nil {
-		http.Error(w, "User not found", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
 	// Validate device ownership
 	device, err := h.store.GetDeviceByID(deviceID)
 	if err != nil {
-		log.Printf("Terminal: device lookup error: %v", err)
+		slog.Error("terminal device lookup failed", "device_id", deviceID, "error", err)
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
@@ -68,57 +67,160 @@ func (h *Handler) handleTerminalWebSocket(w http.ResponseWriter, r *http.Request
 	}
 
 	// Upgrade to WebSocket
-	browserConn, err := upgrader.Upgrade(w, r, nil)
+	terminalUpgrader := upgrader
+	terminalUpgrader.CheckOrigin = h.sameOriginOrAllowed
+	browserConn, err := terminalUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Terminal: WebSocket upgrade failed: %v", err)
+		tunnel.logger.Warn("terminal websocket upgrade failed", "error", err)
+		return
+	}
+
+	// Refuse over the socket rather than before the upgrade, which browsers
+	// only report as a failed connection
+	if message, _, usedUp := h.quotaUsedUp(device, quotaTerminal); usedUp {
+		tunnel.logger.Info("terminal session rejected", "reason", "quota used up")
+		browserConn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, message))
+		browserConn.Close()
 		return
 	}
+	defer browserConn.Close()
+
+	// A browser that lost its connection picks its session back up, if it
+	// hasn't outlived the reattach grace
+	if sessionID := r.URL.Query().Get("session"); sessionID != "" {
+		if session := tunnel.ReattachTerminalSession(sessionID, browserConn, user.Email); session != nil {
+			h.reattachTerminal(tunnel, session)
+			return
+		}
+	}
 
 	// Generate session ID
 	sessionID := generateSessionID()
-	log.Printf("Terminal session %s: opened for device %s by user %s", sessionID, device.Subdomain, user.Email)
+	logger := tunnel.logger.With("session_id", sessionID)
+	logger.Info("terminal session opened", "user", user.Email)
 
 	// Register browser connection with tunnel
-	tunnel.RegisterTerminalSession(sessionID, browserConn)
+	session, err := tunnel.RegisterTerminalSession(sessionID, browserConn, user.Email)
+	if err != nil {
+		logger.Warn("terminal session rejected", "error", err)
+		reason := "device is disconnecting"
+		switch {
+		case errors.Is(err, ErrTooManyTerminals):
+			reason = fmt.Sprintf("too many terminal sessions on this device (max %d)", h.config.MaxTerminalSessions)
+		case errors.Is(err, ErrTooManyUserTerminals):
+			reason = fmt.Sprintf("you have too many terminal sessions on this device (max %d)", h.config.MaxUserTerminalSessions)
+		}
+		browserConn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason))
+		return
+	}
+
+	// Tell the browser which session it has, so it can ask for it back
+	session.send(terminalSessionMessage(sessionID))
 
 	// Read initial size from browser (first message)
-	rows, cols := 24, 80 // defaults
-	_, initMsg, err := browserConn.ReadMessage()
-	if err == nil {
-		var init struct {
-			Rows int `json:"rows"`
-			Cols int `json:"cols"`
-		}
-		if json.Unmarshal(initMsg, &init) == nil && init.Rows > 0 && init.Cols > 0 {
-			rows = init.Rows
-			cols = init.Cols
+	rows, cols := readTerminalSize(browserConn)
+
+	// Record the session if the owner opted in
+	var recorder *TerminalRecorder
+	if settings, err := h.store.GetRecordingSettings(device.ID); err != nil {
+		logger.Error("loading recording settings failed", "error", err)
+	} else if settings != nil && settings.Enabled {
+		recorder, err = NewTerminalRecorder(h.config.RecordingsDir, device.ID, sessionID, cols, rows, settings.Keystrokes)
+		if err != nil {
+			logger.Error("starting terminal recording failed", "error", err)
+		} else {
+			tunnel.SetTerminalRecorder(sessionID, recorder)
 		}
 	}
 
 	// Send terminal_open to Pi client
 	openMsg := NewTerminalOpenMessage(sessionID, rows, cols)
 	if err := tunnel.SendJSON(openMsg); err != nil {
-		log.Printf("Terminal session %s: failed to send open to client: %v", sessionID, err)
+		logger.Warn("sending terminal open to client failed", "error", err)
 		tunnel.UnregisterTerminalSession(sessionID)
-		browserConn.Close()
+		if recorder != nil {
+			recorder.Close()
+		}
 		return
 	}
 
-	// Bridge: read from browser WS, forward to tunnel as terminal_data
-	defer func() {
+	stopMeter := h.meterTerminal(tunnel, device, sessionID, logger)
+
+	// Ends the session for good, whichever browser connection it's on by then
+	session.end = sync.OnceFunc(func() {
+		stopMeter()
 		tunnel.UnregisterTerminalSession(sessionID)
 		// Tell client to close the session
 		tunnel.SendJSON(NewTerminalCloseMessage(sessionID))
-		browserConn.Close()
-		log.Printf("Terminal session %s: closed", sessionID)
-	}()
+		if recorder != nil {
+			recorder.Close()
+		}
+		logger.Info("terminal session closed")
+	})
+
+	h.bridgeTerminal(tunnel, session, recorder, logger)
+}
+
+// reattachTerminal bridges a new browser connection to a detached session.
+// The client resizes the shell and replays its scrollback when it sees the
+// session opened again.
+func (h *Handler) reattachTerminal(tunnel *Tunnel, session *terminalSession) {
+	logger := tunnel.logger.With("session_id", session.id)
+	logger.Info("terminal session reattached", "user", session.user)
+
+	session.send(terminalSessionMessage(session.id))
+	rows, cols := readTerminalSize(session.conn)
+	recorder := tunnel.TerminalRecorder(session.id)
+	if recorder != nil {
+		recorder.Resize(cols, rows)
+	}
+	if err := tunnel.SendJSON(NewTerminalOpenMessage(session.id, rows, cols)); err != nil {
+		logger.Warn("sending terminal open to client failed", "error", err)
+		session.end()
+		return
+	}
 
+	h.bridgeTerminal(tunnel, session, recorder, logger)
+}
+
+// bridgeTerminal forwards browser input to the client until the browser
+// goes. A browser that closed deliberately, or sat idle, ends the session;
+// one that dropped off is given the reattach grace to come back.
+func (h *Handler) bridgeTerminal(tunnel *Tunnel, session *terminalSession, recorder *TerminalRecorder, logger *slog.Logger) {
+	browserConn := session.conn
+	sessionID := session.id
+	idleTimeout := h.config.TerminalIdleTimeout
 	for {
+		// Any browser input (keystrokes, resizes) keeps the session alive
+		if idleTimeout > 0 {
+			browserConn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
 		msgType, data, err := browserConn.ReadMessage()
 		if err != nil {
-			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				log.Printf("Terminal session %s: browser read error: %v", sessionID, err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				logger.Info("terminal session idle, closing", "idle", idleTimeout)
+				browserConn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"),
+					time.Now().Add(time.Second))
+				session.end()
+				return
+			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+				session.end()
+				return
 			}
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				logger.Warn("terminal browser read error", "error", err)
+			}
+			grace := h.config.TerminalReattachGrace
+			if tunnel.DetachTerminalSession(session, grace) {
+				logger.Info("terminal browser disconnected, keeping session for reattach", "grace", grace)
+				return
+			}
+			session.end()
 			return
 		}
 
@@ -133,6 +235,9 @@ func (h *Handler) handleTerminalWebSocket(w http.ResponseWriter, r *http.Request
 				}
 				if json.Unmarshal(data, &resize) == nil {
 					tunnel.SendJSON(NewTerminalResizeMessage(sessionID, resize.Rows, resize.Cols))
+					if recorder != nil {
+						recorder.Resize(resize.Cols, resize.Rows)
+					}
 				}
 				continue
 			}
@@ -144,11 +249,40 @@ func (h *Handler) handleTerminalWebSocket(w http.ResponseWriter, r *http.Request
 			}
 			if json.Unmarshal(data, &inputMsg) == nil && inputMsg.Data != "" {
 				tunnel.SendJSON(NewTerminalDataMessage(sessionID, []byte(inputMsg.Data)))
+				if recorder != nil {
+					recorder.Input([]byte(inputMsg.Data))
+				}
 			}
 		}
 	}
 }
 
+// readTerminalSize reads the browser's first message, its terminal size
+func readTerminalSize(conn *websocket.Conn) (rows, cols int) {
+	rows, cols = 24, 80 // defaults
+	_, initMsg, err := conn.ReadMessage()
+	if err == nil {
+		var init struct {
+			Rows int `json:"rows"`
+			Cols int `json:"cols"`
+		}
+		if json.Unmarshal(initMsg, &init) == nil && init.Rows > 0 && init.Cols > 0 {
+			rows = init.Rows
+			cols = init.Cols
+		}
+	}
+	return rows, cols
+}
+
+// terminalSessionMessage tells the browser its session ID
+func terminalSessionMessage(sessionID string) []byte {
+	msg, _ := json.Marshal(struct {
+		Type      string `json:"type"`
+		SessionID string `json:"session_id"`
+	}{"terminal_session", sessionID})
+	return msg
+}
+
 func generateSessionID() string {
 	b := make([]byte, 8)
 	rand.Read(b)
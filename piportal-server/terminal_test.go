@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// terminalMessage is any terminal message, seen from either end
+type terminalMessage struct {
+	Type       string `json:"type"`
+	SessionID  string `json:"session_id"`
+	DataBase64 string `json:"data_base64"`
+}
+
+// terminalOwner makes the test device belong to a user, returning a token
+// for them
+func (tt *testTunnel) terminalOwner(t *testing.T) string {
+	t.Helper()
+	user, token := newTestUser(t, tt.handler, "owner@example.com")
+	if err := tt.store.AssignDeviceToUser(tt.device.ID, user.ID, DeviceLimits{}); err != nil {
+		t.Fatalf("assign device: %v", err)
+	}
+	return token
+}
+
+// openTerminal connects a browser to the device's terminal, asking for
+// session back if it's set, and returns the session it was given
+func (tt *testTunnel) openTerminal(t *testing.T, token, session string) (*websocket.Conn, string) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(tt.server.URL, "http") + "/api/v1/devices/" + tt.device.ID + "/terminal"
+	if session != "" {
+		url += "?session=" + session
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("dial terminal: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	msg := readTerminalMessage(t, conn)
+	if msg.Type != "terminal_session" || msg.SessionID == "" {
+		t.Fatalf("first message = %+v, want the session ID", msg)
+	}
+	if err := conn.WriteJSON(map[string]int{"rows": 24, "cols": 80}); err != nil {
+		t.Fatalf("send size: %v", err)
+	}
+	return conn, msg.SessionID
+}
+
+func readTerminalMessage(t *testing.T, conn *websocket.Conn) terminalMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg terminalMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("browser read: %v", err)
+	}
+	return msg
+}
+
+// expectAtDevice waits for the device to get a terminal message of msgType
+// for session. Unless that's what's expected, the session being closed
+// fails the test.
+func (tt *testTunnel) expectAtDevice(t *testing.T, msgType, session string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case data := <-tt.received:
+			var msg terminalMessage
+			if json.Unmarshal(data, &msg) != nil || msg.SessionID != session {
+				continue
+			}
+			if msg.Type == msgType {
+				return
+			}
+			if msg.Type == MessageTypeTerminalClose {
+				t.Fatalf("device got terminal_close while waiting for %s", msgType)
+			}
+		case <-timeout:
+			t.Fatalf("device never got %s", msgType)
+		}
+	}
+}
+
+// Another site can't open a terminal with the user's credentials
+func TestTerminalCrossOrigin(t *testing.T) {
+	tt := startTestTunnel(t, testConfig(t), nil)
+	token := tt.terminalOwner(t)
+
+	url := "ws" + strings.TrimPrefix(tt.server.URL, "http") + "/api/v1/devices/" + tt.device.ID + "/terminal"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Authorization": {"Bearer " + token},
+		"Origin":        {"https://evil.example"},
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatal("terminal opened from another origin")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("response = %v, want 403", resp)
+	}
+}
+
+func TestTerminalReattach(t *testing.T) {
+	tt := startTestTunnel(t, testConfig(t), nil)
+	token := tt.terminalOwner(t)
+
+	browser, session := tt.openTerminal(t, token, "")
+	tt.expectAtDevice(t, MessageTypeTerminalOpen, session)
+	tt.send(NewTerminalDataMessage(session, []byte("$ ls\r\nnotes.txt\r\n")))
+	if msg := readTerminalMessage(t, browser); msg.Type != MessageTypeTerminalData {
+		t.Fatalf("browser got %+v, want output", msg)
+	}
+
+	// The connection drops without a close handshake
+	browser.UnderlyingConn().Close()
+	tunnel := tt.handler.tunnels.GetTunnel(tt.device.Subdomain)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if sessions := tunnel.ListTerminalSessions(); len(sessions) == 1 && sessions[0].Detached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session never detached: %+v", tunnel.ListTerminalSessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The shell is still there for the browser that comes back, and the
+	// client replays its scrollback when it's opened again
+	browser, reattached := tt.openTerminal(t, token, session)
+	if reattached != session {
+		t.Fatalf("reattached to %s, want %s", reattached, session)
+	}
+	tt.expectAtDevice(t, MessageTypeTerminalOpen, session)
+	tt.send(NewTerminalDataMessage(session, []byte("$ ls\r\nnotes.txt\r\n")))
+	msg := readTerminalMessage(t, browser)
+	replay, _ := base64.StdEncoding.DecodeString(msg.DataBase64)
+	if msg.Type != MessageTypeTerminalData || !strings.Contains(string(replay), "notes.txt") {
+		t.Fatalf("browser got %+v, want the replayed scrollback", msg)
+	}
+
+	// Closing on purpose ends it straight away
+	browser.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	tt.expectAtDevice(t, MessageTypeTerminalClose, session)
+}
+
+func TestTerminalReattachGraceExpires(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TerminalReattachGrace = 50 * time.Millisecond
+	tt := startTestTunnel(t, cfg, nil)
+	token := tt.terminalOwner(t)
+
+	browser, session := tt.openTerminal(t, token, "")
+	tt.expectAtDevice(t, MessageTypeTerminalOpen, session)
+	browser.UnderlyingConn().Close()
+	tt.expectAtDevice(t, MessageTypeTerminalClose, session)
+
+	// Too late to have it back, so the browser gets a new one
+	if _, fresh := tt.openTerminal(t, token, session); fresh == session {
+		t.Fatalf("reattached to %s after the grace ran out", session)
+	}
+}
+
+// Draining a tunnel doesn't wait on terminals, which can stay open for
+// hours: they're closed straight away and the browser is told why
+func TestDrainClosesTerminalSessions(t *testing.T) {
+	tt := startTestTunnel(t, testConfig(t), nil)
+	token := tt.terminalOwner(t)
+	browser, session := tt.openTerminal(t, token, "")
+	tt.expectAtDevice(t, MessageTypeTerminalOpen, session)
+
+	drained := make(chan bool, 1)
+	go func() { drained <- tt.handler.tunnels.GetTunnel(tt.device.Subdomain).Drain(5 * time.Second) }()
+
+	browser.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := browser.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) || !strings.Contains(err.Error(), "device is disconnecting") {
+		t.Fatalf("browser read: %v, want a normal close saying why", err)
+	}
+	tt.expectAtDevice(t, MessageTypeTerminalClose, session)
+	select {
+	case finished := <-drained:
+		if !finished {
+			t.Error("drain timed out")
+		}
+	case <-time.After(time.Second):
+		t.Error("drain waited on the terminal")
+	}
+}
+
+// One user can't take every terminal on a device others share
+func TestTerminalLimitPerUser(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxTerminalSessions = 3
+	cfg.MaxUserTerminalSessions = 2
+	tt := startTestTunnel(t, cfg, nil)
+	tunnel := tt.handler.tunnels.GetTunnel(tt.device.Subdomain)
+
+	for i := range 2 {
+		if _, err := tunnel.RegisterTerminalSession(fmt.Sprintf("term_alice_%d", i), nil, "alice"); err != nil {
+			t.Fatalf("alice's session %d: %v", i, err)
+		}
+	}
+	if _, err := tunnel.RegisterTerminalSession("term_alice_2", nil, "alice"); !errors.Is(err, ErrTooManyUserTerminals) {
+		t.Errorf("alice's third session: %v, want the per-user limit", err)
+	}
+	if _, err := tunnel.RegisterTerminalSession("term_bob_0", nil, "bob"); err != nil {
+		t.Fatalf("bob's session: %v", err)
+	}
+	if _, err := tunnel.RegisterTerminalSession("term_carol_0", nil, "carol"); !errors.Is(err, ErrTooManyTerminals) {
+		t.Errorf("fourth session: %v, want the device limit", err)
+	}
+}
+
+// A character split across output chunks is recorded whole, not as two
+// replacement characters
+func TestRecorderSplitUTF8(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewTerminalRecorder(dir, "dev", "term_1", 80, 24, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Output([]byte("caf\xc3"))
+	recorder.Output([]byte("\xa9 \xe2\x9c"))
+	recorder.Output([]byte("\x93"))
+	recorder.Output([]byte("bye \xf0\x9f"))
+	recorder.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, "dev", "term_1.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("event %q: %v", line, err)
+		}
+		output.WriteString(event[2].(string))
+	}
+	// The bytes still cut off when the session ended can't be saved as text
+	if got, want := output.String(), "café ✓bye \uFFFD\uFFFD"; got != want {
+		t.Errorf("recorded %q, want %q", got, want)
+	}
+}
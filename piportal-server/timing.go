@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Timing headers, added to tunnel responses for devices with timing
+// headers turned on. Upstream is what the local service took, as the client
+// measured it; tunnel is the rest of the round trip from the server.
+const (
+	UpstreamTimeHeader = "X-PiPortal-Upstream-Time"
+	TunnelTimeHeader   = "X-PiPortal-Tunnel-Time"
+)
+
+// setTimingHeaders breaks a response's round trip down into the local
+// service's part and the tunnel's, also as Server-Timing so browser dev
+// tools show it. Clients too old to report upstream time get neither.
+func setTimingHeaders(w http.ResponseWriter, resp *ResponseMessage) {
+	if resp.UpstreamTime <= 0 || resp.RoundTrip <= 0 {
+		return
+	}
+	upstream := time.Duration(resp.UpstreamTime) * time.Microsecond
+	tunnel := max(resp.RoundTrip-upstream, 0)
+	w.Header().Set(UpstreamTimeHeader, formatMillis(upstream))
+	w.Header().Set(TunnelTimeHeader, formatMillis(tunnel))
+	w.Header().Add("Server-Timing", fmt.Sprintf("upstream;dur=%.3f, tunnel;dur=%.3f", millis(upstream), millis(tunnel)))
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// formatMillis formats d as milliseconds, e.g. "12.345ms"
+func formatMillis(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", millis(d))
+}
+
+// Path: /api/v1/devices/{id}/debug
+func (h *Handler) handleSetDebug(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	var req struct {
+		TimingHeaders bool `json:"timing_headers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.SetTimingHeaders(device.ID, req.TimingHeaders); err != nil {
+		slog.Error("set timing headers failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply to the live tunnel straight away
+	if tunnel := h.tunnels.GetTunnel(device.Subdomain); tunnel != nil {
+		tunnel.timingHeaders.Store(req.TimingHeaders)
+	}
+
+	slog.Info("timing headers updated", "subdomain", device.Subdomain, "enabled", req.TimingHeaders)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"debug":   map[string]bool{"timing_headers": req.TimingHeaders},
+	})
+}
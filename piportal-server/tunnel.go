@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,9 +22,19 @@ import (
 
 // TunnelManager manages all active tunnel connections
 type TunnelManager struct {
-	tunnels map[string]*Tunnel // subdomain -> tunnel
-	mu      sync.RWMutex
-	store   *Store
+	tunnels  map[string]*Tunnel // subdomain -> tunnel
+	reserved int                // Slots held by ReserveSlot for tunnels not yet registered
+	mu       sync.RWMutex
+	store    Storage
+	config   *Config
+	notifier *Notifier
+
+	offline      map[string]*time.Timer // device ID -> pending offline transition
+	shuttingDown bool                   // Set by DrainAll: no more offline transitions are scheduled
+	events       *EventHub              // Live updates for dashboards
+
+	// Requests waiting for a dropped device to reconnect
+	reconnectWaiters map[string][]chan *Tunnel // subdomain -> waiters
 }
 
 // Tunnel represents a single client connection
@@ -24,14 +42,66 @@ type Tunnel struct {
 	Device           *Device
 	Conn             *websocket.Conn
 	Manager          *TunnelManager
-	Responses        map[string]chan *ResponseMessage        // requestID -> response channel
-	CommandResults   map[string]chan *CommandResultMessage    // commandID -> result channel
-	TerminalSessions map[string]*websocket.Conn              // sessionID -> browser WS conn
+	Responses        map[string]chan *ResponseMessage      // requestID -> response channel
+	CommandResults   map[string]chan *CommandResultMessage // commandID -> result channel
+	CommandOutputs   map[string]*commandStream             // commandID -> output chunks (streaming only)
+	TerminalSessions map[string]*terminalSession           // sessionID -> browser side of the session
+	Recorders        map[string]*TerminalRecorder          // sessionID -> recorder (opted-in devices only)
 	Metrics          *MetricsMessage
 	MetricsUpdatedAt time.Time
+	MetricsRequests  map[string]chan *MetricsMessage // requestID -> on-demand metrics
 	mu               sync.Mutex
+	logger           *slog.Logger    // Tagged with the device's subdomain
+	inflight         chan struct{}   // Semaphore bounding concurrent proxied requests
+	limiter          rateLimiter     // The device's request rate limit, if any
+	cache            responseCache   // Opt-in cache of static responses
+	breaker          *circuitBreaker // Fails fast while the local service is down
+	abuseSeen        pathSet         // Paths whose first response has been scanned for abuse
+	timingHeaders    atomic.Bool     // Add upstream/tunnel timing headers to responses
+	noProxy          bool            // Monitoring-only client: nothing to forward requests to
+	draining         bool            // Being closed by Drain: no new requests or terminal sessions (guarded by mu)
+	connectedAt      time.Time
 	ctx              context.Context
 	cancel           context.CancelFunc
+
+	// The device's forwarding settings, loaded when it connects and
+	// replaced when its owner changes them
+	policy        atomic.Pointer[RequestPolicy]     // Method and path restrictions (nil = none)
+	maintenance   atomic.Pointer[MaintenanceMode]   // Set while the maintenance page is up
+	routeTimeouts atomic.Pointer[[]RouteTimeout]    // Per-path timeouts, in match order
+	headers       atomic.Pointer[map[string]string] // Added to every response
+
+	lastSeen   atomic.Int64 // UnixNano of the last frame (or pong) from the client
+	latency    atomic.Int64 // Round trip of the latest ping, as a time.Duration
+	lastActive atomic.Int64 // UnixNano of the last proxied request or terminal activity
+}
+
+// Errors returned by ForwardRequest that map to specific HTTP statuses
+var (
+	ErrBodyTooLarge   = errors.New("request body too large")
+	ErrRequestTimeout = errors.New("request timeout")
+	ErrTunnelClosed   = errors.New("tunnel closed")
+	ErrTunnelBusy     = errors.New("too many requests in flight")
+)
+
+// ErrTooManyTerminals is returned when a device is at its terminal session limit
+var ErrTooManyTerminals = errors.New("too many terminal sessions")
+
+// ErrTooManyUserTerminals is returned when a user holds as many of a
+// device's terminal sessions as one user may
+var ErrTooManyUserTerminals = errors.New("too many terminal sessions for this user")
+
+// How long Drain waits for requests to finish when a device is deleted or
+// its token rotated, and how often it checks
+const (
+	tunnelDrainTimeout = 10 * time.Second
+	drainPollInterval  = 50 * time.Millisecond
+)
+
+// commandStream queues a streaming command's output for StreamExecCommand
+type commandStream struct {
+	chunks  chan *CommandOutputMessage
+	dropped int64 // Bytes lost because chunks was full (guarded by the tunnel's mu)
 }
 
 // PendingRequest tracks a request waiting for a response
@@ -41,10 +111,16 @@ type PendingRequest struct {
 }
 
 // NewTunnelManager creates a new tunnel manager
-func NewTunnelManager(store *Store) *TunnelManager {
+func NewTunnelManager(store Storage, config *Config) *TunnelManager {
 	return &TunnelManager{
-		tunnels: make(map[string]*Tunnel),
-		store:   store,
+		tunnels:  make(map[string]*Tunnel),
+		store:    store,
+		config:   config,
+		notifier: NewNotifier(store, config.WebhookAllowPrivate),
+		offline:  make(map[string]*time.Timer),
+		events:   NewEventHub(),
+
+		reconnectWaiters: make(map[string][]chan *Tunnel),
 	}
 }
 
@@ -55,33 +131,173 @@ func (tm *TunnelManager) GetTunnel(subdomain string) *Tunnel {
 	return tm.tunnels[subdomain]
 }
 
-// RegisterTunnel adds a new tunnel
+// RegisterTunnel adds a new tunnel in the slot ReserveSlot held for it
 func (tm *TunnelManager) RegisterTunnel(tunnel *Tunnel) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
+	tm.reserved--
 
 	// Close existing tunnel for this subdomain if any
-	if existing, ok := tm.tunnels[tunnel.Device.Subdomain]; ok {
+	existing, replaced := tm.tunnels[tunnel.Device.Subdomain]
+	if replaced {
 		existing.Close()
 	}
 
 	tm.tunnels[tunnel.Device.Subdomain] = tunnel
 	tm.store.UpdateDeviceStatus(tunnel.Device.ID, true)
 
-	log.Printf("Tunnel registered: %s (device: %s)", tunnel.Device.Subdomain, tunnel.Device.ID[:8])
+	// Hand the new connection to requests held over from the old one
+	for _, ch := range tm.reconnectWaiters[tunnel.Device.Subdomain] {
+		ch <- tunnel
+	}
+	delete(tm.reconnectWaiters, tunnel.Device.Subdomain)
+
+	// Reconnecting within the offline grace period cancels the transition
+	reconnected := false
+	if timer, ok := tm.offline[tunnel.Device.ID]; ok {
+		timer.Stop()
+		delete(tm.offline, tunnel.Device.ID)
+		reconnected = true
+	}
+
+	// A replacement connection or quick reconnect isn't a state change
+	if !replaced && !reconnected {
+		tm.notifier.DeviceEvent(tunnel.Device, EventDeviceOnline)
+		tm.events.Publish(tunnel.Device, EventDeviceOnline, nil)
+	}
+
+	tunnel.logger.Info("tunnel registered", "device_id", tunnel.Device.ID, "replaced", replaced, "reconnected", reconnected)
 }
 
-// UnregisterTunnel removes a tunnel
+// ReserveSlot holds a tunnel slot for subdomain until RegisterTunnel fills it
+// or ReleaseSlot gives it back, so a client is only told it's connected once
+// there's room for it. It reports false if MaxTunnels are connected or held,
+// unless subdomain's current tunnel is being replaced.
+func (tm *TunnelManager) ReserveSlot(subdomain string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	_, replacing := tm.tunnels[subdomain]
+	if !replacing && tm.config.MaxTunnels > 0 && len(tm.tunnels)+tm.reserved >= tm.config.MaxTunnels {
+		return false
+	}
+	tm.reserved++
+	return true
+}
+
+// ReleaseSlot gives back a slot held by ReserveSlot without registering
+func (tm *TunnelManager) ReleaseSlot() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.reserved--
+}
+
+// UnregisterTunnel removes a tunnel. The device is marked offline once the
+// grace period passes without it reconnecting, so brief drops don't flap
+// its status or fire webhooks.
 func (tm *TunnelManager) UnregisterTunnel(tunnel *Tunnel) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
 	// Only remove if it's the same tunnel (not a replacement)
-	if current, ok := tm.tunnels[tunnel.Device.Subdomain]; ok && current == tunnel {
-		delete(tm.tunnels, tunnel.Device.Subdomain)
+	current, ok := tm.tunnels[tunnel.Device.Subdomain]
+	if !ok || current != tunnel {
+		return
+	}
+	delete(tm.tunnels, tunnel.Device.Subdomain)
+
+	grace := tm.config.OfflineGracePeriod
+	tunnel.logger.Info("tunnel unregistered", "offline_grace", grace)
+	if tm.shuttingDown {
+		// The server is going away, not the device, so there's nothing to
+		// tell its owner about
 		tm.store.UpdateDeviceStatus(tunnel.Device.ID, false)
-		log.Printf("Tunnel unregistered: %s", tunnel.Device.Subdomain)
+		return
+	}
+	if grace <= 0 {
+		tm.markOffline(tunnel)
+		return
 	}
+
+	if timer, ok := tm.offline[tunnel.Device.ID]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		tm.mu.Lock()
+		defer tm.mu.Unlock()
+		// Cancelled or superseded while waiting for the lock
+		if tm.offline[tunnel.Device.ID] != timer {
+			return
+		}
+		delete(tm.offline, tunnel.Device.ID)
+		tm.markOffline(tunnel)
+	})
+	tm.offline[tunnel.Device.ID] = timer
+}
+
+// AwaitReconnect waits up to the replay window for the device behind a
+// closed tunnel to connect again, returning its new tunnel or nil. Only
+// ReplayMaxRequests requests per device wait at once; the rest get nil
+// straight away.
+func (tm *TunnelManager) AwaitReconnect(ctx context.Context, closed *Tunnel) *Tunnel {
+	window := tm.config.ReplayWindow
+	if window <= 0 {
+		return nil
+	}
+	subdomain := closed.Device.Subdomain
+
+	tm.mu.Lock()
+	if current := tm.tunnels[subdomain]; current != nil && current != closed {
+		tm.mu.Unlock()
+		return current
+	}
+	if len(tm.reconnectWaiters[subdomain]) >= tm.config.ReplayMaxRequests {
+		tm.mu.Unlock()
+		return nil
+	}
+	ch := make(chan *Tunnel, 1)
+	tm.reconnectWaiters[subdomain] = append(tm.reconnectWaiters[subdomain], ch)
+	tm.mu.Unlock()
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	select {
+	case tunnel := <-ch:
+		return tunnel
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	waiters := tm.reconnectWaiters[subdomain]
+	for i, w := range waiters {
+		if w == ch {
+			tm.reconnectWaiters[subdomain] = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(tm.reconnectWaiters[subdomain]) == 0 {
+		delete(tm.reconnectWaiters, subdomain)
+	}
+	// The device may have come back just as we gave up
+	select {
+	case tunnel := <-ch:
+		if ctx.Err() == nil {
+			return tunnel
+		}
+	default:
+	}
+	return nil
+}
+
+// markOffline records the device as offline and notifies its owner.
+// Called with tm.mu held.
+func (tm *TunnelManager) markOffline(tunnel *Tunnel) {
+	tm.store.UpdateDeviceStatus(tunnel.Device.ID, false)
+	tm.notifier.DeviceEvent(tunnel.Device, EventDeviceOffline)
+	tm.events.Publish(tunnel.Device, EventDeviceOffline, nil)
+	tunnel.logger.Info("device offline", "device_id", tunnel.Device.ID)
 }
 
 // Stats returns tunnel statistics
@@ -90,31 +306,50 @@ func (tm *TunnelManager) Stats() map[string]interface{} {
 	defer tm.mu.RUnlock()
 
 	subdomains := make([]string, 0, len(tm.tunnels))
-	for subdomain := range tm.tunnels {
+	inFlight := 0
+	for subdomain, tunnel := range tm.tunnels {
 		subdomains = append(subdomains, subdomain)
+		inFlight += tunnel.InFlight()
 	}
 
 	return map[string]interface{}{
-		"active_tunnels": len(tm.tunnels),
-		"subdomains":     subdomains,
+		"active_tunnels":     len(tm.tunnels),
+		"max_tunnels":        tm.config.MaxTunnels,
+		"subdomains":         subdomains,
+		"in_flight_requests": inFlight,
 	}
 }
 
 // --- Tunnel methods ---
 
+// InFlight returns the number of proxied requests awaiting a response
+func (t *Tunnel) InFlight() int {
+	return len(t.inflight)
+}
+
 // NewTunnel creates a new tunnel
 func NewTunnel(device *Device, conn *websocket.Conn, manager *TunnelManager) *Tunnel {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Tunnel{
+	t := &Tunnel{
 		Device:           device,
 		Conn:             conn,
 		Manager:          manager,
 		Responses:        make(map[string]chan *ResponseMessage),
 		CommandResults:   make(map[string]chan *CommandResultMessage),
-		TerminalSessions: make(map[string]*websocket.Conn),
+		CommandOutputs:   make(map[string]*commandStream),
+		TerminalSessions: make(map[string]*terminalSession),
+		Recorders:        make(map[string]*TerminalRecorder),
+		MetricsRequests:  make(map[string]chan *MetricsMessage),
+		logger:           slog.With("subdomain", device.Subdomain),
+		inflight:         make(chan struct{}, manager.config.MaxInFlight),
+		breaker:          newCircuitBreaker(manager.config.BreakerThreshold, manager.config.BreakerCooldown),
+		connectedAt:      time.Now(),
 		ctx:              ctx,
 		cancel:           cancel,
 	}
+	t.touchSeen()
+	t.touchActive()
+	return t
 }
 
 // Run handles the tunnel connection
@@ -122,14 +357,23 @@ func (t *Tunnel) Run() {
 	defer t.Close()
 	defer t.Manager.UnregisterTunnel(t)
 
-	// Set up ping/pong
-	t.Conn.SetPongHandler(func(string) error {
-		t.Conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+	// Set up ping/pong. Pings carry the time they were sent, so each pong
+	// gives the link's round trip.
+	readTimeout := t.Manager.config.TunnelReadTimeout
+	t.Conn.SetPongHandler(func(payload string) error {
+		t.touchSeen()
+		t.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+		if sent, err := strconv.ParseInt(payload, 10, 64); err == nil {
+			if rtt := time.Since(time.Unix(0, sent)); rtt >= 0 {
+				t.latency.Store(int64(rtt))
+			}
+		}
 		return nil
 	})
 
-	// Start ping loop
+	// Start ping loop and liveness checks
 	go t.pingLoop()
+	go t.watchdog()
 
 	// Read messages
 	for {
@@ -139,25 +383,72 @@ func (t *Tunnel) Run() {
 		default:
 		}
 
-		t.Conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+		t.Conn.SetReadDeadline(time.Now().Add(readTimeout))
 		_, data, err := t.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				log.Printf("Tunnel %s: client disconnected", t.Device.Subdomain)
+				t.logger.Info("client disconnected")
 			} else {
-				log.Printf("Tunnel %s: read error: %v", t.Device.Subdomain, err)
+				t.logger.Warn("tunnel read error", "error", err)
 			}
 			return
 		}
 
+		t.touchSeen()
 		t.handleMessage(data)
 	}
 }
 
+func (t *Tunnel) touchSeen()   { t.lastSeen.Store(time.Now().UnixNano()) }
+func (t *Tunnel) touchActive() { t.lastActive.Store(time.Now().UnixNano()) }
+
+// watchdog closes the tunnel when the client goes silent (dead network
+// without a clean close) or, if configured, when the tunnel sits unused
+func (t *Tunnel) watchdog() {
+	liveness := t.Manager.config.LivenessTimeout
+	idle := t.Manager.config.IdleTimeout
+	if liveness <= 0 && idle <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		silent := time.Since(time.Unix(0, t.lastSeen.Load()))
+		if liveness > 0 && silent > liveness {
+			t.logger.Warn("no traffic from client, closing tunnel", "silent", silent.Round(time.Second))
+			t.Close()
+			return
+		}
+
+		unused := time.Since(time.Unix(0, t.lastActive.Load()))
+		if idle > 0 && unused > idle && !t.hasActivity() {
+			t.logger.Info("tunnel idle, closing", "idle", unused.Round(time.Second))
+			t.SendJSON(NewErrorMessage("idle_timeout", "Tunnel closed after being idle"))
+			t.Close()
+			return
+		}
+	}
+}
+
+// hasActivity reports whether requests, commands or terminal sessions are in flight
+func (t *Tunnel) hasActivity() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.Responses) > 0 || len(t.CommandResults) > 0 || len(t.TerminalSessions) > 0
+}
+
 func (t *Tunnel) handleMessage(data []byte) {
 	msg, msgType, err := ParseClientMessage(data)
 	if err != nil {
-		log.Printf("Tunnel %s: parse error: %v", t.Device.Subdomain, err)
+		t.logger.Warn("invalid message from client", "error", err)
 		return
 	}
 
@@ -182,15 +473,46 @@ func (t *Tunnel) handleMessage(data []byte) {
 		t.mu.Lock()
 		t.Metrics = &metrics
 		t.MetricsUpdatedAt = time.Now()
+		if ch, ok := t.MetricsRequests[metrics.RequestID]; ok {
+			select {
+			case ch <- &metrics:
+			default:
+			}
+		}
 		t.mu.Unlock()
+		t.Manager.events.Publish(t.Device, EventDeviceMetrics, &metrics)
 
 	case MessageTypeTerminalData:
+		t.touchActive()
 		termData := msg.(TerminalDataMessage)
+		t.recordTerminalOutput(termData)
 		t.forwardTerminalToBrowser(termData.SessionID, data)
 
 	case MessageTypeTerminalClose:
 		termClose := msg.(TerminalCloseMessage)
-		t.closeTerminalSession(termClose.SessionID)
+		// The device says why when it refuses a terminal, e.g. one its
+		// owner hasn't enabled, and the browser shows it
+		reason := "session closed"
+		if termClose.Reason != "" && len(termClose.Reason) <= maxCloseReason {
+			reason = termClose.Reason
+		}
+		t.closeTerminalSession(termClose.SessionID, reason)
+
+	case MessageTypeCommandOutput:
+		output := msg.(CommandOutputMessage)
+		t.mu.Lock()
+		if stream, ok := t.CommandOutputs[output.CommandID]; ok {
+			select {
+			case stream.chunks <- &output:
+			default:
+				// Don't stall the tunnel on a slow reader; the chunk is
+				// lost, and counted so the result can say so
+				data, _ := output.GetData()
+				stream.dropped += int64(len(data))
+				t.logger.Warn("command output buffer full, dropping chunk", "command_id", output.CommandID)
+			}
+		}
+		t.mu.Unlock()
 
 	case MessageTypeCommandResult:
 		cmdResult := msg.(CommandResultMessage)
@@ -206,24 +528,44 @@ func (t *Tunnel) handleMessage(data []byte) {
 	}
 }
 
+// pingLoop pings the client every PingInterval, starting straight away so
+// the link's latency is known from the start
 func (t *Tunnel) pingLoop() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(t.Manager.config.PingInterval)
 	defer ticker.Stop()
 
 	for {
+		payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := t.Conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(10*time.Second)); err != nil {
+			return
+		}
 		select {
 		case <-t.ctx.Done():
 			return
 		case <-ticker.C:
-			if err := t.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
-				return
-			}
 		}
 	}
 }
 
+// Latency returns the round trip of the latest ping, or 0 before the first
+// pong
+func (t *Tunnel) Latency() time.Duration {
+	return time.Duration(t.latency.Load())
+}
+
 // ForwardRequest sends an HTTP request through the tunnel and waits for response
-func (t *Tunnel) ForwardRequest(req *http.Request, requestID string) (*ResponseMessage, error) {
+func (t *Tunnel) ForwardRequest(req *http.Request, requestID string, limits RequestLimits) (*ResponseMessage, error) {
+	t.touchActive()
+
+	// Shed load rather than queue without bound. The slot is released on
+	// every return path: response, timeout, tunnel close or error.
+	select {
+	case t.inflight <- struct{}{}:
+	default:
+		return nil, ErrTunnelBusy
+	}
+	defer func() { <-t.inflight }()
+
 	// Build the request message
 	headers := make(map[string]string)
 	for key, values := range req.Header {
@@ -232,35 +574,31 @@ func (t *Tunnel) ForwardRequest(req *http.Request, requestID string) (*ResponseM
 		}
 	}
 
-	// Add forwarding headers
-	if clientIP := req.Header.Get("X-Forwarded-For"); clientIP != "" {
-		headers["X-Forwarded-For"] = clientIP
-	} else if req.RemoteAddr != "" {
-		headers["X-Forwarded-For"] = req.RemoteAddr
-	}
-
 	// Read request body
+	if req.ContentLength > limits.MaxBodySize {
+		return nil, ErrBodyTooLarge
+	}
 	var body []byte
 	if req.Body != nil {
-		body = make([]byte, 0)
-		buf := make([]byte, 1024)
-		for {
-			n, err := req.Body.Read(buf)
-			if n > 0 {
-				body = append(body, buf[:n]...)
-			}
-			if err != nil {
-				break
-			}
-			if len(body) > 10*1024*1024 { // 10MB limit
-				return nil, fmt.Errorf("request body too large")
-			}
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, limits.MaxBodySize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		if int64(len(body)) > limits.MaxBodySize {
+			return nil, ErrBodyTooLarge
 		}
+		// Keep the body readable so the request can be retried
+		req.Body = io.NopCloser(bytes.NewReader(body))
 	}
 
 	// Create response channel
 	respChan := make(chan *ResponseMessage, 1)
 	t.mu.Lock()
+	if t.draining {
+		t.mu.Unlock()
+		return nil, ErrTunnelClosed
+	}
 	t.Responses[requestID] = respChan
 	t.mu.Unlock()
 
@@ -273,18 +611,24 @@ func (t *Tunnel) ForwardRequest(req *http.Request, requestID string) (*ResponseM
 
 	// Send request to client
 	reqMsg := NewRequestMessage(requestID, req.Method, req.URL.Path+"?"+req.URL.RawQuery, headers, body)
+	reqMsg.Timeout = int(math.Ceil(limits.Timeout.Seconds()))
+	reqMsg.Host = req.Host
+	reqMsg.Scheme = forwardedProto(req, t.Manager.config.BehindProxy)
+	reqMsg.ClientIP = clientIP(req, t.Manager.config.BehindProxy)
+	sent := time.Now()
 	if err := t.SendJSON(reqMsg); err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("%w: failed to send request: %v", ErrTunnelClosed, err)
 	}
 
 	// Wait for response with timeout
 	select {
 	case resp := <-respChan:
+		resp.RoundTrip = time.Since(sent)
 		return resp, nil
-	case <-time.After(30 * time.Second):
-		return nil, fmt.Errorf("request timeout")
+	case <-time.After(limits.Timeout):
+		return nil, ErrRequestTimeout
 	case <-t.ctx.Done():
-		return nil, fmt.Errorf("tunnel closed")
+		return nil, ErrTunnelClosed
 	}
 }
 
@@ -299,61 +643,370 @@ func (t *Tunnel) SendJSON(msg interface{}) error {
 	}
 
 	t.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	t.Conn.EnableWriteCompression(len(data) >= minCompressedMessage) // No-op unless negotiated
 	return t.Conn.WriteMessage(websocket.TextMessage, data)
 }
 
+// Browser side of terminal output
+const (
+	terminalWriteTimeout = 10 * time.Second // A browser that takes no output for this long is disconnected
+	terminalOutputQueue  = 64               // Output messages held for a slow browser before more are dropped
+	maxCloseReason       = 123              // Longest reason a WebSocket close frame can carry
+)
+
+// terminalSession is the browser end of an open terminal. Output is queued
+// and written by its own goroutine, so a slow browser never holds up the
+// tunnel's read loop.
+type terminalSession struct {
+	id       string
+	conn     *websocket.Conn
+	user     string // Email of whoever opened it
+	openedAt time.Time
+
+	out     chan []byte
+	done    chan struct{}
+	stop    sync.Once
+	dropped atomic.Int64 // Output messages dropped since the last write
+
+	// Carried over when a browser reattaches. end finishes the session for
+	// good: it stops metering, tells the client and closes any recording.
+	end      func()
+	detached *time.Timer // Set while no browser is attached; ends the session when it fires
+}
+
+func newTerminalSession(id string, conn *websocket.Conn, user string) *terminalSession {
+	s := &terminalSession{
+		id:       id,
+		conn:     conn,
+		user:     user,
+		openedAt: time.Now(),
+		out:      make(chan []byte, terminalOutputQueue),
+		done:     make(chan struct{}),
+	}
+	go s.writeLoop()
+	return s
+}
+
+// send queues output for the browser. If the browser has fallen a whole
+// queue behind, the output is dropped and the browser told so.
+func (s *terminalSession) send(msg []byte) {
+	select {
+	case s.out <- msg:
+	case <-s.done:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *terminalSession) writeLoop() {
+	for {
+		var msg []byte
+		select {
+		case <-s.done:
+			return
+		case msg = <-s.out:
+		}
+
+		if n := s.dropped.Swap(0); n > 0 {
+			notice := fmt.Sprintf("\r\n[PiPortal: %d output messages dropped, the browser couldn't keep up]\r\n", n)
+			data, err := json.Marshal(NewTerminalDataMessage(s.id, []byte(notice)))
+			if err == nil && !s.write(data) {
+				return
+			}
+		}
+		if !s.write(msg) {
+			return
+		}
+	}
+}
+
+// write sends one message to the browser. A write that times out means the
+// browser is stuck, so the connection is closed, which ends the session.
+func (s *terminalSession) write(msg []byte) bool {
+	s.conn.SetWriteDeadline(time.Now().Add(terminalWriteTimeout))
+	if err := s.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		s.conn.Close()
+		return false
+	}
+	return true
+}
+
+// close stops the writer and closes the browser connection with code
+func (s *terminalSession) close(code int, reason string) {
+	s.stop.Do(func() { close(s.done) })
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	s.conn.Close()
+}
+
+// TerminalSessionInfo describes an open terminal session for the dashboard API
+type TerminalSessionInfo struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	OpenedAt  time.Time `json:"opened_at"`
+	Recording bool      `json:"recording"`
+	Detached  bool      `json:"detached"` // Its browser dropped off and may reconnect
+}
+
 // RegisterTerminalSession registers a browser WebSocket for a terminal session
-func (t *Tunnel) RegisterTerminalSession(sessionID string, browserConn *websocket.Conn) {
+// opened by user. Returns ErrTooManyTerminals if the device already has the
+// maximum open, or ErrTooManyUserTerminals if user has their share of them.
+func (t *Tunnel) RegisterTerminalSession(sessionID string, browserConn *websocket.Conn, user string) (*terminalSession, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, ErrTunnelClosed
+	}
+	if max := t.Manager.config.MaxTerminalSessions; max > 0 && len(t.TerminalSessions) >= max {
+		return nil, ErrTooManyTerminals
+	}
+	if max := t.Manager.config.MaxUserTerminalSessions; max > 0 {
+		held := 0
+		for _, session := range t.TerminalSessions {
+			if session.user == user {
+				held++
+			}
+		}
+		if held >= max {
+			return nil, ErrTooManyUserTerminals
+		}
+	}
+	t.touchActive()
+	session := newTerminalSession(sessionID, browserConn, user)
+	t.TerminalSessions[sessionID] = session
+	return session, nil
+}
+
+// DetachTerminalSession keeps a session whose browser connection dropped,
+// with its shell still running, for up to grace. If no browser reattaches
+// in that time the session ends. Reports false, leaving the caller to end
+// it, if the session was closed meanwhile or grace is 0.
+func (t *Tunnel) DetachTerminalSession(session *terminalSession, grace time.Duration) bool {
+	if grace <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining || t.TerminalSessions[session.id] != session {
+		return false
+	}
+	session.stop.Do(func() { close(session.done) })
+	session.detached = time.AfterFunc(grace, func() {
+		t.mu.Lock()
+		expired := t.TerminalSessions[session.id] == session // Not reattached or closed since
+		if expired {
+			delete(t.TerminalSessions, session.id)
+		}
+		t.mu.Unlock()
+		if expired {
+			session.end()
+		}
+	})
+	return true
+}
+
+// ReattachTerminalSession hands a detached session to a new browser
+// connection from the user who opened it, returning nil if there's no such
+// session waiting
+func (t *Tunnel) ReattachTerminalSession(sessionID string, browserConn *websocket.Conn, user string) *terminalSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.TerminalSessions[sessionID]
+	if !ok || old.detached == nil || old.user != user || t.draining {
+		return nil
+	}
+	old.detached.Stop()
+	t.touchActive()
+	session := newTerminalSession(sessionID, browserConn, user)
+	session.openedAt = old.openedAt
+	session.end = old.end
+	t.TerminalSessions[sessionID] = session
+	return session
+}
+
+// ListTerminalSessions returns the open terminal sessions, oldest first
+func (t *Tunnel) ListTerminalSessions() []TerminalSessionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sessions := make([]TerminalSessionInfo, 0, len(t.TerminalSessions))
+	for id, s := range t.TerminalSessions {
+		_, recording := t.Recorders[id]
+		sessions = append(sessions, TerminalSessionInfo{ID: id, User: s.user, OpenedAt: s.openedAt, Recording: recording, Detached: s.detached != nil})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].OpenedAt.Before(sessions[j].OpenedAt) })
+	return sessions
+}
+
+// TerminalSessionCount returns how many terminal sessions are open
+func (t *Tunnel) TerminalSessionCount() int {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.TerminalSessions[sessionID] = browserConn
+	return len(t.TerminalSessions)
 }
 
 // UnregisterTerminalSession removes a terminal session
 func (t *Tunnel) UnregisterTerminalSession(sessionID string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if session, ok := t.TerminalSessions[sessionID]; ok {
+		session.stop.Do(func() { close(session.done) })
+	}
 	delete(t.TerminalSessions, sessionID)
+	delete(t.Recorders, sessionID)
+}
+
+// SetTerminalRecorder tees a session's output to a recorder
+func (t *Tunnel) SetTerminalRecorder(sessionID string, recorder *TerminalRecorder) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Recorders[sessionID] = recorder
+}
+
+// TerminalRecorder returns a session's recorder, or nil if it isn't recorded
+func (t *Tunnel) TerminalRecorder(sessionID string) *TerminalRecorder {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Recorders[sessionID]
+}
+
+// recordTerminalOutput writes terminal output to the session's recorder, if any
+func (t *Tunnel) recordTerminalOutput(msg TerminalDataMessage) {
+	t.mu.Lock()
+	recorder, ok := t.Recorders[msg.SessionID]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	if data, err := base64.StdEncoding.DecodeString(msg.DataBase64); err == nil {
+		recorder.Output(data)
+	}
 }
 
-// forwardTerminalToBrowser forwards raw terminal data from the client to the browser WS
+// forwardTerminalToBrowser queues raw terminal data from the client for the browser WS
 func (t *Tunnel) forwardTerminalToBrowser(sessionID string, rawMsg []byte) {
 	t.mu.Lock()
-	browserConn, ok := t.TerminalSessions[sessionID]
+	session, ok := t.TerminalSessions[sessionID]
 	t.mu.Unlock()
 	if !ok {
 		return
 	}
-	browserConn.WriteMessage(websocket.TextMessage, rawMsg)
+	session.send(rawMsg)
 }
 
-// closeTerminalSession closes the browser WS for a terminal session
-func (t *Tunnel) closeTerminalSession(sessionID string) {
+// closeTerminalSession closes the browser WS for a terminal session with
+// reason, reporting whether it was open. The browser bridge then tells the
+// client to end the shell. A detached session has no bridge, so it's
+// ended here.
+func (t *Tunnel) closeTerminalSession(sessionID, reason string) bool {
 	t.mu.Lock()
-	browserConn, ok := t.TerminalSessions[sessionID]
+	session, ok := t.TerminalSessions[sessionID]
+	var detached bool
 	if ok {
 		delete(t.TerminalSessions, sessionID)
+		detached = session.detached != nil
 	}
 	t.mu.Unlock()
-	if ok {
-		browserConn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session closed"))
-		browserConn.Close()
+	switch {
+	case !ok:
+	case detached:
+		session.detached.Stop()
+		session.end()
+	default:
+		session.close(websocket.CloseNormalClosure, reason)
+	}
+	return ok
+}
+
+// Drain closes the tunnel without cutting requests off: new requests and
+// terminal sessions are refused straight away, those in flight get up to
+// timeout to finish, then the client gets a clean WebSocket close. A
+// terminal can stay open for hours, so open ones are closed at the start
+// rather than waited for. Reports whether everything finished in time.
+func (t *Tunnel) Drain(timeout time.Duration) bool {
+	t.mu.Lock()
+	t.draining = true
+	sessionIDs := make([]string, 0, len(t.TerminalSessions))
+	for id := range t.TerminalSessions {
+		sessionIDs = append(sessionIDs, id)
+	}
+	t.mu.Unlock()
+	for _, id := range sessionIDs {
+		t.closeTerminalSession(id, "device is disconnecting")
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	finished := true
+	for t.hasActivity() && finished {
+		select {
+		case <-ticker.C:
+		case <-t.ctx.Done():
+			return false // Closed underneath us
+		case <-deadline.C:
+			finished = false
+		}
+	}
+	if !finished {
+		t.logger.Warn("tunnel drain timed out, closing", "timeout", timeout, "in_flight", t.InFlight())
 	}
+
+	t.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tunnel closed"),
+		time.Now().Add(time.Second))
+	t.Close()
+	return finished
+}
+
+// DrainAll drains every tunnel at once, for a graceful shutdown. Pending
+// offline transitions are stopped rather than left to fire against a
+// store that's about to close; those devices are just recorded offline.
+func (tm *TunnelManager) DrainAll(timeout time.Duration) {
+	tm.mu.Lock()
+	tm.shuttingDown = true
+	for deviceID, timer := range tm.offline {
+		timer.Stop()
+		tm.store.UpdateDeviceStatus(deviceID, false)
+		delete(tm.offline, deviceID)
+	}
+	tunnels := make([]*Tunnel, 0, len(tm.tunnels))
+	for _, tunnel := range tm.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	tm.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, tunnel := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tunnel.Drain(timeout)
+		}()
+	}
+	wg.Wait()
 }
 
 // Close closes the tunnel
 func (t *Tunnel) Close() {
 	t.cancel()
-	// Close all terminal sessions
+	// Close all terminal sessions. Detached ones have no browser to see
+	// the close, so they're ended directly.
+	var detached []*terminalSession
 	t.mu.Lock()
-	for sid, conn := range t.TerminalSessions {
-		conn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseGoingAway, "tunnel disconnected"))
-		conn.Close()
+	for sid, session := range t.TerminalSessions {
+		if session.detached != nil {
+			session.detached.Stop()
+			detached = append(detached, session)
+		} else {
+			session.close(websocket.CloseGoingAway, "tunnel disconnected")
+		}
 		delete(t.TerminalSessions, sid)
 	}
 	t.mu.Unlock()
+	for _, session := range detached {
+		session.end()
+	}
 	t.Conn.Close()
 }
 
@@ -393,7 +1046,96 @@ func (t *Tunnel) SendExecCommand(shell string, dryRun bool) (*CommandResultMessa
 	case <-time.After(90 * time.Second):
 		return nil, fmt.Errorf("command timed out")
 	case <-t.ctx.Done():
-		return nil, fmt.Errorf("tunnel closed")
+		return nil, ErrTunnelClosed
+	}
+}
+
+// StreamExecCommand sends a shell command to the client and calls onOutput
+// for each chunk of output as it arrives. It returns the final result
+// (exit code) once the command finishes. If ctx ends first the client is
+// told to stop the command.
+func (t *Tunnel) StreamExecCommand(ctx context.Context, shell string, dryRun bool, timeout time.Duration, onOutput func(*CommandOutputMessage)) (*CommandResultMessage, error) {
+	cmdID := fmt.Sprintf("cmd_%d", time.Now().UnixNano())
+
+	resultChan := make(chan *CommandResultMessage, 1)
+	stream := &commandStream{chunks: make(chan *CommandOutputMessage, 256)}
+	outputChan := stream.chunks
+	t.mu.Lock()
+	t.CommandResults[cmdID] = resultChan
+	t.CommandOutputs[cmdID] = stream
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.CommandResults, cmdID)
+		delete(t.CommandOutputs, cmdID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.SendJSON(NewStreamingExecCommand(cmdID, shell, dryRun, timeout)); err != nil {
+		return nil, fmt.Errorf("failed to send exec command: %w", err)
+	}
+
+	// Allow the client a little longer than its own timeout to report back
+	deadline := time.After(timeout + 30*time.Second)
+	for {
+		select {
+		case output := <-outputChan:
+			onOutput(output)
+		case result := <-resultChan:
+			// Chunks are queued before the result, so flush what's left
+			for {
+				select {
+				case output := <-outputChan:
+					onOutput(output)
+				default:
+					t.mu.Lock()
+					result.OutputDropped += stream.dropped
+					t.mu.Unlock()
+					return result, nil
+				}
+			}
+		case <-ctx.Done():
+			// Nobody is waiting for the output any more
+			if err := t.SendJSON(NewCommandCancel(cmdID)); err != nil {
+				t.logger.Warn("failed to cancel command", "command_id", cmdID, "error", err)
+			}
+			return nil, ctx.Err()
+		case <-deadline:
+			return nil, fmt.Errorf("command timed out")
+		case <-t.ctx.Done():
+			return nil, ErrTunnelClosed
+		}
+	}
+}
+
+// RequestMetrics asks the client for fresh metrics and waits up to timeout
+// for them. They're also stored as the latest metrics, like pushed ones.
+func (t *Tunnel) RequestMetrics(timeout time.Duration) (*MetricsMessage, error) {
+	requestID := fmt.Sprintf("metrics_%d", time.Now().UnixNano())
+
+	resultChan := make(chan *MetricsMessage, 1)
+	t.mu.Lock()
+	t.MetricsRequests[requestID] = resultChan
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.MetricsRequests, requestID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.SendJSON(NewMetricsRequest(requestID)); err != nil {
+		return nil, fmt.Errorf("failed to send metrics request: %w", err)
+	}
+
+	select {
+	case metrics := <-resultChan:
+		return metrics, nil
+	case <-time.After(timeout):
+		return nil, ErrRequestTimeout
+	case <-t.ctx.Done():
+		return nil, ErrTunnelClosed
 	}
 }
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// usageRow is one month of an exported usage history
+type usageRow struct {
+	Month    string `json:"month"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	Total    int64  `json:"total"`
+}
+
+// handleUsageExport serves a device's monthly bandwidth history as CSV or JSON.
+// Query: format=csv|json (default json), from=YYYY-MM, to=YYYY-MM (both optional).
+func (h *Handler) handleUsageExport(w http.ResponseWriter, r *http.Request) {
+	device, _ := h.ownedDeviceFromPath(w, r)
+	if device == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		jsonError(w, ErrCodeInvalidRequest, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+	from, to := query.Get("from"), query.Get("to")
+	for _, month := range []string{from, to} {
+		if month == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01", month); err != nil {
+			jsonError(w, ErrCodeInvalidRequest, "from and to must be months in YYYY-MM format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	usages, err := h.store.ListUsage(device.ID, from, to)
+	if err != nil {
+		slog.Error("usage export failed", "device_id", device.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		limit, err := h.store.GetBandwidthLimit(device.ID)
+		if err != nil {
+			slog.Error("usage export failed", "device_id", device.ID, "error", err)
+			jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		override, _ := h.store.GetBandwidthLimitOverride(device.ID)
+
+		rows := []usageRow{}
+		for _, u := range usages {
+			rows = append(rows, usageRow{Month: u.Month, BytesIn: u.BytesIn, BytesOut: u.BytesOut, Total: u.BytesIn + u.BytesOut})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_id":      device.ID,
+			"subdomain":      device.Subdomain,
+			"limit":          limit,
+			"limit_override": override != nil,
+			"usage":          rows,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "piportal-usage-"+device.Subdomain+".csv"))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"month", "bytes_in", "bytes_out", "total"})
+	for _, u := range usages {
+		cw.Write([]string{
+			u.Month,
+			strconv.FormatInt(u.BytesIn, 10),
+			strconv.FormatInt(u.BytesOut, 10),
+			strconv.FormatInt(u.BytesIn+u.BytesOut, 10),
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Device events that webhooks can subscribe to
+const (
+	EventDeviceOnline     = "device.online"
+	EventDeviceOffline    = "device.offline"
+	EventBandwidthWarning = "device.bandwidth_warning"
+)
+
+var webhookEvents = map[string]bool{
+	EventDeviceOnline:     true,
+	EventDeviceOffline:    true,
+	EventBandwidthWarning: true,
+}
+
+const (
+	maxWebhooksPerUser  = 10
+	webhookMaxAttempts  = 5
+	webhookInitialDelay = 2 * time.Second // Doubles after each failed attempt
+	webhookTimeout      = 10 * time.Second
+)
+
+// errWebhookPrivateAddress refuses webhook URLs, and connections, to
+// addresses inside the server's own network, so a webhook can't be used to
+// reach services that aren't public
+var errWebhookPrivateAddress = errors.New("url must not point to a private or local address")
+
+// Webhook is a URL subscribed to device events. Deliveries are signed with
+// Secret so receivers can verify they came from this server.
+type Webhook struct {
+	ID        string
+	UserID    string
+	OrgID     string // Only devices in this org (empty for all of the user's devices)
+	URL       string
+	Secret    string
+	Events    []string // Empty means all events
+	CreatedAt time.Time
+}
+
+// Wants reports whether the webhook is subscribed to event
+func (wh *Webhook) Wants(event string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body POSTed to subscribers
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	DeviceID  string      `json:"device_id"`
+	Subdomain string      `json:"subdomain"`
+	Timestamp string      `json:"timestamp"`
+	Data      interface{} `json:"data,omitempty"` // Event-specific details
+}
+
+// Notifier delivers device events to webhook subscribers in the background
+type Notifier struct {
+	store      Storage
+	client     *http.Client
+	retryDelay time.Duration // Before the second attempt; doubles after each one
+}
+
+// NewNotifier creates a notifier backed by store. Unless allowPrivate is
+// set, deliveries only connect to public addresses, checked when dialing
+// so a DNS answer that changes after the webhook was saved can't get round
+// it. Redirects aren't followed: a 3xx counts as a failed delivery.
+func NewNotifier(store Storage, allowPrivate bool) *Notifier {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivate {
+		dialer.Control = refusePrivateAddress
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // The address check has to see the real destination
+	transport.DialContext = dialer.DialContext
+
+	return &Notifier{
+		store: store,
+		client: &http.Client{
+			Timeout:   webhookTimeout,
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		retryDelay: webhookInitialDelay,
+	}
+}
+
+// refusePrivateAddress is a net.Dialer Control hook that refuses to connect
+// to anything but a public address
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	if !isPublicIP(parseIP(address)) {
+		return errWebhookPrivateAddress
+	}
+	return nil
+}
+
+// checkWebhookHost resolves a webhook URL's host and refuses it if any of
+// its addresses isn't public
+func checkWebhookHost(ctx context.Context, host string) error {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("url host %q could not be resolved", host)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip.Unmap()) {
+			return errWebhookPrivateAddress
+		}
+	}
+	return nil
+}
+
+// DeviceEvent notifies every webhook covering device about event. It never blocks.
+func (n *Notifier) DeviceEvent(device *Device, event string) {
+	n.DeviceEventData(device, event, nil)
+}
+
+// DeviceEventData is DeviceEvent with event-specific details in the payload
+func (n *Notifier) DeviceEventData(device *Device, event string, data interface{}) {
+	payload := WebhookPayload{
+		Event:     event,
+		DeviceID:  device.ID,
+		Subdomain: device.Subdomain,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      data,
+	}
+
+	go func() {
+		webhooks, err := n.store.ListWebhooksForDevice(device.ID)
+		if err != nil {
+			slog.Error("webhook lookup failed", "subdomain", device.Subdomain, "error", err)
+			return
+		}
+		if len(webhooks) == 0 {
+			return
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return
+		}
+		for _, webhook := range webhooks {
+			if webhook.Wants(event) {
+				go n.deliver(webhook, event, body)
+			}
+		}
+	}()
+}
+
+// deliver POSTs body to the webhook, retrying with exponential backoff until
+// it gets a 2xx response or runs out of attempts
+func (n *Notifier) deliver(webhook *Webhook, event string, body []byte) {
+	deliveryID := generateID()
+	signature := signWebhook(webhook.Secret, body)
+
+	delay := n.retryDelay
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		err := n.post(webhook.URL, event, deliveryID, signature, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookMaxAttempts {
+			slog.Warn("webhook delivery failed", "webhook_id", webhook.ID, "delivery_id", deliveryID, "attempts", attempt, "error", err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (n *Notifier) post(target, event, deliveryID, signature string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PiPortal-Webhook")
+	req.Header.Set("X-PiPortal-Event", event)
+	req.Header.Set("X-PiPortal-Delivery", deliveryID)
+	req.Header.Set("X-PiPortal-Signature", signature)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook returns the X-PiPortal-Signature value: "sha256=" followed by
+// the hex HMAC-SHA256 of the body keyed with the webhook secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// --- Handlers ---
+
+type webhookResponse struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	OrgID     string   `json:"org_id,omitempty"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"` // Only returned on creation
+	CreatedAt string   `json:"created_at"`
+}
+
+func newWebhookResponse(webhook *Webhook) webhookResponse {
+	events := webhook.Events
+	if events == nil {
+		events = []string{}
+	}
+	return webhookResponse{
+		ID:        webhook.ID,
+		URL:       webhook.URL,
+		OrgID:     webhook.OrgID,
+		Events:    events,
+		CreatedAt: webhook.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+}
+
+// webhookRequest is the body for creating or updating a webhook
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	OrgID  *string  `json:"org_id"`
+}
+
+// decodeWebhookRequest parses and validates a webhook body, writing an error
+// response and returning nil if it is invalid
+func (h *Handler) decodeWebhookRequest(w http.ResponseWriter, r *http.Request) *webhookRequest {
+	user := UserFromContext(r)
+
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, ErrCodeInvalidRequest, "Invalid JSON", http.StatusBadRequest)
+		return nil
+	}
+
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		jsonError(w, ErrCodeInvalidRequest, "url must be an http or https URL", http.StatusBadRequest)
+		return nil
+	}
+	req.URL = u.String()
+	if !h.config.WebhookAllowPrivate {
+		if err := checkWebhookHost(r.Context(), u.Hostname()); err != nil {
+			jsonError(w, ErrCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	for _, event := range req.Events {
+		if !webhookEvents[event] {
+			jsonError(w, ErrCodeInvalidRequest, fmt.Sprintf("unknown event %q", event), http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	if req.OrgID != nil && *req.OrgID != "" {
+		org, err := h.store.GetOrganizationByID(*req.OrgID)
+		if err != nil {
+			slog.Error("webhook organization lookup failed", "org_id", *req.OrgID, "error", err)
+			jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+			return nil
+		}
+		if org == nil || org.UserID != user.ID {
+			jsonError(w, ErrCodeNotFound, "Organization not found", http.StatusNotFound)
+			return nil
+		}
+	}
+
+	return &req
+}
+
+// ownedWebhookFromPath looks up /api/v1/webhooks/{id} and checks it belongs
+// to the current user, writing an error response if not
+func (h *Handler) ownedWebhookFromPath(w http.ResponseWriter, r *http.Request) *Webhook {
+	user := UserFromContext(r)
+	webhookID := strings.TrimPrefix(r.URL.Path, "/api/v1/webhooks/")
+
+	webhook, err := h.store.GetWebhookByID(webhookID)
+	if err != nil {
+		slog.Error("webhook lookup failed", "webhook_id", webhookID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return nil
+	}
+	if webhook == nil || webhook.UserID != user.ID {
+		jsonError(w, ErrCodeNotFound, "Webhook not found", http.StatusNotFound)
+		return nil
+	}
+	return webhook
+}
+
+func (h *Handler) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+
+	webhooks, err := h.store.ListWebhooksByUser(user.ID)
+	if err != nil {
+		slog.Error("list webhooks failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	result := []webhookResponse{}
+	for _, webhook := range webhooks {
+		result = append(result, newWebhookResponse(webhook))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r)
+
+	req := h.decodeWebhookRequest(w, r)
+	if req == nil {
+		return
+	}
+
+	existing, err := h.store.ListWebhooksByUser(user.ID)
+	if err != nil {
+		slog.Error("create webhook failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		jsonError(w, ErrCodeForbidden, fmt.Sprintf("webhook limit reached (%d)", maxWebhooksPerUser), http.StatusForbidden)
+		return
+	}
+
+	webhook, err := h.store.CreateWebhook(user.ID, req.OrgID, req.URL, req.Events)
+	if err != nil {
+		slog.Error("create webhook failed", "user_id", user.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := newWebhookResponse(webhook)
+	resp.Secret = webhook.Secret
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := h.ownedWebhookFromPath(w, r)
+	if webhook == nil {
+		return
+	}
+
+	req := h.decodeWebhookRequest(w, r)
+	if req == nil {
+		return
+	}
+
+	if err := h.store.UpdateWebhook(webhook.ID, req.OrgID, req.URL, req.Events); err != nil {
+		slog.Error("update webhook failed", "webhook_id", webhook.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	webhook.URL = req.URL
+	webhook.Events = req.Events
+	webhook.OrgID = ""
+	if req.OrgID != nil {
+		webhook.OrgID = *req.OrgID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newWebhookResponse(webhook))
+}
+
+func (h *Handler) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := h.ownedWebhookFromPath(w, r)
+	if webhook == nil {
+		return
+	}
+
+	if err := h.store.DeleteWebhook(webhook.ID); err != nil {
+		slog.Error("delete webhook failed", "webhook_id", webhook.ID, "error", err)
+		jsonError(w, ErrCodeInternal, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
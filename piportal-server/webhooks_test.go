@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// HMAC-SHA256 of the body keyed with the secret, worked out independently
+	got := signWebhook("whsec", []byte(`{"event":"device.online"}`))
+	want := "sha256=6f377013bc0916e2d4c1a0d21fb9c3891d8688df4b7ddd58280a5ce59b20f1c8"
+	if got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+	if signWebhook("other", []byte(`{"event":"device.online"}`)) == want {
+		t.Error("a different secret gave the same signature")
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		event  string
+		want   bool
+	}{
+		{"no events means all", nil, EventDeviceOffline, true},
+		{"subscribed", []string{EventDeviceOnline, EventDeviceOffline}, EventDeviceOffline, true},
+		{"not subscribed", []string{EventDeviceOnline}, EventBandwidthWarning, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhook := &Webhook{Events: tt.events}
+			if got := webhook.Wants(tt.event); got != tt.want {
+				t.Errorf("Wants(%q) = %v, want %v", tt.event, got, tt.want)
+			}
+		})
+	}
+}
+
+// webhookReceiver records the deliveries it gets, answering the first
+// failures of them with a 500
+type webhookReceiver struct {
+	mu         sync.Mutex
+	failures   int
+	deliveries []*http.Request
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.deliveries = append(wr.deliveries, r)
+	if len(wr.deliveries) <= wr.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// A failed delivery is retried, with a growing delay, as the same signed
+// delivery until the receiver takes it
+func TestWebhookRetries(t *testing.T) {
+	receiver := &webhookReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	notifier := NewNotifier(nil, true)
+	notifier.retryDelay = 20 * time.Millisecond
+	webhook := &Webhook{ID: "wh_test", URL: server.URL, Secret: "whsec"}
+	body := []byte(`{"event":"device.online"}`)
+
+	start := time.Now()
+	notifier.deliver(webhook, EventDeviceOnline, body)
+	// 20ms before the second attempt, then 40ms before the third
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("three attempts took %v, want at least 60ms of backoff", elapsed)
+	}
+
+	if len(receiver.deliveries) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(receiver.deliveries))
+	}
+	first := receiver.deliveries[0]
+	for _, r := range receiver.deliveries {
+		if r.Header.Get("X-PiPortal-Delivery") != first.Header.Get("X-PiPortal-Delivery") {
+			t.Error("retries carried a different delivery ID")
+		}
+		if got := r.Header.Get("X-PiPortal-Signature"); got != signWebhook("whsec", body) {
+			t.Errorf("signature = %q", got)
+		}
+		if got := r.Header.Get("X-PiPortal-Event"); got != EventDeviceOnline {
+			t.Errorf("event = %q", got)
+		}
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	receiver := &webhookReceiver{failures: webhookMaxAttempts + 1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	notifier := NewNotifier(nil, true)
+	notifier.retryDelay = time.Millisecond
+	notifier.deliver(&Webhook{ID: "wh_test", URL: server.URL}, EventDeviceOnline, []byte("{}"))
+
+	if len(receiver.deliveries) != webhookMaxAttempts {
+		t.Errorf("got %d attempts, want %d", len(receiver.deliveries), webhookMaxAttempts)
+	}
+}
+
+// Deliveries never connect to a local address, whatever the URL's host
+// resolved to when the webhook was saved
+func TestWebhookRefusesPrivateAddressWhenDialing(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	err := NewNotifier(nil, false).post(server.URL, EventDeviceOnline, "delivery", "", []byte("{}"))
+	if !errors.Is(err, errWebhookPrivateAddress) {
+		t.Errorf("post to %s: err = %v, want it refused", server.URL, err)
+	}
+	if len(receiver.deliveries) != 0 {
+		t.Error("the local server got the delivery")
+	}
+}
+
+// A redirect could send a delivery somewhere the URL check never saw
+func TestWebhookDoesNotFollowRedirects(t *testing.T) {
+	target := &webhookReceiver{}
+	targetServer := httptest.NewServer(target)
+	defer targetServer.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(targetServer.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+
+	if err := NewNotifier(nil, true).post(redirect.URL, EventDeviceOnline, "delivery", "", []byte("{}")); err == nil {
+		t.Error("a redirect counted as delivered")
+	}
+	if len(target.deliveries) != 0 {
+		t.Error("the redirect was followed")
+	}
+}
+
+func TestCreateWebhookRefusesPrivateURLs(t *testing.T) {
+	server, handler, _ := startTestServer(t, testConfig(t))
+	_, token := newTestUser(t, handler, "hooks@example.com")
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"https://203.0.113.10/hook", http.StatusCreated},
+		{"http://127.0.0.1:8080/hook", http.StatusBadRequest},
+		{"http://localhost/hook", http.StatusBadRequest},
+		{"http://[::1]/hook", http.StatusBadRequest},
+		{"http://10.0.0.5/hook", http.StatusBadRequest},
+		{"http://192.168.1.20/hook", http.StatusBadRequest},
+		{"http://169.254.169.254/latest/meta-data", http.StatusBadRequest},
+		{"http://0.0.0.0/hook", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			status, code := postJSON(t, server.URL+"/api/v1/webhooks", token, map[string]string{"url": tt.url})
+			if status != tt.want {
+				t.Errorf("status = %d (%s), want %d", status, code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateWebhookAllowPrivate(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.WebhookAllowPrivate = true
+	server, handler, _ := startTestServer(t, cfg)
+	_, token := newTestUser(t, handler, "hooks@example.com")
+
+	if status, code := postJSON(t, server.URL+"/api/v1/webhooks", token, map[string]string{"url": "http://192.168.1.20/hook"}); status != http.StatusCreated {
+		t.Errorf("status = %d (%s), want %d", status, code, http.StatusCreated)
+	}
+}